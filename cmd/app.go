@@ -0,0 +1,321 @@
+package main
+
+import (
+	"reliproxy/pkg/cancellation"
+	"reliproxy/pkg/config"
+	"reliproxy/pkg/consumer"
+	"reliproxy/pkg/events"
+	"reliproxy/pkg/handlers"
+	"reliproxy/pkg/httpclient"
+	"reliproxy/pkg/idempotency"
+	"reliproxy/pkg/metrics"
+	"reliproxy/pkg/outbox"
+	"reliproxy/pkg/queue"
+	"reliproxy/pkg/reload"
+	"reliproxy/pkg/repository"
+	"reliproxy/pkg/routing"
+	"reliproxy/pkg/scheduler"
+	"reliproxy/pkg/tracing"
+	"reliproxy/pkg/utils"
+	"reliproxy/pkg/webhook"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/time/rate"
+	"gorm.io/gorm"
+)
+
+// app は API サーバーとワーカーが共有するストレージ、キューとルート
+type app struct {
+	cfg        *config.Config
+	configPath string
+	load       func(path string) (*config.Config, error)
+
+	dbn                  *gorm.DB
+	rdb                  *redis.Client
+	requestQueue         *queue.PriorityQueue
+	delayedQueue         *queue.DelayedQueue
+	schedule             queue.Schedule
+	statusRepository     repository.RequestStatusRepository
+	idempotencyStore     idempotency.Store
+	webhookRepository    repository.WebhookDeliveryRepository
+	routeRepository      repository.RouteRepository
+	routeManager         *routing.Manager
+	routeInvalidator     routing.Invalidator
+	cancellationNotifier cancellation.Notifier
+	statusEvents         events.Broker
+}
+
+func newApp(cfg *config.Config, configPath string, load func(path string) (*config.Config, error)) *app {
+	a := &app{cfg: cfg, configPath: configPath, load: load}
+
+	switch cfg.Storage {
+	case "memory":
+		a.statusEvents = initStatusEvents(cfg, nil)
+		// MySQL と Redis なしで単一プロセスとして動かす
+		a.requestQueue = initPriorityQueue(cfg, func(name string) queue.PollingQueue {
+			return initFairQueue(cfg, queue.NewMemoryTenantRegistry(), name, func(name string) queue.PollingQueue {
+				return queue.NewMemoryQueue().WithMaxAttempts(cfg.Queue.MaxAttempts)
+			})
+		})
+		a.schedule = queue.NewMemorySchedule()
+		a.statusRepository = repository.NewMemoryRequestStatusRepository()
+		a.idempotencyStore = idempotency.NewMemoryStore()
+		a.webhookRepository = repository.NewMemoryWebhookDeliveryRepository()
+		a.routeRepository = repository.NewMemoryRouteRepository()
+	case "mysql":
+		var err error
+		a.dbn, err = initDatabase(cfg.MySQL)
+		if err != nil {
+			panic(err)
+		}
+		a.statusRepository = repository.NewGormRequestStatusRepository(a.dbn)
+		a.webhookRepository = repository.NewGormWebhookDeliveryRepository(a.dbn)
+		a.routeRepository = repository.NewGormRouteRepository(a.dbn)
+		if cfg.Queue.Backend == "redis" {
+			// キュー、ロック、レプリカ間の通知とヘルスチェックで1つの接続プールを共有する
+			a.rdb = initRedisClient(cfg.Redis)
+		}
+		// キューは最大試行回数に達したリクエストを failed にしたことを通知するため、先に作る
+		a.statusEvents = initStatusEvents(cfg, a.rdb)
+		a.requestQueue, a.schedule, a.idempotencyStore = initQueue(cfg, a.dbn, a.rdb, a.statusRepository, a.statusEvents)
+	}
+
+	// 実行時刻が指定されたリクエストはスケジュールに保持し、時刻を迎えたものからキューに追加する
+	a.delayedQueue = queue.NewDelayedQueue(a.requestQueue, a.schedule)
+
+	// ルートごとのサーキットブレーカー、レートリミッターと再試行の設定は、設定の再読み込みや
+	// 管理 API でのルートの変更のたびにルートテーブルごと差し替える
+	a.routeManager = routing.NewManager(cfg.RouteSpecs(), cfg.Reload.DrainTimeout.Duration, &httpclient.DefaultHttpClient{}, a.routeRepository, credentialPolicy(cfg.Admin))
+	a.routeInvalidator = initRouteInvalidator(cfg, a.rdb)
+	go a.routeManager.Start(a.routeInvalidator, cfg.Reload.RouteRefreshInterval.Duration)
+
+	a.cancellationNotifier = initCancellationNotifier(cfg, a.rdb)
+
+	// 優先度ごとのキューの深さと最も古いリクエストの経過時間はスクレイプのたびに取得する
+	prometheus.MustRegister(metrics.NewQueueCollector[queue.Priority](a.requestQueue))
+	return a
+}
+
+// startWorker はキューのリクエストを処理するコンシューマーと、キューへの追加や完了通知を行うバックグラウンドの処理を起動する
+func (a *app) startWorker() (*consumer.Consumer, *consumer.TenantLimiter) {
+	cfg := a.cfg
+
+	promoter := scheduler.NewPromoter(a.delayedQueue, a.statusRepository, cfg.Scheduler.PollInterval.Duration, cfg.Scheduler.BatchSize)
+	go promoter.Start()
+
+	if a.dbn != nil {
+		// 定期実行ジョブの定義は MySQL に保存し、実行時刻ごとのロックで1つのレプリカだけが追加する
+		recurringScheduler := scheduler.NewRecurringScheduler(
+			repository.NewGormRecurringJobRepository(a.dbn),
+			a.statusRepository,
+			a.delayedQueue,
+			initLocker(cfg, a.dbn, a.rdb),
+			cfg.Scheduler.RecurringPollInterval.Duration,
+			cfg.Scheduler.RecurringGracePeriod.Duration,
+		)
+		go recurringScheduler.Start()
+
+		if cfg.Async.WriteMode == "outbox" {
+			// API サーバーがアウトボックスに保存したジョブをキューへ送る
+			relay := outbox.NewRelay(repository.NewGormOutboxRepository(a.dbn), a.delayedQueue, cfg.Async.OutboxRelayInterval.Duration, cfg.Async.OutboxBatchSize)
+			go relay.Start()
+		}
+	}
+
+	// ワーカーと上流へのレートはテナントの重みに応じて分配する
+	tenantLimiter := consumer.NewTenantLimiter(rate.Limit(cfg.Consumer.TenantRateLimit), cfg.Consumer.TenantBurst, cfg.Tenants.Weights)
+	opts := []consumer.Option{
+		consumer.WithRouter(a.routeManager.Router()),
+		consumer.WithWorkers(cfg.Consumer.Workers),
+		consumer.WithTenantLimiter(tenantLimiter),
+		consumer.WithCancellation(a.cancellationNotifier),
+		consumer.WithEvents(a.statusEvents),
+	}
+	if cfg.Webhook.Secret != "" {
+		opts = append(opts, consumer.WithWebhooks(a.webhookRepository))
+	}
+	c := consumer.NewConsumer(a.delayedQueue, a.statusRepository, nil, opts...)
+	go c.Start()
+
+	if cfg.Webhook.Secret == "" {
+		utils.Logger.Warn("webhook.secret is not configured, completion callbacks are disabled")
+		return c, tenantLimiter
+	}
+
+	// 完了通知は署名を付けてコールバック URL へ送信し、失敗した場合はバックオフして再送する。
+	// 内部向けのアドレスへは webhook.allow_private_networks が有効な場合だけ送る
+	dispatcher := webhook.NewDispatcher(
+		a.webhookRepository,
+		webhook.NewHTTPClient(cfg.Webhook.Timeout.Duration, cfg.Webhook.AllowPrivateNetworks),
+		cfg.Webhook.Timeout.Duration,
+		cfg.Webhook.Secret,
+		cfg.Webhook.MaxAttempts,
+		cfg.Webhook.Backoff.Duration,
+		cfg.Webhook.PollInterval.Duration,
+		cfg.Webhook.BatchSize,
+	)
+	go dispatcher.Start()
+
+	return c, tenantLimiter
+}
+
+// watchStatusEvents は他のレプリカのワーカーが発行したステータスの遷移を、このプロセスで待ち受けるクライアントに届ける
+func (a *app) watchStatusEvents() {
+	if broker, ok := a.statusEvents.(interface{ Start() }); ok {
+		go broker.Start()
+	}
+}
+
+// startReloader は設定ファイルを使う場合に SIGHUP か変更を検知して、再起動せずにルートなどを差し替える
+//
+// tenantLimiter はワーカーを動かさないプロセスでは nil になる。
+func (a *app) startReloader(tenantLimiter *consumer.TenantLimiter) {
+	if a.configPath == "" {
+		return
+	}
+	reloader := reload.NewReloader(a.configPath, a.cfg, a.cfg.Reload.WatchInterval.Duration, a.load, applyConfig(a.routeManager, tenantLimiter))
+	go reloader.Start()
+}
+
+// newServer は API サーバーのルーターを返す
+//
+// c と tenantLimiter は同じプロセスでワーカーを動かす場合だけ指定し、ヘルスチェックと管理 API の対象にする。
+func (a *app) newServer(c *consumer.Consumer, tenantLimiter *consumer.TenantLimiter) *gin.Engine {
+	cfg := a.cfg
+	router := a.routeManager.Router()
+	handler := handlers.NewSyncWriteHandler(nil).WithRouter(router)
+
+	// キューに入る前のスケジュールやアウトボックスのリクエストも受け付けの判断に含める
+	backlog := []queue.Measurable{a.schedule}
+	var asyncWriteHandler *handlers.AsyncWriteHandler
+	switch {
+	case a.dbn == nil:
+		asyncWriteHandler = handlers.NewAsyncWriteHandler(a.delayedQueue, a.statusRepository)
+	case cfg.Async.WriteMode == "direct":
+		// キューへ直接追加し、失敗した場合はローカルディスクのスプールに退避する
+		asyncWriteHandler = handlers.NewAsyncWriteHandler(initSpooledQueue(cfg.Async, a.delayedQueue), a.statusRepository)
+	default:
+		// ステータスとジョブはアウトボックス経由で同一トランザクションに保存し、ワーカーのリレーがキューへ送る
+		outboxRepository := repository.NewGormOutboxRepository(a.dbn)
+		asyncWriteHandler = handlers.NewOutboxAsyncWriteHandler(outboxRepository)
+		backlog = append(backlog, outboxRepository)
+		if cfg.Async.SpoolDir != "" {
+			utils.Logger.Warn("async.spool_dir is only used when async.write_mode is direct")
+		}
+	}
+
+	// キューが高水位を超えている間は新しいリクエストを 503 で拒否し、キューが際限なく伸びないようにする
+	asyncWriteHandler.WithAdmission(initAdmission(cfg.Admission, a.requestQueue, backlog...))
+	asyncWriteHandler.WithCallbackPolicy(cfg.Webhook.AllowedHosts, cfg.Webhook.AllowPrivateNetworks)
+	if cfg.Webhook.Secret == "" {
+		// 署名できない完了通知は送らないため、コールバック URL を指定したリクエストは受け付けない
+		asyncWriteHandler.DisableCallbacks()
+	}
+
+	// 書き込みのルートは sync_overflow を設定したルートの上流が混雑している場合に非同期へ切り替える
+	writeHandler := handlers.NewOverflowSyncWriteHandler(nil, asyncWriteHandler, a.statusRepository, 0).
+		WithRouter(router).
+		WithEvents(a.statusEvents).
+		WithCancellation(a.cancellationNotifier)
+	go writeHandler.Start()
+
+	tenantMiddleware := handlers.NewTenantMiddleware(cfg.Tenants.APIKeys, cfg.Tenants.CallbackURLs, cfg.TenantNames())
+	idempotencyMiddleware := handlers.NewIdempotencyMiddleware(a.idempotencyStore, cfg.Idempotency.ReservationTTL.Duration, cfg.Idempotency.TTL.Duration)
+
+	queueStatsHandler := handlers.NewQueueStatsHandler(a.requestQueue)
+	batchStatusHandler := handlers.NewBatchStatusHandler(a.statusRepository)
+	requestStatusHandler := handlers.NewRequestStatusHandler(a.statusRepository, a.delayedQueue, a.cancellationNotifier, a.webhookRepository, a.statusEvents)
+	requestWaitHandler := handlers.NewRequestWaitHandler(a.statusRepository, a.statusEvents)
+
+	r := a.newEngine(c)
+	r.GET("/proxy", idempotencyMiddleware.Handle, handler.HandleRequest)
+	r.POST("/proxy", idempotencyMiddleware.Handle, writeHandler.HandleRequest)
+	r.GET("/proxy/:route", idempotencyMiddleware.Handle, handler.HandleRequest)
+	r.POST("/proxy/:route", idempotencyMiddleware.Handle, writeHandler.HandleRequest)
+	r.GET("/async-proxy", tenantMiddleware.Handle, idempotencyMiddleware.Handle, asyncWriteHandler.HandleRequest)
+	r.POST("/async-proxy", tenantMiddleware.Handle, idempotencyMiddleware.Handle, asyncWriteHandler.HandleRequest)
+	r.POST("/async-proxy/batch", handlers.LimitBody(handlers.MaxBatchBytes), tenantMiddleware.Handle, idempotencyMiddleware.Handle, asyncWriteHandler.HandleBatch)
+	r.GET("/async-proxy/:route", tenantMiddleware.Handle, idempotencyMiddleware.Handle, asyncWriteHandler.HandleRequest)
+	r.POST("/async-proxy/:route", tenantMiddleware.Handle, idempotencyMiddleware.Handle, asyncWriteHandler.HandleRequest)
+	r.POST("/async-proxy/:route/batch", handlers.LimitBody(handlers.MaxBatchBytes), tenantMiddleware.Handle, idempotencyMiddleware.Handle, asyncWriteHandler.HandleBatch)
+	r.GET("/queue/stats", queueStatsHandler.HandleRequest)
+	r.GET("/requests/:id", requestStatusHandler.HandleGet)
+	r.DELETE("/requests/:id", requestStatusHandler.HandleCancel)
+	r.GET("/requests/:id/wait", requestWaitHandler.HandleWait)
+	r.GET("/requests/:id/events", requestWaitHandler.HandleEvents)
+	r.GET("/batches/:id", batchStatusHandler.HandleRequest)
+
+	if admin := a.addAdminRoutes(r, tenantLimiter); admin != nil {
+		// 管理 API で登録したルートは MySQL に保存し、変更を全てのレプリカに通知する
+		routeHandler := handlers.NewRouteHandler(a.routeRepository, a.routeInvalidator).
+			WithStaticRoutes(a.routeManager.IsStatic).
+			WithCredentialPolicy(credentialPolicy(cfg.Admin))
+		admin.GET("/routes", routeHandler.HandleListRoutes)
+		admin.GET("/routes/:name", routeHandler.HandleGetRoute)
+		admin.PUT("/routes/:name", routeHandler.HandlePutRoute)
+		admin.DELETE("/routes/:name", routeHandler.HandleDeleteRoute)
+		admin.GET("/routes/:name/versions", routeHandler.HandleListRouteVersions)
+		admin.POST("/routes/:name/rollback", routeHandler.HandleRollbackRoute)
+		admin.GET("/policies", routeHandler.HandleListPolicies)
+		admin.GET("/policies/:name", routeHandler.HandleGetPolicy)
+		admin.PUT("/policies/:name", routeHandler.HandlePutPolicy)
+		admin.DELETE("/policies/:name", routeHandler.HandleDeletePolicy)
+		admin.GET("/credentials", routeHandler.HandleListCredentials)
+		admin.GET("/credentials/:name", routeHandler.HandleGetCredential)
+		admin.PUT("/credentials/:name", routeHandler.HandlePutCredential)
+		admin.DELETE("/credentials/:name", routeHandler.HandleDeleteCredential)
+	}
+	return r
+}
+
+// newWorkerEngine は worker コマンドのルーターを返す
+//
+// サーキットブレーカーとレートリミッターはプロセスごとに持つため、ワーカーのものも管理 API で操作できるようにする。
+func (a *app) newWorkerEngine(c *consumer.Consumer, tenantLimiter *consumer.TenantLimiter) *gin.Engine {
+	r := a.newEngine(c)
+	a.addAdminRoutes(r, tenantLimiter)
+	return r
+}
+
+// addAdminRoutes はこのプロセスのサーキットブレーカーとレートリミッターを操作する管理 API を追加する
+//
+// 管理 API は運用者のトークンが設定されている場合だけ公開し、公開しない場合は nil を返す。
+func (a *app) addAdminRoutes(r *gin.Engine, tenantLimiter *consumer.TenantLimiter) *gin.RouterGroup {
+	cfg := a.cfg
+	if len(cfg.Admin.Tokens) == 0 {
+		return nil
+	}
+
+	adminHandler := handlers.NewAdminHandler().WithRouter(a.routeManager.Router())
+	if tenantLimiter != nil {
+		adminHandler.AddLimiter("tenant", tenantLimiter)
+	}
+	admin := r.Group("/admin", handlers.NewAdminAuthMiddleware(cfg.Admin.Tokens).Handle)
+	admin.GET("/breakers", adminHandler.HandleListBreakers)
+	admin.POST("/breakers/:name/:action", adminHandler.HandleBreakerAction)
+	admin.GET("/limiters", adminHandler.HandleListLimiters)
+	admin.PATCH("/limiters/:name", adminHandler.HandleUpdateLimiter)
+	admin.DELETE("/limiters/:name", adminHandler.HandleResetLimiter)
+	return admin
+}
+
+// newEngine はメトリクスとヘルスチェックだけを公開するルーターを返す。c が nil の場合はコンシューマーを確認しない
+func (a *app) newEngine(c *consumer.Consumer) *gin.Engine {
+	healthHandler := handlers.NewHealthHandler(initReadiness(a.cfg, a.dbn, a.rdb, a.routeManager.Router(), c))
+
+	r := gin.New()
+	r.Use(gin.LoggerWithFormatter(redactedLogFormatter), gin.Recovery())
+	r.Use(tracing.Middleware(), handlers.RequestIDMiddleware(), metrics.Middleware())
+	r.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	r.GET("/healthz", healthHandler.HandleLiveness)
+	r.GET("/readyz", healthHandler.HandleReadiness)
+	return r
+}
+
+// credentialPolicy は管理 API で登録する認証情報の参照先として許可する環境変数とファイルを返す
+func credentialPolicy(cfg config.AdminConfig) routing.CredentialPolicy {
+	return routing.CredentialPolicy{EnvPrefix: cfg.CredentialEnvPrefix, Dir: cfg.CredentialDir}
+}
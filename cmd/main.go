@@ -1,84 +1,449 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"regexp"
+	"reliproxy/pkg/cancellation"
+	"reliproxy/pkg/config"
 	"reliproxy/pkg/consumer"
 	"reliproxy/pkg/db"
+	"reliproxy/pkg/events"
 	"reliproxy/pkg/handlers"
+	"reliproxy/pkg/health"
 	"reliproxy/pkg/httpclient"
+	"reliproxy/pkg/idempotency"
+	"reliproxy/pkg/metrics"
 	"reliproxy/pkg/queue"
 	"reliproxy/pkg/repository"
+	"reliproxy/pkg/routing"
+	"reliproxy/pkg/scheduler"
+	"reliproxy/pkg/spool"
+	"reliproxy/pkg/tracing"
 	"reliproxy/pkg/utils"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-redis/redis/v8"
-	"github.com/sony/gobreaker"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	"golang.org/x/time/rate"
 	"gorm.io/gorm"
 )
 
+// tracingShutdownTimeout は終了時に送信待ちのスパンを送る時間の上限
+const tracingShutdownTimeout = 5 * time.Second
+
+// usage はサブコマンドの一覧
+const usage = `usage: reliproxy <command> [flags]
+
+commands:
+  serve    run the API server without the queue consumer; requires queue.backend redis
+  worker   run the queue consumer and background jobs; serves metrics, health checks and the breaker
+           and limiter admin API on server.worker_addr; requires queue.backend redis
+  migrate  create or update the MySQL tables and exit
+  all      run the API server and the worker in one process (default)
+
+flags:
+  -config string        path to a YAML or JSON config file
+  -print-config         print the effective config and exit
+  -storage string       storage for request statuses and the queue (mysql or memory); overrides the config
+`
+
 func main() {
-	// サーキットブレーカーの設定
-	circuitBreaker := initCircuitBreaker()
-	rateLimiter := rate.NewLimiter(rate.Limit(5), 10)
-	httpClient := &httpclient.DefaultHttpClient{}
+	// 後方互換のため、サブコマンドを省略した場合は API サーバーとワーカーを1つのプロセスで動かす
+	command, args := "all", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	switch command {
+	case "serve", "worker", "migrate", "all":
+	case "help":
+		fmt.Fprint(os.Stdout, usage)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", command, usage)
+		os.Exit(2)
+	}
 
-	reliClient := httpclient.NewReliClient(httpClient, circuitBreaker, rateLimiter, 3)
+	cfg, configPath, load := loadConfig(command, args)
+	if cfg.Storage == "memory" && command != "all" {
+		// メモリのキューはプロセス間で共有できないため、API サーバーとワーカーを分けられない
+		fmt.Fprintf(os.Stderr, "%s: storage memory can only be used with the all command\n", command)
+		os.Exit(1)
+	}
+	if (command == "serve" || command == "worker") && cfg.Queue.Backend != "redis" {
+		// ステータスの遷移と取り消しの通知は Redis でしかプロセス間に届けられないため、
+		// 分けると API サーバーで待ち受けるクライアントに完了が届かず、実行中のリクエストも取り消せない
+		fmt.Fprintf(os.Stderr, "%s: queue.backend %s can only be used with the all command\n", command, cfg.Queue.Backend)
+		os.Exit(1)
+	}
 
-	handler := handlers.NewSyncWriteHandler(reliClient)
+	initRedaction(cfg.Logging)
 
-	dbn, err := initDatabase()
-	if err != nil {
-		panic(err)
+	if command == "migrate" {
+		runMigrate(cfg)
+		return
 	}
-	statusRepository := repository.NewGormRequestStatusRepository(dbn)
 
-	rdb := initRedisClient()
-	queue := queue.NewRedisQueue(rdb, utils.GetEnv("REDIS_QUEUE_NAME", "queue"))
+	initTracing(cfg.Tracing)
+	a := newApp(cfg, configPath, load)
 
-	asyncWriteHandler := handlers.NewAsyncWriteHandler(queue, statusRepository)
+	switch command {
+	case "serve":
+		a.watchStatusEvents()
+		a.startReloader(nil)
+		a.newServer(nil, nil).Run(cfg.Server.Addr)
+	case "worker":
+		c, tenantLimiter := a.startWorker()
+		a.startReloader(tenantLimiter)
+		if cfg.Server.WorkerAddr == "" {
+			select {}
+		}
+		a.newWorkerEngine(c, tenantLimiter).Run(cfg.Server.WorkerAddr)
+	case "all":
+		a.watchStatusEvents()
+		c, tenantLimiter := a.startWorker()
+		a.startReloader(tenantLimiter)
+		a.newServer(c, tenantLimiter).Run(cfg.Server.Addr)
+	}
+}
+
+// runMigrate は設定の mysql.auto_migrate に関わらずテーブルを作成または更新する
+func runMigrate(cfg *config.Config) {
+	if cfg.Storage != "mysql" {
+		fmt.Fprintf(os.Stderr, "migrate: storage must be mysql, got %q\n", cfg.Storage)
+		os.Exit(1)
+	}
+	cfg.MySQL.AutoMigrate = true
+	if _, err := initDatabase(cfg.MySQL); err != nil {
+		utils.Logger.WithError(err).Error("Failed to migrate the database")
+		os.Exit(1)
+	}
+	utils.Logger.Info("Migrated the database")
+}
 
-	consumer := consumer.NewConsumer(queue, statusRepository, reliClient)
-	go consumer.Start()
+// loadConfig はサブコマンドのフラグで指定された設定ファイルと環境変数から設定を読み込む
+//
+// 設定が不正な場合は全ての不正な項目を表示して終了し、--print-config が指定された場合は有効な設定を表示して終了する。
+// 設定ファイルのパスと、再読み込みでフラグの指定を同じように反映して読み込む関数も返す。
+func loadConfig(command string, args []string) (*config.Config, string, func(path string) (*config.Config, error)) {
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	flags.Usage = func() { fmt.Fprint(flags.Output(), usage) }
+	configPath := flags.String("config", utils.GetEnv("RELIPROXY_CONFIG", ""), "path to a YAML or JSON config file")
+	printConfig := flags.Bool("print-config", false, "print the effective config and exit")
+	storage := flags.String("storage", "", "storage for request statuses and the queue (mysql or memory); overrides the config")
+	flags.Parse(args)
 
-	// Ginルーターの設定
-	r := gin.Default()
-	r.GET("/proxy", handler.HandleRequest)
-	r.GET("/async-proxy", asyncWriteHandler.HandleRequest)
+	load := func(path string) (*config.Config, error) {
+		cfg, err := config.Load(path)
+		if err != nil {
+			return nil, err
+		}
+		if *storage != "" {
+			cfg.Storage = *storage
+			if err := cfg.Validate(); err != nil {
+				return nil, err
+			}
+		}
+		return cfg, nil
+	}
 
-	// サーバーの起動
-	r.Run(":8080")
+	cfg, err := load(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration:\n%v\n", err)
+		os.Exit(1)
+	}
+
+	if *printConfig {
+		out, err := cfg.Redacted().YAML()
+		if err != nil {
+			panic(err)
+		}
+		os.Stdout.Write(out)
+		os.Exit(0)
+	}
+	return cfg, *configPath, load
 }
 
-func initCircuitBreaker() *gobreaker.CircuitBreaker {
-	cbSettings := gobreaker.Settings{
-		Name:        "HTTP GET",
-		MaxRequests: 5,
-		Interval:    2 * time.Second,
-		Timeout:     10 * time.Second,
-		ReadyToTrip: func(counts gobreaker.Counts) bool {
-			return counts.TotalFailures > 3
-		},
+// applyConfig は再読み込みした設定のうち、ルート、テナントのレート制限とログの秘匿を反映する
+func applyConfig(routeManager *routing.Manager, tenantLimiter *consumer.TenantLimiter) func(old, cfg *config.Config) {
+	return func(old, cfg *config.Config) {
+		routeManager.Reconfigure(cfg.RouteSpecs(), cfg.Reload.DrainTimeout.Duration)
+		if tenantLimiter != nil {
+			tenantLimiter.SetLimit(rate.Limit(cfg.Consumer.TenantRateLimit))
+			tenantLimiter.SetBurst(cfg.Consumer.TenantBurst)
+		}
+		initRedaction(cfg.Logging)
 	}
-	return gobreaker.NewCircuitBreaker(cbSettings)
 }
 
-func initDatabase() (*gorm.DB, error) {
-	connectionEnv := db.NewMySQLConnectionEnv()
+func initDatabase(cfg config.MySQLConfig) (*gorm.DB, error) {
+	connectionEnv := &db.MySQLConnectionEnv{
+		Host:     cfg.Host,
+		Port:     cfg.Port,
+		User:     cfg.User,
+		DBName:   cfg.DBName,
+		Password: cfg.Password,
+	}
 	dbn, err := connectionEnv.ConnectDBWithRetry()
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	if err := dbn.Use(metrics.NewGormPlugin()); err != nil {
+		return nil, err
 	}
-	if err := db.Migrate(dbn); err != nil {
+	if err := dbn.Use(tracing.NewGormPlugin()); err != nil {
 		return nil, err
 	}
+	if cfg.AutoMigrate {
+		if err := db.Migrate(dbn); err != nil {
+			return nil, err
+		}
+	}
 	return dbn, nil
 }
 
-func initRedisClient() *redis.Client {
-	return redis.NewClient(&redis.Options{
-		Addr:     utils.GetEnv("REDIS_ADDR", "localhost:6379"),
-		Password: utils.GetEnv("REDIS_PASSWORD", ""),
-		DB:       0,
+func initRedisClient(cfg config.RedisConfig) *redis.Client {
+	rdb := redis.NewClient(&redis.Options{
+		Addr:     cfg.Addr,
+		Password: cfg.Password,
+		DB:       cfg.DB,
+	})
+	rdb.AddHook(tracing.RedisHook{})
+	return rdb
+}
+
+// initRedaction はログから秘匿する値と本文の出力方法を設定する
+//
+// 既定の規則に設定したヘッダ名、フィールド名と正規表現を追加する。値は検証済みのため失敗しない。
+func initRedaction(cfg config.LoggingConfig) {
+	rules := utils.DefaultRedactionRules()
+	rules.Headers = append(rules.Headers, cfg.RedactHeaders...)
+	rules.Fields = append(rules.Fields, cfg.RedactFields...)
+	for _, pattern := range cfg.RedactPatterns {
+		rules.Patterns = append(rules.Patterns, regexp.MustCompile(pattern))
+	}
+
+	bodyMode, _ := utils.ParseBodyLogMode(cfg.BodyMode)
+	utils.SetRedactor(utils.NewRedactor(rules, bodyMode, cfg.BodyMaxBytes))
+}
+
+// redactedLogFormatter はクエリのトークンなどを秘匿してアクセスログを出力する
+func redactedLogFormatter(params gin.LogFormatterParams) string {
+	redactor := utils.CurrentRedactor()
+	return fmt.Sprintf("[GIN] %v | %3d | %13v | %15s | %-7s %#v\n%s",
+		params.TimeStamp.Format("2006/01/02 - 15:04:05"),
+		params.StatusCode,
+		params.Latency,
+		params.ClientIP,
+		params.Method,
+		redactor.Redact(params.Path),
+		redactor.Redact(params.ErrorMessage),
+	)
+}
+
+// initReadiness は /readyz で確認する依存先を登録する
+//
+// 上流のサーキットブレーカーは readiness.check_breaker が有効な場合だけ確認し、コンシューマーは c が nil でない場合だけ確認する。
+func initReadiness(cfg *config.Config, dbn *gorm.DB, rdb *redis.Client, router *httpclient.Router, c *consumer.Consumer) *health.Checker {
+	checker := health.NewChecker(cfg.Readiness.CacheTTL.Duration, cfg.Readiness.Timeout.Duration)
+	if dbn != nil {
+		checker.Add("mysql", health.DBCheck(dbn))
+	}
+	if rdb != nil {
+		checker.Add("redis", health.RedisCheck(rdb))
+	}
+	if c != nil {
+		checker.Add("consumer", func(ctx context.Context) error {
+			return c.Healthy(cfg.Consumer.MaxDequeueFailure.Duration)
+		})
+	}
+	if cfg.Readiness.CheckBreaker {
+		// ルートのサーキットブレーカーは再読み込みで差し替わるため、確認のたびに現在のものを使う
+		checker.Add("upstream_breaker", func(ctx context.Context) error {
+			for _, breaker := range router.Current().Breakers() {
+				if err := health.BreakerCheck(breaker)(ctx); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	return checker
+}
+
+// initTracing は exporter が otlp の場合にスパンを OTLP/HTTP で送信するよう設定する
+//
+// 送信先は OTEL_EXPORTER_OTLP_ENDPOINT などの OpenTelemetry の標準の環境変数で指定する。
+func initTracing(cfg config.TracingConfig) {
+	if cfg.Exporter != "otlp" {
+		return
+	}
+	otlpExporter, err := otlptracehttp.New(context.Background())
+	if err != nil {
+		panic(err)
+	}
+	go shutdownTracingOnSignal(tracing.Setup(otlpExporter, cfg.ServiceName))
+}
+
+// shutdownTracingOnSignal は SIGINT か SIGTERM を受け取ると、送信待ちのスパンを送ってからプロセスを終了する
+func shutdownTracingOnSignal(provider *sdktrace.TracerProvider) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+
+	ctx, cancel := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+	defer cancel()
+	if err := provider.Shutdown(ctx); err != nil {
+		utils.Logger.WithError(err).Error("Failed to flush spans")
+	}
+	os.Exit(128 + int(sig.(syscall.Signal)))
+}
+
+func initQueue(cfg *config.Config, dbn *gorm.DB, rdb *redis.Client, statusRepository repository.RequestStatusRepository, statusEvents events.Publisher) (*queue.PriorityQueue, queue.Schedule, idempotency.Store) {
+	if rdb == nil {
+		// Redis を使わない環境ではキューも冪等性キーも MySQL に保存する
+		requestQueue := initPriorityQueue(cfg, func(name string) queue.PollingQueue {
+			return initFairQueue(cfg, queue.NewGormTenantRegistry(dbn, name), name, func(name string) queue.PollingQueue {
+				return initMySQLQueue(cfg.Queue, dbn, name).WithEvents(statusEvents)
+			})
+		})
+		return requestQueue, queue.NewGormSchedule(dbn), idempotency.NewGormStore(dbn)
+	}
+
+	requestQueue := initPriorityQueue(cfg, func(name string) queue.PollingQueue {
+		return initFairQueue(cfg, queue.NewRedisTenantRegistry(rdb, name+":tenants"), name, func(name string) queue.PollingQueue {
+			return queue.NewRedisQueue(rdb, name, cfg.Queue.LeaseDuration.Duration, cfg.Queue.PollInterval.Duration, cfg.Queue.MaxAttempts).
+				WithDeadLetters(statusRepository, statusEvents)
+		})
 	})
+	schedule := queue.NewRedisSchedule(rdb, cfg.Queue.Name+":scheduled")
+	return requestQueue, schedule, idempotency.NewRedisStore(rdb, cfg.Redis.IdempotencyKeyPrefix)
+}
+
+// initLocker はレプリカ間で共有するロックを返す
+//
+// Redis を使わない環境では MySQL の行でロックする。
+func initLocker(cfg *config.Config, dbn *gorm.DB, rdb *redis.Client) scheduler.Locker {
+	if rdb == nil {
+		return scheduler.NewGormLocker(dbn)
+	}
+	return scheduler.NewRedisLocker(rdb, cfg.Redis.LockKeyPrefix)
+}
+
+// initCancellationNotifier は実行中のリクエストの取り消しを通知する Notifier を返す
+//
+// Redis を使わない環境では同じプロセスのワーカーにだけ通知し、他のレプリカは取り出し時のステータス確認で破棄する。
+func initCancellationNotifier(cfg *config.Config, rdb *redis.Client) cancellation.Notifier {
+	if rdb == nil {
+		return cancellation.NewMemoryNotifier()
+	}
+	return cancellation.NewRedisNotifier(rdb, cfg.Redis.CancellationChannel)
+}
+
+// initStatusEvents はステータスの遷移を待ち受けるクライアントに通知する Broker を返す
+//
+// Redis を使わない環境では同じプロセスのワーカーが処理したリクエストの遷移だけを通知する。
+// 他のレプリカの遷移の購読は待ち受けるクライアントがいる API サーバーだけが開始する。
+func initStatusEvents(cfg *config.Config, rdb *redis.Client) events.Broker {
+	if rdb == nil {
+		return events.NewMemoryBroker()
+	}
+	return events.NewRedisBroker(rdb, cfg.Redis.StatusEventsChannel)
+}
+
+// initRouteInvalidator は管理 API でのルートの変更を通知する Invalidator を返す
+//
+// Redis を使わない環境では同じプロセスにだけ通知し、他のレプリカは定期的な読み込みで反映する。
+func initRouteInvalidator(cfg *config.Config, rdb *redis.Client) routing.Invalidator {
+	if rdb == nil {
+		return routing.NewMemoryInvalidator()
+	}
+	return routing.NewRedisInvalidator(rdb, cfg.Redis.RouteInvalidationChannel)
+}
+
+// initPriorityQueue は優先度ごとのキューを newLane で作成する
+//
+// 通常の優先度のキューは既存のキュー名をそのまま使い、それ以外は優先度を後ろに付けた名前を使う。
+func initPriorityQueue(cfg *config.Config, newLane func(name string) queue.PollingQueue) *queue.PriorityQueue {
+	baseName := cfg.Queue.Name
+	lanes := make(map[queue.Priority]queue.PollingQueue)
+	for _, priority := range queue.Priorities {
+		name := baseName
+		if priority != queue.PriorityNormal {
+			name = baseName + ":" + string(priority)
+		}
+		lanes[priority] = newLane(name)
+	}
+
+	weights := make(map[queue.Priority]int)
+	for priority, weight := range cfg.Queue.PriorityWeights {
+		weights[queue.Priority(priority)] = weight
+	}
+	strict := cfg.Queue.Scheduling == "strict"
+	return queue.NewPriorityQueue(lanes, weights, strict, cfg.Queue.PollInterval.Duration)
+}
+
+func initSpooledQueue(cfg config.AsyncConfig, requestQueue queue.Queue) queue.Queue {
+	if cfg.SpoolDir == "" {
+		return requestQueue
+	}
+
+	requestSpool, err := spool.Open(cfg.SpoolDir, cfg.SpoolSegmentBytes)
+	if err != nil {
+		panic(err)
+	}
+	relay := spool.NewRelay(requestSpool, requestQueue, cfg.SpoolRelayInterval.Duration)
+	go relay.Start()
+
+	return spool.NewFallbackQueue(requestQueue, requestSpool)
+}
+
+// initFairQueue はテナントごとのサブキューを newQueue で作成する
+//
+// デフォルトのテナントのサブキューは name をそのまま使い、それ以外はテナント名を後ろに付けた名前を使う。
+func initFairQueue(cfg *config.Config, registry queue.TenantRegistry, name string, newQueue func(name string) queue.PollingQueue) *queue.FairQueue {
+	return queue.NewFairQueue(registry, func(tenant string) queue.PollingQueue {
+		if tenant == queue.DefaultTenant {
+			return newQueue(name)
+		}
+		return newQueue(name + ":tenant:" + tenant)
+	}, cfg.Tenants.Weights, cfg.Queue.PollInterval.Duration)
+}
+
+// initAdmission は設定の高水位でアドミッション制御を作成する。高水位が設定されていなければ nil を返す
+func initAdmission(cfg config.AdmissionConfig, requestQueue *queue.PriorityQueue, backlog ...queue.Measurable) *handlers.AdmissionController {
+	global := handlers.AdmissionLimits{
+		MaxDepth: cfg.MaxDepth,
+		MaxAge:   cfg.MaxAge.Duration,
+	}
+	tenants := make(map[string]handlers.AdmissionLimits)
+	for tenant, limits := range cfg.Tenants {
+		tenants[tenant] = handlers.AdmissionLimits{
+			MaxDepth: limits.MaxDepth,
+			MaxAge:   limits.MaxAge.Duration,
+		}
+	}
+
+	if global == (handlers.AdmissionLimits{}) && len(tenants) == 0 {
+		return nil
+	}
+	return handlers.NewAdmissionController(requestQueue, global, tenants, cfg.RetryAfter.Duration).WithBacklog(backlog...)
+}
+
+func initMySQLQueue(cfg config.QueueConfig, dbn *gorm.DB, queueName string) *queue.MySQLQueue {
+	return queue.NewMySQLQueue(
+		dbn,
+		queueName,
+		cfg.LeaseDuration.Duration,
+		cfg.MySQLPollInterval.Duration,
+		cfg.MaxAttempts,
+	)
 }
@@ -0,0 +1,92 @@
+package cancellation
+
+import (
+	"context"
+	"sync"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Notifier はリクエストの取り消しを全てのワーカーに通知する
+type Notifier interface {
+	Publish(requestID string) error
+	// Subscribe は ctx が終了するまで取り消されたリクエストの ID を handler に渡す
+	Subscribe(ctx context.Context, handler func(requestID string)) error
+}
+
+type RedisClient interface {
+	Publish(ctx context.Context, channel string, message interface{}) *redis.IntCmd
+	Subscribe(ctx context.Context, channels ...string) *redis.PubSub
+}
+
+// RedisNotifier は Redis の Pub/Sub でレプリカ間に取り消しを通知する
+type RedisNotifier struct {
+	client  RedisClient
+	channel string
+}
+
+func NewRedisNotifier(client RedisClient, channel string) *RedisNotifier {
+	return &RedisNotifier{client: client, channel: channel}
+}
+
+func (n *RedisNotifier) Publish(requestID string) error {
+	return n.client.Publish(context.Background(), n.channel, requestID).Err()
+}
+
+func (n *RedisNotifier) Subscribe(ctx context.Context, handler func(requestID string)) error {
+	pubsub := n.client.Subscribe(ctx, n.channel)
+	defer pubsub.Close()
+
+	// 購読の完了を待ってから受信を始める
+	if _, err := pubsub.Receive(ctx); err != nil {
+		return err
+	}
+	messages := pubsub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case message, ok := <-messages:
+			if !ok {
+				return nil
+			}
+			handler(message.Payload)
+		}
+	}
+}
+
+// MemoryNotifier は単一プロセス用の Notifier
+type MemoryNotifier struct {
+	mu       sync.RWMutex
+	handlers map[int]func(requestID string)
+	nextID   int
+}
+
+func NewMemoryNotifier() *MemoryNotifier {
+	return &MemoryNotifier{handlers: make(map[int]func(requestID string))}
+}
+
+func (n *MemoryNotifier) Publish(requestID string) error {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	for _, handler := range n.handlers {
+		handler(requestID)
+	}
+	return nil
+}
+
+func (n *MemoryNotifier) Subscribe(ctx context.Context, handler func(requestID string)) error {
+	n.mu.Lock()
+	id := n.nextID
+	n.nextID++
+	n.handlers[id] = handler
+	n.mu.Unlock()
+
+	<-ctx.Done()
+
+	n.mu.Lock()
+	delete(n.handlers, id)
+	n.mu.Unlock()
+	return ctx.Err()
+}
@@ -0,0 +1,434 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reliproxy/pkg/utils"
+	"sort"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config は reliproxy の起動に使う全ての設定
+//
+// 既定値に設定ファイルの値を重ね、さらに環境変数の値で上書きしたものを使う。
+type Config struct {
+	Server      ServerConfig      `yaml:"server" json:"server"`
+	Storage     string            `yaml:"storage" json:"storage"`
+	MySQL       MySQLConfig       `yaml:"mysql" json:"mysql"`
+	Redis       RedisConfig       `yaml:"redis" json:"redis"`
+	Upstream    UpstreamConfig    `yaml:"upstream" json:"upstream"`
+	Breaker     BreakerConfig     `yaml:"breaker" json:"breaker"`
+	Routes      []RouteConfig     `yaml:"routes" json:"routes"`
+	Queue       QueueConfig       `yaml:"queue" json:"queue"`
+	Scheduler   SchedulerConfig   `yaml:"scheduler" json:"scheduler"`
+	Async       AsyncConfig       `yaml:"async" json:"async"`
+	Admission   AdmissionConfig   `yaml:"admission" json:"admission"`
+	Idempotency IdempotencyConfig `yaml:"idempotency" json:"idempotency"`
+	Tenants     TenantsConfig     `yaml:"tenants" json:"tenants"`
+	Consumer    ConsumerConfig    `yaml:"consumer" json:"consumer"`
+	Webhook     WebhookConfig     `yaml:"webhook" json:"webhook"`
+	Readiness   ReadinessConfig   `yaml:"readiness" json:"readiness"`
+	Admin       AdminConfig       `yaml:"admin" json:"admin"`
+	Logging     LoggingConfig     `yaml:"logging" json:"logging"`
+	Tracing     TracingConfig     `yaml:"tracing" json:"tracing"`
+	Reload      ReloadConfig      `yaml:"reload" json:"reload"`
+}
+
+type ServerConfig struct {
+	Addr string `yaml:"addr" json:"addr"`
+	// WorkerAddr で worker コマンドがメトリクス、ヘルスチェックとサーキットブレーカーとレートリミッターの管理 API を公開する。空の場合は公開しない
+	WorkerAddr string `yaml:"worker_addr" json:"worker_addr"`
+}
+
+type MySQLConfig struct {
+	Host     string `yaml:"host" json:"host"`
+	Port     string `yaml:"port" json:"port"`
+	User     string `yaml:"user" json:"user"`
+	DBName   string `yaml:"db_name" json:"db_name"`
+	Password string `yaml:"password" json:"password"`
+	// AutoMigrate が有効な場合は起動時にテーブルを作成、更新する。無効な場合は migrate コマンドで行う
+	AutoMigrate bool `yaml:"auto_migrate" json:"auto_migrate"`
+}
+
+type RedisConfig struct {
+	Addr                 string `yaml:"addr" json:"addr"`
+	Password             string `yaml:"password" json:"password"`
+	DB                   int    `yaml:"db" json:"db"`
+	IdempotencyKeyPrefix string `yaml:"idempotency_key_prefix" json:"idempotency_key_prefix"`
+	LockKeyPrefix        string `yaml:"lock_key_prefix" json:"lock_key_prefix"`
+	CancellationChannel  string `yaml:"cancellation_channel" json:"cancellation_channel"`
+	StatusEventsChannel  string `yaml:"status_events_channel" json:"status_events_channel"`
+	// RouteInvalidationChannel で管理 API によるルートの変更をレプリカに通知する
+	RouteInvalidationChannel string `yaml:"route_invalidation_channel" json:"route_invalidation_channel"`
+}
+
+// UpstreamConfig は上流へのリクエストの設定
+type UpstreamConfig struct {
+	URL        string  `yaml:"url" json:"url"`
+	MaxRetries int     `yaml:"max_retries" json:"max_retries"`
+	RateLimit  float64 `yaml:"rate_limit" json:"rate_limit"`
+	Burst      int     `yaml:"burst" json:"burst"`
+}
+
+// BreakerConfig は上流へのサーキットブレーカーの設定
+type BreakerConfig struct {
+	Name        string   `yaml:"name" json:"name"`
+	MaxRequests uint32   `yaml:"max_requests" json:"max_requests"`
+	Interval    Duration `yaml:"interval" json:"interval"`
+	Timeout     Duration `yaml:"timeout" json:"timeout"`
+	// FailureThreshold を超えて失敗するとブレーカーを開く
+	FailureThreshold uint32 `yaml:"failure_threshold" json:"failure_threshold"`
+}
+
+// RouteConfig は /proxy/:route で名前を指定してリクエストを送る上流の設定
+//
+// 指定しなかった項目は upstream と breaker の値を使う。breaker を省略したルートは
+// デフォルトのルートとサーキットブレーカーを共有する。sync_overflow と sync_overflow_latency は
+// 省略すると async の値を使う。
+type RouteConfig struct {
+	Name                string         `yaml:"name" json:"name"`
+	URL                 string         `yaml:"url" json:"url"`
+	MaxRetries          int            `yaml:"max_retries,omitempty" json:"max_retries,omitempty"`
+	RateLimit           float64        `yaml:"rate_limit,omitempty" json:"rate_limit,omitempty"`
+	Burst               int            `yaml:"burst,omitempty" json:"burst,omitempty"`
+	Breaker             *BreakerConfig `yaml:"breaker,omitempty" json:"breaker,omitempty"`
+	SyncOverflow        *bool          `yaml:"sync_overflow,omitempty" json:"sync_overflow,omitempty"`
+	SyncOverflowLatency Duration       `yaml:"sync_overflow_latency,omitempty" json:"sync_overflow_latency,omitempty"`
+}
+
+type QueueConfig struct {
+	Backend         string         `yaml:"backend" json:"backend"`
+	Name            string         `yaml:"name" json:"name"`
+	PriorityWeights map[string]int `yaml:"priority_weights" json:"priority_weights"`
+	Scheduling      string         `yaml:"scheduling" json:"scheduling"`
+	PollInterval    Duration       `yaml:"poll_interval" json:"poll_interval"`
+	// MySQLPollInterval は QUEUE_BACKEND が mysql の場合に使う
+	MySQLPollInterval Duration `yaml:"mysql_poll_interval" json:"mysql_poll_interval"`
+	// LeaseDuration を過ぎても完了しないリクエストはワーカーが落ちたものとみなして再び取り出し、
+	// MaxAttempts を超えて取り出されたリクエストは dead-letter に移す
+	LeaseDuration Duration `yaml:"lease_duration" json:"lease_duration"`
+	MaxAttempts   int      `yaml:"max_attempts" json:"max_attempts"`
+}
+
+type SchedulerConfig struct {
+	PollInterval          Duration `yaml:"poll_interval" json:"poll_interval"`
+	BatchSize             int      `yaml:"batch_size" json:"batch_size"`
+	RecurringPollInterval Duration `yaml:"recurring_poll_interval" json:"recurring_poll_interval"`
+	RecurringGracePeriod  Duration `yaml:"recurring_grace_period" json:"recurring_grace_period"`
+}
+
+// AsyncConfig は非同期リクエストの受け付け方の設定
+type AsyncConfig struct {
+	WriteMode           string   `yaml:"write_mode" json:"write_mode"`
+	OutboxRelayInterval Duration `yaml:"outbox_relay_interval" json:"outbox_relay_interval"`
+	OutboxBatchSize     int      `yaml:"outbox_batch_size" json:"outbox_batch_size"`
+	// SpoolDir を設定すると、write_mode が direct の場合にキューへ追加できなかったリクエストをローカルディスクに退避する。
+	// outbox の場合はリクエストがデータベースに残ってリレーが再送するため使わない
+	SpoolDir           string   `yaml:"spool_dir" json:"spool_dir"`
+	SpoolSegmentBytes  int64    `yaml:"spool_segment_bytes" json:"spool_segment_bytes"`
+	SpoolRelayInterval Duration `yaml:"spool_relay_interval" json:"spool_relay_interval"`
+	// SyncOverflow と SyncOverflowLatency はデフォルトのルートと、指定しなかったルートに使う
+	SyncOverflow        bool     `yaml:"sync_overflow" json:"sync_overflow"`
+	SyncOverflowLatency Duration `yaml:"sync_overflow_latency" json:"sync_overflow_latency"`
+}
+
+type AdmissionLimits struct {
+	MaxDepth int64    `yaml:"max_depth" json:"max_depth"`
+	MaxAge   Duration `yaml:"max_age" json:"max_age"`
+}
+
+type AdmissionConfig struct {
+	AdmissionLimits `yaml:",inline"`
+	Tenants         map[string]AdmissionLimits `yaml:"tenants" json:"tenants"`
+	RetryAfter      Duration                   `yaml:"retry_after" json:"retry_after"`
+}
+
+type IdempotencyConfig struct {
+	// TTL は処理を終えたリクエストの応答を再送できる期間
+	TTL Duration `yaml:"ttl" json:"ttl"`
+	// ReservationTTL は処理中のリクエストのキーを予約しておく期間。途中でプロセスが落ちた場合もこの期間が過ぎれば再試行できる
+	ReservationTTL Duration `yaml:"reservation_ttl" json:"reservation_ttl"`
+}
+
+type TenantsConfig struct {
+	// APIKeys は API キーからテナント名への対応
+	APIKeys      map[string]string `yaml:"api_keys" json:"api_keys"`
+	CallbackURLs map[string]string `yaml:"callback_urls" json:"callback_urls"`
+	Weights      map[string]int    `yaml:"weights" json:"weights"`
+}
+
+type ConsumerConfig struct {
+	Workers           int      `yaml:"workers" json:"workers"`
+	TenantRateLimit   float64  `yaml:"tenant_rate_limit" json:"tenant_rate_limit"`
+	TenantBurst       int      `yaml:"tenant_burst" json:"tenant_burst"`
+	MaxDequeueFailure Duration `yaml:"max_dequeue_failure" json:"max_dequeue_failure"`
+}
+
+type WebhookConfig struct {
+	Timeout Duration `yaml:"timeout" json:"timeout"`
+	// Secret は完了通知の署名の鍵。空の場合はコールバック URL を指定したリクエストを拒否し、完了通知を送らない
+	Secret       string   `yaml:"secret" json:"secret"`
+	MaxAttempts  int      `yaml:"max_attempts" json:"max_attempts"`
+	Backoff      Duration `yaml:"backoff" json:"backoff"`
+	PollInterval Duration `yaml:"poll_interval" json:"poll_interval"`
+	BatchSize    int      `yaml:"batch_size" json:"batch_size"`
+	// AllowedHosts が空でない場合、コールバック URL のホストはこのいずれかに限る。"." で始まるものはサブドメインにも一致する
+	AllowedHosts []string `yaml:"allowed_hosts" json:"allowed_hosts"`
+	// AllowPrivateNetworks の場合はループバック、プライベート、リンクローカルのアドレスにも完了通知を送る
+	AllowPrivateNetworks bool `yaml:"allow_private_networks" json:"allow_private_networks"`
+}
+
+type ReadinessConfig struct {
+	CacheTTL     Duration `yaml:"cache_ttl" json:"cache_ttl"`
+	Timeout      Duration `yaml:"timeout" json:"timeout"`
+	CheckBreaker bool     `yaml:"check_breaker" json:"check_breaker"`
+}
+
+type AdminConfig struct {
+	// Tokens はトークンから運用者名への対応。空の場合は管理 API を公開しない
+	Tokens map[string]string `yaml:"tokens" json:"tokens"`
+	// CredentialEnvPrefix で始まる環境変数と CredentialDir の下のファイルだけを、管理 API で登録する認証情報の参照先に使える。
+	// 空の場合はその参照先を使えない
+	CredentialEnvPrefix string `yaml:"credential_env_prefix" json:"credential_env_prefix"`
+	CredentialDir       string `yaml:"credential_dir" json:"credential_dir"`
+}
+
+type LoggingConfig struct {
+	RedactHeaders  []string `yaml:"redact_headers" json:"redact_headers"`
+	RedactFields   []string `yaml:"redact_fields" json:"redact_fields"`
+	RedactPatterns []string `yaml:"redact_patterns" json:"redact_patterns"`
+	BodyMode       string   `yaml:"body_mode" json:"body_mode"`
+	BodyMaxBytes   int      `yaml:"body_max_bytes" json:"body_max_bytes"`
+}
+
+// ReloadConfig は設定ファイルの再読み込みの設定
+type ReloadConfig struct {
+	// WatchInterval ごとに設定ファイルの変更を確認する。0 の場合は SIGHUP でだけ再読み込みする
+	WatchInterval Duration `yaml:"watch_interval" json:"watch_interval"`
+	// DrainTimeout は差し替える前の設定で処理中のリクエストの完了を待つ時間
+	DrainTimeout Duration `yaml:"drain_timeout" json:"drain_timeout"`
+	// RouteRefreshInterval ごとに管理 API で登録したルートを読み込み直す。変更の通知を取りこぼした場合に備える
+	RouteRefreshInterval Duration `yaml:"route_refresh_interval" json:"route_refresh_interval"`
+}
+
+type TracingConfig struct {
+	Exporter    string `yaml:"exporter" json:"exporter"`
+	ServiceName string `yaml:"service_name" json:"service_name"`
+}
+
+// Default は設定ファイルと環境変数で何も指定しない場合の設定を返す
+func Default() *Config {
+	return &Config{
+		Server:  ServerConfig{Addr: ":8080", WorkerAddr: ":9090"},
+		Storage: "mysql",
+		MySQL: MySQLConfig{
+			Host:        "localhost",
+			Port:        "3306",
+			User:        "root",
+			DBName:      "my_tutor",
+			Password:    "password",
+			AutoMigrate: true,
+		},
+		Redis: RedisConfig{
+			Addr:                     "localhost:6379",
+			IdempotencyKeyPrefix:     "idempotency:",
+			LockKeyPrefix:            "lock:",
+			CancellationChannel:      "reliproxy:cancellations",
+			StatusEventsChannel:      "reliproxy:status-events",
+			RouteInvalidationChannel: "reliproxy:route-invalidations",
+		},
+		Upstream: UpstreamConfig{
+			URL:        "https://api.thirdparty.com/data",
+			MaxRetries: 3,
+			RateLimit:  5,
+			Burst:      10,
+		},
+		Breaker: BreakerConfig{
+			Name:             "HTTP GET",
+			MaxRequests:      5,
+			Interval:         Duration{2 * time.Second},
+			Timeout:          Duration{10 * time.Second},
+			FailureThreshold: 3,
+		},
+		Queue: QueueConfig{
+			Backend:           "redis",
+			Name:              "queue",
+			PriorityWeights:   map[string]int{"high": 6, "normal": 3, "low": 1},
+			Scheduling:        "weighted",
+			PollInterval:      Duration{100 * time.Millisecond},
+			MySQLPollInterval: Duration{time.Second},
+			LeaseDuration:     Duration{5 * time.Minute},
+			MaxAttempts:       5,
+		},
+		Scheduler: SchedulerConfig{
+			PollInterval:          Duration{time.Second},
+			BatchSize:             100,
+			RecurringPollInterval: Duration{time.Second},
+			RecurringGracePeriod:  Duration{time.Minute},
+		},
+		Async: AsyncConfig{
+			WriteMode:           "outbox",
+			OutboxRelayInterval: Duration{time.Second},
+			OutboxBatchSize:     100,
+			SpoolSegmentBytes:   64 * 1024 * 1024,
+			SpoolRelayInterval:  Duration{5 * time.Second},
+		},
+		Admission: AdmissionConfig{
+			RetryAfter: Duration{30 * time.Second},
+		},
+		Idempotency: IdempotencyConfig{
+			TTL:            Duration{24 * time.Hour},
+			ReservationTTL: Duration{time.Minute},
+		},
+		Consumer: ConsumerConfig{
+			Workers:           10,
+			TenantRateLimit:   5,
+			TenantBurst:       10,
+			MaxDequeueFailure: Duration{30 * time.Second},
+		},
+		Webhook: WebhookConfig{
+			Timeout:      Duration{10 * time.Second},
+			MaxAttempts:  8,
+			Backoff:      Duration{5 * time.Second},
+			PollInterval: Duration{time.Second},
+			BatchSize:    100,
+		},
+		Readiness: ReadinessConfig{
+			CacheTTL: Duration{2 * time.Second},
+			Timeout:  Duration{time.Second},
+		},
+		Admin: AdminConfig{
+			CredentialEnvPrefix: "RELIPROXY_CREDENTIAL_",
+			CredentialDir:       "/etc/reliproxy/credentials",
+		},
+		Logging: LoggingConfig{
+			BodyMode:     string(utils.BodyLogTruncated),
+			BodyMaxBytes: 512,
+		},
+		Tracing: TracingConfig{
+			Exporter:    "none",
+			ServiceName: "reliproxy",
+		},
+		Reload: ReloadConfig{
+			WatchInterval:        Duration{5 * time.Second},
+			DrainTimeout:         Duration{30 * time.Second},
+			RouteRefreshInterval: Duration{time.Minute},
+		},
+	}
+}
+
+// Redacted はパスワードやトークンを伏せたコピーを返す。設定を表示する際に使う
+func (c *Config) Redacted() *Config {
+	redacted := *c
+	redacted.MySQL.Password = redactString(c.MySQL.Password)
+	redacted.Redis.Password = redactString(c.Redis.Password)
+	redacted.Webhook.Secret = redactString(c.Webhook.Secret)
+	// API キーと管理トークンは対応の元の側が秘密の値になる
+	redacted.Tenants.APIKeys = redactKeys(c.Tenants.APIKeys)
+	redacted.Admin.Tokens = redactKeys(c.Admin.Tokens)
+	return &redacted
+}
+
+// TenantNames は重みやコールバック URL、受付の制限のいずれかを設定したテナントの名前を返す
+//
+// API キーを持たないクライアントが X-Tenant-ID ヘッダで指定できるのはこれらのテナントに限る。
+func (c *Config) TenantNames() []string {
+	seen := make(map[string]struct{})
+	for tenant := range c.Tenants.Weights {
+		seen[tenant] = struct{}{}
+	}
+	for tenant := range c.Tenants.CallbackURLs {
+		seen[tenant] = struct{}{}
+	}
+	for tenant := range c.Admission.Tenants {
+		seen[tenant] = struct{}{}
+	}
+	names := make([]string, 0, len(seen))
+	for tenant := range seen {
+		names = append(names, tenant)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// YAML は設定を YAML で返す
+func (c *Config) YAML() ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(c); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func redactString(s string) string {
+	if s == "" {
+		return ""
+	}
+	return utils.Redacted
+}
+
+func redactKeys(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	redacted := make(map[string]string, len(m))
+	for i, value := range sortedValues(m) {
+		redacted[fmt.Sprintf("%s-%d", utils.Redacted, i+1)] = value
+	}
+	return redacted
+}
+
+func sortedValues(m map[string]string) []string {
+	values := make([]string, 0, len(m))
+	for _, value := range m {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	return values
+}
+
+// Duration は "10s" のような文字列で YAML と JSON に読み書きする time.Duration
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return d.String(), nil
+}
+
+func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
+	var s string
+	if err := value.Decode(&s); err != nil {
+		return err
+	}
+	return d.parse(s)
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"10s\": %s", data)
+	}
+	return d.parse(s)
+}
+
+func (d *Duration) parse(s string) error {
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = duration
+	return nil
+}
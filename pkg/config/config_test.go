@@ -0,0 +1,246 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reliproxy/pkg/httpclient"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func env(values map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		value, ok := values[key]
+		return value, ok
+	}
+}
+
+func writeFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	return path
+}
+
+func TestDefault(t *testing.T) {
+	cfg, err := load("", env(nil))
+	assert.NoError(t, err)
+	assert.Equal(t, Default(), cfg)
+}
+
+func TestLoad_YAML(t *testing.T) {
+	path := writeFile(t, "reliproxy.yaml", `
+server:
+  addr: ":9090"
+upstream:
+  url: https://partner.example.com/data
+breaker:
+  timeout: 30s
+queue:
+  priority_weights:
+    high: 10
+    normal: 1
+admission:
+  max_depth: 1000
+  tenants:
+    acme:
+      max_age: 1m
+`)
+
+	cfg, err := load(path, env(nil))
+	require.NoError(t, err)
+	assert.Equal(t, ":9090", cfg.Server.Addr)
+	assert.Equal(t, "https://partner.example.com/data", cfg.Upstream.URL)
+	assert.Equal(t, 30*time.Second, cfg.Breaker.Timeout.Duration)
+	// マップは既定値に重ねる
+	assert.Equal(t, map[string]int{"high": 10, "normal": 1, "low": 1}, cfg.Queue.PriorityWeights)
+	assert.Equal(t, int64(1000), cfg.Admission.MaxDepth)
+	assert.Equal(t, time.Minute, cfg.Admission.Tenants["acme"].MaxAge.Duration)
+	// ファイルで指定しなかった項目は既定値のまま
+	assert.Equal(t, uint32(5), cfg.Breaker.MaxRequests)
+	assert.Equal(t, 10, cfg.Consumer.Workers)
+}
+
+func TestLoad_JSON(t *testing.T) {
+	path := writeFile(t, "reliproxy.json", `{"storage": "memory", "consumer": {"workers": 4, "max_dequeue_failure": "1m"}}`)
+
+	cfg, err := load(path, env(nil))
+	require.NoError(t, err)
+	assert.Equal(t, "memory", cfg.Storage)
+	assert.Equal(t, 4, cfg.Consumer.Workers)
+	assert.Equal(t, time.Minute, cfg.Consumer.MaxDequeueFailure.Duration)
+}
+
+func TestLoad_UnknownField(t *testing.T) {
+	_, err := load(writeFile(t, "reliproxy.yaml", "breakr:\n  timeout: 1s\n"), env(nil))
+	assert.ErrorContains(t, err, "field breakr not found")
+
+	_, err = load(writeFile(t, "reliproxy.json", `{"breakr": {}}`), env(nil))
+	assert.ErrorContains(t, err, `unknown field "breakr"`)
+}
+
+func TestLoad_EnvOverridesFile(t *testing.T) {
+	path := writeFile(t, "reliproxy.yaml", "upstream:\n  max_retries: 5\nqueue:\n  name: from-file\n")
+
+	cfg, err := load(path, env(map[string]string{
+		"UPSTREAM_MAX_RETRIES":       "7",
+		"REDIS_QUEUE_NAME":           "legacy",
+		"QUEUE_POLL_INTERVAL":        "250ms",
+		"QUEUE_PRIORITY_WEIGHTS":     "high=2,low=1",
+		"SYNC_OVERFLOW":              "enabled",
+		"API_KEYS":                   "key-1=acme,key-2=globex",
+		"ADMISSION_TENANT_MAX_DEPTH": "acme=10",
+		"ADMISSION_TENANT_MAX_AGE":   "acme=30s",
+		"LOG_REDACT_FIELDS":          "account_id, iban",
+		"WEBHOOK_SECRET":             "",
+		"WORKER_ADDR":                ":9191",
+		"MYSQL_AUTO_MIGRATE":         "false",
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, 7, cfg.Upstream.MaxRetries)
+	assert.Equal(t, "legacy", cfg.Queue.Name)
+	assert.Equal(t, 250*time.Millisecond, cfg.Queue.PollInterval.Duration)
+	assert.Equal(t, 250*time.Millisecond, cfg.Queue.MySQLPollInterval.Duration)
+	assert.Equal(t, map[string]int{"high": 2, "low": 1}, cfg.Queue.PriorityWeights)
+	assert.True(t, cfg.Async.SyncOverflow)
+	assert.Equal(t, map[string]string{"key-1": "acme", "key-2": "globex"}, cfg.Tenants.APIKeys)
+	assert.Equal(t, AdmissionLimits{MaxDepth: 10, MaxAge: Duration{30 * time.Second}}, cfg.Admission.Tenants["acme"])
+	assert.Equal(t, []string{"account_id", "iban"}, cfg.Logging.RedactFields)
+	assert.Equal(t, "", cfg.Webhook.Secret)
+	assert.Equal(t, ":9191", cfg.Server.WorkerAddr)
+	assert.False(t, cfg.MySQL.AutoMigrate)
+}
+
+func TestLoad_InvalidEnv(t *testing.T) {
+	_, err := load("", env(map[string]string{
+		"UPSTREAM_MAX_RETRIES": "three",
+		"BREAKER_TIMEOUT":      "10",
+	}))
+	assert.EqualError(t, err, "UPSTREAM_MAX_RETRIES: invalid integer: \"three\"\nBREAKER_TIMEOUT: invalid duration: \"10\"")
+}
+
+func TestValidate(t *testing.T) {
+	cfg := Default()
+	cfg.Storage = "sqlite"
+	cfg.Upstream.URL = "api.thirdparty.com/data"
+	cfg.Breaker.Timeout = Duration{}
+	cfg.Queue.PriorityWeights = map[string]int{"urgent": 1}
+	cfg.Tenants.Weights = map[string]int{"acme": 0}
+	cfg.Tenants.CallbackURLs = map[string]string{"acme": "https://acme.example.com/callback"}
+	cfg.Logging.RedactPatterns = []string{"("}
+	cfg.Logging.BodyMode = "verbose"
+
+	// 不正な項目は全てまとめて報告する
+	err := cfg.Validate()
+	assert.EqualError(t, err, `storage: must be one of [mysql memory], got "sqlite"
+upstream.url: must be an absolute http or https URL, got "api.thirdparty.com/data"
+breaker.timeout: must be positive
+queue.priority_weights: unknown priority "urgent"
+tenants.weights.acme: must be positive
+webhook.secret: must not be empty when tenants.callback_urls is set
+logging.redact_patterns[0]: invalid regular expression: error parsing regexp: missing closing ): `+"`(`"+`
+logging.body_mode: must be one of off, truncated, full, got "verbose"`)
+}
+
+func TestRedacted(t *testing.T) {
+	cfg := Default()
+	cfg.Webhook.Secret = "webhook-secret"
+	cfg.Tenants.APIKeys = map[string]string{"key-1": "acme"}
+	cfg.Admin.Tokens = map[string]string{"admin-token": "alice"}
+
+	out, err := cfg.Redacted().YAML()
+	require.NoError(t, err)
+	assert.NotContains(t, string(out), "webhook-secret")
+	assert.NotContains(t, string(out), "key-1")
+	assert.NotContains(t, string(out), "admin-token")
+	assert.Contains(t, string(out), "alice")
+
+	// 元の設定は変更しない
+	assert.Equal(t, "webhook-secret", cfg.Webhook.Secret)
+	assert.Equal(t, "acme", cfg.Tenants.APIKeys["key-1"])
+
+	// 伏せていない値は読み込み直せる
+	var decoded Config
+	require.NoError(t, yaml.Unmarshal(out, &decoded))
+	assert.Equal(t, cfg.Breaker, decoded.Breaker)
+}
+
+func TestRouteSpecs(t *testing.T) {
+	path := writeFile(t, "reliproxy.yaml", `
+routes:
+  - name: partner
+    url: https://partner.example.com/data
+    rate_limit: 1
+    sync_overflow_latency: 2s
+  - name: billing
+    url: https://billing.example.com/data
+    sync_overflow: false
+    breaker:
+      timeout: 1m
+async:
+  sync_overflow: true
+`)
+
+	cfg, err := load(path, env(nil))
+	require.NoError(t, err)
+	specs := cfg.RouteSpecs()
+	require.Len(t, specs, 3)
+
+	assert.Equal(t, httpclient.DefaultRoute, specs[0].Name)
+	assert.Equal(t, cfg.Upstream.URL, specs[0].URL)
+
+	// 指定しなかった項目は upstream の値を使い、サーキットブレーカーはデフォルトのルートと共有する
+	assert.Equal(t, 1.0, specs[1].RateLimit)
+	assert.Equal(t, cfg.Upstream.Burst, specs[1].Burst)
+	assert.Equal(t, specs[0].Breaker, specs[1].Breaker)
+
+	assert.Equal(t, "billing", specs[2].Breaker.Name)
+	assert.Equal(t, time.Minute, specs[2].Breaker.Timeout)
+	assert.Equal(t, cfg.Breaker.MaxRequests, specs[2].Breaker.MaxRequests)
+
+	// 非同期への切り替えはルートで指定しなければ async の値を使う
+	assert.True(t, specs[0].SyncOverflow)
+	assert.True(t, specs[1].SyncOverflow)
+	assert.Equal(t, 2*time.Second, specs[1].SyncOverflowLatency)
+	assert.False(t, specs[2].SyncOverflow)
+	assert.Equal(t, cfg.Async.SyncOverflowLatency.Duration, specs[2].SyncOverflowLatency)
+}
+
+func TestValidate_Routes(t *testing.T) {
+	cfg := Default()
+	cfg.Routes = []RouteConfig{
+		{Name: "default", URL: "https://a.example.com"},
+		{Name: "Partner", URL: "https://b.example.com"},
+		{Name: "billing", URL: "billing.example.com", Burst: -1},
+		{Name: "billing", URL: "https://c.example.com", Breaker: &BreakerConfig{Name: "HTTP GET", Timeout: Duration{time.Second}}},
+	}
+
+	err := cfg.Validate()
+	assert.EqualError(t, err, `routes[0].name: duplicate route "default"
+routes[1].name: must match ^[a-z0-9][a-z0-9_-]*$, got "Partner"
+routes[2].url: must be an absolute http or https URL, got "billing.example.com"
+routes[2].burst: must not be negative
+routes[3].name: duplicate route "billing"
+routes[3].breaker.name: "HTTP GET" is already used by a breaker with different settings`)
+}
+
+func TestRestartRequired(t *testing.T) {
+	old := Default()
+	cfg := Default()
+	cfg.Upstream.URL = "https://partner.example.com/data"
+	cfg.Breaker.Timeout = Duration{time.Minute}
+	cfg.Routes = []RouteConfig{{Name: "partner", URL: "https://partner.example.com/data"}}
+	cfg.Consumer.TenantRateLimit = 1
+	cfg.Logging.BodyMode = "off"
+	cfg.Async.SyncOverflow = true
+	assert.Empty(t, RestartRequired(old, cfg))
+
+	cfg.Storage = "memory"
+	cfg.Queue.Name = "other"
+	cfg.Async.WriteMode = "direct"
+	cfg.Consumer.Workers = 1
+	assert.Equal(t, []string{"storage", "queue", "async", "consumer"}, RestartRequired(old, cfg))
+}
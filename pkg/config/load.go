@@ -0,0 +1,380 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reliproxy/pkg/queue"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Load は既定値に path の設定ファイルと環境変数を重ねて検証した設定を返す。path が空の場合はファイルを読まない
+func Load(path string) (*Config, error) {
+	return load(path, os.LookupEnv)
+}
+
+func load(path string, lookupEnv func(string) (string, bool)) (*Config, error) {
+	cfg := Default()
+	if path != "" {
+		if err := cfg.readFile(path); err != nil {
+			return nil, err
+		}
+	}
+	if err := cfg.applyEnv(lookupEnv); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// readFile は拡張子が .json であれば JSON として、それ以外は YAML として設定ファイルを読み込む
+//
+// 未知のキーは書き間違いの可能性が高いためエラーにする。
+func (c *Config) readFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(c)
+	} else {
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		err = decoder.Decode(c)
+		// 空のファイルは既定値のまま使う
+		if errors.Is(err, io.EOF) {
+			err = nil
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// envBinding は環境変数で上書きする設定の項目
+type envBinding struct {
+	name string
+	set  func(value string) error
+}
+
+// envBindings は環境変数と設定の項目の対応を返す。後にあるものほど優先する
+func (c *Config) envBindings() []envBinding {
+	return []envBinding{
+		{"SERVER_ADDR", setString(&c.Server.Addr)},
+		{"WORKER_ADDR", setString(&c.Server.WorkerAddr)},
+		{"STORAGE", setString(&c.Storage)},
+
+		{"MYSQL_HOST", setString(&c.MySQL.Host)},
+		{"MYSQL_PORT", setString(&c.MySQL.Port)},
+		{"MYSQL_USER", setString(&c.MySQL.User)},
+		{"MYSQL_DBNAME", setString(&c.MySQL.DBName)},
+		{"MYSQL_PASSWORD", setString(&c.MySQL.Password)},
+		{"MYSQL_AUTO_MIGRATE", setBool(&c.MySQL.AutoMigrate)},
+
+		{"REDIS_ADDR", setString(&c.Redis.Addr)},
+		{"REDIS_PASSWORD", setString(&c.Redis.Password)},
+		{"REDIS_DB", setInt(&c.Redis.DB)},
+		{"IDEMPOTENCY_KEY_PREFIX", setString(&c.Redis.IdempotencyKeyPrefix)},
+		{"LOCK_KEY_PREFIX", setString(&c.Redis.LockKeyPrefix)},
+		{"CANCELLATION_CHANNEL", setString(&c.Redis.CancellationChannel)},
+		{"STATUS_EVENTS_CHANNEL", setString(&c.Redis.StatusEventsChannel)},
+		{"ROUTE_INVALIDATION_CHANNEL", setString(&c.Redis.RouteInvalidationChannel)},
+
+		{"UPSTREAM_URL", setString(&c.Upstream.URL)},
+		{"UPSTREAM_MAX_RETRIES", setInt(&c.Upstream.MaxRetries)},
+		{"UPSTREAM_RATE_LIMIT", setFloat(&c.Upstream.RateLimit)},
+		{"UPSTREAM_BURST", setInt(&c.Upstream.Burst)},
+
+		{"BREAKER_NAME", setString(&c.Breaker.Name)},
+		{"BREAKER_MAX_REQUESTS", setUint32(&c.Breaker.MaxRequests)},
+		{"BREAKER_INTERVAL", setDuration(&c.Breaker.Interval)},
+		{"BREAKER_TIMEOUT", setDuration(&c.Breaker.Timeout)},
+		{"BREAKER_FAILURE_THRESHOLD", setUint32(&c.Breaker.FailureThreshold)},
+
+		{"QUEUE_BACKEND", setString(&c.Queue.Backend)},
+		// REDIS_QUEUE_NAME は以前の名前のため QUEUE_NAME を優先する
+		{"REDIS_QUEUE_NAME", setString(&c.Queue.Name)},
+		{"QUEUE_NAME", setString(&c.Queue.Name)},
+		{"QUEUE_PRIORITY_WEIGHTS", setPriorityWeights(&c.Queue.PriorityWeights)},
+		{"QUEUE_SCHEDULING", setString(&c.Queue.Scheduling)},
+		{"QUEUE_POLL_INTERVAL", func(value string) error {
+			// 以前は同じ環境変数で両方のポーリング間隔を指定していた
+			if err := setDuration(&c.Queue.PollInterval)(value); err != nil {
+				return err
+			}
+			return setDuration(&c.Queue.MySQLPollInterval)(value)
+		}},
+		{"QUEUE_LEASE_DURATION", setDuration(&c.Queue.LeaseDuration)},
+		{"QUEUE_MAX_ATTEMPTS", setInt(&c.Queue.MaxAttempts)},
+
+		{"SCHEDULE_POLL_INTERVAL", setDuration(&c.Scheduler.PollInterval)},
+		{"RECURRING_POLL_INTERVAL", setDuration(&c.Scheduler.RecurringPollInterval)},
+		{"RECURRING_GRACE_PERIOD", setDuration(&c.Scheduler.RecurringGracePeriod)},
+
+		{"ASYNC_WRITE_MODE", setString(&c.Async.WriteMode)},
+		{"OUTBOX_RELAY_INTERVAL", setDuration(&c.Async.OutboxRelayInterval)},
+		{"SPOOL_DIR", setString(&c.Async.SpoolDir)},
+		{"SPOOL_RELAY_INTERVAL", setDuration(&c.Async.SpoolRelayInterval)},
+		{"SYNC_OVERFLOW", setBool(&c.Async.SyncOverflow)},
+		{"SYNC_OVERFLOW_LATENCY", setDuration(&c.Async.SyncOverflowLatency)},
+
+		{"ADMISSION_MAX_DEPTH", setInt64(&c.Admission.MaxDepth)},
+		{"ADMISSION_MAX_AGE", setDuration(&c.Admission.MaxAge)},
+		{"ADMISSION_TENANT_MAX_DEPTH", setTenantLimits(&c.Admission.Tenants, func(limits *AdmissionLimits, value string) error {
+			return setInt64(&limits.MaxDepth)(value)
+		})},
+		{"ADMISSION_TENANT_MAX_AGE", setTenantLimits(&c.Admission.Tenants, func(limits *AdmissionLimits, value string) error {
+			return setDuration(&limits.MaxAge)(value)
+		})},
+		{"ADMISSION_RETRY_AFTER", setDuration(&c.Admission.RetryAfter)},
+
+		{"IDEMPOTENCY_TTL", setDuration(&c.Idempotency.TTL)},
+		{"IDEMPOTENCY_RESERVATION_TTL", setDuration(&c.Idempotency.ReservationTTL)},
+
+		{"API_KEYS", setStringMap(&c.Tenants.APIKeys)},
+		{"CALLBACK_URLS", setStringMap(&c.Tenants.CallbackURLs)},
+		{"TENANT_WEIGHTS", setIntMap(&c.Tenants.Weights)},
+
+		{"CONSUMER_WORKERS", setInt(&c.Consumer.Workers)},
+		{"CONSUMER_TENANT_RATE_LIMIT", setFloat(&c.Consumer.TenantRateLimit)},
+		{"CONSUMER_TENANT_BURST", setInt(&c.Consumer.TenantBurst)},
+		{"CONSUMER_MAX_DEQUEUE_FAILURE", setDuration(&c.Consumer.MaxDequeueFailure)},
+
+		{"WEBHOOK_TIMEOUT", setDuration(&c.Webhook.Timeout)},
+		{"WEBHOOK_SECRET", setString(&c.Webhook.Secret)},
+		{"WEBHOOK_MAX_ATTEMPTS", setInt(&c.Webhook.MaxAttempts)},
+		{"WEBHOOK_BACKOFF", setDuration(&c.Webhook.Backoff)},
+		{"WEBHOOK_POLL_INTERVAL", setDuration(&c.Webhook.PollInterval)},
+		{"WEBHOOK_ALLOWED_HOSTS", setList(&c.Webhook.AllowedHosts)},
+		{"WEBHOOK_ALLOW_PRIVATE_NETWORKS", setBool(&c.Webhook.AllowPrivateNetworks)},
+
+		{"READINESS_CACHE_TTL", setDuration(&c.Readiness.CacheTTL)},
+		{"READINESS_TIMEOUT", setDuration(&c.Readiness.Timeout)},
+		{"READINESS_CHECK_BREAKER", setBool(&c.Readiness.CheckBreaker)},
+
+		{"ADMIN_TOKENS", setStringMap(&c.Admin.Tokens)},
+		{"ADMIN_CREDENTIAL_ENV_PREFIX", setString(&c.Admin.CredentialEnvPrefix)},
+		{"ADMIN_CREDENTIAL_DIR", setString(&c.Admin.CredentialDir)},
+
+		{"LOG_REDACT_HEADERS", setList(&c.Logging.RedactHeaders)},
+		{"LOG_REDACT_FIELDS", setList(&c.Logging.RedactFields)},
+		{"LOG_REDACT_PATTERN", func(value string) error {
+			c.Logging.RedactPatterns = append(c.Logging.RedactPatterns, value)
+			return nil
+		}},
+		{"LOG_BODY_MODE", setString(&c.Logging.BodyMode)},
+		{"LOG_BODY_MAX_BYTES", setInt(&c.Logging.BodyMaxBytes)},
+
+		{"TRACING_EXPORTER", setString(&c.Tracing.Exporter)},
+		{"OTEL_SERVICE_NAME", setString(&c.Tracing.ServiceName)},
+
+		{"CONFIG_WATCH_INTERVAL", setDuration(&c.Reload.WatchInterval)},
+		{"CONFIG_DRAIN_TIMEOUT", setDuration(&c.Reload.DrainTimeout)},
+		{"ROUTE_REFRESH_INTERVAL", setDuration(&c.Reload.RouteRefreshInterval)},
+	}
+}
+
+// applyEnv は空でない環境変数で設定を上書きする
+func (c *Config) applyEnv(lookupEnv func(string) (string, bool)) error {
+	var errs []error
+	for _, binding := range c.envBindings() {
+		value, ok := lookupEnv(binding.name)
+		if !ok || value == "" {
+			continue
+		}
+		if err := binding.set(value); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", binding.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func setString(field *string) func(string) error {
+	return func(value string) error {
+		*field = value
+		return nil
+	}
+}
+
+func setInt(field *int) func(string) error {
+	return func(value string) error {
+		v, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid integer: %q", value)
+		}
+		*field = v
+		return nil
+	}
+}
+
+func setInt64(field *int64) func(string) error {
+	return func(value string) error {
+		v, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid integer: %q", value)
+		}
+		*field = v
+		return nil
+	}
+}
+
+func setUint32(field *uint32) func(string) error {
+	return func(value string) error {
+		v, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid non-negative integer: %q", value)
+		}
+		*field = uint32(v)
+		return nil
+	}
+}
+
+func setFloat(field *float64) func(string) error {
+	return func(value string) error {
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number: %q", value)
+		}
+		*field = v
+		return nil
+	}
+}
+
+// setBool は以前の環境変数で使っていた enabled と disabled も受け付ける
+func setBool(field *bool) func(string) error {
+	return func(value string) error {
+		switch value {
+		case "enabled":
+			*field = true
+			return nil
+		case "disabled":
+			*field = false
+			return nil
+		}
+		v, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean: %q", value)
+		}
+		*field = v
+		return nil
+	}
+}
+
+func setDuration(field *Duration) func(string) error {
+	return func(value string) error {
+		v, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration: %q", value)
+		}
+		field.Duration = v
+		return nil
+	}
+}
+
+// setList は "value1,value2" 形式の値を読み取る
+func setList(field *[]string) func(string) error {
+	return func(value string) error {
+		*field = nil
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				*field = append(*field, item)
+			}
+		}
+		return nil
+	}
+}
+
+// parseMap は "key1=value1,key2=value2" 形式の値を読み取る
+func parseMap(value string) (map[string]string, error) {
+	values := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("invalid key=value pair: %q", pair)
+		}
+		values[k] = v
+	}
+	return values, nil
+}
+
+func setStringMap(field *map[string]string) func(string) error {
+	return func(value string) error {
+		values, err := parseMap(value)
+		if err != nil {
+			return err
+		}
+		*field = values
+		return nil
+	}
+}
+
+func setIntMap(field *map[string]int) func(string) error {
+	return func(value string) error {
+		pairs, err := parseMap(value)
+		if err != nil {
+			return err
+		}
+		values := make(map[string]int, len(pairs))
+		for k, v := range pairs {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("%s: invalid integer: %q", k, v)
+			}
+			values[k] = n
+		}
+		*field = values
+		return nil
+	}
+}
+
+func setPriorityWeights(field *map[string]int) func(string) error {
+	return func(value string) error {
+		weights, err := queue.ParsePriorityWeights(value)
+		if err != nil {
+			return err
+		}
+		*field = make(map[string]int, len(weights))
+		for priority, weight := range weights {
+			(*field)[string(priority)] = weight
+		}
+		return nil
+	}
+}
+
+// setTenantLimits はテナントごとの値を読み取り、テナントのアドミッション制御の上限に set で設定する
+func setTenantLimits(field *map[string]AdmissionLimits, set func(limits *AdmissionLimits, value string) error) func(string) error {
+	return func(value string) error {
+		pairs, err := parseMap(value)
+		if err != nil {
+			return err
+		}
+		if *field == nil {
+			*field = make(map[string]AdmissionLimits)
+		}
+		for tenant, v := range pairs {
+			limits := (*field)[tenant]
+			if err := set(&limits, v); err != nil {
+				return fmt.Errorf("%s: %w", tenant, err)
+			}
+			(*field)[tenant] = limits
+		}
+		return nil
+	}
+}
@@ -0,0 +1,106 @@
+package config
+
+import (
+	"reflect"
+	"reliproxy/pkg/httpclient"
+)
+
+// RouteSpecs はデフォルトのルートと routes の各ルートの設定を返す
+//
+// ルートで指定しなかった項目には upstream と breaker の値を、同期リクエストの非同期への切り替えには async の値を使う。
+func (c *Config) RouteSpecs() []httpclient.RouteSpec {
+	specs := []httpclient.RouteSpec{{
+		Name:       httpclient.DefaultRoute,
+		URL:        c.Upstream.URL,
+		MaxRetries: c.Upstream.MaxRetries,
+		RateLimit:  c.Upstream.RateLimit,
+		Burst:      c.Upstream.Burst,
+		Breaker:    breakerSpec(c.Breaker),
+
+		SyncOverflow:        c.Async.SyncOverflow,
+		SyncOverflowLatency: c.Async.SyncOverflowLatency.Duration,
+	}}
+	for _, route := range c.Routes {
+		spec := httpclient.RouteSpec{
+			Name:       route.Name,
+			URL:        route.URL,
+			MaxRetries: orDefault(route.MaxRetries, c.Upstream.MaxRetries),
+			RateLimit:  orDefault(route.RateLimit, c.Upstream.RateLimit),
+			Burst:      orDefault(route.Burst, c.Upstream.Burst),
+			Breaker:    breakerSpec(c.Breaker),
+
+			SyncOverflow:        c.Async.SyncOverflow,
+			SyncOverflowLatency: orDefault(route.SyncOverflowLatency, c.Async.SyncOverflowLatency).Duration,
+		}
+		if route.SyncOverflow != nil {
+			spec.SyncOverflow = *route.SyncOverflow
+		}
+		if route.Breaker != nil {
+			spec.Breaker = httpclient.BreakerSpec{
+				// 名前を省略した場合はルートの名前を使い、デフォルトのサーキットブレーカーと区別する
+				Name:             orDefault(route.Breaker.Name, route.Name),
+				MaxRequests:      orDefault(route.Breaker.MaxRequests, c.Breaker.MaxRequests),
+				Interval:         orDefault(route.Breaker.Interval, c.Breaker.Interval).Duration,
+				Timeout:          orDefault(route.Breaker.Timeout, c.Breaker.Timeout).Duration,
+				FailureThreshold: orDefault(route.Breaker.FailureThreshold, c.Breaker.FailureThreshold),
+			}
+		}
+		specs = append(specs, spec)
+	}
+	return specs
+}
+
+// RestartRequired は再読み込みでは反映できない項目のうち、old から cfg で変更された項目の名前を返す
+//
+// ルート、サーキットブレーカー、レート制限、再試行、同期リクエストの非同期への切り替え、ログの秘匿の設定は再読み込みで反映する。
+func RestartRequired(old, cfg *Config) []string {
+	var changed []string
+	oldValue, newValue := reflect.ValueOf(*old), reflect.ValueOf(*cfg)
+	for i := 0; i < oldValue.NumField(); i++ {
+		field := oldValue.Type().Field(i)
+		switch field.Name {
+		case "Upstream", "Breaker", "Routes", "Logging", "Reload":
+			continue
+		case "Consumer":
+			// テナントごとのレート制限は再読み込みで反映する
+			oldConsumer, newConsumer := old.Consumer, cfg.Consumer
+			oldConsumer.TenantRateLimit, oldConsumer.TenantBurst = 0, 0
+			newConsumer.TenantRateLimit, newConsumer.TenantBurst = 0, 0
+			if oldConsumer != newConsumer {
+				changed = append(changed, field.Tag.Get("yaml"))
+			}
+			continue
+		case "Async":
+			// 同期リクエストの非同期への切り替えはルートの設定として再読み込みで反映する
+			oldAsync, newAsync := old.Async, cfg.Async
+			oldAsync.SyncOverflow, oldAsync.SyncOverflowLatency = false, Duration{}
+			newAsync.SyncOverflow, newAsync.SyncOverflowLatency = false, Duration{}
+			if oldAsync != newAsync {
+				changed = append(changed, field.Tag.Get("yaml"))
+			}
+			continue
+		}
+		if !reflect.DeepEqual(oldValue.Field(i).Interface(), newValue.Field(i).Interface()) {
+			changed = append(changed, field.Tag.Get("yaml"))
+		}
+	}
+	return changed
+}
+
+func breakerSpec(cfg BreakerConfig) httpclient.BreakerSpec {
+	return httpclient.BreakerSpec{
+		Name:             cfg.Name,
+		MaxRequests:      cfg.MaxRequests,
+		Interval:         cfg.Interval.Duration,
+		Timeout:          cfg.Timeout.Duration,
+		FailureThreshold: cfg.FailureThreshold,
+	}
+}
+
+func orDefault[T comparable](value, fallback T) T {
+	var zero T
+	if value == zero {
+		return fallback
+	}
+	return value
+}
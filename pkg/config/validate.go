@@ -0,0 +1,216 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"reliproxy/pkg/httpclient"
+	"reliproxy/pkg/queue"
+	"reliproxy/pkg/utils"
+	"sort"
+)
+
+// Validate は全ての項目を検証し、不正な項目をまとめたエラーを返す
+func (c *Config) Validate() error {
+	v := &validator{}
+
+	v.require(c.Server.Addr != "", "server.addr", "must not be empty")
+	v.oneOf("storage", c.Storage, "mysql", "memory")
+
+	if c.Storage == "mysql" {
+		v.require(c.MySQL.Host != "", "mysql.host", "must not be empty")
+		v.require(c.MySQL.Port != "", "mysql.port", "must not be empty")
+		v.require(c.MySQL.DBName != "", "mysql.db_name", "must not be empty")
+		v.oneOf("queue.backend", c.Queue.Backend, "redis", "mysql")
+		v.oneOf("async.write_mode", c.Async.WriteMode, "outbox", "direct")
+		if c.Queue.Backend == "redis" {
+			v.require(c.Redis.Addr != "", "redis.addr", "must not be empty")
+		}
+	}
+	v.require(c.Redis.DB >= 0, "redis.db", "must not be negative")
+
+	if !isHTTPURL(c.Upstream.URL) {
+		v.fail("upstream.url", "must be an absolute http or https URL, got %q", c.Upstream.URL)
+	}
+	v.require(c.Upstream.MaxRetries > 0, "upstream.max_retries", "must be positive")
+	v.require(c.Upstream.RateLimit > 0, "upstream.rate_limit", "must be positive")
+	v.require(c.Upstream.Burst > 0, "upstream.burst", "must be positive")
+
+	v.require(c.Breaker.Name != "", "breaker.name", "must not be empty")
+	v.require(c.Breaker.MaxRequests > 0, "breaker.max_requests", "must be positive")
+	v.require(c.Breaker.Interval.Duration >= 0, "breaker.interval", "must not be negative")
+	v.require(c.Breaker.Timeout.Duration > 0, "breaker.timeout", "must be positive")
+
+	v.routes(c)
+
+	v.require(c.Queue.Name != "", "queue.name", "must not be empty")
+	v.oneOf("queue.scheduling", c.Queue.Scheduling, "weighted", "strict")
+	for _, priority := range sortedKeys(c.Queue.PriorityWeights) {
+		if _, err := queue.ParsePriority(priority); err != nil {
+			v.fail("queue.priority_weights", "unknown priority %q", priority)
+		}
+		v.require(c.Queue.PriorityWeights[priority] >= 0, "queue.priority_weights."+priority, "must not be negative")
+	}
+	v.positive("queue.poll_interval", c.Queue.PollInterval)
+	v.positive("queue.mysql_poll_interval", c.Queue.MySQLPollInterval)
+	v.positive("queue.lease_duration", c.Queue.LeaseDuration)
+	v.require(c.Queue.MaxAttempts > 0, "queue.max_attempts", "must be positive")
+
+	v.positive("scheduler.poll_interval", c.Scheduler.PollInterval)
+	v.require(c.Scheduler.BatchSize > 0, "scheduler.batch_size", "must be positive")
+	v.positive("scheduler.recurring_poll_interval", c.Scheduler.RecurringPollInterval)
+	v.require(c.Scheduler.RecurringGracePeriod.Duration >= 0, "scheduler.recurring_grace_period", "must not be negative")
+
+	v.positive("async.outbox_relay_interval", c.Async.OutboxRelayInterval)
+	v.require(c.Async.OutboxBatchSize > 0, "async.outbox_batch_size", "must be positive")
+	v.require(c.Async.SpoolSegmentBytes > 0, "async.spool_segment_bytes", "must be positive")
+	v.positive("async.spool_relay_interval", c.Async.SpoolRelayInterval)
+	v.require(c.Async.SyncOverflowLatency.Duration >= 0, "async.sync_overflow_latency", "must not be negative")
+
+	v.admissionLimits("admission", c.Admission.AdmissionLimits)
+	for _, tenant := range sortedKeys(c.Admission.Tenants) {
+		v.admissionLimits("admission.tenants."+tenant, c.Admission.Tenants[tenant])
+	}
+	v.positive("admission.retry_after", c.Admission.RetryAfter)
+
+	v.positive("idempotency.ttl", c.Idempotency.TTL)
+	v.positive("idempotency.reservation_ttl", c.Idempotency.ReservationTTL)
+
+	for _, tenant := range sortedKeys(c.Tenants.Weights) {
+		v.require(c.Tenants.Weights[tenant] > 0, "tenants.weights."+tenant, "must be positive")
+	}
+	for _, tenant := range sortedKeys(c.Tenants.CallbackURLs) {
+		if !isHTTPURL(c.Tenants.CallbackURLs[tenant]) {
+			v.fail("tenants.callback_urls."+tenant, "must be an absolute http or https URL")
+		}
+	}
+
+	v.require(c.Consumer.Workers > 0, "consumer.workers", "must be positive")
+	v.require(c.Consumer.TenantRateLimit > 0, "consumer.tenant_rate_limit", "must be positive")
+	v.require(c.Consumer.TenantBurst > 0, "consumer.tenant_burst", "must be positive")
+	v.positive("consumer.max_dequeue_failure", c.Consumer.MaxDequeueFailure)
+
+	v.positive("webhook.timeout", c.Webhook.Timeout)
+	v.require(c.Webhook.MaxAttempts > 0, "webhook.max_attempts", "must be positive")
+	v.positive("webhook.backoff", c.Webhook.Backoff)
+	v.positive("webhook.poll_interval", c.Webhook.PollInterval)
+	v.require(c.Webhook.BatchSize > 0, "webhook.batch_size", "must be positive")
+	if len(c.Tenants.CallbackURLs) > 0 {
+		v.require(c.Webhook.Secret != "", "webhook.secret", "must not be empty when tenants.callback_urls is set")
+	}
+
+	if c.Admin.CredentialDir != "" && !filepath.IsAbs(c.Admin.CredentialDir) {
+		v.fail("admin.credential_dir", "must be an absolute path, got %q", c.Admin.CredentialDir)
+	}
+
+	v.require(c.Readiness.CacheTTL.Duration >= 0, "readiness.cache_ttl", "must not be negative")
+	v.positive("readiness.timeout", c.Readiness.Timeout)
+
+	for i, pattern := range c.Logging.RedactPatterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			v.fail(fmt.Sprintf("logging.redact_patterns[%d]", i), "invalid regular expression: %v", err)
+		}
+	}
+	if _, err := utils.ParseBodyLogMode(c.Logging.BodyMode); err != nil {
+		v.fail("logging.body_mode", "must be one of off, truncated, full, got %q", c.Logging.BodyMode)
+	}
+	v.require(c.Logging.BodyMaxBytes > 0, "logging.body_max_bytes", "must be positive")
+
+	v.oneOf("tracing.exporter", c.Tracing.Exporter, "none", "otlp")
+	v.require(c.Tracing.ServiceName != "", "tracing.service_name", "must not be empty")
+
+	v.require(c.Reload.WatchInterval.Duration >= 0, "reload.watch_interval", "must not be negative")
+	v.positive("reload.drain_timeout", c.Reload.DrainTimeout)
+	v.positive("reload.route_refresh_interval", c.Reload.RouteRefreshInterval)
+
+	return v.err()
+}
+
+// routes はルートの設定を検証する。上書きしない項目は upstream と breaker の検証に任せる
+func (v *validator) routes(c *Config) {
+	names := map[string]bool{httpclient.DefaultRoute: true}
+	for i, route := range c.Routes {
+		field := fmt.Sprintf("routes[%d]", i)
+		switch {
+		case !httpclient.RouteNamePattern.MatchString(route.Name):
+			v.fail(field+".name", "must match %s, got %q", httpclient.RouteNamePattern, route.Name)
+		case names[route.Name]:
+			v.fail(field+".name", "duplicate route %q", route.Name)
+		}
+		names[route.Name] = true
+
+		if !isHTTPURL(route.URL) {
+			v.fail(field+".url", "must be an absolute http or https URL, got %q", route.URL)
+		}
+		v.require(route.MaxRetries >= 0, field+".max_retries", "must not be negative")
+		v.require(route.RateLimit >= 0, field+".rate_limit", "must not be negative")
+		v.require(route.Burst >= 0, field+".burst", "must not be negative")
+		if route.Breaker != nil {
+			v.require(route.Breaker.Interval.Duration >= 0, field+".breaker.interval", "must not be negative")
+			v.require(route.Breaker.Timeout.Duration >= 0, field+".breaker.timeout", "must not be negative")
+		}
+		v.require(route.SyncOverflowLatency.Duration >= 0, field+".sync_overflow_latency", "must not be negative")
+	}
+
+	// 管理 API は名前でサーキットブレーカーを操作するため、設定が異なるものには別の名前が必要
+	breakers := make(map[string]httpclient.BreakerSpec)
+	for i, spec := range c.RouteSpecs() {
+		if other, ok := breakers[spec.Breaker.Name]; ok && other != spec.Breaker {
+			v.fail(fmt.Sprintf("routes[%d].breaker.name", i-1), "%q is already used by a breaker with different settings", spec.Breaker.Name)
+		}
+		breakers[spec.Breaker.Name] = spec.Breaker
+	}
+}
+
+// validator は不正な項目をまとめて報告するために検証のエラーを集める
+type validator struct {
+	errs []error
+}
+
+func (v *validator) fail(field, format string, args ...interface{}) {
+	v.errs = append(v.errs, fmt.Errorf("%s: %s", field, fmt.Sprintf(format, args...)))
+}
+
+func (v *validator) require(ok bool, field, message string) {
+	if !ok {
+		v.fail(field, "%s", message)
+	}
+}
+
+func (v *validator) positive(field string, d Duration) {
+	v.require(d.Duration > 0, field, "must be positive")
+}
+
+func (v *validator) oneOf(field, value string, allowed ...string) {
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	v.fail(field, "must be one of %v, got %q", allowed, value)
+}
+
+func (v *validator) admissionLimits(field string, limits AdmissionLimits) {
+	v.require(limits.MaxDepth >= 0, field+".max_depth", "must not be negative")
+	v.require(limits.MaxAge.Duration >= 0, field+".max_age", "must not be negative")
+}
+
+func (v *validator) err() error {
+	return errors.Join(v.errs...)
+}
+
+func isHTTPURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -1,59 +1,472 @@
 package consumer
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reliproxy/pkg/cancellation"
+	"reliproxy/pkg/events"
 	"reliproxy/pkg/httpclient"
+	"reliproxy/pkg/metrics"
 	"reliproxy/pkg/queue"
 	"reliproxy/pkg/repository"
+	"reliproxy/pkg/tracing"
 	"reliproxy/pkg/utils"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// 失敗したリクエストを再び取り出せるようにするまでの待ち時間
+const retryDelay = 10 * time.Second
+
+// DefaultUpstreamURL は上流の URL が設定されていない場合にリクエストを送る URL
+const DefaultUpstreamURL = "https://api.thirdparty.com/data"
+
+// メトリクスに記録するジョブの処理結果
+const (
+	outcomeProcessed = "processed"
+	outcomeFailed    = "failed"
+	outcomeRetried   = "retried"
+	outcomeCancelled = "cancelled"
+	outcomeSkipped   = "skipped"
 )
 
 type Consumer struct {
-	queue            queue.Queue
-	statusRepository repository.RequestStatusRepository
-	client           httpclient.HttpClient
+	queue             queue.Queue
+	statusRepository  repository.RequestStatusRepository
+	client            httpclient.HttpClient
+	upstreamURL       string
+	router            *httpclient.Router
+	workers           chan struct{}
+	tenantLimiter     *TenantLimiter
+	notifier          cancellation.Notifier
+	webhookRepository repository.WebhookDeliveryRepository
+	events            events.Publisher
+
+	mu      sync.Mutex
+	running map[string]context.CancelFunc
+
+	// 取り出しのループの状態。ヘルスチェックから参照する
+	looping      atomic.Bool
+	failingSince atomic.Int64
+}
+
+type Option func(*Consumer)
+
+// WithWorkers は同時に処理するリクエスト数の上限を設定する
+//
+// 空いたワーカーの分だけキューから取り出すため、キューの取り出し順がそのままワーカーの割り当てになる。
+func WithWorkers(workers int) Option {
+	return func(c *Consumer) {
+		if workers > 0 {
+			c.workers = make(chan struct{}, workers)
+		}
+	}
+}
+
+// WithUpstreamURL はリクエストを送る上流の URL を設定する
+func WithUpstreamURL(upstreamURL string) Option {
+	return func(c *Consumer) {
+		c.upstreamURL = upstreamURL
+	}
 }
 
-func NewConsumer(queue queue.Queue, repository repository.RequestStatusRepository, client httpclient.HttpClient) *Consumer {
-	return &Consumer{
+// WithRouter は現在のルートテーブルからジョブのルートを選んで上流へリクエストを送る
+//
+// 設定の再読み込みで差し替わる前に始まったリクエストは差し替え前のルートで完了させる。
+func WithRouter(router *httpclient.Router) Option {
+	return func(c *Consumer) {
+		c.router = router
+	}
+}
+
+// WithTenantLimiter は上流へのリクエストをテナントごとのレート制限に従わせる
+func WithTenantLimiter(limiter *TenantLimiter) Option {
+	return func(c *Consumer) {
+		c.tenantLimiter = limiter
+	}
+}
+
+// WithCancellation は通知された取り消しで実行中のリクエストを中断する
+func WithCancellation(notifier cancellation.Notifier) Option {
+	return func(c *Consumer) {
+		c.notifier = notifier
+	}
+}
+
+// WithWebhooks はコールバック URL が指定されたリクエストの完了時に通知を配信待ちにする
+func WithWebhooks(webhookRepository repository.WebhookDeliveryRepository) Option {
+	return func(c *Consumer) {
+		c.webhookRepository = webhookRepository
+	}
+}
+
+// WithEvents はステータスが遷移するたびにイベントを発行する
+func WithEvents(publisher events.Publisher) Option {
+	return func(c *Consumer) {
+		c.events = publisher
+	}
+}
+
+func NewConsumer(queue queue.Queue, repository repository.RequestStatusRepository, client httpclient.HttpClient, opts ...Option) *Consumer {
+	c := &Consumer{
 		queue:            queue,
 		statusRepository: repository,
 		client:           client,
+		upstreamURL:      DefaultUpstreamURL,
+		running:          make(map[string]context.CancelFunc),
 	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
 }
 
 func (c *Consumer) Start() {
+	if c.notifier != nil {
+		go c.subscribeCancellation()
+	}
+
+	c.looping.Store(true)
+	defer c.looping.Store(false)
+
 	for {
+		c.acquireWorker()
 		requestID, requestData, err := c.queue.Dequeue()
 		if err != nil {
+			c.failingSince.CompareAndSwap(0, time.Now().UnixNano())
+			c.releaseWorker()
 			utils.Logger.WithFields(logrus.Fields{
 				"error": err,
 			}).Error("Failed to dequeue request")
 			time.Sleep(1 * time.Second)
 			continue
 		}
+		c.failingSince.Store(0)
 
-		go c.consume(requestID, requestData)
+		go func() {
+			defer c.releaseWorker()
+			c.consume(requestID, requestData)
+		}()
+	}
+}
 
+// Healthy は取り出しのループが動いており、maxFailure より長く取り出しに失敗し続けていないかを確認する
+func (c *Consumer) Healthy(maxFailure time.Duration) error {
+	if !c.looping.Load() {
+		return errors.New("consumer loop is not running")
 	}
+	if since := c.failingSince.Load(); since != 0 && time.Since(time.Unix(0, since)) > maxFailure {
+		return fmt.Errorf("consumer has failed to dequeue since %s", time.Unix(0, since).Format(time.RFC3339))
+	}
+	return nil
 }
 
 func (c *Consumer) consume(requestID string, requestData interface{}) {
-	_, err := c.client.Get("https://api.thirdparty.com/data")
+	start := time.Now()
+	var outcome string
+	defer func() {
+		metrics.ConsumerJobs.WithLabelValues(outcome).Inc()
+		metrics.ConsumerJobDuration.WithLabelValues(outcome).Observe(time.Since(start).Seconds())
+	}()
+
+	ctx, span := startSpan(requestID, requestData)
+	defer func() {
+		span.SetAttributes(attribute.String("consumer.outcome", outcome))
+		if outcome == outcomeFailed || outcome == outcomeRetried {
+			span.SetStatus(codes.Error, outcome)
+		}
+		span.End()
+	}()
+
+	ctx = withJobLogger(ctx, requestID, requestData)
+
+	// ステータスを変更する前に登録し、その後に通知された取り消しを取りこぼさないようにする
+	ctx, cancel := context.WithCancel(ctx)
+	c.track(requestID, cancel)
+	defer c.untrack(requestID)
+
+	// 再試行されたリクエストは running のまま取り出される
+	started, err := c.statuses(ctx).TransitionStatus(requestID, []string{repository.StatusQueued, repository.StatusRunning}, repository.StatusRunning)
 	if err != nil {
-		utils.Logger.WithFields(logrus.Fields{
+		utils.LoggerFromContext(ctx).WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Failed to update request status")
+		outcome = c.nack(ctx, requestID, requestData)
+		return
+	}
+	if !started {
+		utils.LoggerFromContext(ctx).Info("Skipping cancelled request")
+		outcome = outcomeSkipped
+		c.ack(ctx, requestID)
+		return
+	}
+	c.publish(ctx, requestID, repository.StatusRunning)
+
+	if c.tenantLimiter != nil {
+		if err := c.tenantLimiter.Wait(ctx, queue.JobTenant(requestData)); err != nil {
+			if ctx.Err() != nil {
+				outcome = outcomeCancelled
+				c.ack(ctx, requestID)
+				return
+			}
+			utils.LoggerFromContext(ctx).WithFields(logrus.Fields{
+				"error": err,
+			}).Error("Failed to wait for tenant rate limit")
+			outcome = c.nack(ctx, requestID, requestData)
+			return
+		}
+	}
+
+	resp, err := c.get(ctx, requestData)
+	if err != nil {
+		if ctx.Err() != nil {
+			utils.LoggerFromContext(ctx).Info("Request cancelled while running")
+			outcome = outcomeCancelled
+			c.ack(ctx, requestID)
+			return
+		}
+		utils.LoggerFromContext(ctx).WithFields(logrus.Fields{
 			"error": err,
 		}).Error("Failed to make request")
+		outcome = c.nack(ctx, requestID, requestData)
 		return
 	}
 
-	err = c.statusRepository.Create(&repository.RequestStatus{
-		ID: requestID, Status: "processed"})
+	resp.Body.Close()
+
+	processed, err := c.statuses(ctx).TransitionStatus(requestID, []string{repository.StatusRunning}, repository.StatusProcessed)
+	outcome = outcomeProcessed
 	if err != nil {
+		utils.LoggerFromContext(ctx).WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Failed to update request status")
+	} else if !processed {
+		utils.LoggerFromContext(ctx).Warn("Request was cancelled after the upstream call completed")
+		outcome = outcomeCancelled
+	}
+	if processed {
+		c.publish(ctx, requestID, repository.StatusProcessed)
+		c.notifyCompletion(ctx, requestID, requestData, repository.StatusProcessed, resp.StatusCode)
+	}
+	c.ack(ctx, requestID)
+}
+
+// statuses はジョブのスパンの子として操作を記録するリポジトリを返す
+//
+// 取り消されたジョブのステータスも更新できるよう、ctx の取り消しには従わない。
+func (c *Consumer) statuses(ctx context.Context) repository.RequestStatusRepository {
+	return c.statusRepository.WithContext(context.WithoutCancel(ctx))
+}
+
+// withJobLogger はジョブの ID、受け付けたリクエストの X-Request-ID とルートを付けたロガーを ctx に保存する
+//
+// 上流へのリクエストにも受け付けたときの X-Request-ID を引き継ぐ。
+func withJobLogger(ctx context.Context, requestID string, requestData interface{}) context.Context {
+	fields := logrus.Fields{"jobID": requestID}
+	if job, err := queue.DecodeJob(requestData); err == nil {
+		if job.CorrelationID != "" {
+			fields["requestID"] = job.CorrelationID
+			ctx = utils.WithRequestID(ctx, job.CorrelationID)
+		}
+		if job.Route != "" {
+			fields["route"] = job.Route
+		}
+	}
+	return utils.WithLogger(ctx, utils.Logger.WithFields(fields))
+}
+
+// startSpan はジョブを処理するスパンを開始する
+//
+// ジョブを受け付けたリクエストとは別のトレースにし、リンクから元のリクエストのスパンを辿れるようにする。
+func startSpan(requestID string, requestData interface{}) (context.Context, trace.Span) {
+	opts := []trace.SpanStartOption{
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(attribute.String("reliproxy.request_id", requestID)),
+	}
+	origin := trace.SpanContextFromContext(tracing.Extract(context.Background(), queue.JobTraceContext(requestData)))
+	if origin.IsValid() {
+		opts = append(opts, trace.WithLinks(trace.Link{SpanContext: origin}))
+	}
+	return tracing.Tracer().Start(context.Background(), "consumer.process", opts...)
+}
+
+// get はジョブのメソッドと本文で上流へ送る。ルーターが設定されている場合はジョブのルートを使い、指定がなければデフォルトのルートを使う
+//
+// ルートが削除されている場合はエラーを返し、他のリクエストと同じく再試行した後に失敗として記録する。
+func (c *Consumer) get(ctx context.Context, requestData interface{}) (*http.Response, error) {
+	if job, err := queue.DecodeJob(requestData); err == nil {
+		ctx = httpclient.WithRequest(ctx, httpclient.Request{Method: job.Method, ContentType: job.ContentType, Body: []byte(job.Body)})
+	}
+	if c.router == nil {
+		return c.client.GetWithContext(ctx, c.upstreamURL)
+	}
+
+	name := queue.JobRoute(requestData)
+	if name == "" {
+		name = httpclient.DefaultRoute
+	}
+	table, release := c.router.Acquire()
+	defer release()
+	route, ok := table.Route(name)
+	if !ok {
+		return nil, fmt.Errorf("route %q not found", name)
+	}
+	return route.Client.GetWithContext(ctx, route.Spec.URL)
+}
+
+func (c *Consumer) publish(ctx context.Context, requestID string, status string) {
+	if c.events == nil {
+		return
+	}
+	if err := c.events.Publish(events.Event{RequestID: requestID, Status: status, At: time.Now()}); err != nil {
+		utils.LoggerFromContext(ctx).WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Failed to publish status event")
+	}
+}
+
+// completion はコールバック URL へ送信する完了通知の本文
+type completion struct {
+	RequestID          string    `json:"request_id"`
+	Status             string    `json:"status"`
+	UpstreamStatusCode int       `json:"upstream_status_code,omitempty"`
+	CompletedAt        time.Time `json:"completed_at"`
+}
+
+// notifyCompletion はコールバック URL が指定されたリクエストの完了通知を配信待ちにする
+func (c *Consumer) notifyCompletion(ctx context.Context, requestID string, requestData interface{}, status string, upstreamStatusCode int) {
+	if c.webhookRepository == nil {
+		return
+	}
+	job, err := queue.DecodeJob(requestData)
+	if err != nil || job.CallbackURL == "" {
+		return
+	}
+
+	payload, err := json.Marshal(completion{
+		RequestID:          requestID,
+		Status:             status,
+		UpstreamStatusCode: upstreamStatusCode,
+		CompletedAt:        time.Now(),
+	})
+	if err != nil {
+		return
+	}
+	err = c.webhookRepository.Create(&repository.WebhookDelivery{
+		RequestID:     requestID,
+		URL:           job.CallbackURL,
+		Payload:       string(payload),
+		Status:        repository.DeliveryPending,
+		NextAttemptAt: time.Now(),
+	})
+	if err != nil {
+		utils.LoggerFromContext(ctx).WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Failed to create webhook delivery")
+	}
+}
+
+func (c *Consumer) subscribeCancellation() {
+	for {
+		err := c.notifier.Subscribe(context.Background(), c.cancelRunning)
 		utils.Logger.WithFields(logrus.Fields{
 			"error": err,
+		}).Error("Cancellation subscription stopped")
+		time.Sleep(1 * time.Second)
+	}
+}
+
+// cancelRunning はこのワーカーで実行中のリクエストであれば中断する
+func (c *Consumer) cancelRunning(requestID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if cancel, ok := c.running[requestID]; ok {
+		cancel()
+	}
+}
+
+func (c *Consumer) track(requestID string, cancel context.CancelFunc) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.running[requestID] = cancel
+}
+
+func (c *Consumer) untrack(requestID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if cancel, ok := c.running[requestID]; ok {
+		cancel()
+		delete(c.running, requestID)
+	}
+}
+
+func (c *Consumer) acquireWorker() {
+	if c.workers != nil {
+		c.workers <- struct{}{}
+	}
+}
+
+func (c *Consumer) releaseWorker() {
+	if c.workers != nil {
+		<-c.workers
+	}
+}
+
+func (c *Consumer) ack(ctx context.Context, requestID string) {
+	acknowledger, ok := c.queue.(queue.Acknowledger)
+	if !ok {
+		return
+	}
+	if err := acknowledger.Ack(requestID); err != nil {
+		utils.LoggerFromContext(ctx).WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Failed to ack request")
+	}
+}
+
+// nack はリクエストを再試行できるようキューに戻し、処理結果を返す
+//
+// キューが再試行できない場合や最大試行回数に達した場合は失敗として記録する。
+func (c *Consumer) nack(ctx context.Context, requestID string, requestData interface{}) string {
+	acknowledger, ok := c.queue.(queue.Acknowledger)
+	if !ok {
+		return c.fail(ctx, requestID, requestData)
+	}
+	err := acknowledger.Nack(requestID, retryDelay)
+	if errors.Is(err, queue.ErrMaxAttemptsExceeded) || errors.Is(err, queue.ErrRetryUnsupported) {
+		return c.fail(ctx, requestID, requestData)
+	}
+	if err != nil {
+		// キューに戻せなかったリクエストはリースが切れた後に再び取り出される
+		utils.LoggerFromContext(ctx).WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Failed to nack request")
+	}
+	return outcomeRetried
+}
+
+// fail は再試行されないリクエストを失敗として記録し、完了を通知する
+func (c *Consumer) fail(ctx context.Context, requestID string, requestData interface{}) string {
+	failed, err := c.statuses(ctx).TransitionStatus(requestID, []string{repository.StatusRunning}, repository.StatusFailed)
+	if err != nil {
+		utils.LoggerFromContext(ctx).WithFields(logrus.Fields{
+			"error": err,
 		}).Error("Failed to update request status")
 	}
+	if failed {
+		c.publish(ctx, requestID, repository.StatusFailed)
+		c.notifyCompletion(ctx, requestID, requestData, repository.StatusFailed, 0)
+	}
+	return outcomeFailed
 }
@@ -0,0 +1,341 @@
+package consumer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reliproxy/pkg/cancellation"
+	"reliproxy/pkg/httpclient"
+	"reliproxy/pkg/queue"
+	"reliproxy/pkg/repository"
+	"reliproxy/pkg/tracing"
+	"reliproxy/pkg/utils"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestConsumer_SkipsCancelledRequest(t *testing.T) {
+	requestQueue := queue.NewMemoryQueue()
+	statusRepository := repository.NewMemoryRequestStatusRepository()
+	mockClient := new(httpclient.MockClient)
+	consumer := NewConsumer(requestQueue, statusRepository, mockClient)
+
+	assert.NoError(t, statusRepository.Create(&repository.RequestStatus{ID: "request-1", Status: repository.StatusCancelled}))
+	assert.NoError(t, requestQueue.Enqueue("request-1", &queue.Job{Body: "test"}))
+
+	requestID, requestData, err := requestQueue.Dequeue()
+	assert.NoError(t, err)
+	consumer.consume(requestID, requestData)
+
+	// 上流を呼ばずに破棄される
+	mockClient.AssertNotCalled(t, "GetWithContext", mock.Anything, mock.Anything)
+	requestStatus, _ := statusRepository.GetByID("request-1")
+	assert.Equal(t, repository.StatusCancelled, requestStatus.Status)
+}
+
+func TestConsumer_InterruptsRunningRequest(t *testing.T) {
+	requestQueue := queue.NewMemoryQueue()
+	statusRepository := repository.NewMemoryRequestStatusRepository()
+	notifier := cancellation.NewMemoryNotifier()
+	started := make(chan struct{})
+	mockClient := new(httpclient.MockClient)
+	mockClient.On("GetWithContext", mock.Anything, "https://api.thirdparty.com/data").
+		Run(func(args mock.Arguments) {
+			close(started)
+			<-args.Get(0).(context.Context).Done()
+		}).
+		Return(nil, context.Canceled)
+	consumer := NewConsumer(requestQueue, statusRepository, mockClient, WithCancellation(notifier))
+
+	assert.NoError(t, statusRepository.Create(&repository.RequestStatus{ID: "request-1", Status: repository.StatusQueued}))
+	assert.NoError(t, requestQueue.Enqueue("request-1", &queue.Job{Body: "test"}))
+	requestID, requestData, err := requestQueue.Dequeue()
+	assert.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		consumer.consume(requestID, requestData)
+		close(done)
+	}()
+	<-started
+
+	requestStatus, _ := statusRepository.GetByID("request-1")
+	assert.Equal(t, repository.StatusRunning, requestStatus.Status)
+
+	// 取り消しの通知を受け取った時と同じく中断する
+	_, err = statusRepository.TransitionStatus("request-1", []string{repository.StatusRunning}, repository.StatusCancelled)
+	assert.NoError(t, err)
+	consumer.cancelRunning("request-1")
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("running request was not interrupted")
+	}
+	requestStatus, _ = statusRepository.GetByID("request-1")
+	assert.Equal(t, repository.StatusCancelled, requestStatus.Status)
+	// 中断したリクエストは再試行されない
+	length, _ := requestQueue.Len()
+	assert.Equal(t, int64(0), length)
+}
+
+func TestConsumer_NotifiesCompletion(t *testing.T) {
+	requestQueue := queue.NewMemoryQueue()
+	statusRepository := repository.NewMemoryRequestStatusRepository()
+	deliveries := repository.NewMemoryWebhookDeliveryRepository()
+	mockClient := new(httpclient.MockClient)
+	mockClient.On("GetWithContext", mock.Anything, "https://api.thirdparty.com/data").
+		Return(&http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("ok"))}, nil)
+	consumer := NewConsumer(requestQueue, statusRepository, mockClient, WithWebhooks(deliveries))
+
+	assert.NoError(t, statusRepository.Create(&repository.RequestStatus{ID: "request-1", Status: repository.StatusQueued}))
+	assert.NoError(t, requestQueue.Enqueue("request-1", &queue.Job{Body: "test", CallbackURL: "https://example.com/callback"}))
+	requestID, requestData, err := requestQueue.Dequeue()
+	assert.NoError(t, err)
+	consumer.consume(requestID, requestData)
+
+	stored, err := deliveries.ListByRequestID("request-1")
+	assert.NoError(t, err)
+	assert.Len(t, stored, 1)
+	assert.Equal(t, "https://example.com/callback", stored[0].URL)
+	assert.Equal(t, repository.DeliveryPending, stored[0].Status)
+
+	var payload map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(stored[0].Payload), &payload))
+	assert.Equal(t, "request-1", payload["request_id"])
+	assert.Equal(t, repository.StatusProcessed, payload["status"])
+	assert.Equal(t, float64(http.StatusOK), payload["upstream_status_code"])
+}
+
+// unacknowledgedQueue は Ack と Nack を持たないキュー
+type unacknowledgedQueue struct {
+	queue *queue.MemoryQueue
+}
+
+func (q *unacknowledgedQueue) Enqueue(requestID string, requestData interface{}) error {
+	return q.queue.Enqueue(requestID, requestData)
+}
+
+func (q *unacknowledgedQueue) Dequeue() (string, interface{}, error) {
+	return q.queue.Dequeue()
+}
+
+func (q *unacknowledgedQueue) TryDequeue() (string, interface{}, error) {
+	return q.queue.TryDequeue()
+}
+
+func TestConsumer_FailsRequestThatCannotBeRetried(t *testing.T) {
+	tests := []struct {
+		name  string
+		queue queue.Queue
+	}{
+		{"max attempts exceeded", queue.NewMemoryQueue().WithMaxAttempts(1)},
+		{"lane without retries", queue.NewPriorityQueue(
+			map[queue.Priority]queue.PollingQueue{queue.PriorityNormal: &unacknowledgedQueue{queue: queue.NewMemoryQueue()}},
+			map[queue.Priority]int{queue.PriorityNormal: 1}, false, time.Millisecond,
+		)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			statusRepository := repository.NewMemoryRequestStatusRepository()
+			deliveries := repository.NewMemoryWebhookDeliveryRepository()
+			mockClient := new(httpclient.MockClient)
+			mockClient.On("GetWithContext", mock.Anything, "https://api.thirdparty.com/data").Return(nil, errors.New("upstream unavailable"))
+			consumer := NewConsumer(tt.queue, statusRepository, mockClient, WithWebhooks(deliveries))
+
+			assert.NoError(t, statusRepository.Create(&repository.RequestStatus{ID: "request-1", Status: repository.StatusQueued}))
+			assert.NoError(t, tt.queue.Enqueue("request-1", &queue.Job{Body: "test", CallbackURL: "https://example.com/callback"}))
+			requestID, requestData, err := tt.queue.Dequeue()
+			assert.NoError(t, err)
+			consumer.consume(requestID, requestData)
+
+			// 再試行されないリクエストは running のまま残さずに失敗として通知する
+			requestStatus, _ := statusRepository.GetByID("request-1")
+			assert.Equal(t, repository.StatusFailed, requestStatus.Status)
+			stored, err := deliveries.ListByRequestID("request-1")
+			assert.NoError(t, err)
+			assert.Len(t, stored, 1)
+		})
+	}
+}
+
+func TestConsumer_UsesJobRoute(t *testing.T) {
+	mockClient := new(httpclient.MockClient)
+	mockClient.On("GetWithContext", mock.Anything, mock.Anything).
+		Return(&http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("ok"))}, nil)
+	table := httpclient.NewRouteTable([]httpclient.RouteSpec{
+		{Name: httpclient.DefaultRoute, URL: "https://default.example.com/data", MaxRetries: 1, RateLimit: 100, Burst: 100, Breaker: httpclient.BreakerSpec{Name: "default"}},
+		{Name: "partner", URL: "https://partner.example.com/data", MaxRetries: 1, RateLimit: 100, Burst: 100, Breaker: httpclient.BreakerSpec{Name: "partner"}},
+	}, nil, mockClient, nil)
+
+	tests := []struct {
+		name   string
+		route  string
+		url    string
+		status string
+	}{
+		{"named route", "partner", "https://partner.example.com/data", repository.StatusProcessed},
+		{"default route", "", "https://default.example.com/data", repository.StatusProcessed},
+		{"path saved by an older version", "/async-proxy", "https://default.example.com/data", repository.StatusProcessed},
+		// 削除されたルートは上流を呼ばずに失敗させる
+		{"deleted route", "removed", "", repository.StatusFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockClient.Calls = nil
+			requestQueue := queue.NewMemoryQueue().WithMaxAttempts(1)
+			statusRepository := repository.NewMemoryRequestStatusRepository()
+			consumer := NewConsumer(requestQueue, statusRepository, nil, WithRouter(httpclient.NewRouter(table)))
+
+			assert.NoError(t, statusRepository.Create(&repository.RequestStatus{ID: "request-1", Status: repository.StatusQueued}))
+			assert.NoError(t, requestQueue.Enqueue("request-1", &queue.Job{Body: "test", Route: tt.route}))
+			requestID, requestData, err := requestQueue.Dequeue()
+			assert.NoError(t, err)
+			consumer.consume(requestID, requestData)
+
+			requestStatus, _ := statusRepository.GetByID("request-1")
+			assert.Equal(t, tt.status, requestStatus.Status)
+			if tt.url == "" {
+				assert.Empty(t, mockClient.Calls)
+			} else if assert.Len(t, mockClient.Calls, 1) {
+				assert.Equal(t, tt.url, mockClient.Calls[0].Arguments.Get(1))
+			}
+		})
+	}
+}
+
+func TestConsumer_SendsJobBody(t *testing.T) {
+	var method, contentType, body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		method, contentType, body = r.Method, r.Header.Get("Content-Type"), string(b)
+	}))
+	defer server.Close()
+
+	requestQueue := queue.NewMemoryQueue()
+	statusRepository := repository.NewMemoryRequestStatusRepository()
+	consumer := NewConsumer(requestQueue, statusRepository, &httpclient.DefaultHttpClient{}, WithUpstreamURL(server.URL))
+
+	// 定期実行ジョブのテンプレートなど、ジョブのメソッドと本文で上流へ送る
+	assert.NoError(t, statusRepository.Create(&repository.RequestStatus{ID: "request-1", Status: repository.StatusQueued}))
+	consumer.consume("request-1", &queue.Job{Method: http.MethodPut, Body: `{"data": "poll"}`})
+
+	assert.Equal(t, http.MethodPut, method)
+	assert.Equal(t, "application/json", contentType)
+	assert.Equal(t, `{"data": "poll"}`, body)
+	requestStatus, _ := statusRepository.GetByID("request-1")
+	assert.Equal(t, repository.StatusProcessed, requestStatus.Status)
+
+	// メソッドを指定しないジョブは本文があっても GET で送る
+	assert.NoError(t, statusRepository.Create(&repository.RequestStatus{ID: "request-2", Status: repository.StatusQueued}))
+	consumer.consume("request-2", &queue.Job{Body: "poll", ContentType: "text/plain"})
+
+	assert.Equal(t, http.MethodGet, method)
+	assert.Equal(t, "text/plain", contentType)
+	assert.Equal(t, "poll", body)
+}
+
+func TestConsumer_LinksSpanToOriginatingRequest(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := tracing.Setup(exporter, "reliproxy-test", sdktrace.WithSyncer(exporter))
+	defer provider.Shutdown(context.Background())
+
+	requestQueue := queue.NewMemoryQueue()
+	statusRepository := repository.NewMemoryRequestStatusRepository()
+	mockClient := new(httpclient.MockClient)
+	mockClient.On("GetWithContext", mock.Anything, "https://api.thirdparty.com/data").
+		Return(&http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("ok"))}, nil)
+	consumer := NewConsumer(requestQueue, statusRepository, mockClient)
+
+	ctx, origin := tracing.Tracer().Start(context.Background(), "POST /async-proxy")
+	origin.End()
+
+	// Redis のキューと同じく JSON を経由したメッセージから取り出す
+	data, _ := json.Marshal(&queue.Job{Body: "test", TraceContext: tracing.Inject(ctx)})
+	var requestData interface{}
+	assert.NoError(t, json.Unmarshal(data, &requestData))
+	assert.NoError(t, statusRepository.Create(&repository.RequestStatus{ID: "request-1", Status: repository.StatusQueued}))
+	consumer.consume("request-1", requestData)
+
+	var process *tracetest.SpanStub
+	spans := exporter.GetSpans()
+	for i := range spans {
+		if spans[i].Name == "consumer.process" {
+			process = &spans[i]
+		}
+	}
+	if assert.NotNil(t, process) {
+		assert.Len(t, process.Links, 1)
+		assert.Equal(t, origin.SpanContext().TraceID(), process.Links[0].SpanContext.TraceID())
+		assert.Equal(t, origin.SpanContext().SpanID(), process.Links[0].SpanContext.SpanID())
+
+		// 上流へのリクエストはワーカーのスパンの子として呼ばれる
+		upstreamCtx := mockClient.Calls[0].Arguments.Get(0).(context.Context)
+		assert.Equal(t, process.SpanContext.SpanID(), trace.SpanContextFromContext(upstreamCtx).SpanID())
+	}
+}
+
+func TestConsumer_PropagatesRequestID(t *testing.T) {
+	requestQueue := queue.NewMemoryQueue()
+	statusRepository := repository.NewMemoryRequestStatusRepository()
+	mockClient := new(httpclient.MockClient)
+	mockClient.On("GetWithContext", mock.Anything, "https://api.thirdparty.com/data").
+		Return(&http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("ok"))}, nil)
+	consumer := NewConsumer(requestQueue, statusRepository, mockClient)
+
+	assert.NoError(t, statusRepository.Create(&repository.RequestStatus{ID: "request-1", Status: repository.StatusQueued}))
+	consumer.consume("request-1", &queue.Job{Body: "test", Route: "partner", CorrelationID: "client-request-1"})
+
+	// 上流へのリクエストとログに受け付けたときの X-Request-ID とジョブの ID を引き継ぐ
+	upstreamCtx := mockClient.Calls[0].Arguments.Get(0).(context.Context)
+	assert.Equal(t, "client-request-1", utils.RequestIDFromContext(upstreamCtx))
+	logger := utils.LoggerFromContext(upstreamCtx)
+	assert.Equal(t, "client-request-1", logger.Data["requestID"])
+	assert.Equal(t, "request-1", logger.Data["jobID"])
+	assert.Equal(t, "partner", logger.Data["route"])
+}
+
+type failingQueue struct{}
+
+func (failingQueue) Enqueue(requestID string, requestData interface{}) error {
+	return nil
+}
+
+func (failingQueue) Dequeue() (string, interface{}, error) {
+	return "", nil, errors.New("connection refused")
+}
+
+func TestConsumer_Healthy(t *testing.T) {
+	statusRepository := repository.NewMemoryRequestStatusRepository()
+
+	t.Run("NotStarted", func(t *testing.T) {
+		consumer := NewConsumer(queue.NewMemoryQueue(), statusRepository, new(httpclient.MockClient))
+		assert.Error(t, consumer.Healthy(time.Minute))
+	})
+
+	t.Run("Idle", func(t *testing.T) {
+		consumer := NewConsumer(queue.NewMemoryQueue(), statusRepository, new(httpclient.MockClient))
+		go consumer.Start()
+		// 空のキューを待っている間も動いているとみなす
+		assert.Eventually(t, func() bool { return consumer.Healthy(time.Minute) == nil }, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("DequeueFailing", func(t *testing.T) {
+		consumer := NewConsumer(failingQueue{}, statusRepository, new(httpclient.MockClient))
+		go consumer.Start()
+		assert.Eventually(t, func() bool { return consumer.Healthy(0) != nil }, time.Second, 10*time.Millisecond)
+		assert.NoError(t, consumer.Healthy(time.Minute))
+	})
+}
@@ -0,0 +1,142 @@
+package consumer
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// tenantIdleTimeout はリクエストを処理しないままこの期間が過ぎたテナントを分配の対象から外す
+const tenantIdleTimeout = time.Minute
+
+// TenantLimiter は上流へのリクエストレートの上限をテナントの重みに応じて分配する
+//
+// 分配はこのプロセスで直近にリクエストを処理したテナントの重みの合計に対する割合で行い、
+// しばらく処理のないテナントには割り当てを残さない。
+type TenantLimiter struct {
+	limit       rate.Limit
+	burst       int
+	weights     map[string]int
+	idleTimeout time.Duration
+
+	mu      sync.Mutex
+	tenants map[string]*tenantRate
+}
+
+type tenantRate struct {
+	limiter *rate.Limiter
+	// waiting は割り当てを待っているリクエストの数で、待っている間は分配の対象から外さない
+	waiting  int
+	lastUsed time.Time
+}
+
+func NewTenantLimiter(limit rate.Limit, burst int, weights map[string]int) *TenantLimiter {
+	return &TenantLimiter{
+		limit:       limit,
+		burst:       burst,
+		weights:     weights,
+		idleTimeout: tenantIdleTimeout,
+		tenants:     make(map[string]*tenantRate),
+	}
+}
+
+func (l *TenantLimiter) Wait(ctx context.Context, tenant string) error {
+	limiter := l.acquire(tenant)
+	defer l.release(tenant)
+	return limiter.Wait(ctx)
+}
+
+func (l *TenantLimiter) acquire(tenant string) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	changed := l.expire(now)
+	entry, ok := l.tenants[tenant]
+	if !ok {
+		entry = &tenantRate{limiter: rate.NewLimiter(0, l.burst)}
+		l.tenants[tenant] = entry
+		changed = true
+	}
+	entry.waiting++
+	entry.lastUsed = now
+
+	// 対象のテナントが増減したので全てのテナントの割り当てを計算し直す
+	if changed {
+		l.distribute()
+	}
+	return entry.limiter
+}
+
+func (l *TenantLimiter) release(tenant string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if entry, ok := l.tenants[tenant]; ok {
+		entry.waiting--
+		entry.lastUsed = time.Now()
+	}
+}
+
+// expire は待っているリクエストがなく idleTimeout の間処理のないテナントを外し、外したかどうかを返す
+func (l *TenantLimiter) expire(now time.Time) bool {
+	expired := false
+	for name, entry := range l.tenants {
+		if entry.waiting == 0 && now.Sub(entry.lastUsed) >= l.idleTimeout {
+			delete(l.tenants, name)
+			expired = true
+		}
+	}
+	return expired
+}
+
+// Limit は全てのテナントで分配するレートの上限を返す
+func (l *TenantLimiter) Limit() rate.Limit {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
+
+// Burst はテナントごとのバーストを返す
+func (l *TenantLimiter) Burst() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.burst
+}
+
+// SetLimit は全てのテナントで分配するレートの上限を変更し、各テナントの割り当てを計算し直す
+func (l *TenantLimiter) SetLimit(limit rate.Limit) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limit = limit
+	l.distribute()
+}
+
+// SetBurst はテナントごとのバーストを変更する
+func (l *TenantLimiter) SetBurst(burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.burst = burst
+	for _, entry := range l.tenants {
+		entry.limiter.SetBurst(burst)
+	}
+}
+
+func (l *TenantLimiter) distribute() {
+	totalWeight := 0
+	for name := range l.tenants {
+		totalWeight += l.weight(name)
+	}
+	for name, entry := range l.tenants {
+		entry.limiter.SetLimit(l.limit * rate.Limit(l.weight(name)) / rate.Limit(totalWeight))
+	}
+}
+
+func (l *TenantLimiter) weight(tenant string) int {
+	if weight, ok := l.weights[tenant]; ok && weight > 0 {
+		return weight
+	}
+	return 1
+}
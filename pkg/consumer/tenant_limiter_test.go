@@ -0,0 +1,26 @@
+package consumer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/time/rate"
+)
+
+func TestTenantLimiter_DistributesAcrossActiveTenants(t *testing.T) {
+	limiter := NewTenantLimiter(100, 100, map[string]int{"team-a": 3})
+	limiter.idleTimeout = 50 * time.Millisecond
+
+	assert.NoError(t, limiter.Wait(context.Background(), "team-a"))
+	assert.NoError(t, limiter.Wait(context.Background(), "team-b"))
+	assert.Equal(t, rate.Limit(75), limiter.tenants["team-a"].limiter.Limit())
+	assert.Equal(t, rate.Limit(25), limiter.tenants["team-b"].limiter.Limit())
+
+	// team-a の処理が途絶えた後は、処理を続けている team-b に上限のすべてを割り当てる
+	time.Sleep(60 * time.Millisecond)
+	assert.NoError(t, limiter.Wait(context.Background(), "team-b"))
+	assert.NotContains(t, limiter.tenants, "team-a")
+	assert.Equal(t, rate.Limit(100), limiter.tenants["team-b"].limiter.Limit())
+}
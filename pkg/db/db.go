@@ -4,7 +4,10 @@ import (
 	"fmt"
 	"time"
 
+	"reliproxy/pkg/idempotency"
+	"reliproxy/pkg/queue"
 	"reliproxy/pkg/repository"
+	"reliproxy/pkg/scheduler"
 	"reliproxy/pkg/utils"
 
 	"gorm.io/driver/mysql"
@@ -59,5 +62,53 @@ func Migrate(db *gorm.DB) error {
 	if err != nil {
 		return fmt.Errorf("failed to migrate RequestStatus model: %v", err)
 	}
+	err = db.AutoMigrate(&repository.OutboxMessage{})
+	if err != nil {
+		return fmt.Errorf("failed to migrate OutboxMessage model: %v", err)
+	}
+	err = db.AutoMigrate(&queue.QueueJob{})
+	if err != nil {
+		return fmt.Errorf("failed to migrate QueueJob model: %v", err)
+	}
+	err = db.AutoMigrate(&queue.QueueTenant{})
+	if err != nil {
+		return fmt.Errorf("failed to migrate QueueTenant model: %v", err)
+	}
+	err = db.AutoMigrate(&queue.ScheduledJob{})
+	if err != nil {
+		return fmt.Errorf("failed to migrate ScheduledJob model: %v", err)
+	}
+	err = db.AutoMigrate(&idempotency.IdempotencyRecord{})
+	if err != nil {
+		return fmt.Errorf("failed to migrate IdempotencyRecord model: %v", err)
+	}
+	err = db.AutoMigrate(&repository.RecurringJob{})
+	if err != nil {
+		return fmt.Errorf("failed to migrate RecurringJob model: %v", err)
+	}
+	err = db.AutoMigrate(&scheduler.SchedulerLock{})
+	if err != nil {
+		return fmt.Errorf("failed to migrate SchedulerLock model: %v", err)
+	}
+	err = db.AutoMigrate(&repository.WebhookDelivery{})
+	if err != nil {
+		return fmt.Errorf("failed to migrate WebhookDelivery model: %v", err)
+	}
+	err = db.AutoMigrate(&repository.Route{})
+	if err != nil {
+		return fmt.Errorf("failed to migrate Route model: %v", err)
+	}
+	err = db.AutoMigrate(&repository.RouteVersion{})
+	if err != nil {
+		return fmt.Errorf("failed to migrate RouteVersion model: %v", err)
+	}
+	err = db.AutoMigrate(&repository.RoutePolicy{})
+	if err != nil {
+		return fmt.Errorf("failed to migrate RoutePolicy model: %v", err)
+	}
+	err = db.AutoMigrate(&repository.RouteCredential{})
+	if err != nil {
+		return fmt.Errorf("failed to migrate RouteCredential model: %v", err)
+	}
 	return nil
 }
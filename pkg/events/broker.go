@@ -0,0 +1,149 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"reliproxy/pkg/utils"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+)
+
+// Event はリクエストのステータスの遷移
+type Event struct {
+	RequestID string    `json:"request_id"`
+	Status    string    `json:"status"`
+	At        time.Time `json:"at"`
+}
+
+type Publisher interface {
+	Publish(event Event) error
+}
+
+type Watcher interface {
+	// Watch はリクエストのイベントを受け取るチャネルと、受け取りをやめる関数を返す
+	Watch(requestID string) (<-chan Event, func())
+}
+
+type Broker interface {
+	Publisher
+	Watcher
+}
+
+// watcherBuffer は1つの待ち受けが受信しきれずに保持できるイベント数
+const watcherBuffer = 16
+
+// hub はプロセス内の待ち受けにイベントを配る
+type hub struct {
+	mu       sync.Mutex
+	watchers map[string]map[chan Event]struct{}
+}
+
+func newHub() *hub {
+	return &hub{watchers: make(map[string]map[chan Event]struct{})}
+}
+
+func (h *hub) Watch(requestID string) (<-chan Event, func()) {
+	ch := make(chan Event, watcherBuffer)
+
+	h.mu.Lock()
+	if h.watchers[requestID] == nil {
+		h.watchers[requestID] = make(map[chan Event]struct{})
+	}
+	h.watchers[requestID][ch] = struct{}{}
+	h.mu.Unlock()
+
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(h.watchers[requestID], ch)
+		if len(h.watchers[requestID]) == 0 {
+			delete(h.watchers, requestID)
+		}
+	}
+}
+
+func (h *hub) dispatch(event Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch := range h.watchers[event.RequestID] {
+		// 受信が滞っている待ち受けのためにイベントの配信を止めない
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// MemoryBroker は単一プロセス用の Broker
+type MemoryBroker struct {
+	*hub
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{hub: newHub()}
+}
+
+func (b *MemoryBroker) Publish(event Event) error {
+	b.dispatch(event)
+	return nil
+}
+
+type RedisClient interface {
+	Publish(ctx context.Context, channel string, message interface{}) *redis.IntCmd
+	Subscribe(ctx context.Context, channels ...string) *redis.PubSub
+}
+
+// RedisBroker は Redis の Pub/Sub で全てのレプリカにイベントを配る
+//
+// 待ち受けごとに購読せず、レプリカごとに1つのチャネルを購読してプロセス内で振り分ける。
+type RedisBroker struct {
+	*hub
+	client  RedisClient
+	channel string
+}
+
+func NewRedisBroker(client RedisClient, channel string) *RedisBroker {
+	return &RedisBroker{hub: newHub(), client: client, channel: channel}
+}
+
+func (b *RedisBroker) Publish(event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return b.client.Publish(context.Background(), b.channel, string(data)).Err()
+}
+
+func (b *RedisBroker) Start() {
+	for {
+		err := b.subscribe(context.Background())
+		utils.Logger.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Status event subscription stopped")
+		time.Sleep(1 * time.Second)
+	}
+}
+
+func (b *RedisBroker) subscribe(ctx context.Context) error {
+	pubsub := b.client.Subscribe(ctx, b.channel)
+	defer pubsub.Close()
+
+	if _, err := pubsub.Receive(ctx); err != nil {
+		return err
+	}
+	for message := range pubsub.Channel() {
+		var event Event
+		if err := json.Unmarshal([]byte(message.Payload), &event); err != nil {
+			utils.Logger.WithFields(logrus.Fields{
+				"error": err,
+			}).Error("Failed to decode status event")
+			continue
+		}
+		b.dispatch(event)
+	}
+	return nil
+}
@@ -0,0 +1,282 @@
+package handlers
+
+import (
+	"net/http"
+	"reliproxy/pkg/httpclient"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+const operatorKey = "reliproxy.operator"
+
+// AdminBreaker は管理 API から操作するサーキットブレーカー
+type AdminBreaker interface {
+	Snapshot() httpclient.BreakerSnapshot
+	ForceOpen()
+	ForceClose()
+	Reset()
+}
+
+// AdminLimiter は管理 API からレートとバーストを変更するレートリミッター
+type AdminLimiter interface {
+	Limit() rate.Limit
+	Burst() int
+	SetLimit(limit rate.Limit)
+	SetBurst(burst int)
+}
+
+type limiterSnapshot struct {
+	Name   string   `json:"name"`
+	Rate   float64  `json:"rate"`
+	Burst  int      `json:"burst"`
+	Tokens *float64 `json:"tokens,omitempty"`
+	// Override は運用者が変更した値を使っているか
+	Override bool `json:"override,omitempty"`
+}
+
+type updateLimiterRequest struct {
+	Rate  *float64 `json:"rate"`
+	Burst *int     `json:"burst"`
+}
+
+// AdminAuthMiddleware は Authorization ヘッダの Bearer トークンで運用者を認証する
+type AdminAuthMiddleware struct {
+	// tokens はトークンから運用者名への対応
+	tokens map[string]string
+}
+
+func NewAdminAuthMiddleware(tokens map[string]string) *AdminAuthMiddleware {
+	return &AdminAuthMiddleware{tokens: tokens}
+}
+
+func (m *AdminAuthMiddleware) Handle(c *gin.Context) {
+	token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	operator, found := m.tokens[token]
+	if !ok || !found {
+		requestLogger(c).Warn("Rejecting admin request with invalid token")
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid admin token"})
+		return
+	}
+	c.Set(operatorKey, operator)
+	c.Next()
+}
+
+// AdminHandler は実行中のサーキットブレーカーとレートリミッターを参照、変更する
+//
+// 変更はすべて運用者名を付けて監査ログに記録する。
+type AdminHandler struct {
+	breakers map[string]AdminBreaker
+	limiters map[string]AdminLimiter
+	router   *httpclient.Router
+}
+
+func NewAdminHandler() *AdminHandler {
+	return &AdminHandler{
+		breakers: make(map[string]AdminBreaker),
+		limiters: make(map[string]AdminLimiter),
+	}
+}
+
+func (h *AdminHandler) AddBreaker(breaker AdminBreaker) *AdminHandler {
+	h.breakers[breaker.Snapshot().Name] = breaker
+	return h
+}
+
+func (h *AdminHandler) AddLimiter(name string, limiter AdminLimiter) *AdminHandler {
+	h.limiters[name] = limiter
+	return h
+}
+
+// WithRouter は現在のルートテーブルのサーキットブレーカーとレートリミッターも操作できるようにする
+//
+// レートリミッターはデフォルトのルートを upstream、それ以外を upstream:<ルート名> の名前で扱う。
+// ルートのレートリミッターの変更は設定の再読み込みやルートの変更の後も維持し、リセットすると設定の値に戻る。
+func (h *AdminHandler) WithRouter(router *httpclient.Router) *AdminHandler {
+	h.router = router
+	return h
+}
+
+// allBreakers は追加したサーキットブレーカーと現在のルートテーブルのサーキットブレーカーを返す
+func (h *AdminHandler) allBreakers() map[string]AdminBreaker {
+	breakers := make(map[string]AdminBreaker, len(h.breakers))
+	for name, breaker := range h.breakers {
+		breakers[name] = breaker
+	}
+	if h.router != nil {
+		for _, breaker := range h.router.Current().Breakers() {
+			breakers[breaker.Name()] = breaker
+		}
+	}
+	return breakers
+}
+
+// allLimiters は追加したレートリミッターと現在のルートテーブルのレートリミッターを返す
+func (h *AdminHandler) allLimiters() map[string]AdminLimiter {
+	limiters := make(map[string]AdminLimiter, len(h.limiters))
+	for name, limiter := range h.limiters {
+		limiters[name] = limiter
+	}
+	if h.router != nil {
+		for _, route := range h.router.Current().Routes() {
+			name := "upstream"
+			if route.Spec.Name != httpclient.DefaultRoute {
+				name += ":" + route.Spec.Name
+			}
+			limiters[name] = route.Limiter
+		}
+	}
+	return limiters
+}
+
+func (h *AdminHandler) HandleListBreakers(c *gin.Context) {
+	all := h.allBreakers()
+	breakers := make([]httpclient.BreakerSnapshot, 0, len(all))
+	for _, breaker := range all {
+		breakers = append(breakers, breaker.Snapshot())
+	}
+	sort.Slice(breakers, func(i, j int) bool { return breakers[i].Name < breakers[j].Name })
+	c.JSON(http.StatusOK, gin.H{"breakers": breakers})
+}
+
+// HandleBreakerAction はサーキットブレーカーを強制的に開閉するか、リセットする
+func (h *AdminHandler) HandleBreakerAction(c *gin.Context) {
+	name := c.Param("name")
+	breaker, ok := h.allBreakers()[name]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Breaker not found"})
+		return
+	}
+
+	before := breaker.Snapshot()
+	action := c.Param("action")
+	switch action {
+	case "open":
+		breaker.ForceOpen()
+	case "close":
+		breaker.ForceClose()
+	case "reset":
+		breaker.Reset()
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown action: " + action})
+		return
+	}
+	after := breaker.Snapshot()
+
+	auditLogger(c).WithFields(logrus.Fields{
+		"action":  "breaker." + action,
+		"breaker": name,
+		"from":    before.State,
+		"to":      after.State,
+	}).Info("Changed circuit breaker")
+	c.JSON(http.StatusOK, after)
+}
+
+func (h *AdminHandler) HandleListLimiters(c *gin.Context) {
+	all := h.allLimiters()
+	limiters := make([]limiterSnapshot, 0, len(all))
+	for name, limiter := range all {
+		limiters = append(limiters, snapshotLimiter(name, limiter))
+	}
+	sort.Slice(limiters, func(i, j int) bool { return limiters[i].Name < limiters[j].Name })
+	c.JSON(http.StatusOK, gin.H{"limiters": limiters})
+}
+
+// HandleUpdateLimiter はレートリミッターのレートとバーストを変更する。指定しなかった値は変更しない
+func (h *AdminHandler) HandleUpdateLimiter(c *gin.Context) {
+	name := c.Param("name")
+	limiter, ok := h.allLimiters()[name]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Limiter not found"})
+		return
+	}
+
+	var req updateLimiterRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if req.Rate == nil && req.Burst == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "rate or burst is required"})
+		return
+	}
+	if (req.Rate != nil && *req.Rate < 0) || (req.Burst != nil && *req.Burst < 0) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "rate and burst must not be negative"})
+		return
+	}
+
+	before := snapshotLimiter(name, limiter)
+	if req.Rate != nil {
+		limiter.SetLimit(rate.Limit(*req.Rate))
+	}
+	if req.Burst != nil {
+		limiter.SetBurst(*req.Burst)
+	}
+	after := snapshotLimiter(name, limiter)
+
+	auditLogger(c).WithFields(logrus.Fields{
+		"action":    "limiter.update",
+		"limiter":   name,
+		"fromRate":  before.Rate,
+		"fromBurst": before.Burst,
+		"toRate":    after.Rate,
+		"toBurst":   after.Burst,
+	}).Info("Changed rate limiter")
+	c.JSON(http.StatusOK, after)
+}
+
+// HandleResetLimiter は運用者が変更したレートとバーストを捨てて設定の値に戻す
+func (h *AdminHandler) HandleResetLimiter(c *gin.Context) {
+	name := c.Param("name")
+	limiter, ok := h.allLimiters()[name]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Limiter not found"})
+		return
+	}
+	resettable, ok := limiter.(interface{ Reset() })
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Limiter cannot be reset"})
+		return
+	}
+
+	before := snapshotLimiter(name, limiter)
+	resettable.Reset()
+	after := snapshotLimiter(name, limiter)
+
+	auditLogger(c).WithFields(logrus.Fields{
+		"action":    "limiter.reset",
+		"limiter":   name,
+		"fromRate":  before.Rate,
+		"fromBurst": before.Burst,
+		"toRate":    after.Rate,
+		"toBurst":   after.Burst,
+	}).Info("Reset rate limiter")
+	c.JSON(http.StatusOK, after)
+}
+
+func snapshotLimiter(name string, limiter AdminLimiter) limiterSnapshot {
+	snapshot := limiterSnapshot{
+		Name:  name,
+		Rate:  float64(limiter.Limit()),
+		Burst: limiter.Burst(),
+	}
+	if l, ok := limiter.(interface{ Tokens() float64 }); ok {
+		tokens := l.Tokens()
+		snapshot.Tokens = &tokens
+	}
+	if l, ok := limiter.(interface{ Overridden() bool }); ok {
+		snapshot.Override = l.Overridden()
+	}
+	return snapshot
+}
+
+// auditLogger は操作した運用者を付けた監査ログ用のロガーを返す
+func auditLogger(c *gin.Context) *logrus.Entry {
+	return requestLogger(c).WithFields(logrus.Fields{
+		"audit":    true,
+		"operator": c.GetString(operatorKey),
+	})
+}
@@ -0,0 +1,186 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reliproxy/pkg/consumer"
+	"reliproxy/pkg/httpclient"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sony/gobreaker"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/time/rate"
+)
+
+func setupAdminRouter(breaker *httpclient.ManagedBreaker, limiter *httpclient.ManagedLimiter, tenantLimiter *consumer.TenantLimiter) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	handler := NewAdminHandler().
+		AddBreaker(breaker).
+		AddLimiter("upstream", limiter).
+		AddLimiter("tenant", tenantLimiter)
+
+	router := gin.New()
+	admin := router.Group("/admin", NewAdminAuthMiddleware(map[string]string{"secret-token": "alice"}).Handle)
+	admin.GET("/breakers", handler.HandleListBreakers)
+	admin.POST("/breakers/:name/:action", handler.HandleBreakerAction)
+	admin.GET("/limiters", handler.HandleListLimiters)
+	admin.PATCH("/limiters/:name", handler.HandleUpdateLimiter)
+	admin.DELETE("/limiters/:name", handler.HandleResetLimiter)
+	return router
+}
+
+func adminRequest(router *gin.Engine, method, path, body string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+	req.Header.Set("Authorization", "Bearer secret-token")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestAdminHandler_Authentication(t *testing.T) {
+	router := setupAdminRouter(httpclient.NewManagedBreaker(gobreaker.Settings{Name: "upstream"}), httpclient.NewManagedLimiter(5, 10), consumer.NewTenantLimiter(5, 10, nil))
+
+	for _, header := range []string{"", "Bearer wrong-token", "secret-token"} {
+		req, _ := http.NewRequest("GET", "/admin/breakers", nil)
+		req.Header.Set("Authorization", header)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusUnauthorized, w.Code, header)
+	}
+}
+
+func TestAdminHandler_Breakers(t *testing.T) {
+	var transitions []string
+	breaker := httpclient.NewManagedBreaker(gobreaker.Settings{
+		Name: "upstream",
+		ReadyToTrip: func(counts gobreaker.Counts) bool {
+			return counts.ConsecutiveFailures >= 2
+		},
+		OnStateChange: func(name string, from, to gobreaker.State) {
+			transitions = append(transitions, from.String()+"->"+to.String())
+		},
+	})
+	router := setupAdminRouter(breaker, httpclient.NewManagedLimiter(5, 10), consumer.NewTenantLimiter(5, 10, nil))
+	called := false
+	request := func() (interface{}, error) {
+		called = true
+		return nil, errors.New("failed")
+	}
+
+	t.Run("List", func(t *testing.T) {
+		breaker.Execute(request)
+
+		w := adminRequest(router, "GET", "/admin/breakers", "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		var response struct {
+			Breakers []httpclient.BreakerSnapshot `json:"breakers"`
+		}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Equal(t, []httpclient.BreakerSnapshot{{
+			Name:                "upstream",
+			State:               "closed",
+			Requests:            1,
+			TotalFailures:       1,
+			ConsecutiveFailures: 1,
+		}}, response.Breakers)
+	})
+
+	t.Run("ForceOpen", func(t *testing.T) {
+		w := adminRequest(router, "POST", "/admin/breakers/upstream/open", "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, gobreaker.StateOpen, breaker.State())
+
+		// 上流を呼ばずに拒否する
+		called = false
+		_, err := breaker.Execute(request)
+		assert.ErrorIs(t, err, gobreaker.ErrOpenState)
+		assert.False(t, called)
+	})
+
+	t.Run("ForceClose", func(t *testing.T) {
+		w := adminRequest(router, "POST", "/admin/breakers/upstream/close", "")
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		// 失敗が続いても開かない
+		for i := 0; i < 3; i++ {
+			breaker.Execute(request)
+		}
+		assert.Equal(t, gobreaker.StateClosed, breaker.State())
+	})
+
+	t.Run("Reset", func(t *testing.T) {
+		breaker.Reset()
+		breaker.Execute(request)
+		breaker.Execute(request)
+		assert.Equal(t, gobreaker.StateOpen, breaker.State())
+
+		w := adminRequest(router, "POST", "/admin/breakers/upstream/reset", "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, gobreaker.StateClosed, breaker.State())
+		assert.Equal(t, httpclient.BreakerSnapshot{Name: "upstream", State: "closed"}, breaker.Snapshot())
+	})
+
+	t.Run("UnknownBreakerAndAction", func(t *testing.T) {
+		assert.Equal(t, http.StatusNotFound, adminRequest(router, "POST", "/admin/breakers/unknown/open", "").Code)
+		assert.Equal(t, http.StatusBadRequest, adminRequest(router, "POST", "/admin/breakers/upstream/explode", "").Code)
+	})
+
+	assert.Equal(t, []string{"closed->open", "open->closed", "closed->open", "open->closed"}, transitions)
+}
+
+func TestAdminHandler_Limiters(t *testing.T) {
+	limiter := httpclient.NewManagedLimiter(5, 10)
+	tenantLimiter := consumer.NewTenantLimiter(5, 10, nil)
+	router := setupAdminRouter(httpclient.NewManagedBreaker(gobreaker.Settings{Name: "upstream"}), limiter, tenantLimiter)
+
+	t.Run("Update", func(t *testing.T) {
+		w := adminRequest(router, "PATCH", "/admin/limiters/upstream", `{"rate": 20, "burst": 40}`)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, rate.Limit(20), limiter.Limit())
+		assert.Equal(t, 40, limiter.Burst())
+
+		// 指定しなかった値は変更しない
+		w = adminRequest(router, "PATCH", "/admin/limiters/tenant", `{"rate": 50}`)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, rate.Limit(50), tenantLimiter.Limit())
+		assert.Equal(t, 10, tenantLimiter.Burst())
+	})
+
+	t.Run("List", func(t *testing.T) {
+		w := adminRequest(router, "GET", "/admin/limiters", "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		var response struct {
+			Limiters []limiterSnapshot `json:"limiters"`
+		}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Len(t, response.Limiters, 2)
+		assert.Equal(t, "tenant", response.Limiters[0].Name)
+		assert.Nil(t, response.Limiters[0].Tokens)
+		assert.Equal(t, "upstream", response.Limiters[1].Name)
+		assert.Equal(t, float64(20), response.Limiters[1].Rate)
+		assert.NotNil(t, response.Limiters[1].Tokens)
+		assert.True(t, response.Limiters[1].Override)
+	})
+
+	t.Run("InvalidRequest", func(t *testing.T) {
+		assert.Equal(t, http.StatusNotFound, adminRequest(router, "PATCH", "/admin/limiters/unknown", `{"rate": 1}`).Code)
+		assert.Equal(t, http.StatusBadRequest, adminRequest(router, "PATCH", "/admin/limiters/upstream", `{}`).Code)
+		assert.Equal(t, http.StatusBadRequest, adminRequest(router, "PATCH", "/admin/limiters/upstream", `{"burst": -1}`).Code)
+		assert.Equal(t, 40, limiter.Burst())
+	})
+
+	t.Run("Reset", func(t *testing.T) {
+		w := adminRequest(router, "DELETE", "/admin/limiters/upstream", "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, rate.Limit(5), limiter.Limit())
+		assert.Equal(t, 10, limiter.Burst())
+		assert.False(t, limiter.Overridden())
+
+		// テナントのレートリミッターは設定の再読み込みで戻すためリセットできない
+		assert.Equal(t, http.StatusBadRequest, adminRequest(router, "DELETE", "/admin/limiters/tenant", "").Code)
+	})
+}
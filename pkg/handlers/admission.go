@@ -0,0 +1,195 @@
+package handlers
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"reliproxy/pkg/queue"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AdmissionLimits はリクエストの受け付けを止めるキューの高水位。0 の項目は制限しない
+type AdmissionLimits struct {
+	MaxDepth int64
+	MaxAge   time.Duration
+}
+
+// QueueLoad は保留中のリクエスト数と、最も古いリクエストがキューに追加されてからの秒数
+type QueueLoad struct {
+	Depth            int64   `json:"depth"`
+	OldestAgeSeconds float64 `json:"oldest_age_seconds"`
+}
+
+// AdmissionQueue はアドミッション制御で負荷を確認するキュー
+//
+// テナントごとの高水位を使う場合は queue.TenantStatser も実装している必要がある。
+type AdmissionQueue interface {
+	queue.Measurable
+	queue.Ager
+}
+
+// QueueOverloadedError はキューが高水位を超えているためリクエストを受け付けないことを表す
+type QueueOverloadedError struct {
+	// Tenant はテナントの高水位を超えた場合のテナント。全体の高水位を超えた場合は空
+	Tenant     string
+	Load       QueueLoad
+	RetryAfter time.Duration
+}
+
+func (e *QueueOverloadedError) Error() string {
+	if e.Tenant == "" {
+		return fmt.Sprintf("queue is overloaded: depth=%d oldest_age=%.0fs", e.Load.Depth, e.Load.OldestAgeSeconds)
+	}
+	return fmt.Sprintf("queue for tenant %s is overloaded: depth=%d oldest_age=%.0fs", e.Tenant, e.Load.Depth, e.Load.OldestAgeSeconds)
+}
+
+// AdmissionController はキューの深さと最も古いリクエストの経過時間が高水位を超えている間、新しいリクエストを拒否する
+//
+// リクエストごとに共有ストアへ問い合わせないよう、負荷は取得に失敗した場合も含めて refreshInterval の間キャッシュする。
+// 取得はロックの外で1つのリクエストだけが行い、他のリクエストはその結果を待つ。
+type AdmissionController struct {
+	queue           AdmissionQueue
+	backlog         []queue.Measurable
+	global          AdmissionLimits
+	tenants         map[string]AdmissionLimits
+	retryAfter      time.Duration
+	refreshInterval time.Duration
+
+	mu          sync.Mutex
+	load        QueueLoad
+	tenantLoads map[string]QueueLoad
+	refreshedAt time.Time
+	refreshErr  error
+	refreshing  chan struct{}
+}
+
+func NewAdmissionController(queue AdmissionQueue, global AdmissionLimits, tenants map[string]AdmissionLimits, retryAfter time.Duration) *AdmissionController {
+	return &AdmissionController{
+		queue:           queue,
+		global:          global,
+		tenants:         tenants,
+		retryAfter:      retryAfter,
+		refreshInterval: time.Second,
+		tenantLoads:     make(map[string]QueueLoad),
+	}
+}
+
+// WithBacklog はアウトボックスやスケジュールのように、まだキューに入っていないリクエストの数を全体の深さに加える
+func (a *AdmissionController) WithBacklog(backlog ...queue.Measurable) *AdmissionController {
+	a.backlog = append(a.backlog, backlog...)
+	return a
+}
+
+// Admit は tenant の n 件のリクエストを受け付けられるかを確認し、受け付けられなければ *QueueOverloadedError を返す
+func (a *AdmissionController) Admit(tenant string, n int) error {
+	if err := a.refresh(); err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.global.exceeded(a.load, n) {
+		return &QueueOverloadedError{Load: a.load, RetryAfter: a.retryAfter}
+	}
+	tenantLoad := a.tenantLoads[tenant]
+	if limits, ok := a.tenants[tenant]; ok && limits.exceeded(tenantLoad, n) {
+		return &QueueOverloadedError{Tenant: tenant, Load: tenantLoad, RetryAfter: a.retryAfter}
+	}
+
+	// 次に負荷を取得するまでの間に高水位を超えて受け付けないよう、受け付けた件数を加算しておく
+	a.load.Depth += int64(n)
+	tenantLoad.Depth += int64(n)
+	a.tenantLoads[tenant] = tenantLoad
+	return nil
+}
+
+// refresh はキャッシュが古ければキューの負荷を取得し直し、最後の取得の結果を返す
+func (a *AdmissionController) refresh() error {
+	a.mu.Lock()
+	if !a.refreshedAt.IsZero() && time.Since(a.refreshedAt) < a.refreshInterval {
+		err := a.refreshErr
+		a.mu.Unlock()
+		return err
+	}
+	if refreshing := a.refreshing; refreshing != nil {
+		a.mu.Unlock()
+		<-refreshing
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		return a.refreshErr
+	}
+	refreshing := make(chan struct{})
+	a.refreshing = refreshing
+	a.mu.Unlock()
+
+	load, tenantLoads, err := a.measure()
+
+	a.mu.Lock()
+	if err == nil {
+		a.load = load
+		a.tenantLoads = tenantLoads
+	}
+	a.refreshErr = err
+	a.refreshedAt = time.Now()
+	a.refreshing = nil
+	a.mu.Unlock()
+	close(refreshing)
+	return err
+}
+
+// measure はキューとキューに入る前のリクエストの負荷を取得する
+func (a *AdmissionController) measure() (QueueLoad, map[string]QueueLoad, error) {
+	depth, err := a.queue.Len()
+	if err != nil {
+		return QueueLoad{}, nil, err
+	}
+	for _, backlog := range a.backlog {
+		n, err := backlog.Len()
+		if err != nil {
+			return QueueLoad{}, nil, err
+		}
+		depth += n
+	}
+	age, err := a.queue.OldestAge()
+	if err != nil {
+		return QueueLoad{}, nil, err
+	}
+
+	tenantLoads := make(map[string]QueueLoad)
+	if statser, ok := a.queue.(queue.TenantStatser); ok && len(a.tenants) > 0 {
+		stats, err := statser.TenantStats()
+		if err != nil {
+			return QueueLoad{}, nil, err
+		}
+		for tenant, s := range stats {
+			tenantLoads[tenant] = QueueLoad{Depth: s.Backlog, OldestAgeSeconds: s.OldestAgeSeconds}
+		}
+	}
+	return QueueLoad{Depth: depth, OldestAgeSeconds: age.Seconds()}, tenantLoads, nil
+}
+
+func (l AdmissionLimits) exceeded(load QueueLoad, n int) bool {
+	if l.MaxDepth > 0 && load.Depth+int64(n) > l.MaxDepth {
+		return true
+	}
+	return l.MaxAge > 0 && load.OldestAgeSeconds >= l.MaxAge.Seconds()
+}
+
+// abortOverloaded は Retry-After を付けて 503 を返す
+func abortOverloaded(c *gin.Context, err *QueueOverloadedError) {
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(err.RetryAfter.Seconds()))))
+	response := gin.H{
+		"error":              "Queue is overloaded, retry later",
+		"depth":              err.Load.Depth,
+		"oldest_age_seconds": err.Load.OldestAgeSeconds,
+	}
+	if err.Tenant != "" {
+		response["tenant"] = err.Tenant
+	}
+	c.JSON(http.StatusServiceUnavailable, response)
+}
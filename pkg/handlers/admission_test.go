@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reliproxy/pkg/queue"
+	"reliproxy/pkg/repository"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func newAdmissionRouter(requestQueue *queue.FairQueue, global AdmissionLimits, tenants map[string]AdmissionLimits) *gin.Engine {
+	admission := NewAdmissionController(requestQueue, global, tenants, 30*time.Second)
+	// テストでは毎回キューの負荷を取得し直す
+	admission.refreshInterval = 0
+	handler := NewAsyncWriteHandler(requestQueue, repository.NewMemoryRequestStatusRepository()).WithAdmission(admission)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.Default()
+	tenantMiddleware := NewTenantMiddleware(nil, nil, []string{"bulk", "team-a"})
+	router.POST("/request", tenantMiddleware.Handle, handler.HandleRequest)
+	router.POST("/batch", tenantMiddleware.Handle, handler.HandleBatch)
+	return router
+}
+
+func newAdmissionQueue() *queue.FairQueue {
+	return queue.NewFairQueue(queue.NewMemoryTenantRegistry(), func(tenant string) queue.PollingQueue {
+		return queue.NewMemoryQueue()
+	}, nil, time.Millisecond)
+}
+
+func postRequest(router *gin.Engine, path, tenant, body string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", path, bytes.NewBufferString(body))
+	if tenant != "" {
+		req.Header.Set(TenantHeader, tenant)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestAdmissionController(t *testing.T) {
+	t.Run("GlobalMaxDepth", func(t *testing.T) {
+		router := newAdmissionRouter(newAdmissionQueue(), AdmissionLimits{MaxDepth: 2}, nil)
+
+		for i := 0; i < 2; i++ {
+			assert.Equal(t, http.StatusAccepted, postRequest(router, "/request", "", `{"data": "test"}`).Code)
+		}
+
+		w := postRequest(router, "/request", "", `{"data": "test"}`)
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		assert.Equal(t, "30", w.Header().Get("Retry-After"))
+
+		var response struct {
+			Depth int64 `json:"depth"`
+		}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Equal(t, int64(2), response.Depth)
+	})
+
+	t.Run("TenantMaxDepth", func(t *testing.T) {
+		router := newAdmissionRouter(newAdmissionQueue(), AdmissionLimits{}, map[string]AdmissionLimits{"bulk": {MaxDepth: 1}})
+
+		assert.Equal(t, http.StatusAccepted, postRequest(router, "/request", "bulk", `{"data": "test"}`).Code)
+
+		w := postRequest(router, "/request", "bulk", `{"data": "test"}`)
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		assert.Contains(t, w.Body.String(), `"tenant":"bulk"`)
+
+		// 他のテナントは受け付ける
+		assert.Equal(t, http.StatusAccepted, postRequest(router, "/request", "team-a", `{"data": "test"}`).Code)
+	})
+
+	t.Run("MaxAge", func(t *testing.T) {
+		requestQueue := newAdmissionQueue()
+		router := newAdmissionRouter(requestQueue, AdmissionLimits{MaxAge: 20 * time.Millisecond}, nil)
+
+		assert.Equal(t, http.StatusAccepted, postRequest(router, "/request", "", `{"data": "test"}`).Code)
+		time.Sleep(30 * time.Millisecond)
+		assert.Equal(t, http.StatusServiceUnavailable, postRequest(router, "/request", "", `{"data": "test"}`).Code)
+
+		// 古いリクエストが取り出されれば再び受け付ける
+		requestID, _, err := requestQueue.Dequeue()
+		assert.NoError(t, err)
+		assert.NoError(t, requestQueue.Ack(requestID))
+		assert.Equal(t, http.StatusAccepted, postRequest(router, "/request", "", `{"data": "test"}`).Code)
+	})
+
+	t.Run("BatchExceedingMaxDepth", func(t *testing.T) {
+		requestQueue := newAdmissionQueue()
+		router := newAdmissionRouter(requestQueue, AdmissionLimits{MaxDepth: 2}, nil)
+
+		w := postRequest(router, "/batch", "", `[{"data": 1}, {"data": 2}, {"data": 3}]`)
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+		depth, err := requestQueue.Len()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(0), depth)
+	})
+	t.Run("CountsBacklog", func(t *testing.T) {
+		schedule := queue.NewMemorySchedule()
+		for _, requestID := range []string{"scheduled-1", "scheduled-2"} {
+			assert.NoError(t, schedule.Add(requestID, &queue.Job{}, time.Now().Add(time.Hour)))
+		}
+		admission := NewAdmissionController(newAdmissionQueue(), AdmissionLimits{MaxDepth: 2}, nil, 30*time.Second).
+			WithBacklog(schedule)
+
+		var overloaded *QueueOverloadedError
+		assert.ErrorAs(t, admission.Admit(queue.DefaultTenant, 1), &overloaded)
+		assert.Equal(t, int64(2), overloaded.Load.Depth)
+	})
+
+	t.Run("CachesRefreshErrors", func(t *testing.T) {
+		failing := &failingAdmissionQueue{}
+		admission := NewAdmissionController(failing, AdmissionLimits{MaxDepth: 2}, nil, 30*time.Second)
+
+		// 共有ストアの障害中もリクエストごとに問い合わせない
+		assert.ErrorIs(t, admission.Admit(queue.DefaultTenant, 1), errAdmissionQueue)
+		assert.ErrorIs(t, admission.Admit(queue.DefaultTenant, 1), errAdmissionQueue)
+		assert.Equal(t, int32(1), failing.calls.Load())
+	})
+}
+
+var errAdmissionQueue = errors.New("queue is unavailable")
+
+// failingAdmissionQueue は負荷の取得に常に失敗するキュー
+type failingAdmissionQueue struct {
+	calls atomic.Int32
+}
+
+func (q *failingAdmissionQueue) Len() (int64, error) {
+	q.calls.Add(1)
+	return 0, errAdmissionQueue
+}
+
+func (q *failingAdmissionQueue) OldestAge() (time.Duration, error) {
+	return 0, errAdmissionQueue
+}
@@ -0,0 +1,223 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reliproxy/pkg/queue"
+	"reliproxy/pkg/repository"
+	"reliproxy/pkg/tracing"
+	"reliproxy/pkg/utils"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// MaxBatchSize は1回のバッチで受け付けるリクエスト数の上限
+	MaxBatchSize = 10000
+	// MaxBatchBytes は1回のバッチで受け付ける本文のバイト数の上限
+	MaxBatchBytes = 32 << 20
+)
+
+var (
+	errBatchTooLarge     = fmt.Errorf("batch must not contain more than %d requests", MaxBatchSize)
+	errBatchBodyTooLarge = fmt.Errorf("batch body must not exceed %d bytes", MaxBatchBytes)
+)
+
+// LimitBody は本文を limit バイトまでに制限するミドルウェアを返す
+//
+// 本文を全て読み込む冪等性のミドルウェアより前に置き、上限を超えた本文をメモリに読み込まないようにする。
+func LimitBody(limit int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Body != nil {
+			c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+		}
+		c.Next()
+	}
+}
+
+// HandleBatch は JSON 配列または NDJSON の各要素を1件のリクエストとしてまとめて受け付ける
+//
+// ステータスはまとめて保存し、キューにもまとめて追加する。ヘッダやクエリで指定した優先度、実行時刻、コールバック URL は全ての要素に適用される。
+func (h *AsyncWriteHandler) HandleBatch(c *gin.Context) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, MaxBatchBytes)
+	items, err := readBatch(c.Request)
+	if errors.Is(err, errBatchTooLarge) || errors.Is(err, errBatchBodyTooLarge) {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(items) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Batch must contain at least one request"})
+		return
+	}
+	priority, err := requestPriority(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	notBefore, err := requestNotBefore(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	callbackURL, err := h.callbackURL(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	status := repository.StatusQueued
+	if notBefore != nil {
+		status = repository.StatusScheduled
+	}
+	tenant := requestTenant(c)
+	if !h.admit(c, tenant, len(items)) {
+		return
+	}
+	batchID := uuid.New().String()
+	now := time.Now()
+	traceContext := tracing.Inject(c.Request.Context())
+	correlationID := utils.RequestIDFromContext(c.Request.Context())
+
+	requestIDs := make([]string, len(items))
+	requestStatuses := make([]repository.RequestStatus, len(items))
+	requests := make([]queue.Request, len(items))
+	for i, item := range items {
+		requestIDs[i] = uuid.New().String()
+		requestStatuses[i] = repository.RequestStatus{
+			ID:      requestIDs[i],
+			Status:  status,
+			BatchID: batchID,
+		}
+		requests[i] = queue.Request{
+			ID: requestIDs[i],
+			Data: &queue.Job{
+				// 要素はそれぞれ JSON の値として POST で送る
+				Method:        http.MethodPost,
+				ContentType:   "application/json",
+				Body:          string(item),
+				Route:         c.Param("route"),
+				Priority:      priority,
+				Tenant:        tenant,
+				EnqueuedAt:    now,
+				NotBefore:     notBefore,
+				CallbackURL:   callbackURL,
+				TraceContext:  traceContext,
+				CorrelationID: correlationID,
+			},
+		}
+	}
+
+	if h.outboxRepository != nil {
+		err = h.saveBatchWithOutbox(c.Request.Context(), requestStatuses, requests)
+	} else {
+		err = h.saveBatch(c.Request.Context(), batchID, requestStatuses, requests)
+	}
+	if err != nil {
+		requestLogger(c).WithFields(logrus.Fields{
+			"error":   err,
+			"batchID": batchID,
+		}).Error("Failed to save batch")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save batch"})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"batch_id": batchID, "request_ids": requestIDs, "status": status})
+}
+
+// saveBatch はステータスを保存してからキューに追加する
+//
+// キューへの追加に失敗した場合は、まだ取り出されていないリクエストを failed にする。追加済みのリクエストを
+// ワーカーが取り出しても実行しない。
+func (h *AsyncWriteHandler) saveBatch(ctx context.Context, batchID string, requestStatuses []repository.RequestStatus, requests []queue.Request) error {
+	statusRepository := h.statusRepository.WithContext(ctx)
+	if err := statusRepository.CreateBatch(requestStatuses); err != nil {
+		return err
+	}
+	err := queue.EnqueueBatch(h.queue, requests)
+	if err == nil {
+		return nil
+	}
+	if _, transitionErr := statusRepository.TransitionBatchStatus(batchID, []string{repository.StatusQueued, repository.StatusScheduled}, repository.StatusFailed); transitionErr != nil {
+		utils.LoggerFromContext(ctx).WithFields(logrus.Fields{
+			"error":   transitionErr,
+			"batchID": batchID,
+		}).Error("Failed to mark batch as failed")
+	}
+	return err
+}
+
+func (h *AsyncWriteHandler) saveBatchWithOutbox(ctx context.Context, requestStatuses []repository.RequestStatus, requests []queue.Request) error {
+	messages := make([]repository.OutboxMessage, len(requests))
+	for i, request := range requests {
+		payload, err := json.Marshal(request.Data)
+		if err != nil {
+			return err
+		}
+		messages[i] = repository.OutboxMessage{
+			RequestID: request.ID,
+			Payload:   string(payload),
+		}
+	}
+	return h.outboxRepository.WithContext(ctx).CreateBatchWithStatus(requestStatuses, messages)
+}
+
+// readBatch は本文を JSON 配列として、Content-Type が NDJSON か配列でない場合は1行1件として読み込む
+func readBatch(r *http.Request) ([]json.RawMessage, error) {
+	body, err := io.ReadAll(r.Body)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return nil, errBatchBodyTooLarge
+	}
+	if err != nil {
+		return nil, errors.New("Failed to read request body")
+	}
+
+	trimmed := bytes.TrimSpace(body)
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-ndjson") && bytes.HasPrefix(trimmed, []byte("[")) {
+		var items []json.RawMessage
+		if err := json.Unmarshal(trimmed, &items); err != nil {
+			return nil, fmt.Errorf("invalid JSON array: %v", err)
+		}
+		if len(items) > MaxBatchSize {
+			return nil, errBatchTooLarge
+		}
+		return items, nil
+	}
+
+	var items []json.RawMessage
+	scanner := bufio.NewScanner(bytes.NewReader(trimmed))
+	scanner.Buffer(make([]byte, 64*1024), len(trimmed)+1)
+	line := 0
+	for scanner.Scan() {
+		line++
+		item := bytes.TrimSpace(scanner.Bytes())
+		if len(item) == 0 {
+			continue
+		}
+		if !json.Valid(item) {
+			return nil, fmt.Errorf("invalid JSON on line %d", line)
+		}
+		if len(items) == MaxBatchSize {
+			return nil, errBatchTooLarge
+		}
+		items = append(items, json.RawMessage(append([]byte(nil), item...)))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
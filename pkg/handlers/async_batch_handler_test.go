@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reliproxy/pkg/idempotency"
+	"reliproxy/pkg/queue"
+	"reliproxy/pkg/repository"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAsyncWriteHandler_HandleBatch(t *testing.T) {
+	repo := repository.NewMemoryRequestStatusRepository()
+	memoryQueue := queue.NewMemoryQueue()
+	asyncHandler := NewAsyncWriteHandler(memoryQueue, repo)
+	batchHandler := NewBatchStatusHandler(repo)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.Default()
+	router.POST("/async-proxy/batch", asyncHandler.HandleBatch)
+	router.GET("/batches/:id", batchHandler.HandleRequest)
+
+	type batchResponse struct {
+		BatchID    string   `json:"batch_id"`
+		RequestIDs []string `json:"request_ids"`
+	}
+	submit := func(t *testing.T, body string, contentType string) (*httptest.ResponseRecorder, batchResponse) {
+		req, _ := http.NewRequest("POST", "/async-proxy/batch", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		var response batchResponse
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w, response
+	}
+
+	t.Run("json array", func(t *testing.T) {
+		w, response := submit(t, `[{"data": 1}, {"data": 2}, {"data": 3}]`, "application/json")
+		assert.Equal(t, http.StatusAccepted, w.Code)
+		assert.NotEmpty(t, response.BatchID)
+		assert.Len(t, response.RequestIDs, 3)
+
+		for i, requestID := range response.RequestIDs {
+			dequeuedID, requestData, err := memoryQueue.TryDequeue()
+			assert.NoError(t, err)
+			assert.Equal(t, requestID, dequeuedID)
+			job, err := queue.DecodeJob(requestData)
+			assert.NoError(t, err)
+			assert.JSONEq(t, `{"data": `+string(rune('1'+i))+`}`, job.Body)
+		}
+	})
+
+	t.Run("ndjson", func(t *testing.T) {
+		w, response := submit(t, "{\"data\": 1}\n\n{\"data\": 2}\n", "application/x-ndjson")
+		assert.Equal(t, http.StatusAccepted, w.Code)
+		assert.Len(t, response.RequestIDs, 2)
+	})
+
+	t.Run("invalid ndjson line", func(t *testing.T) {
+		w, _ := submit(t, "{\"data\": 1}\n{broken\n", "application/x-ndjson")
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), "line 2")
+	})
+
+	t.Run("empty batch", func(t *testing.T) {
+		w, _ := submit(t, `[]`, "application/json")
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("too large batch", func(t *testing.T) {
+		w, _ := submit(t, strings.Repeat("{}\n", MaxBatchSize+1), "application/x-ndjson")
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	})
+
+	t.Run("too large body", func(t *testing.T) {
+		router := gin.Default()
+		router.POST("/async-proxy/batch", LimitBody(16), NewIdempotencyMiddleware(idempotency.NewMemoryStore(), time.Minute, time.Hour).Handle, asyncHandler.HandleBatch)
+
+		// 冪等性キーの有無にかかわらず、上限を超えた本文は読み込まずに拒否する
+		for _, key := range []string{"", "key-1"} {
+			req, _ := http.NewRequest("POST", "/async-proxy/batch", bytes.NewBufferString(`[{"data": 1}, {"data": 2}]`))
+			req.Header.Set("Content-Type", "application/json")
+			if key != "" {
+				req.Header.Set(IdempotencyKeyHeader, key)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+		}
+	})
+
+	t.Run("batch status", func(t *testing.T) {
+		_, response := submit(t, `[{"data": 1}, {"data": 2}, {"data": 3}, {"data": 4}]`, "application/json")
+		transitionStatus(t, repo, response.RequestIDs[0], repository.StatusQueued, repository.StatusProcessed)
+		transitionStatus(t, repo, response.RequestIDs[1], repository.StatusQueued, repository.StatusFailed)
+		transitionStatus(t, repo, response.RequestIDs[2], repository.StatusQueued, repository.StatusRunning)
+
+		req, _ := http.NewRequest("GET", "/batches/"+response.BatchID, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, `{"batch_id": "`+response.BatchID+`", "total": 4, "succeeded": 1, "failed": 1, "cancelled": 0, "pending": 2}`, w.Body.String())
+	})
+
+	t.Run("unknown batch", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/batches/unknown", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
+
+// unavailableQueue は全ての追加に失敗するキュー
+type unavailableQueue struct {
+	requestIDs []string
+}
+
+func (q *unavailableQueue) Enqueue(requestID string, requestData interface{}) error {
+	q.requestIDs = append(q.requestIDs, requestID)
+	return errors.New("redis connection error")
+}
+
+func (q *unavailableQueue) Dequeue() (string, interface{}, error) {
+	return "", nil, queue.ErrQueueEmpty
+}
+
+func TestAsyncWriteHandler_HandleBatchEnqueueFailure(t *testing.T) {
+	repo := repository.NewMemoryRequestStatusRepository()
+	unavailable := &unavailableQueue{}
+	asyncHandler := NewAsyncWriteHandler(unavailable, repo)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.Default()
+	router.POST("/async-proxy/batch", asyncHandler.HandleBatch)
+
+	req, _ := http.NewRequest("POST", "/async-proxy/batch", bytes.NewBufferString(`[{"data": 1}, {"data": 2}]`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+
+	// キューに追加できなかったリクエストは queued のまま残さない
+	assert.NotEmpty(t, unavailable.requestIDs)
+	requestStatus, err := repo.GetByID(unavailable.requestIDs[0])
+	assert.NoError(t, err)
+	counts, err := repo.CountByBatch(requestStatus.BatchID)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int64{repository.StatusFailed: 2}, counts)
+}
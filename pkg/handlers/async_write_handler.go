@@ -1,17 +1,42 @@
 package handlers
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"net/url"
 	"reliproxy/pkg/queue"
 	"reliproxy/pkg/repository"
+	"reliproxy/pkg/tracing"
+	"reliproxy/pkg/utils"
+	"reliproxy/pkg/webhook"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	PriorityHeader    = "X-Reliproxy-Priority"
+	NotBeforeHeader   = "X-Reliproxy-Not-Before"
+	CallbackURLHeader = "X-Reliproxy-Callback-URL"
 )
 
 type AsyncWriteHandler struct {
 	queue            queue.Queue
 	statusRepository repository.RequestStatusRepository
+	outboxRepository repository.OutboxRepository
+	admission        *AdmissionController
+	// callbacksDisabled の場合はコールバック URL を指定したリクエストを拒否する
+	callbacksDisabled bool
+	// callbackHosts が空でない場合、リクエストで指定するコールバック URL のホストはこのいずれかに限る
+	callbackHosts         []string
+	allowPrivateCallbacks bool
 }
 
 func NewAsyncWriteHandler(queue queue.Queue, repository repository.RequestStatusRepository) *AsyncWriteHandler {
@@ -21,15 +46,89 @@ func NewAsyncWriteHandler(queue queue.Queue, repository repository.RequestStatus
 	}
 }
 
+// NewOutboxAsyncWriteHandler はステータスとジョブを同一トランザクションでアウトボックスに保存するハンドラを返す
+func NewOutboxAsyncWriteHandler(outboxRepository repository.OutboxRepository) *AsyncWriteHandler {
+	return &AsyncWriteHandler{
+		outboxRepository: outboxRepository,
+	}
+}
+
+// WithAdmission はキューが高水位を超えている間リクエストを 503 で拒否するようにする
+func (h *AsyncWriteHandler) WithAdmission(admission *AdmissionController) *AsyncWriteHandler {
+	h.admission = admission
+	return h
+}
+
+// DisableCallbacks はコールバック URL を指定したリクエストを 400 で拒否する。完了通知に署名できない場合に使う
+func (h *AsyncWriteHandler) DisableCallbacks() *AsyncWriteHandler {
+	h.callbacksDisabled = true
+	return h
+}
+
+// WithCallbackPolicy はリクエストで指定できるコールバック URL のホストを制限する
+//
+// allowedHosts が空でなければそのいずれかのホストに限り、"." で始まるものはサブドメインにも一致する。
+// allowPrivateNetworks でなければ localhost と内部向けの IP アドレスを拒否する。ホスト名から解決した
+// アドレスは完了通知を送るときに確認する。テナントの既定のコールバック URL は運用者が設定するため制限しない。
+func (h *AsyncWriteHandler) WithCallbackPolicy(allowedHosts []string, allowPrivateNetworks bool) *AsyncWriteHandler {
+	h.callbackHosts = allowedHosts
+	h.allowPrivateCallbacks = allowPrivateNetworks
+	return h
+}
+
 func (h *AsyncWriteHandler) HandleRequest(c *gin.Context) {
 	requestID := uuid.New().String()
-	requestData := c.Request.Body
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
+		return
+	}
+	priority, err := requestPriority(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	notBefore, err := requestNotBefore(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	callbackURL, err := h.callbackURL(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	requestData := &queue.Job{
+		Method:        c.Request.Method,
+		ContentType:   c.GetHeader("Content-Type"),
+		Body:          string(body),
+		Route:         c.Param("route"),
+		Priority:      priority,
+		Tenant:        requestTenant(c),
+		EnqueuedAt:    time.Now(),
+		NotBefore:     notBefore,
+		CallbackURL:   callbackURL,
+		TraceContext:  tracing.Inject(c.Request.Context()),
+		CorrelationID: utils.RequestIDFromContext(c.Request.Context()),
+	}
+	if !h.admit(c, requestData.Tenant, 1) {
+		return
+	}
 
 	requestStatus := repository.RequestStatus{
 		ID:     requestID,
-		Status: "queued",
+		Status: repository.StatusQueued,
+	}
+	if notBefore != nil {
+		requestStatus.Status = repository.StatusScheduled
 	}
-	err := h.statusRepository.Create(&requestStatus)
+
+	if h.outboxRepository != nil {
+		h.handleWithOutbox(c, &requestStatus, requestData)
+		return
+	}
+
+	err = h.statusRepository.WithContext(c.Request.Context()).Create(&requestStatus)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save request status to db"})
 		return
@@ -41,5 +140,137 @@ func (h *AsyncWriteHandler) HandleRequest(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"request_id": requestID})
+	c.JSON(http.StatusAccepted, gin.H{"request_id": requestID, "status": requestStatus.Status, "status_url": statusURL(requestID)})
+}
+
+func (h *AsyncWriteHandler) handleWithOutbox(c *gin.Context, requestStatus *repository.RequestStatus, requestData interface{}) {
+	payload, err := json.Marshal(requestData)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encode request"})
+		return
+	}
+
+	err = h.outboxRepository.WithContext(c.Request.Context()).CreateWithStatus(requestStatus, &repository.OutboxMessage{
+		RequestID: requestStatus.ID,
+		Payload:   string(payload),
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save request to db"})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"request_id": requestStatus.ID, "status": requestStatus.Status, "status_url": statusURL(requestStatus.ID)})
+}
+
+// admit は tenant の n 件のリクエストを受け付けられるかを確認し、受け付けられなければ 503 を返す
+//
+// キューの負荷を取得できない場合は受け付けを止めない。
+func (h *AsyncWriteHandler) admit(c *gin.Context, tenant string, n int) bool {
+	if h.admission == nil {
+		return true
+	}
+
+	err := h.admission.Admit(tenant, n)
+	var overloaded *QueueOverloadedError
+	if errors.As(err, &overloaded) {
+		requestLogger(c).WithFields(logrus.Fields{
+			"tenant": tenant,
+			"error":  err,
+		}).Warn("Rejecting request because the queue is overloaded")
+		abortOverloaded(c, overloaded)
+		return false
+	}
+	if err != nil {
+		requestLogger(c).WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Failed to get queue load")
+	}
+	return true
+}
+
+// statusURL はリクエストのステータスを取得できるパスを返す
+func statusURL(requestID string) string {
+	return "/requests/" + requestID
+}
+
+// requestPriority はヘッダの優先度を返す。指定がなければ通常の優先度にする
+func requestPriority(c *gin.Context) (queue.Priority, error) {
+	if header := c.GetHeader(PriorityHeader); header != "" {
+		return queue.ParsePriority(header)
+	}
+	return queue.PriorityNormal, nil
+}
+
+// requestNotBefore はヘッダの時刻またはクエリの delay から実行時刻を決める。指定がなければ nil を返す
+func requestNotBefore(c *gin.Context) (*time.Time, error) {
+	var notBefore time.Time
+	if header := c.GetHeader(NotBeforeHeader); header != "" {
+		t, err := time.Parse(time.RFC3339, header)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %q", NotBeforeHeader, header)
+		}
+		notBefore = t
+	} else if delay := c.Query("delay"); delay != "" {
+		d, err := time.ParseDuration(delay)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid delay: %q", delay)
+		}
+		notBefore = time.Now().Add(d)
+	}
+
+	if !notBefore.After(time.Now()) {
+		return nil, nil
+	}
+	return &notBefore, nil
+}
+
+// callbackURL はヘッダまたはクエリの callback_url、なければテナントの既定のコールバック URL を返す
+func (h *AsyncWriteHandler) callbackURL(c *gin.Context) (string, error) {
+	callbackURL := c.GetHeader(CallbackURLHeader)
+	if callbackURL == "" {
+		callbackURL = c.Query("callback_url")
+	}
+	tenantDefault := callbackURL == ""
+	if tenantDefault {
+		callbackURL = c.GetString(callbackURLKey)
+		if callbackURL == "" {
+			return "", nil
+		}
+	}
+	if h.callbacksDisabled {
+		return "", errors.New("callbacks are disabled because no webhook secret is configured")
+	}
+	if tenantDefault {
+		return callbackURL, nil
+	}
+
+	u, err := url.Parse(callbackURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("invalid callback_url: %q", callbackURL)
+	}
+	if !h.callbackHostAllowed(strings.ToLower(u.Hostname())) {
+		return "", fmt.Errorf("callback_url host is not allowed: %q", u.Hostname())
+	}
+	return callbackURL, nil
+}
+
+func (h *AsyncWriteHandler) callbackHostAllowed(host string) bool {
+	if !h.allowPrivateCallbacks {
+		if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+			return false
+		}
+		if ip := net.ParseIP(host); ip != nil && !webhook.IsPublicIP(ip) {
+			return false
+		}
+	}
+	if len(h.callbackHosts) == 0 {
+		return true
+	}
+	for _, allowed := range h.callbackHosts {
+		allowed = strings.ToLower(allowed)
+		if host == allowed || (strings.HasPrefix(allowed, ".") && strings.HasSuffix(host, allowed)) {
+			return true
+		}
+	}
+	return false
 }
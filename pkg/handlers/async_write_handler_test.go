@@ -3,16 +3,21 @@ package handlers
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"net/http"
 	"net/http/httptest"
 	"reliproxy/pkg/queue"
 	"reliproxy/pkg/repository"
+	"reliproxy/pkg/tracing"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-redis/redis/v8"
 	"github.com/stretchr/testify/assert"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 	gomock "go.uber.org/mock/gomock"
 )
 
@@ -21,8 +26,9 @@ func TestAsyncWriteHandler_HandleRequest(t *testing.T) {
 	defer ctrl.Finish()
 
 	mockRedisClient := queue.NewMockRedisClient(ctrl)
-	queue := queue.NewRedisQueue(mockRedisClient, "request_queue")
+	queue := queue.NewRedisQueue(mockRedisClient, "request_queue", time.Minute, time.Second, 5)
 	mockRepo := repository.NewMockRequestStatusRepository(ctrl)
+	mockRepo.EXPECT().WithContext(gomock.Any()).Return(mockRepo).AnyTimes()
 
 	handler := NewAsyncWriteHandler(queue, mockRepo)
 
@@ -39,7 +45,7 @@ func TestAsyncWriteHandler_HandleRequest(t *testing.T) {
 		w := httptest.NewRecorder()
 		router.ServeHTTP(w, req)
 
-		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, http.StatusAccepted, w.Code)
 		assert.Contains(t, w.Body.String(), `"request_id"`)
 	})
 
@@ -70,3 +76,210 @@ func TestAsyncWriteHandler_HandleRequest(t *testing.T) {
 		assert.JSONEq(t, `{"error": "Failed to enqueue request"}`, w.Body.String())
 	})
 }
+
+func TestAsyncWriteHandler_HandleRequestWithOutbox(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockOutboxRepo := repository.NewMockOutboxRepository(ctrl)
+	mockOutboxRepo.EXPECT().WithContext(gomock.Any()).Return(mockOutboxRepo).AnyTimes()
+	handler := NewOutboxAsyncWriteHandler(mockOutboxRepo)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.Default()
+	router.POST("/request", handler.HandleRequest)
+
+	t.Run("successful request", func(t *testing.T) {
+		mockOutboxRepo.EXPECT().CreateWithStatus(gomock.Any(), gomock.Any()).DoAndReturn(func(requestStatus *repository.RequestStatus, message *repository.OutboxMessage) error {
+			assert.Equal(t, "queued", requestStatus.Status)
+			assert.Equal(t, requestStatus.ID, message.RequestID)
+			job, err := queue.DecodeJob(json.RawMessage(message.Payload))
+			assert.NoError(t, err)
+			assert.Equal(t, `{"data": "test"}`, job.Body)
+			assert.Equal(t, queue.PriorityNormal, job.Priority)
+			return nil
+		})
+
+		reqBody := bytes.NewBufferString(`{"data": "test"}`)
+		req, _ := http.NewRequest("POST", "/request", reqBody)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusAccepted, w.Code)
+		assert.Contains(t, w.Body.String(), `"request_id"`)
+	})
+
+	t.Run("transaction failure", func(t *testing.T) {
+		mockOutboxRepo.EXPECT().CreateWithStatus(gomock.Any(), gomock.Any()).Return(assert.AnError)
+
+		reqBody := bytes.NewBufferString(`{"data": "test"}`)
+		req, _ := http.NewRequest("POST", "/request", reqBody)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		assert.JSONEq(t, `{"error": "Failed to save request to db"}`, w.Body.String())
+	})
+}
+
+func TestAsyncWriteHandler_HandleRequestWithMemoryStorage(t *testing.T) {
+	memoryQueue := queue.NewMemoryQueue()
+	repo := repository.NewMemoryRequestStatusRepository()
+	handler := NewAsyncWriteHandler(memoryQueue, repo)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.Default()
+	router.POST("/request", handler.HandleRequest)
+
+	reqBody := bytes.NewBufferString(`{"data": "test"}`)
+	req, _ := http.NewRequest("POST", "/request", reqBody)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusAccepted, w.Code)
+
+	var response struct {
+		RequestID string `json:"request_id"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+
+	requestStatus, err := repo.GetByID(response.RequestID)
+	assert.NoError(t, err)
+	assert.Equal(t, "queued", requestStatus.Status)
+
+	requestID, requestData, err := memoryQueue.Dequeue()
+	assert.NoError(t, err)
+	assert.Equal(t, response.RequestID, requestID)
+	job, err := queue.DecodeJob(requestData)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"data": "test"}`, job.Body)
+}
+
+func TestAsyncWriteHandler_HandleRequestPriority(t *testing.T) {
+	memoryQueue := queue.NewMemoryQueue()
+	handler := NewAsyncWriteHandler(memoryQueue, repository.NewMemoryRequestStatusRepository())
+
+	gin.SetMode(gin.TestMode)
+	router := gin.Default()
+	router.POST("/request", handler.HandleRequest)
+
+	tests := []struct {
+		name     string
+		path     string
+		header   string
+		expected queue.Priority
+	}{
+		{"default priority", "/request", "", queue.PriorityNormal},
+		{"priority header", "/request", "high", queue.PriorityHigh},
+		{"low priority header", "/request", "low", queue.PriorityLow},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("POST", tt.path, bytes.NewBufferString(`{"data": "test"}`))
+			if tt.header != "" {
+				req.Header.Set(PriorityHeader, tt.header)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusAccepted, w.Code)
+
+			_, requestData, err := memoryQueue.Dequeue()
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, queue.JobPriority(requestData))
+		})
+	}
+
+	t.Run("invalid priority", func(t *testing.T) {
+		req, _ := http.NewRequest("POST", "/request", bytes.NewBufferString(`{"data": "test"}`))
+		req.Header.Set(PriorityHeader, "urgent")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
+
+func TestAsyncWriteHandler_HandleRequestTraceContext(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := tracing.Setup(exporter, "reliproxy-test", sdktrace.WithSyncer(exporter))
+	defer provider.Shutdown(context.Background())
+
+	memoryQueue := queue.NewMemoryQueue()
+	handler := NewAsyncWriteHandler(memoryQueue, repository.NewMemoryRequestStatusRepository())
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(tracing.Middleware())
+	router.POST("/request", handler.HandleRequest)
+
+	req, _ := http.NewRequest("POST", "/request", bytes.NewBufferString(`{"data": "test"}`))
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	// キューのメッセージにハンドラのスパンのトレースコンテキストが含まれる
+	_, requestData, err := memoryQueue.Dequeue()
+	assert.NoError(t, err)
+	spans := exporter.GetSpans()
+	assert.Len(t, spans, 1)
+	traceparent := "00-" + spans[0].SpanContext.TraceID().String() + "-" + spans[0].SpanContext.SpanID().String() + "-01"
+	assert.Equal(t, traceparent, queue.JobTraceContext(requestData)["traceparent"])
+}
+
+func TestAsyncWriteHandler_HandleRequestCallbackURL(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	newRouter := func(handler *AsyncWriteHandler) *gin.Engine {
+		router := gin.New()
+		router.POST("/request", handler.HandleRequest)
+		return router
+	}
+	post := func(router *gin.Engine, callbackURL string) int {
+		req, _ := http.NewRequest("POST", "/request", bytes.NewBufferString(`{"data": "test"}`))
+		req.Header.Set(CallbackURLHeader, callbackURL)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	t.Run("accepted", func(t *testing.T) {
+		memoryQueue := queue.NewMemoryQueue()
+		router := newRouter(NewAsyncWriteHandler(memoryQueue, repository.NewMemoryRequestStatusRepository()))
+
+		assert.Equal(t, http.StatusAccepted, post(router, "https://example.com/callback"))
+		_, requestData, err := memoryQueue.Dequeue()
+		assert.NoError(t, err)
+		job, _ := queue.DecodeJob(requestData)
+		assert.Equal(t, "https://example.com/callback", job.CallbackURL)
+
+		assert.Equal(t, http.StatusBadRequest, post(router, "ftp://example.com/callback"))
+		// 内部向けのアドレスは拒否する
+		assert.Equal(t, http.StatusBadRequest, post(router, "http://127.0.0.1:8080/callback"))
+		assert.Equal(t, http.StatusBadRequest, post(router, "http://169.254.169.254/latest/meta-data"))
+		assert.Equal(t, http.StatusBadRequest, post(router, "http://[::1]/callback"))
+		assert.Equal(t, http.StatusBadRequest, post(router, "http://localhost/callback"))
+	})
+
+	t.Run("allowed hosts", func(t *testing.T) {
+		handler := NewAsyncWriteHandler(queue.NewMemoryQueue(), repository.NewMemoryRequestStatusRepository()).
+			WithCallbackPolicy([]string{"hooks.example.com", ".partner.example.com"}, false)
+		router := newRouter(handler)
+
+		assert.Equal(t, http.StatusAccepted, post(router, "https://hooks.example.com/callback"))
+		assert.Equal(t, http.StatusAccepted, post(router, "https://api.partner.example.com/callback"))
+		assert.Equal(t, http.StatusBadRequest, post(router, "https://example.com/callback"))
+		assert.Equal(t, http.StatusBadRequest, post(router, "https://evilpartner.example.com/callback"))
+	})
+
+	t.Run("private networks allowed", func(t *testing.T) {
+		handler := NewAsyncWriteHandler(queue.NewMemoryQueue(), repository.NewMemoryRequestStatusRepository()).
+			WithCallbackPolicy(nil, true)
+		assert.Equal(t, http.StatusAccepted, post(newRouter(handler), "http://10.0.0.5/callback"))
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		memoryQueue := queue.NewMemoryQueue()
+		router := newRouter(NewAsyncWriteHandler(memoryQueue, repository.NewMemoryRequestStatusRepository()).DisableCallbacks())
+
+		// 署名できない完了通知は送らないため受け付けない
+		assert.Equal(t, http.StatusBadRequest, post(router, "https://example.com/callback"))
+		assert.Equal(t, http.StatusAccepted, post(router, ""))
+	})
+}
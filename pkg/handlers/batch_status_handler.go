@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"net/http"
+	"reliproxy/pkg/repository"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+type BatchStatusHandler struct {
+	statusRepository repository.RequestStatusRepository
+}
+
+func NewBatchStatusHandler(repository repository.RequestStatusRepository) *BatchStatusHandler {
+	return &BatchStatusHandler{statusRepository: repository}
+}
+
+// HandleRequest はバッチに含まれるリクエストの件数を結果ごとに集計して返す
+func (h *BatchStatusHandler) HandleRequest(c *gin.Context) {
+	batchID := c.Param("id")
+	counts, err := h.statusRepository.WithContext(c.Request.Context()).CountByBatch(batchID)
+	if err != nil {
+		requestLogger(c).WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Failed to count batch requests")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get batch status"})
+		return
+	}
+
+	var total int64
+	for _, count := range counts {
+		total += count
+	}
+	if total == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Batch not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"batch_id":  batchID,
+		"total":     total,
+		"succeeded": counts[repository.StatusProcessed],
+		"failed":    counts[repository.StatusFailed],
+		"cancelled": counts[repository.StatusCancelled],
+		"pending":   counts[repository.StatusScheduled] + counts[repository.StatusQueued] + counts[repository.StatusRunning],
+	})
+}
@@ -0,0 +1,37 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"reliproxy/pkg/health"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+type HealthHandler struct {
+	checker *health.Checker
+}
+
+func NewHealthHandler(checker *health.Checker) *HealthHandler {
+	return &HealthHandler{checker: checker}
+}
+
+// HandleLiveness はプロセスが応答できることだけを返す。依存先の障害で再起動されないよう依存先は確認しない
+func (h *HealthHandler) HandleLiveness(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": health.StatusUp})
+}
+
+// HandleReadiness は依存先ごとの確認結果を返し、1つでも利用できなければ 503 を返す
+func (h *HealthHandler) HandleReadiness(c *gin.Context) {
+	// 結果は他のプローブと共有するため、このリクエストが切断されても確認は続ける
+	report := h.checker.Check(context.WithoutCancel(c.Request.Context()))
+	if !report.Ready() {
+		requestLogger(c).WithFields(logrus.Fields{
+			"checks": report.Checks,
+		}).Warn("Not ready")
+		c.JSON(http.StatusServiceUnavailable, report)
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reliproxy/pkg/health"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var redisErr error
+	checker := health.NewChecker(0, time.Second)
+	checker.Add("mysql", func(ctx context.Context) error { return nil })
+	checker.Add("redis", func(ctx context.Context) error { return redisErr })
+	handler := NewHealthHandler(checker)
+
+	router := gin.New()
+	router.GET("/healthz", handler.HandleLiveness)
+	router.GET("/readyz", handler.HandleReadiness)
+
+	t.Run("Liveness", func(t *testing.T) {
+		redisErr = errors.New("connection refused")
+		defer func() { redisErr = nil }()
+
+		req, _ := http.NewRequest("GET", "/healthz", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		// 依存先の障害に関係なく応答する
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("Ready", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/readyz", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		var report health.Report
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+		assert.Equal(t, health.StatusUp, report.Status)
+		assert.Len(t, report.Checks, 2)
+	})
+
+	t.Run("NotReady", func(t *testing.T) {
+		redisErr = errors.New("connection refused")
+		defer func() { redisErr = nil }()
+
+		req, _ := http.NewRequest("GET", "/readyz", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		var report health.Report
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+		assert.Equal(t, health.StatusDown, report.Status)
+		assert.Equal(t, health.StatusUp, report.Checks["mysql"].Status)
+		assert.Equal(t, "connection refused", report.Checks["redis"].Error)
+	})
+}
@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"reliproxy/pkg/idempotency"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// IdempotencyMiddleware は同じ Idempotency-Key のリクエストに最初の応答を返す
+//
+// 処理中のキーは reservationTTL の間だけ予約し、応答を保存するときに ttl まで延ばす。
+// 処理中にプロセスが落ちても、キーが ttl の間使えなくなることはない。
+type IdempotencyMiddleware struct {
+	store          idempotency.Store
+	reservationTTL time.Duration
+	ttl            time.Duration
+}
+
+func NewIdempotencyMiddleware(store idempotency.Store, reservationTTL time.Duration, ttl time.Duration) *IdempotencyMiddleware {
+	return &IdempotencyMiddleware{
+		store:          store,
+		reservationTTL: reservationTTL,
+		ttl:            ttl,
+	}
+}
+
+func (m *IdempotencyMiddleware) Handle(c *gin.Context) {
+	key := c.GetHeader(IdempotencyKeyHeader)
+	if key == "" {
+		c.Next()
+		return
+	}
+
+	body, err := io.ReadAll(c.Request.Body)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Request body is too large"})
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
+		return
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+	// 同じキーでもルートやテナントが異なれば別のリクエストとして扱う
+	if tenant := c.GetString(tenantKey); tenant != "" {
+		key = tenant + ":" + key
+	}
+	key = c.FullPath() + ":" + key
+	fingerprint := requestFingerprint(c.Request, body)
+
+	reserved, err := m.store.Reserve(key, fingerprint, m.reservationTTL)
+	if err != nil {
+		requestLogger(c).WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Failed to reserve idempotency key")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to check idempotency key"})
+		return
+	}
+	if !reserved {
+		m.replay(c, key, fingerprint)
+		return
+	}
+
+	writer := &recordingResponseWriter{ResponseWriter: c.Writer}
+	c.Writer = writer
+	c.Next()
+
+	// 5xx はリトライで成功する可能性があるため結果を保存せずキーを解放する
+	if writer.Status() >= http.StatusInternalServerError {
+		if err := m.store.Delete(key); err != nil {
+			requestLogger(c).WithFields(logrus.Fields{
+				"error": err,
+			}).Error("Failed to release idempotency key")
+		}
+		return
+	}
+
+	record := &idempotency.Record{
+		Fingerprint: fingerprint,
+		Completed:   true,
+		StatusCode:  writer.Status(),
+		ContentType: writer.Header().Get("Content-Type"),
+		Body:        writer.body.Bytes(),
+	}
+	if err := m.store.Save(key, record, m.ttl); err != nil {
+		requestLogger(c).WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Failed to save idempotency record")
+	}
+}
+
+func (m *IdempotencyMiddleware) replay(c *gin.Context, key string, fingerprint string) {
+	record, err := m.store.Get(key)
+	if errors.Is(err, idempotency.ErrRecordNotFound) {
+		// 予約後に期限切れ・解放された場合はリトライを促す
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "Request with the same Idempotency-Key is being processed"})
+		return
+	}
+	if err != nil {
+		requestLogger(c).WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Failed to get idempotency record")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to check idempotency key"})
+		return
+	}
+
+	if record.Fingerprint != fingerprint {
+		c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": "Idempotency-Key is already used with a different request payload"})
+		return
+	}
+	if !record.Completed {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "Request with the same Idempotency-Key is being processed"})
+		return
+	}
+
+	c.Header("Idempotent-Replayed", "true")
+	c.Data(record.StatusCode, record.ContentType, record.Body)
+	c.Abort()
+}
+
+func requestFingerprint(r *http.Request, body []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(r.Method))
+	hash.Write([]byte{0})
+	hash.Write([]byte(r.URL.RequestURI()))
+	hash.Write([]byte{0})
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// recordingResponseWriter はレスポンスを書き込みつつ保存用に本文を記録する
+type recordingResponseWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingResponseWriter) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *recordingResponseWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
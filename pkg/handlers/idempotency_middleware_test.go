@@ -0,0 +1,116 @@
+package handlers
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"reliproxy/pkg/idempotency"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	gomock "go.uber.org/mock/gomock"
+)
+
+func TestIdempotencyMiddleware_Handle(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStore := idempotency.NewMockStore(ctrl)
+	middleware := NewIdempotencyMiddleware(mockStore, time.Minute, time.Hour)
+
+	gin.SetMode(gin.TestMode)
+	calls := 0
+	router := gin.Default()
+	router.POST("/request", middleware.Handle, func(c *gin.Context) {
+		calls++
+		c.JSON(http.StatusAccepted, gin.H{"request_id": "first"})
+	})
+
+	newRequest := func(key string, body string) *http.Request {
+		req, _ := http.NewRequest("POST", "/request", bytes.NewBufferString(body))
+		if key != "" {
+			req.Header.Set(IdempotencyKeyHeader, key)
+		}
+		return req
+	}
+	fingerprint := func(body string) string {
+		return requestFingerprint(newRequest("", body), []byte(body))
+	}
+
+	t.Run("without key", func(t *testing.T) {
+		calls = 0
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, newRequest("", `{"data": "test"}`))
+
+		assert.Equal(t, http.StatusAccepted, w.Code)
+		assert.Equal(t, 1, calls)
+	})
+
+	t.Run("first request", func(t *testing.T) {
+		calls = 0
+		mockStore.EXPECT().Reserve("/request:key-1", fingerprint(`{"data": "test"}`), time.Minute).Return(true, nil)
+		mockStore.EXPECT().Save("/request:key-1", gomock.Any(), time.Hour).DoAndReturn(func(key string, record *idempotency.Record, ttl time.Duration) error {
+			assert.True(t, record.Completed)
+			assert.Equal(t, http.StatusAccepted, record.StatusCode)
+			assert.JSONEq(t, `{"request_id": "first"}`, string(record.Body))
+			return nil
+		})
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, newRequest("key-1", `{"data": "test"}`))
+
+		assert.Equal(t, http.StatusAccepted, w.Code)
+		assert.Equal(t, 1, calls)
+	})
+
+	t.Run("replayed request", func(t *testing.T) {
+		calls = 0
+		mockStore.EXPECT().Reserve("/request:key-1", gomock.Any(), time.Minute).Return(false, nil)
+		mockStore.EXPECT().Get("/request:key-1").Return(&idempotency.Record{
+			Fingerprint: fingerprint(`{"data": "test"}`),
+			Completed:   true,
+			StatusCode:  http.StatusAccepted,
+			ContentType: "application/json; charset=utf-8",
+			Body:        []byte(`{"request_id":"first"}`),
+		}, nil)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, newRequest("key-1", `{"data": "test"}`))
+
+		assert.Equal(t, http.StatusAccepted, w.Code)
+		assert.JSONEq(t, `{"request_id": "first"}`, w.Body.String())
+		assert.Equal(t, "true", w.Header().Get("Idempotent-Replayed"))
+		assert.Equal(t, 0, calls)
+	})
+
+	t.Run("different payload", func(t *testing.T) {
+		calls = 0
+		mockStore.EXPECT().Reserve("/request:key-1", gomock.Any(), time.Minute).Return(false, nil)
+		mockStore.EXPECT().Get("/request:key-1").Return(&idempotency.Record{
+			Fingerprint: fingerprint(`{"data": "test"}`),
+			Completed:   true,
+		}, nil)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, newRequest("key-1", `{"data": "other"}`))
+
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+		assert.Equal(t, 0, calls)
+	})
+
+	t.Run("request in progress", func(t *testing.T) {
+		calls = 0
+		mockStore.EXPECT().Reserve("/request:key-2", gomock.Any(), time.Minute).Return(false, nil)
+		mockStore.EXPECT().Get("/request:key-2").Return(&idempotency.Record{
+			Fingerprint: fingerprint(`{"data": "test"}`),
+		}, nil)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, newRequest("key-2", `{"data": "test"}`))
+
+		assert.Equal(t, http.StatusConflict, w.Code)
+		assert.Equal(t, 0, calls)
+	})
+}
@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"net/http"
+	"reliproxy/pkg/queue"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+type QueueDepths interface {
+	Depths() (map[queue.Priority]int64, error)
+}
+
+type QueueStatsHandler struct {
+	queue QueueDepths
+}
+
+func NewQueueStatsHandler(queue QueueDepths) *QueueStatsHandler {
+	return &QueueStatsHandler{queue: queue}
+}
+
+func (h *QueueStatsHandler) HandleRequest(c *gin.Context) {
+	depths, err := h.queue.Depths()
+	if err != nil {
+		requestLogger(c).WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Failed to get queue depth")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get queue depth"})
+		return
+	}
+
+	var total int64
+	for _, depth := range depths {
+		total += depth
+	}
+	response := gin.H{"depth": total, "depth_by_priority": depths}
+
+	if ager, ok := h.queue.(queue.Ager); ok {
+		age, err := ager.OldestAge()
+		if err != nil {
+			requestLogger(c).WithFields(logrus.Fields{
+				"error": err,
+			}).Error("Failed to get oldest request age")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get oldest request age"})
+			return
+		}
+		response["oldest_age_seconds"] = age.Seconds()
+	}
+
+	if statser, ok := h.queue.(queue.TenantStatser); ok {
+		tenants, err := statser.TenantStats()
+		if err != nil {
+			requestLogger(c).WithFields(logrus.Fields{
+				"error": err,
+			}).Error("Failed to get tenant stats")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get tenant stats"})
+			return
+		}
+		response["tenants"] = tenants
+	}
+	c.JSON(http.StatusOK, response)
+}
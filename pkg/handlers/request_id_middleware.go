@@ -0,0 +1,41 @@
+package handlers
+
+import (
+	"regexp"
+	"reliproxy/pkg/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+const RequestIDHeader = "X-Request-ID"
+
+// ログや上流へのヘッダにそのまま使うため、受け取る X-Request-ID の文字と長さを制限する
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9_.:-]{1,128}$`)
+
+// RequestIDMiddleware は X-Request-ID を受け取るか生成し、その ID を付けたロガーをリクエストのコンテキストに保存するミドルウェアを返す
+//
+// ID はレスポンスのヘッダで返し、上流へのリクエストとキューに追加するジョブにも引き継ぐ。
+func RequestIDMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestID := c.GetHeader(RequestIDHeader)
+		if !requestIDPattern.MatchString(requestID) {
+			requestID = uuid.New().String()
+		}
+		c.Header(RequestIDHeader, requestID)
+
+		logger := utils.Logger.WithFields(logrus.Fields{
+			"requestID": requestID,
+			"route":     c.FullPath(),
+		})
+		ctx := utils.WithLogger(utils.WithRequestID(c.Request.Context(), requestID), logger)
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+
+// requestLogger はリクエストの ID とルートを付けたロガーを返す
+func requestLogger(c *gin.Context) *logrus.Entry {
+	return utils.LoggerFromContext(c.Request.Context())
+}
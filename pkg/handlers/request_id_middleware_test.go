@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"reliproxy/pkg/httpclient"
+	"reliproxy/pkg/queue"
+	"reliproxy/pkg/repository"
+	"reliproxy/pkg/utils"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestIDMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(RequestIDMiddleware())
+	router.GET("/requests/:id", func(c *gin.Context) {
+		c.String(http.StatusOK, "%v", requestLogger(c).Data["requestID"])
+	})
+
+	t.Run("GeneratesRequestID", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/requests/abc", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		requestID := w.Header().Get(RequestIDHeader)
+		assert.NotEmpty(t, requestID)
+		// ロガーにも同じ ID が付く
+		assert.Equal(t, requestID, w.Body.String())
+	})
+
+	t.Run("AcceptsRequestID", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/requests/abc", nil)
+		req.Header.Set(RequestIDHeader, "client-request-1")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, "client-request-1", w.Header().Get(RequestIDHeader))
+		assert.Equal(t, "client-request-1", w.Body.String())
+	})
+
+	t.Run("ReplacesInvalidRequestID", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/requests/abc", nil)
+		req.Header.Set(RequestIDHeader, "bad id\nwith newline")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.NotEqual(t, "bad id\nwith newline", w.Header().Get(RequestIDHeader))
+		assert.NotEmpty(t, w.Header().Get(RequestIDHeader))
+	})
+}
+
+func TestRequestIDMiddleware_Propagation(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	t.Run("UpstreamRequest", func(t *testing.T) {
+		var upstreamRequestID string
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			upstreamRequestID = r.Header.Get(RequestIDHeader)
+		}))
+		defer upstream.Close()
+
+		router := gin.New()
+		router.Use(RequestIDMiddleware())
+		router.GET("/proxy", func(c *gin.Context) {
+			resp, err := (&httpclient.DefaultHttpClient{}).GetWithContext(c.Request.Context(), upstream.URL)
+			assert.NoError(t, err)
+			resp.Body.Close()
+		})
+
+		req, _ := http.NewRequest("GET", "/proxy", nil)
+		req.Header.Set(RequestIDHeader, "client-request-2")
+		router.ServeHTTP(httptest.NewRecorder(), req)
+
+		assert.Equal(t, "client-request-2", upstreamRequestID)
+	})
+
+	t.Run("QueuedJob", func(t *testing.T) {
+		memoryQueue := queue.NewMemoryQueue()
+		handler := NewAsyncWriteHandler(memoryQueue, repository.NewMemoryRequestStatusRepository())
+
+		router := gin.New()
+		router.Use(RequestIDMiddleware())
+		router.POST("/request", handler.HandleRequest)
+
+		req, _ := http.NewRequest("POST", "/request", bytes.NewBufferString(`{"data": "test"}`))
+		req.Header.Set(RequestIDHeader, "client-request-3")
+		router.ServeHTTP(httptest.NewRecorder(), req)
+
+		_, requestData, err := memoryQueue.Dequeue()
+		assert.NoError(t, err)
+		job, err := queue.DecodeJob(requestData)
+		assert.NoError(t, err)
+		assert.Equal(t, "client-request-3", job.CorrelationID)
+	})
+
+	t.Run("DefaultLogger", func(t *testing.T) {
+		// ミドルウェアを通らない場合はグローバルなロガーを使う
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request, _ = http.NewRequest("GET", "/", nil)
+		assert.Equal(t, utils.Logger, requestLogger(c).Logger)
+	})
+}
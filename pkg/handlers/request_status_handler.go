@@ -0,0 +1,166 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"reliproxy/pkg/cancellation"
+	"reliproxy/pkg/events"
+	"reliproxy/pkg/repository"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// Canceller は実行前のリクエストを取り除けるキュー
+type Canceller interface {
+	Cancel(requestID string) (bool, error)
+}
+
+type RequestStatusHandler struct {
+	statusRepository repository.RequestStatusRepository
+	canceller        Canceller
+	notifier         cancellation.Notifier
+	deliveries       repository.WebhookDeliveryRepository
+	events           events.Publisher
+}
+
+func NewRequestStatusHandler(repository repository.RequestStatusRepository, canceller Canceller, notifier cancellation.Notifier, deliveries repository.WebhookDeliveryRepository, events events.Publisher) *RequestStatusHandler {
+	return &RequestStatusHandler{
+		statusRepository: repository,
+		canceller:        canceller,
+		notifier:         notifier,
+		deliveries:       deliveries,
+		events:           events,
+	}
+}
+
+// callbackAttempts はステータス API で返すコールバックの配信状況
+type callbackAttempts struct {
+	URL            string     `json:"url"`
+	Status         string     `json:"status"`
+	Attempts       int        `json:"attempts"`
+	LastStatusCode int        `json:"last_status_code,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+	NextAttemptAt  *time.Time `json:"next_attempt_at,omitempty"`
+	DeliveredAt    *time.Time `json:"delivered_at,omitempty"`
+}
+
+// cancellableStatuses は取り消せるリクエストのステータス
+var cancellableStatuses = []string{repository.StatusScheduled, repository.StatusQueued, repository.StatusRunning}
+
+func (h *RequestStatusHandler) HandleGet(c *gin.Context) {
+	requestStatus, ok := h.getStatus(c)
+	if !ok {
+		return
+	}
+	response := gin.H{"request_id": requestStatus.ID, "status": requestStatus.Status}
+	if requestStatus.Response != "" {
+		// 同期リクエストを非同期に切り替えた場合は、同期で応答した場合と同じ形で本文を返す
+		response["data"] = requestStatus.Response
+	}
+	if h.deliveries != nil {
+		deliveries, err := h.deliveries.ListByRequestID(requestStatus.ID)
+		if err != nil {
+			requestLogger(c).WithFields(logrus.Fields{
+				"error": err,
+			}).Error("Failed to get webhook deliveries")
+		}
+		if len(deliveries) > 0 {
+			response["callbacks"] = newCallbackAttempts(deliveries)
+		}
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+func newCallbackAttempts(deliveries []repository.WebhookDelivery) []callbackAttempts {
+	attempts := make([]callbackAttempts, len(deliveries))
+	for i, delivery := range deliveries {
+		attempts[i] = callbackAttempts{
+			URL:            delivery.URL,
+			Status:         delivery.Status,
+			Attempts:       delivery.Attempts,
+			LastStatusCode: delivery.LastStatusCode,
+			LastError:      delivery.LastError,
+			DeliveredAt:    delivery.DeliveredAt,
+		}
+		if delivery.Status == repository.DeliveryPending {
+			nextAttemptAt := delivery.NextAttemptAt
+			attempts[i].NextAttemptAt = &nextAttemptAt
+		}
+	}
+	return attempts
+}
+
+// HandleCancel は完了していないリクエストを取り消す
+//
+// キューに残っているリクエストはワーカーが取り出した時点で破棄され、実行中のリクエストは全てのワーカーと、
+// 同期リクエストを応答を待たずに切り替えた API サーバーに通知して中断する。
+func (h *RequestStatusHandler) HandleCancel(c *gin.Context) {
+	requestStatus, ok := h.getStatus(c)
+	if !ok {
+		return
+	}
+
+	statusRepository := h.statusRepository.WithContext(c.Request.Context())
+	cancelled, err := statusRepository.TransitionStatus(requestStatus.ID, cancellableStatuses, repository.StatusCancelled)
+	if err != nil {
+		requestLogger(c).WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Failed to update request status")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update request status"})
+		return
+	}
+	if !cancelled {
+		// 取得後に完了した場合も含めて最新のステータスを返す
+		if latest, err := statusRepository.GetByID(requestStatus.ID); err == nil {
+			requestStatus = latest
+		}
+		c.JSON(http.StatusConflict, gin.H{"error": "Request can no longer be cancelled", "status": requestStatus.Status})
+		return
+	}
+
+	// スケジュールに残っていれば取り除く。キューへ追加済みの場合はワーカーが破棄する
+	if _, err := h.canceller.Cancel(requestStatus.ID); err != nil {
+		requestLogger(c).WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Failed to remove cancelled request from schedule")
+	}
+	if h.notifier != nil {
+		if err := h.notifier.Publish(requestStatus.ID); err != nil {
+			requestLogger(c).WithFields(logrus.Fields{
+				"error": err,
+			}).Error("Failed to publish cancellation")
+		}
+	}
+	if h.events != nil {
+		if err := h.events.Publish(events.Event{RequestID: requestStatus.ID, Status: repository.StatusCancelled, At: time.Now()}); err != nil {
+			requestLogger(c).WithFields(logrus.Fields{
+				"error": err,
+			}).Error("Failed to publish status event")
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"request_id": requestStatus.ID, "status": repository.StatusCancelled})
+}
+
+func (h *RequestStatusHandler) getStatus(c *gin.Context) (*repository.RequestStatus, bool) {
+	return getRequestStatus(c, h.statusRepository)
+}
+
+// getRequestStatus はパスの ID のステータスを返す。取得できなければエラーを応答して false を返す
+func getRequestStatus(c *gin.Context, statusRepository repository.RequestStatusRepository) (*repository.RequestStatus, bool) {
+	requestStatus, err := statusRepository.WithContext(c.Request.Context()).GetByID(c.Param("id"))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Request not found"})
+		return nil, false
+	}
+	if err != nil {
+		requestLogger(c).WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Failed to get request status")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get request status"})
+		return nil, false
+	}
+	return requestStatus, true
+}
@@ -0,0 +1,163 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reliproxy/pkg/queue"
+	"reliproxy/pkg/repository"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestStatusHandler(t *testing.T) {
+	repo := repository.NewMemoryRequestStatusRepository()
+	notifier := &recordingNotifier{}
+	deliveries := repository.NewMemoryWebhookDeliveryRepository()
+	delayedQueue := queue.NewDelayedQueue(queue.NewMemoryQueue(), queue.NewMemorySchedule())
+	asyncHandler := NewAsyncWriteHandler(delayedQueue, repo)
+	statusHandler := NewRequestStatusHandler(repo, delayedQueue, notifier, deliveries, nil)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.Default()
+	router.POST("/async-proxy", asyncHandler.HandleRequest)
+	router.GET("/requests/:id", statusHandler.HandleGet)
+	router.DELETE("/requests/:id", statusHandler.HandleCancel)
+
+	submit := func(t *testing.T, path string, header string) string {
+		req, _ := http.NewRequest("POST", path, bytes.NewBufferString(`{"data": "test"}`))
+		if header != "" {
+			req.Header.Set(NotBeforeHeader, header)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusAccepted, w.Code)
+
+		var response struct {
+			RequestID string `json:"request_id"`
+		}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		return response.RequestID
+	}
+	do := func(method string, requestID string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "/requests/"+requestID, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("scheduled with not-before header", func(t *testing.T) {
+		requestID := submit(t, "/async-proxy", time.Now().Add(time.Hour).Format(time.RFC3339))
+
+		w := do("GET", requestID)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, `{"request_id": "`+requestID+`", "status": "scheduled"}`, w.Body.String())
+	})
+
+	t.Run("cancel scheduled request", func(t *testing.T) {
+		requestID := submit(t, "/async-proxy?delay=1h", "")
+
+		w := do("DELETE", requestID)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, `{"request_id": "`+requestID+`", "status": "cancelled"}`, w.Body.String())
+
+		scheduled, _ := delayedQueue.ScheduledLen()
+		assert.Equal(t, int64(1), scheduled)
+	})
+
+	t.Run("cancel queued request", func(t *testing.T) {
+		requestID := submit(t, "/async-proxy", "")
+
+		w := do("DELETE", requestID)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, `{"request_id": "`+requestID+`", "status": "cancelled"}`, w.Body.String())
+
+		// 実行中のワーカーに取り消しが通知される
+		assert.Contains(t, notifier.published, requestID)
+	})
+
+	t.Run("cancel processed request", func(t *testing.T) {
+		requestID := submit(t, "/async-proxy", "")
+		transitionStatus(t, repo, requestID, repository.StatusQueued, repository.StatusProcessed)
+
+		w := do("DELETE", requestID)
+		assert.Equal(t, http.StatusConflict, w.Code)
+		assert.JSONEq(t, `{"error": "Request can no longer be cancelled", "status": "processed"}`, w.Body.String())
+	})
+
+	t.Run("invalid not-before header", func(t *testing.T) {
+		req, _ := http.NewRequest("POST", "/async-proxy", bytes.NewBufferString(`{"data": "test"}`))
+		req.Header.Set(NotBeforeHeader, "tomorrow")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("callback attempts", func(t *testing.T) {
+		requestID := submit(t, "/async-proxy", "")
+		assert.NoError(t, deliveries.Create(&repository.WebhookDelivery{
+			RequestID:      requestID,
+			URL:            "https://example.com/callback",
+			Status:         repository.DeliveryDead,
+			Attempts:       8,
+			LastStatusCode: http.StatusServiceUnavailable,
+			LastError:      "unexpected status code: 503",
+		}))
+
+		w := do("GET", requestID)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, `{
+			"request_id": "`+requestID+`",
+			"status": "queued",
+			"callbacks": [{
+				"url": "https://example.com/callback",
+				"status": "dead",
+				"attempts": 8,
+				"last_status_code": 503,
+				"last_error": "unexpected status code: 503"
+			}]
+		}`, w.Body.String())
+	})
+
+	t.Run("response of request completed in background", func(t *testing.T) {
+		requestID := submit(t, "/async-proxy", "")
+		assert.NoError(t, repo.SaveResponse(requestID, "ok"))
+		transitionStatus(t, repo, requestID, repository.StatusQueued, repository.StatusProcessed)
+
+		w := do("GET", requestID)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, `{"request_id": "`+requestID+`", "status": "processed", "data": "ok"}`, w.Body.String())
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		w := do("GET", "unknown")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
+
+type recordingNotifier struct {
+	published []string
+}
+
+func (n *recordingNotifier) Publish(requestID string) error {
+	n.published = append(n.published, requestID)
+	return nil
+}
+
+func (n *recordingNotifier) Subscribe(ctx context.Context, handler func(requestID string)) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// transitionStatus はワーカーの代わりにステータスを from から to へ遷移させる
+func transitionStatus(t *testing.T, repo repository.RequestStatusRepository, requestID string, from string, to string) {
+	t.Helper()
+	transitioned, err := repo.TransitionStatus(requestID, []string{from}, to)
+	assert.NoError(t, err)
+	assert.True(t, transitioned)
+}
@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"reliproxy/pkg/events"
+	"reliproxy/pkg/repository"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultWaitTimeout = 10 * time.Second
+	maxWaitTimeout     = 60 * time.Second
+	keepAliveInterval  = 15 * time.Second
+	// maxStreamDuration を超えた Server-Sent Events は終了し、クライアントに接続し直させる
+	maxStreamDuration = 10 * time.Minute
+)
+
+// RequestWaitHandler はリクエストのステータスの遷移を待つクライアントに通知する
+type RequestWaitHandler struct {
+	statusRepository  repository.RequestStatusRepository
+	watcher           events.Watcher
+	keepAliveInterval time.Duration
+	maxStreamDuration time.Duration
+}
+
+func NewRequestWaitHandler(repository repository.RequestStatusRepository, watcher events.Watcher) *RequestWaitHandler {
+	return &RequestWaitHandler{
+		statusRepository:  repository,
+		watcher:           watcher,
+		keepAliveInterval: keepAliveInterval,
+		maxStreamDuration: maxStreamDuration,
+	}
+}
+
+// HandleWait はリクエストが完了するか timeout が経過するまで待ち、その時点のステータスを返す
+func (h *RequestWaitHandler) HandleWait(c *gin.Context) {
+	timeout, err := waitTimeout(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// ステータスの取得後に遷移しても取りこぼさないよう先に待ち受ける
+	ch, stop := h.watcher.Watch(c.Param("id"))
+	defer stop()
+
+	requestStatus, ok := getRequestStatus(c, h.statusRepository)
+	if !ok {
+		return
+	}
+	status := requestStatus.Status
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for !repository.IsTerminalStatus(status) {
+		select {
+		case event := <-ch:
+			status = event.Status
+		case <-timer.C:
+			// 遷移のイベントは取りこぼすことがあるため、応答する前にステータスを読み直す
+			current, err := h.statusRepository.WithContext(c.Request.Context()).GetByID(requestStatus.ID)
+			if err != nil {
+				requestLogger(c).WithFields(logrus.Fields{
+					"error": err,
+				}).Error("Failed to get request status from db")
+			} else {
+				status = current.Status
+			}
+			c.JSON(http.StatusOK, gin.H{"request_id": requestStatus.ID, "status": status, "completed": repository.IsTerminalStatus(status)})
+			return
+		case <-c.Request.Context().Done():
+			return
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"request_id": requestStatus.ID, "status": status, "completed": true})
+}
+
+// HandleEvents は現在のステータスとその後の遷移を Server-Sent Events で送信し、完了した時点で終了する
+//
+// 遷移のイベントは取りこぼすことがあるため、keep-alive のたびにステータスを読み直す。
+// 完了しないまま maxStreamDuration が経過した場合も終了する。
+func (h *RequestWaitHandler) HandleEvents(c *gin.Context) {
+	ch, stop := h.watcher.Watch(c.Param("id"))
+	defer stop()
+
+	requestStatus, ok := getRequestStatus(c, h.statusRepository)
+	if !ok {
+		return
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+
+	status := requestStatus.Status
+	c.SSEvent("status", gin.H{"request_id": requestStatus.ID, "status": status})
+	c.Writer.Flush()
+
+	keepAlive := time.NewTicker(h.keepAliveInterval)
+	defer keepAlive.Stop()
+	deadline := time.NewTimer(h.maxStreamDuration)
+	defer deadline.Stop()
+	c.Stream(func(w io.Writer) bool {
+		if repository.IsTerminalStatus(status) {
+			return false
+		}
+		select {
+		case event := <-ch:
+			status = event.Status
+			c.SSEvent("status", event)
+		case <-keepAlive.C:
+			current, err := h.statusRepository.GetByID(requestStatus.ID)
+			if err != nil {
+				requestLogger(c).WithFields(logrus.Fields{
+					"error": err,
+				}).Error("Failed to get request status from db")
+			} else if current.Status != status {
+				status = current.Status
+				c.SSEvent("status", events.Event{RequestID: requestStatus.ID, Status: status, At: time.Now()})
+				return true
+			}
+			// プロキシに接続を切られないようコメント行を送る
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-deadline.C:
+			return false
+		case <-c.Request.Context().Done():
+			return false
+		}
+		return true
+	})
+}
+
+func waitTimeout(c *gin.Context) (time.Duration, error) {
+	value := c.Query("timeout")
+	if value == "" {
+		return defaultWaitTimeout, nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout <= 0 {
+		return 0, fmt.Errorf("invalid timeout: %q", value)
+	}
+	if timeout > maxWaitTimeout {
+		timeout = maxWaitTimeout
+	}
+	return timeout, nil
+}
@@ -0,0 +1,183 @@
+package handlers
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reliproxy/pkg/events"
+	"reliproxy/pkg/repository"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestWaitHandler(t *testing.T) {
+	repo := repository.NewMemoryRequestStatusRepository()
+	broker := events.NewMemoryBroker()
+	handler := NewRequestWaitHandler(repo, broker)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.Default()
+	router.GET("/requests/:id/wait", handler.HandleWait)
+	router.GET("/requests/:id/events", handler.HandleEvents)
+
+	// 待ち受けが登録されるまで遷移を発行し続ける
+	publishUntil := func(done <-chan struct{}, requestID string, from string, status string) {
+		transitionStatus(t, repo, requestID, from, status)
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(5 * time.Millisecond):
+				broker.Publish(events.Event{RequestID: requestID, Status: status, At: time.Now()})
+			}
+		}
+	}
+	wait := func(path string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("wait until processed", func(t *testing.T) {
+		assert.NoError(t, repo.Create(&repository.RequestStatus{ID: "request-1", Status: repository.StatusQueued}))
+
+		done := make(chan struct{})
+		go publishUntil(done, "request-1", repository.StatusQueued, repository.StatusProcessed)
+		w := wait("/requests/request-1/wait?timeout=5s")
+		close(done)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, `{"request_id": "request-1", "status": "processed", "completed": true}`, w.Body.String())
+	})
+
+	t.Run("already completed", func(t *testing.T) {
+		assert.NoError(t, repo.Create(&repository.RequestStatus{ID: "request-2", Status: repository.StatusFailed}))
+
+		w := wait("/requests/request-2/wait")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, `{"request_id": "request-2", "status": "failed", "completed": true}`, w.Body.String())
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		assert.NoError(t, repo.Create(&repository.RequestStatus{ID: "request-3", Status: repository.StatusQueued}))
+
+		w := wait("/requests/request-3/wait?timeout=20ms")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, `{"request_id": "request-3", "status": "queued", "completed": false}`, w.Body.String())
+	})
+
+	t.Run("missed event is read on timeout", func(t *testing.T) {
+		assert.NoError(t, repo.Create(&repository.RequestStatus{ID: "request-7", Status: repository.StatusQueued}))
+		go func() {
+			time.Sleep(5 * time.Millisecond)
+			// イベントを発行せずに完了させる
+			repo.TransitionStatus("request-7", []string{repository.StatusQueued}, repository.StatusProcessed)
+		}()
+
+		w := wait("/requests/request-7/wait?timeout=50ms")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, `{"request_id": "request-7", "status": "processed", "completed": true}`, w.Body.String())
+	})
+
+	t.Run("invalid timeout", func(t *testing.T) {
+		w := wait("/requests/request-3/wait?timeout=soon")
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		w := wait("/requests/unknown/wait")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("server-sent events", func(t *testing.T) {
+		assert.NoError(t, repo.Create(&repository.RequestStatus{ID: "request-4", Status: repository.StatusQueued}))
+		server := httptest.NewServer(router)
+		defer server.Close()
+
+		resp, err := http.Get(server.URL + "/requests/request-4/events")
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+		done := make(chan struct{})
+		defer close(done)
+		var data []string
+		running := false
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if !strings.HasPrefix(line, "data:") {
+				continue
+			}
+			data = append(data, line)
+			if len(data) == 1 {
+				go publishUntil(done, "request-4", repository.StatusQueued, repository.StatusRunning)
+			}
+			if strings.Contains(line, `"running"`) && !running {
+				running = true
+				go publishUntil(done, "request-4", repository.StatusRunning, repository.StatusProcessed)
+			}
+		}
+
+		// 現在のステータスから完了までの遷移を送信してストリームを終了する
+		assert.Contains(t, data[0], `"queued"`)
+		assert.Contains(t, data[len(data)-1], `"processed"`)
+	})
+	t.Run("server-sent events without published transitions", func(t *testing.T) {
+		// 他のプロセスが遷移を発行できなかった場合もステータスを読み直して完了を送る
+		handler := NewRequestWaitHandler(repo, broker)
+		handler.keepAliveInterval = 5 * time.Millisecond
+		assert.NoError(t, repo.Create(&repository.RequestStatus{ID: "request-5", Status: repository.StatusRunning}))
+
+		router := gin.New()
+		router.GET("/requests/:id/events", handler.HandleEvents)
+		server := httptest.NewServer(router)
+		defer server.Close()
+
+		resp, err := http.Get(server.URL + "/requests/request-5/events")
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+
+		var data []string
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if !strings.HasPrefix(line, "data:") {
+				continue
+			}
+			data = append(data, line)
+			if len(data) == 1 {
+				transitionStatus(t, repo, "request-5", repository.StatusRunning, repository.StatusProcessed)
+			}
+		}
+
+		assert.Contains(t, data[0], `"running"`)
+		assert.Contains(t, data[len(data)-1], `"processed"`)
+	})
+
+	t.Run("server-sent events are closed after max duration", func(t *testing.T) {
+		handler := NewRequestWaitHandler(repo, broker)
+		handler.maxStreamDuration = 10 * time.Millisecond
+		assert.NoError(t, repo.Create(&repository.RequestStatus{ID: "request-6", Status: repository.StatusQueued}))
+
+		router := gin.New()
+		router.GET("/requests/:id/events", handler.HandleEvents)
+		server := httptest.NewServer(router)
+		defer server.Close()
+
+		resp, err := http.Get(server.URL + "/requests/request-6/events")
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+
+		assert.Contains(t, string(body), `"queued"`)
+		assert.NotContains(t, string(body), `"processed"`)
+	})
+}
@@ -0,0 +1,537 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reliproxy/pkg/httpclient"
+	"reliproxy/pkg/repository"
+	"reliproxy/pkg/routing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+type routeBody struct {
+	Name       string     `json:"name"`
+	URL        string     `json:"url"`
+	Policy     string     `json:"policy,omitempty"`
+	Credential string     `json:"credential,omitempty"`
+	Version    int        `json:"version,omitempty"`
+	UpdatedBy  string     `json:"updated_by,omitempty"`
+	UpdatedAt  *time.Time `json:"updated_at,omitempty"`
+}
+
+type routeVersionBody struct {
+	Version    int       `json:"version"`
+	URL        string    `json:"url,omitempty"`
+	Policy     string    `json:"policy,omitempty"`
+	Credential string    `json:"credential,omitempty"`
+	Deleted    bool      `json:"deleted,omitempty"`
+	CreatedBy  string    `json:"created_by"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// policyBody の 0 や空の項目は upstream、breaker と async の設定を使う。間隔は "10s" のような文字列で指定する
+type policyBody struct {
+	Name                string            `json:"name"`
+	MaxRetries          int               `json:"max_retries,omitempty"`
+	RateLimit           float64           `json:"rate_limit,omitempty"`
+	Burst               int               `json:"burst,omitempty"`
+	Breaker             breakerPolicyBody `json:"breaker"`
+	SyncOverflow        *bool             `json:"sync_overflow,omitempty"`
+	SyncOverflowLatency string            `json:"sync_overflow_latency,omitempty"`
+}
+
+type breakerPolicyBody struct {
+	MaxRequests      uint32 `json:"max_requests,omitempty"`
+	Interval         string `json:"interval,omitempty"`
+	Timeout          string `json:"timeout,omitempty"`
+	FailureThreshold uint32 `json:"failure_threshold,omitempty"`
+}
+
+type credentialBody struct {
+	Name   string `json:"name"`
+	Source string `json:"source"`
+	Ref    string `json:"ref"`
+	Header string `json:"header,omitempty"`
+	Scheme string `json:"scheme,omitempty"`
+}
+
+type rollbackRequest struct {
+	Version int `json:"version" binding:"required"`
+}
+
+// RouteHandler は上流へのルートと、ルートが参照するポリシーと認証情報を管理する
+//
+// ルートの変更は版として記録してロールバックでき、全ての変更は invalidator で全てのレプリカに通知する。
+// 変更はすべて運用者名を付けて監査ログに記録する。
+type RouteHandler struct {
+	routeRepository  repository.RouteRepository
+	invalidator      routing.Invalidator
+	isStatic         func(name string) bool
+	credentialPolicy routing.CredentialPolicy
+}
+
+func NewRouteHandler(routeRepository repository.RouteRepository, invalidator routing.Invalidator) *RouteHandler {
+	return &RouteHandler{
+		routeRepository: routeRepository,
+		invalidator:     invalidator,
+		isStatic:        func(name string) bool { return name == httpclient.DefaultRoute },
+	}
+}
+
+// WithStaticRoutes は設定ファイルで定義したルートかを返す関数を設定する。設定ファイルのルートと同じ名前では登録できない
+func (h *RouteHandler) WithStaticRoutes(isStatic func(name string) bool) *RouteHandler {
+	h.isStatic = isStatic
+	return h
+}
+
+// WithCredentialPolicy は認証情報の参照先として許可する環境変数とファイルを設定する。設定しない場合は認証情報を登録できない
+func (h *RouteHandler) WithCredentialPolicy(policy routing.CredentialPolicy) *RouteHandler {
+	h.credentialPolicy = policy
+	return h
+}
+
+func (h *RouteHandler) HandleListRoutes(c *gin.Context) {
+	routes, err := h.routeRepository.ListRoutes()
+	if err != nil {
+		h.fail(c, err, "")
+		return
+	}
+	bodies := make([]routeBody, len(routes))
+	for i, route := range routes {
+		bodies[i] = newRouteBody(route)
+	}
+	c.JSON(http.StatusOK, gin.H{"routes": bodies})
+}
+
+func (h *RouteHandler) HandleGetRoute(c *gin.Context) {
+	route, err := h.routeRepository.GetRoute(c.Param("name"))
+	if err != nil {
+		h.fail(c, err, "Route not found")
+		return
+	}
+	c.JSON(http.StatusOK, newRouteBody(*route))
+}
+
+// HandlePutRoute はルートを作成または更新し、新しい版として記録する
+func (h *RouteHandler) HandlePutRoute(c *gin.Context) {
+	name := c.Param("name")
+	if !h.validName(c, name) {
+		return
+	}
+	if h.isStatic(name) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Route is defined in the config file"})
+		return
+	}
+
+	var req routeBody
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if u, err := url.Parse(req.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "url must be an absolute http or https URL"})
+		return
+	}
+	if !h.referencesExist(c, req.Policy, req.Credential) {
+		return
+	}
+
+	route := &repository.Route{
+		Name:           name,
+		URL:            req.URL,
+		PolicyName:     req.Policy,
+		CredentialName: req.Credential,
+	}
+	if err := h.routeRepository.SaveRoute(route, c.GetString(operatorKey)); err != nil {
+		h.fail(c, err, "")
+		return
+	}
+
+	auditLogger(c).WithFields(logrus.Fields{
+		"action":  "route.save",
+		"route":   name,
+		"version": route.Version,
+	}).Info("Saved route")
+	h.invalidate(c, name)
+	c.JSON(http.StatusOK, newRouteBody(*route))
+}
+
+func (h *RouteHandler) HandleDeleteRoute(c *gin.Context) {
+	name := c.Param("name")
+	if err := h.routeRepository.DeleteRoute(name, c.GetString(operatorKey)); err != nil {
+		h.fail(c, err, "Route not found")
+		return
+	}
+
+	auditLogger(c).WithFields(logrus.Fields{
+		"action": "route.delete",
+		"route":  name,
+	}).Info("Deleted route")
+	h.invalidate(c, name)
+	c.Status(http.StatusNoContent)
+}
+
+func (h *RouteHandler) HandleListRouteVersions(c *gin.Context) {
+	versions, err := h.routeRepository.ListRouteVersions(c.Param("name"))
+	if err != nil {
+		h.fail(c, err, "")
+		return
+	}
+	if len(versions) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Route not found"})
+		return
+	}
+	bodies := make([]routeVersionBody, len(versions))
+	for i, version := range versions {
+		bodies[i] = newRouteVersionBody(version)
+	}
+	c.JSON(http.StatusOK, gin.H{"versions": bodies})
+}
+
+// HandleRollbackRoute はルートを指定した版の内容に戻す。戻した内容は新しい版として記録する
+func (h *RouteHandler) HandleRollbackRoute(c *gin.Context) {
+	name := c.Param("name")
+	var req rollbackRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "version is required"})
+		return
+	}
+
+	versions, err := h.routeRepository.ListRouteVersions(name)
+	if err != nil {
+		h.fail(c, err, "")
+		return
+	}
+	var target *repository.RouteVersion
+	for i := range versions {
+		if versions[i].Version == req.Version {
+			target = &versions[i]
+		}
+	}
+	if target == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Route version not found"})
+		return
+	}
+	// 版を記録した後に削除されたポリシーや認証情報は参照できない
+	if !target.Deleted && !h.referencesExist(c, target.PolicyName, target.CredentialName) {
+		return
+	}
+
+	rolledBack, err := h.routeRepository.RollbackRoute(name, req.Version, c.GetString(operatorKey))
+	if err != nil {
+		h.fail(c, err, "Route not found")
+		return
+	}
+
+	auditLogger(c).WithFields(logrus.Fields{
+		"action":  "route.rollback",
+		"route":   name,
+		"from":    req.Version,
+		"version": rolledBack.Version,
+	}).Info("Rolled back route")
+	h.invalidate(c, name)
+	c.JSON(http.StatusOK, newRouteVersionBody(*rolledBack))
+}
+
+func (h *RouteHandler) HandleListPolicies(c *gin.Context) {
+	policies, err := h.routeRepository.ListPolicies()
+	if err != nil {
+		h.fail(c, err, "")
+		return
+	}
+	bodies := make([]policyBody, len(policies))
+	for i, policy := range policies {
+		bodies[i] = newPolicyBody(policy)
+	}
+	c.JSON(http.StatusOK, gin.H{"policies": bodies})
+}
+
+func (h *RouteHandler) HandleGetPolicy(c *gin.Context) {
+	policy, err := h.routeRepository.GetPolicy(c.Param("name"))
+	if err != nil {
+		h.fail(c, err, "Policy not found")
+		return
+	}
+	c.JSON(http.StatusOK, newPolicyBody(*policy))
+}
+
+func (h *RouteHandler) HandlePutPolicy(c *gin.Context) {
+	name := c.Param("name")
+	if !h.validName(c, name) {
+		return
+	}
+
+	var req policyBody
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if req.MaxRetries < 0 || req.RateLimit < 0 || req.Burst < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "max_retries, rate_limit and burst must not be negative"})
+		return
+	}
+	interval, err := parsePolicyDuration(req.Breaker.Interval)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "breaker.interval: " + err.Error()})
+		return
+	}
+	timeout, err := parsePolicyDuration(req.Breaker.Timeout)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "breaker.timeout: " + err.Error()})
+		return
+	}
+	overflowLatency, err := parsePolicyDuration(req.SyncOverflowLatency)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "sync_overflow_latency: " + err.Error()})
+		return
+	}
+
+	policy := &repository.RoutePolicy{
+		Name:                    name,
+		MaxRetries:              req.MaxRetries,
+		RateLimit:               req.RateLimit,
+		Burst:                   req.Burst,
+		BreakerMaxRequests:      req.Breaker.MaxRequests,
+		BreakerInterval:         interval,
+		BreakerTimeout:          timeout,
+		BreakerFailureThreshold: req.Breaker.FailureThreshold,
+		SyncOverflow:            req.SyncOverflow,
+		SyncOverflowLatency:     overflowLatency,
+	}
+	if err := h.routeRepository.SavePolicy(policy); err != nil {
+		h.fail(c, err, "")
+		return
+	}
+
+	auditLogger(c).WithFields(logrus.Fields{
+		"action": "policy.save",
+		"policy": name,
+	}).Info("Saved route policy")
+	h.invalidate(c, name)
+	c.JSON(http.StatusOK, newPolicyBody(*policy))
+}
+
+func (h *RouteHandler) HandleDeletePolicy(c *gin.Context) {
+	name := c.Param("name")
+	if err := h.routeRepository.DeletePolicy(name); err != nil {
+		h.fail(c, err, "Policy not found")
+		return
+	}
+
+	auditLogger(c).WithFields(logrus.Fields{
+		"action": "policy.delete",
+		"policy": name,
+	}).Info("Deleted route policy")
+	c.Status(http.StatusNoContent)
+}
+
+func (h *RouteHandler) HandleListCredentials(c *gin.Context) {
+	credentials, err := h.routeRepository.ListCredentials()
+	if err != nil {
+		h.fail(c, err, "")
+		return
+	}
+	bodies := make([]credentialBody, len(credentials))
+	for i, credential := range credentials {
+		bodies[i] = newCredentialBody(credential)
+	}
+	c.JSON(http.StatusOK, gin.H{"credentials": bodies})
+}
+
+func (h *RouteHandler) HandleGetCredential(c *gin.Context) {
+	credential, err := h.routeRepository.GetCredential(c.Param("name"))
+	if err != nil {
+		h.fail(c, err, "Credential not found")
+		return
+	}
+	c.JSON(http.StatusOK, newCredentialBody(*credential))
+}
+
+// HandlePutCredential は認証情報の参照先を登録する。秘密の値そのものは受け付けない
+func (h *RouteHandler) HandlePutCredential(c *gin.Context) {
+	name := c.Param("name")
+	if !h.validName(c, name) {
+		return
+	}
+
+	var req credentialBody
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if req.Source != repository.CredentialSourceEnv && req.Source != repository.CredentialSourceFile {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("source must be %s or %s", repository.CredentialSourceEnv, repository.CredentialSourceFile)})
+		return
+	}
+	if req.Ref == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ref is required"})
+		return
+	}
+	if err := h.credentialPolicy.Check(req.Source, req.Ref); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("ref is not allowed: %v", err)})
+		return
+	}
+	if req.Header == "" {
+		req.Header = "Authorization"
+	}
+
+	credential := &repository.RouteCredential{
+		Name:   name,
+		Source: req.Source,
+		Ref:    req.Ref,
+		Header: req.Header,
+		Scheme: req.Scheme,
+	}
+	if err := h.routeRepository.SaveCredential(credential); err != nil {
+		h.fail(c, err, "")
+		return
+	}
+
+	auditLogger(c).WithFields(logrus.Fields{
+		"action":     "credential.save",
+		"credential": name,
+	}).Info("Saved route credential")
+	h.invalidate(c, name)
+	c.JSON(http.StatusOK, newCredentialBody(*credential))
+}
+
+func (h *RouteHandler) HandleDeleteCredential(c *gin.Context) {
+	name := c.Param("name")
+	if err := h.routeRepository.DeleteCredential(name); err != nil {
+		h.fail(c, err, "Credential not found")
+		return
+	}
+
+	auditLogger(c).WithFields(logrus.Fields{
+		"action":     "credential.delete",
+		"credential": name,
+	}).Info("Deleted route credential")
+	c.Status(http.StatusNoContent)
+}
+
+func (h *RouteHandler) validName(c *gin.Context, name string) bool {
+	if !httpclient.RouteNamePattern.MatchString(name) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("name must match %s", httpclient.RouteNamePattern)})
+		return false
+	}
+	return true
+}
+
+// referencesExist はルートが参照するポリシーと認証情報が登録されているかを確認する
+func (h *RouteHandler) referencesExist(c *gin.Context, policyName, credentialName string) bool {
+	if policyName != "" {
+		if _, err := h.routeRepository.GetPolicy(policyName); err != nil {
+			h.fail(c, err, fmt.Sprintf("Policy %q not found", policyName))
+			return false
+		}
+	}
+	if credentialName != "" {
+		if _, err := h.routeRepository.GetCredential(credentialName); err != nil {
+			h.fail(c, err, fmt.Sprintf("Credential %q not found", credentialName))
+			return false
+		}
+	}
+	return true
+}
+
+// invalidate は変更を全てのレプリカに通知する。通知できなくてもレプリカは定期的な読み込みで反映する
+func (h *RouteHandler) invalidate(c *gin.Context, name string) {
+	if err := h.invalidator.Publish(name); err != nil {
+		requestLogger(c).WithFields(logrus.Fields{
+			"error": err,
+		}).Warn("Failed to publish route invalidation")
+	}
+}
+
+// fail はリポジトリのエラーを応答する。見つからない場合は notFound を、参照されている場合は 409 を返す
+func (h *RouteHandler) fail(c *gin.Context, err error, notFound string) {
+	switch {
+	case notFound != "" && errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": notFound})
+	case errors.Is(err, repository.ErrInUse):
+		c.JSON(http.StatusConflict, gin.H{"error": "Referenced by a route"})
+	default:
+		requestLogger(c).WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Failed to access routes in db")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to access routes in db"})
+	}
+}
+
+func parsePolicyDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("must be a non-negative duration such as \"10s\"")
+	}
+	return d, nil
+}
+
+func formatPolicyDuration(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+	return d.String()
+}
+
+func newRouteBody(route repository.Route) routeBody {
+	body := routeBody{
+		Name:       route.Name,
+		URL:        route.URL,
+		Policy:     route.PolicyName,
+		Credential: route.CredentialName,
+		Version:    route.Version,
+		UpdatedBy:  route.UpdatedBy,
+	}
+	if !route.UpdatedAt.IsZero() {
+		body.UpdatedAt = &route.UpdatedAt
+	}
+	return body
+}
+
+func newRouteVersionBody(version repository.RouteVersion) routeVersionBody {
+	return routeVersionBody{
+		Version:    version.Version,
+		URL:        version.URL,
+		Policy:     version.PolicyName,
+		Credential: version.CredentialName,
+		Deleted:    version.Deleted,
+		CreatedBy:  version.CreatedBy,
+		CreatedAt:  version.CreatedAt,
+	}
+}
+
+func newPolicyBody(policy repository.RoutePolicy) policyBody {
+	return policyBody{
+		Name:       policy.Name,
+		MaxRetries: policy.MaxRetries,
+		RateLimit:  policy.RateLimit,
+		Burst:      policy.Burst,
+		Breaker: breakerPolicyBody{
+			MaxRequests:      policy.BreakerMaxRequests,
+			Interval:         formatPolicyDuration(policy.BreakerInterval),
+			Timeout:          formatPolicyDuration(policy.BreakerTimeout),
+			FailureThreshold: policy.BreakerFailureThreshold,
+		},
+		SyncOverflow:        policy.SyncOverflow,
+		SyncOverflowLatency: formatPolicyDuration(policy.SyncOverflowLatency),
+	}
+}
+
+func newCredentialBody(credential repository.RouteCredential) credentialBody {
+	return credentialBody{
+		Name:   credential.Name,
+		Source: credential.Source,
+		Ref:    credential.Ref,
+		Header: credential.Header,
+		Scheme: credential.Scheme,
+	}
+}
@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"reliproxy/pkg/repository"
+	"reliproxy/pkg/routing"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setupRouteRouter(routeRepository repository.RouteRepository, invalidator routing.Invalidator) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	handler := NewRouteHandler(routeRepository, invalidator).
+		WithCredentialPolicy(routing.CredentialPolicy{EnvPrefix: "RELIPROXY_CREDENTIAL_", Dir: "/etc/reliproxy/credentials"})
+
+	router := gin.New()
+	admin := router.Group("/admin", NewAdminAuthMiddleware(map[string]string{"secret-token": "alice"}).Handle)
+	admin.GET("/routes/:name", handler.HandleGetRoute)
+	admin.PUT("/routes/:name", handler.HandlePutRoute)
+	admin.DELETE("/routes/:name", handler.HandleDeleteRoute)
+	admin.GET("/routes/:name/versions", handler.HandleListRouteVersions)
+	admin.POST("/routes/:name/rollback", handler.HandleRollbackRoute)
+	admin.PUT("/policies/:name", handler.HandlePutPolicy)
+	admin.DELETE("/policies/:name", handler.HandleDeletePolicy)
+	admin.PUT("/credentials/:name", handler.HandlePutCredential)
+	return router
+}
+
+type recordingInvalidator struct {
+	routing.Invalidator
+	published []string
+}
+
+func (i *recordingInvalidator) Publish(name string) error {
+	i.published = append(i.published, name)
+	return nil
+}
+
+func TestRouteHandler_VersionsAndRollback(t *testing.T) {
+	routeRepository := repository.NewMemoryRouteRepository()
+	invalidator := &recordingInvalidator{}
+	router := setupRouteRouter(routeRepository, invalidator)
+
+	w := adminRequest(router, "PUT", "/admin/policies/slow", `{"max_retries": 1, "breaker": {"timeout": "1m"}}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.JSONEq(t, `{"name":"slow","max_retries":1,"breaker":{"timeout":"1m0s"}}`, w.Body.String())
+
+	// 登録されていないポリシーは参照できない
+	w = adminRequest(router, "PUT", "/admin/routes/partner", `{"url": "https://partner.example.com", "policy": "fast"}`)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.JSONEq(t, `{"error":"Policy \"fast\" not found"}`, w.Body.String())
+
+	w = adminRequest(router, "PUT", "/admin/routes/partner", `{"url": "https://partner.example.com", "policy": "slow"}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = adminRequest(router, "PUT", "/admin/routes/partner", `{"url": "https://partner-v2.example.com"}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var route routeBody
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &route))
+	assert.Equal(t, 2, route.Version)
+	assert.Equal(t, "alice", route.UpdatedBy)
+
+	w = adminRequest(router, "POST", "/admin/routes/partner/rollback", `{"version": 1}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	// ロールバックは戻した内容を新しい版として記録する
+	restored, err := routeRepository.GetRoute("partner")
+	require.NoError(t, err)
+	assert.Equal(t, 3, restored.Version)
+	assert.Equal(t, "https://partner.example.com", restored.URL)
+	assert.Equal(t, "slow", restored.PolicyName)
+
+	w = adminRequest(router, "POST", "/admin/routes/partner/rollback", `{"version": 9}`)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// ルートが参照しているポリシーは削除できない
+	w = adminRequest(router, "DELETE", "/admin/policies/slow", "")
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	w = adminRequest(router, "DELETE", "/admin/routes/partner", "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = adminRequest(router, "GET", "/admin/routes/partner", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = adminRequest(router, "GET", "/admin/routes/partner/versions", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var versions struct {
+		Versions []routeVersionBody `json:"versions"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &versions))
+	require.Len(t, versions.Versions, 4)
+	assert.True(t, versions.Versions[3].Deleted)
+
+	assert.Equal(t, []string{"slow", "partner", "partner", "partner", "partner"}, invalidator.published)
+}
+
+func TestRouteHandler_Validation(t *testing.T) {
+	router := setupRouteRouter(repository.NewMemoryRouteRepository(), &recordingInvalidator{})
+
+	tests := []struct {
+		path string
+		body string
+		code int
+	}{
+		{"/admin/routes/default", `{"url": "https://a.example.com"}`, http.StatusConflict},
+		{"/admin/routes/Partner", `{"url": "https://a.example.com"}`, http.StatusBadRequest},
+		{"/admin/routes/partner", `{"url": "a.example.com"}`, http.StatusBadRequest},
+		{"/admin/policies/slow", `{"burst": -1}`, http.StatusBadRequest},
+		{"/admin/policies/slow", `{"breaker": {"interval": "soon"}}`, http.StatusBadRequest},
+		{"/admin/credentials/partner", `{"source": "vault", "ref": "secret/partner"}`, http.StatusBadRequest},
+		{"/admin/credentials/partner", `{"source": "env"}`, http.StatusBadRequest},
+		// プロセスの他の秘密を参照先に指定できない
+		{"/admin/credentials/partner", `{"source": "env", "ref": "MYSQL_PASSWORD"}`, http.StatusBadRequest},
+		{"/admin/credentials/partner", `{"source": "file", "ref": "/etc/passwd"}`, http.StatusBadRequest},
+		{"/admin/credentials/partner", `{"source": "file", "ref": "../../passwd"}`, http.StatusBadRequest},
+		{"/admin/credentials/partner", `{"source": "env", "ref": "RELIPROXY_CREDENTIAL_PARTNER"}`, http.StatusOK},
+		{"/admin/credentials/partner", `{"source": "file", "ref": "partner"}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		w := adminRequest(router, "PUT", tt.path, tt.body)
+		assert.Equal(t, tt.code, w.Code, tt.path+" "+tt.body)
+	}
+}
@@ -0,0 +1,276 @@
+package handlers_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reliproxy/pkg/cancellation"
+	"reliproxy/pkg/events"
+	"reliproxy/pkg/handlers"
+	"reliproxy/pkg/httpclient"
+	"reliproxy/pkg/queue"
+	"reliproxy/pkg/repository"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sony/gobreaker"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"golang.org/x/time/rate"
+)
+
+func TestOverflowSyncWriteHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	type accepted struct {
+		RequestID string `json:"request_id"`
+		Status    string `json:"status"`
+		StatusURL string `json:"status_url"`
+	}
+	newRouter := func(client httpclient.HttpClient, latencyThreshold time.Duration) (*gin.Engine, *queue.MemoryQueue, *repository.MemoryRequestStatusRepository) {
+		memoryQueue := queue.NewMemoryQueue()
+		repo := repository.NewMemoryRequestStatusRepository()
+		asyncHandler := handlers.NewAsyncWriteHandler(memoryQueue, repo)
+		handler := handlers.NewOverflowSyncWriteHandler(client, asyncHandler, repo, latencyThreshold)
+
+		router := gin.Default()
+		router.POST("/proxy", handler.HandleRequest)
+		router.POST("/proxy/:route", handler.HandleRequest)
+		return router, memoryQueue, repo
+	}
+	postTo := func(router *gin.Engine, path string) (*httptest.ResponseRecorder, accepted) {
+		req, _ := http.NewRequest("POST", path, bytes.NewBufferString(`{"data": "test"}`))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		var response accepted
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w, response
+	}
+	post := func(router *gin.Engine) (*httptest.ResponseRecorder, accepted) {
+		return postTo(router, "/proxy")
+	}
+
+	t.Run("rate limited request is enqueued", func(t *testing.T) {
+		circuitBreaker := gobreaker.NewCircuitBreaker(gobreaker.Settings{Name: "overflow"})
+		rateLimiter := rate.NewLimiter(1, 1)
+		rateLimiter.Allow()
+		mockClient := new(httpclient.MockClient)
+		router, memoryQueue, _ := newRouter(httpclient.NewReliClient(mockClient, circuitBreaker, rateLimiter, 1), 0)
+
+		w, response := post(router)
+		assert.Equal(t, http.StatusAccepted, w.Code)
+		assert.Equal(t, repository.StatusQueued, response.Status)
+		assert.Equal(t, "/requests/"+response.RequestID, response.StatusURL)
+
+		requestID, requestData, err := memoryQueue.TryDequeue()
+		assert.NoError(t, err)
+		assert.Equal(t, response.RequestID, requestID)
+		job, _ := queue.DecodeJob(requestData)
+		// 同期で送る場合と同じメソッドと本文でワーカーが送る
+		assert.Equal(t, http.MethodPost, job.Method)
+		assert.Equal(t, `{"data": "test"}`, job.Body)
+		assert.Empty(t, job.Route)
+		mockClient.AssertNotCalled(t, "Get", "https://api.thirdparty.com/data")
+	})
+
+	t.Run("rate limited request is enqueued without retrying", func(t *testing.T) {
+		circuitBreaker := gobreaker.NewCircuitBreaker(gobreaker.Settings{Name: "overflow"})
+		rateLimiter := rate.NewLimiter(1, 1)
+		rateLimiter.Allow()
+		router, memoryQueue, _ := newRouter(httpclient.NewReliClient(new(httpclient.MockClient), circuitBreaker, rateLimiter, 3), 0)
+
+		// 再試行の待機を使い切る前にキューへ切り替える
+		start := time.Now()
+		w, _ := post(router)
+		assert.Equal(t, http.StatusAccepted, w.Code)
+		assert.Less(t, time.Since(start), time.Second)
+		length, _ := memoryQueue.Len()
+		assert.Equal(t, int64(1), length)
+	})
+
+	t.Run("enqueued request keeps the route", func(t *testing.T) {
+		circuitBreaker := gobreaker.NewCircuitBreaker(gobreaker.Settings{Name: "overflow"})
+		rateLimiter := rate.NewLimiter(1, 1)
+		rateLimiter.Allow()
+		router, memoryQueue, _ := newRouter(httpclient.NewReliClient(new(httpclient.MockClient), circuitBreaker, rateLimiter, 1), 0)
+
+		w, _ := postTo(router, "/proxy/partner")
+		assert.Equal(t, http.StatusAccepted, w.Code)
+
+		// ワーカーが同じルートへ送れるようにルート名を保存する
+		_, requestData, err := memoryQueue.TryDequeue()
+		assert.NoError(t, err)
+		job, _ := queue.DecodeJob(requestData)
+		assert.Equal(t, "partner", job.Route)
+	})
+
+	t.Run("request is enqueued while circuit breaker is open", func(t *testing.T) {
+		circuitBreaker := gobreaker.NewCircuitBreaker(gobreaker.Settings{
+			Name:        "overflow",
+			ReadyToTrip: func(counts gobreaker.Counts) bool { return counts.TotalFailures > 0 },
+		})
+		circuitBreaker.Execute(func() (interface{}, error) { return nil, errors.New("upstream error") })
+		assert.Equal(t, gobreaker.StateOpen, circuitBreaker.State())
+
+		mockClient := new(httpclient.MockClient)
+		router, _, _ := newRouter(httpclient.NewReliClient(mockClient, circuitBreaker, rate.NewLimiter(1000, 1000), 1), 0)
+
+		w, response := post(router)
+		assert.Equal(t, http.StatusAccepted, w.Code)
+		assert.Equal(t, repository.StatusQueued, response.Status)
+	})
+
+	t.Run("upstream error is not enqueued", func(t *testing.T) {
+		mockClient := new(httpclient.MockClient)
+		mockClient.On("GetWithContext", mock.Anything, "https://api.thirdparty.com/data").Return(nil, errors.New("client error"))
+		router, memoryQueue, _ := newRouter(mockClient, 0)
+
+		w, _ := post(router)
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		length, _ := memoryQueue.Len()
+		assert.Equal(t, int64(0), length)
+	})
+
+	t.Run("slow request is completed in background", func(t *testing.T) {
+		release := make(chan struct{})
+		mockClient := new(httpclient.MockClient)
+		mockClient.On("GetWithContext", mock.Anything, "https://api.thirdparty.com/data").
+			Run(func(args mock.Arguments) { <-release }).
+			Return(&http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("ok"))}, nil)
+		repo := repository.NewMemoryRequestStatusRepository()
+		broker := events.NewMemoryBroker()
+		handler := handlers.NewOverflowSyncWriteHandler(mockClient, handlers.NewAsyncWriteHandler(queue.NewMemoryQueue(), repo), repo, 10*time.Millisecond).
+			WithEvents(broker)
+		router := gin.Default()
+		router.POST("/proxy", handler.HandleRequest)
+
+		w, response := post(router)
+		assert.Equal(t, http.StatusAccepted, w.Code)
+		assert.Equal(t, repository.StatusRunning, response.Status)
+
+		watched, stop := broker.Watch(response.RequestID)
+		defer stop()
+		close(release)
+		select {
+		case event := <-watched:
+			assert.Equal(t, repository.StatusProcessed, event.Status)
+		case <-time.After(time.Second):
+			t.Fatal("status event was not published")
+		}
+
+		// 応答の本文はステータスから取り出せる
+		requestStatus, err := repo.GetByID(response.RequestID)
+		assert.NoError(t, err)
+		assert.Equal(t, repository.StatusProcessed, requestStatus.Status)
+		assert.Equal(t, "ok", requestStatus.Response)
+	})
+
+	t.Run("slow request is cancelled after hand off", func(t *testing.T) {
+		cancelled := make(chan struct{})
+		mockClient := new(httpclient.MockClient)
+		mockClient.On("GetWithContext", mock.Anything, "https://api.thirdparty.com/data").
+			Run(func(args mock.Arguments) {
+				<-args.Get(0).(context.Context).Done()
+				close(cancelled)
+			}).
+			Return(nil, context.Canceled)
+		repo := repository.NewMemoryRequestStatusRepository()
+		notifier := cancellation.NewMemoryNotifier()
+		handler := handlers.NewOverflowSyncWriteHandler(mockClient, handlers.NewAsyncWriteHandler(queue.NewMemoryQueue(), repo), repo, 10*time.Millisecond).
+			WithCancellation(notifier)
+		go handler.Start()
+		statusHandler := handlers.NewRequestStatusHandler(repo, queue.NewDelayedQueue(queue.NewMemoryQueue(), queue.NewMemorySchedule()), notifier, nil, nil)
+		router := gin.Default()
+		router.POST("/proxy", handler.HandleRequest)
+		router.DELETE("/requests/:id", statusHandler.HandleCancel)
+
+		w, response := post(router)
+		assert.Equal(t, http.StatusAccepted, w.Code)
+
+		req, _ := http.NewRequest("DELETE", "/requests/"+response.RequestID, nil)
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		// 購読を始める前に通知した場合に備えて、中断されるまで通知し直す
+		assert.Eventually(t, func() bool {
+			notifier.Publish(response.RequestID)
+			select {
+			case <-cancelled:
+				return true
+			default:
+				return false
+			}
+		}, time.Second, 10*time.Millisecond)
+
+		requestStatus, err := repo.GetByID(response.RequestID)
+		assert.NoError(t, err)
+		assert.Equal(t, repository.StatusCancelled, requestStatus.Status)
+	})
+
+	t.Run("fast request is answered synchronously", func(t *testing.T) {
+		mockClient := new(httpclient.MockClient)
+		mockClient.On("GetWithContext", mock.Anything, "https://api.thirdparty.com/data").
+			Return(&http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("ok"))}, nil)
+		router, _, _ := newRouter(mockClient, time.Second)
+
+		w, _ := post(router)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, `{"data": "ok"}`, w.Body.String())
+	})
+}
+
+func TestOverflowSyncWriteHandler_RouteSettings(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	spec := func(name string, overflow bool) httpclient.RouteSpec {
+		return httpclient.RouteSpec{
+			Name:         name,
+			URL:          "https://" + name + ".example.com/data",
+			MaxRetries:   1,
+			RateLimit:    1,
+			Burst:        1,
+			Breaker:      httpclient.BreakerSpec{Name: name, MaxRequests: 1, Timeout: time.Minute},
+			SyncOverflow: overflow,
+		}
+	}
+	table := httpclient.NewRouteTable([]httpclient.RouteSpec{
+		spec(httpclient.DefaultRoute, false),
+		spec("partner", true),
+	}, nil, new(httpclient.MockClient), nil)
+	// どちらのルートもレート制限を超えた状態にする
+	for _, name := range []string{httpclient.DefaultRoute, "partner"} {
+		route, _ := table.Route(name)
+		route.Limiter.Allow()
+	}
+
+	memoryQueue := queue.NewMemoryQueue()
+	repo := repository.NewMemoryRequestStatusRepository()
+	handler := handlers.NewOverflowSyncWriteHandler(nil, handlers.NewAsyncWriteHandler(memoryQueue, repo), repo, 0).
+		WithRouter(httpclient.NewRouter(table))
+
+	router := gin.Default()
+	router.POST("/proxy", handler.HandleRequest)
+	router.POST("/proxy/:route", handler.HandleRequest)
+
+	// sync_overflow を設定していないルートは非同期に切り替えない
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/proxy", bytes.NewBufferString(`{"data": "test"}`))
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/proxy/partner", bytes.NewBufferString(`{"data": "test"}`))
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+
+	length, _ := memoryQueue.Len()
+	assert.Equal(t, int64(1), length)
+}
@@ -1,29 +1,330 @@
 package handlers
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"io"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
+	"github.com/sony/gobreaker"
 
+	"reliproxy/pkg/cancellation"
+	"reliproxy/pkg/events"
 	"reliproxy/pkg/httpclient"
+	"reliproxy/pkg/repository"
 	"reliproxy/pkg/utils"
 )
 
+// DefaultUpstreamURL は上流の URL が設定されていない場合にリクエストを送る URL
+const DefaultUpstreamURL = "https://api.thirdparty.com/data"
+
 type SyncWriteHandler struct {
-	client httpclient.HttpClient
+	client      httpclient.HttpClient
+	upstreamURL string
+	router      *httpclient.Router
+
+	overflow         *AsyncWriteHandler
+	statusRepository repository.RequestStatusRepository
+	latencyThreshold time.Duration
+	events           events.Publisher
+	notifier         cancellation.Notifier
+
+	// 応答を待たずに切り替えて実行中のリクエスト。取り消しの通知で中断する
+	mu      sync.Mutex
+	running map[string]context.CancelFunc
 }
 
 func NewSyncWriteHandler(client httpclient.HttpClient) *SyncWriteHandler {
 	return &SyncWriteHandler{
-		client: client,
+		client:      client,
+		upstreamURL: DefaultUpstreamURL,
+	}
+}
+
+// NewOverflowSyncWriteHandler は上流が混雑している場合に失敗させず非同期に切り替えるハンドラを返す
+//
+// レート制限やサーキットブレーカーで拒否されたリクエストは overflow でキューに追加し、
+// latencyThreshold を超えたリクエストは応答を待たずに 202 を返して結果をステータスに記録する。
+// latencyThreshold が 0 の場合は応答を待ち続ける。WithRouter を設定した場合は切り替えるかと
+// latencyThreshold をルートの設定に従って決める。
+func NewOverflowSyncWriteHandler(client httpclient.HttpClient, overflow *AsyncWriteHandler, statusRepository repository.RequestStatusRepository, latencyThreshold time.Duration) *SyncWriteHandler {
+	return &SyncWriteHandler{
+		client:           client,
+		upstreamURL:      DefaultUpstreamURL,
+		overflow:         overflow,
+		statusRepository: statusRepository,
+		latencyThreshold: latencyThreshold,
+		running:          make(map[string]context.CancelFunc),
+	}
+}
+
+// WithUpstreamURL はリクエストを送る上流の URL を設定する
+func (h *SyncWriteHandler) WithUpstreamURL(upstreamURL string) *SyncWriteHandler {
+	h.upstreamURL = upstreamURL
+	return h
+}
+
+// WithRouter はリクエストごとに現在のルートテーブルから上流の URL とクライアントを選ぶ
+//
+// :route パラメータのルートを使い、指定がなければデフォルトのルートを使う。
+// 設定の再読み込みで差し替わる前に始まったリクエストは差し替え前のルートで完了させる。
+func (h *SyncWriteHandler) WithRouter(router *httpclient.Router) *SyncWriteHandler {
+	h.router = router
+	return h
+}
+
+// WithEvents は応答を待たずに切り替えたリクエストが完了したときにステータスの遷移を発行する
+//
+// 設定しない場合、完了を待ち受けるクライアントはステータスを読み直すまで完了に気付かない。
+func (h *SyncWriteHandler) WithEvents(publisher events.Publisher) *SyncWriteHandler {
+	h.events = publisher
+	return h
+}
+
+// WithCancellation は応答を待たずに切り替えたリクエストを、通知された取り消しで中断する
+//
+// 通知を受け取るには Start を呼ぶ。
+func (h *SyncWriteHandler) WithCancellation(notifier cancellation.Notifier) *SyncWriteHandler {
+	h.notifier = notifier
+	return h
+}
+
+// Start は取り消しの通知を購読する。WithCancellation を設定していなければ何もしない
+func (h *SyncWriteHandler) Start() {
+	if h.notifier == nil {
+		return
+	}
+	for {
+		err := h.notifier.Subscribe(context.Background(), h.cancelRunning)
+		utils.Logger.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Cancellation subscription stopped")
+		time.Sleep(1 * time.Second)
+	}
+}
+
+// cancelRunning はこのプロセスで実行中のリクエストであれば中断する
+func (h *SyncWriteHandler) cancelRunning(requestID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if cancel, ok := h.running[requestID]; ok {
+		cancel()
 	}
 }
 
+func (h *SyncWriteHandler) track(requestID string, cancel context.CancelFunc) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.running[requestID] = cancel
+}
+
+func (h *SyncWriteHandler) untrack(requestID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if cancel, ok := h.running[requestID]; ok {
+		cancel()
+		delete(h.running, requestID)
+	}
+}
+
+// upstreamTarget はリクエストを送る上流と、混雑している場合に非同期へ切り替えるかの設定
+type upstreamTarget struct {
+	client           httpclient.HttpClient
+	url              string
+	overflow         bool
+	latencyThreshold time.Duration
+}
+
+// upstream はリクエストを送る上流を返す。release はリクエストが完了したら呼ぶ
+func (h *SyncWriteHandler) upstream(c *gin.Context) (target upstreamTarget, release func(), ok bool) {
+	if h.router == nil {
+		return upstreamTarget{
+			client:           h.client,
+			url:              h.upstreamURL,
+			overflow:         h.overflow != nil,
+			latencyThreshold: h.latencyThreshold,
+		}, func() {}, true
+	}
+
+	name := c.Param("route")
+	if name == "" {
+		name = httpclient.DefaultRoute
+	}
+	table, release := h.router.Acquire()
+	route, ok := table.Route(name)
+	if !ok {
+		release()
+		return upstreamTarget{}, nil, false
+	}
+	return upstreamTarget{
+		client:           route.Client,
+		url:              route.Spec.URL,
+		overflow:         h.overflow != nil && route.Spec.SyncOverflow,
+		latencyThreshold: route.Spec.SyncOverflowLatency,
+	}, release, true
+}
+
+type upstreamResult struct {
+	resp *http.Response
+	err  error
+}
+
 func (h *SyncWriteHandler) HandleRequest(c *gin.Context) {
-	resp, err := h.client.Get("https://api.thirdparty.com/data")
+	target, release, ok := h.upstream(c)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Route not found"})
+		return
+	}
+	var body []byte
+	if c.Request.Body != nil {
+		var err error
+		if body, err = io.ReadAll(c.Request.Body); err != nil {
+			release()
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
+			return
+		}
+	}
+	// 非同期に切り替えた場合と同じく、受け付けたリクエストのメソッドと本文で上流へ送る
+	ctx := httpclient.WithRequest(c.Request.Context(), httpclient.Request{
+		Method:      c.Request.Method,
+		ContentType: c.GetHeader("Content-Type"),
+		Body:        body,
+	})
+	if !target.overflow {
+		defer release()
+		resp, err := target.client.GetWithContext(ctx, target.url)
+		h.respond(c, resp, err)
+		return
+	}
 
+	parent := ctx
+	if target.latencyThreshold > 0 {
+		// 応答を待たずに切り替えた場合も完了させるため、このリクエストのスパンの子のまま
+		// クライアントの切断では中断せず、切り替えた後の取り消しでだけ中断する
+		parent = context.WithoutCancel(ctx)
+	}
+	ctx, cancel := context.WithCancel(parent)
+	// 混雑による拒否は再試行を待たずにキューへ切り替える
+	ctx = httpclient.WithFailFast(ctx)
+	done := make(chan upstreamResult, 1)
+	go func() {
+		defer release()
+		resp, err := target.client.GetWithContext(ctx, target.url)
+		done <- upstreamResult{resp, err}
+	}()
+
+	var slow <-chan time.Time
+	if target.latencyThreshold > 0 {
+		timer := time.NewTimer(target.latencyThreshold)
+		defer timer.Stop()
+		slow = timer.C
+	}
+
+	select {
+	case result := <-done:
+		defer cancel()
+		if isOverloaded(result.err) {
+			requestLogger(c).WithFields(logrus.Fields{
+				"error": result.err,
+			}).Warn("Upstream is overloaded, enqueueing request")
+			c.Request.Body = io.NopCloser(bytes.NewReader(body))
+			h.overflow.HandleRequest(c)
+			return
+		}
+		h.respond(c, result.resp, result.err)
+	case <-slow:
+		h.handOff(ctx, cancel, c, done)
+	}
+}
+
+// handOff は実行中の上流へのリクエストをバックグラウンドで完了させ、結果をステータスに記録する
+//
+// ctx は応答後も取り消されない、このリクエストのスパンを持つコンテキストで、cancel で上流へのリクエストを中断する。
+// 切り替えたリクエストは DELETE /requests/:id で取り消せる。
+func (h *SyncWriteHandler) handOff(ctx context.Context, cancel context.CancelFunc, c *gin.Context, done <-chan upstreamResult) {
+	requestID := uuid.New().String()
+	statusRepository := h.statusRepository.WithContext(ctx)
+	if err := statusRepository.Create(&repository.RequestStatus{ID: requestID, Status: repository.StatusRunning}); err != nil {
+		// 応答しないリクエストは完了させない
+		cancel()
+		requestLogger(c).WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Failed to save request status to db")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save request status to db"})
+		return
+	}
+
+	// gin.Context は応答後に再利用されるため、ゴルーチンの前にロガーを取り出しておく
+	logger := requestLogger(c).WithField("jobID", requestID)
+	h.track(requestID, cancel)
+	go func() {
+		defer h.untrack(requestID)
+		result := <-done
+		if ctx.Err() != nil {
+			// 取り消したリクエストのステータスは取り消した側が記録している
+			if result.resp != nil {
+				result.resp.Body.Close()
+			}
+			logger.Info("Request cancelled while running")
+			return
+		}
+		status := repository.StatusProcessed
+		if result.err != nil {
+			status = repository.StatusFailed
+			logger.WithFields(logrus.Fields{
+				"error": result.err,
+			}).Error("Failed to complete request in background")
+		} else if err := saveResponse(statusRepository, requestID, result.resp); err != nil {
+			status = repository.StatusFailed
+			logger.WithFields(logrus.Fields{
+				"error": err,
+			}).Error("Failed to save response")
+		}
+		transitioned, err := statusRepository.TransitionStatus(requestID, []string{repository.StatusRunning}, status)
+		if err != nil {
+			logger.WithFields(logrus.Fields{
+				"error": err,
+			}).Error("Failed to update request status")
+			return
+		}
+		if transitioned {
+			h.publish(logger, requestID, status)
+		}
+	}()
+
+	c.JSON(http.StatusAccepted, gin.H{"request_id": requestID, "status": repository.StatusRunning, "status_url": statusURL(requestID)})
+}
+
+// saveResponse は上流の応答の本文を読み、同期リクエストの応答と同じくステータスに記録する
+func saveResponse(statusRepository repository.RequestStatusRepository, requestID string, resp *http.Response) error {
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	return statusRepository.SaveResponse(requestID, string(body))
+}
+
+func (h *SyncWriteHandler) publish(logger *logrus.Entry, requestID string, status string) {
+	if h.events == nil {
+		return
+	}
+	if err := h.events.Publish(events.Event{RequestID: requestID, Status: status, At: time.Now()}); err != nil {
+		logger.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Failed to publish status event")
+	}
+}
+
+func (h *SyncWriteHandler) respond(c *gin.Context, resp *http.Response, err error) {
 	if err != nil {
 		HandleError(c, err)
 		return
@@ -31,7 +332,7 @@ func (h *SyncWriteHandler) HandleRequest(c *gin.Context) {
 
 	bodyBytes, err := io.ReadAll(resp.Body)
 	if err != nil {
-		utils.Logger.WithFields(logrus.Fields{
+		requestLogger(c).WithFields(logrus.Fields{
 			"error": err,
 		}).Error("Failed to read response body")
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read response body"})
@@ -39,9 +340,18 @@ func (h *SyncWriteHandler) HandleRequest(c *gin.Context) {
 	}
 	resp.Body.Close()
 
-	utils.Logger.WithFields(logrus.Fields{
-		"status": resp.StatusCode,
-		"body":   string(bodyBytes),
-	}).Info("Request handled successfully")
+	fields := logrus.Fields{"status": resp.StatusCode}
+	// 本文は設定に従って秘匿し、切り詰めてから出力する
+	if body, ok := utils.CurrentRedactor().Body(bodyBytes); ok {
+		fields["body"] = body
+	}
+	requestLogger(c).WithFields(fields).Info("Request handled successfully")
 	c.JSON(http.StatusOK, gin.H{"data": string(bodyBytes)})
 }
+
+// isOverloaded は上流の障害ではなく混雑によって拒否されたかを返す
+func isOverloaded(err error) bool {
+	return errors.Is(err, utils.ErrRateLimitExceeded) ||
+		errors.Is(err, gobreaker.ErrOpenState) ||
+		errors.Is(err, gobreaker.ErrTooManyRequests)
+}
@@ -2,6 +2,7 @@ package handlers_test
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"io"
 	"net/http"
@@ -14,6 +15,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/sony/gobreaker"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 	"golang.org/x/time/rate"
 )
 
@@ -64,7 +66,7 @@ func TestHandleRequest(t *testing.T) {
 			Body:       io.NopCloser(bytes.NewBufferString("Success")),
 		}
 
-		mockClient.On("Get", "https://api.thirdparty.com/data").Return(resp, nil)
+		mockClient.On("GetWithContext", mock.Anything, "https://api.thirdparty.com/data").Return(resp, nil)
 
 		w := httptest.NewRecorder()
 		req, _ := http.NewRequest("GET", "/proxy", nil)
@@ -87,7 +89,7 @@ func TestHandleRequest(t *testing.T) {
 			StatusCode: http.StatusInternalServerError,
 			Body:       io.NopCloser(bytes.NewBufferString(`Internal Server Error`)),
 		}
-		mockClient.On("Get", "https://api.thirdparty.com/data").Return(resp, nil)
+		mockClient.On("GetWithContext", mock.Anything, "https://api.thirdparty.com/data").Return(resp, nil)
 
 		w := httptest.NewRecorder()
 		req, _ := http.NewRequest("GET", "/proxy", nil)
@@ -106,7 +108,7 @@ func TestHandleRequest(t *testing.T) {
 		router := gin.Default()
 		router.GET("/proxy", handler.HandleRequest)
 
-		mockClient.On("Get", "https://api.thirdparty.com/data").Return(nil, errors.New("client error"))
+		mockClient.On("GetWithContext", mock.Anything, "https://api.thirdparty.com/data").Return(nil, errors.New("client error"))
 
 		w := httptest.NewRecorder()
 		req, _ := http.NewRequest("GET", "/proxy", nil)
@@ -138,7 +140,7 @@ func TestHandleRequest(t *testing.T) {
 		router.GET("/proxy", handler.HandleRequest)
 
 		// 最初のリクエストでエラーを返す
-		mockClient.On("Get", "https://api.thirdparty.com/data").Return(nil, errors.New("client error")).Times(2)
+		mockClient.On("GetWithContext", mock.Anything, "https://api.thirdparty.com/data").Return(nil, errors.New("client error")).Times(2)
 
 		// 2回失敗させてサーキットブレーカーをトリップさせる
 		for i := 0; i < 2; i++ {
@@ -159,3 +161,123 @@ func TestHandleRequest(t *testing.T) {
 		mockClient.AssertExpectations(t)
 	})
 }
+
+func TestHandleRequest_Routes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockClient := new(httpclient.MockClient)
+	spec := func(name, url string) httpclient.RouteSpec {
+		return httpclient.RouteSpec{
+			Name:       name,
+			URL:        url,
+			MaxRetries: 1,
+			RateLimit:  1000,
+			Burst:      10,
+			Breaker:    httpclient.BreakerSpec{Name: "HTTP GET", MaxRequests: 1, Timeout: time.Minute},
+		}
+	}
+	table := httpclient.NewRouteTable([]httpclient.RouteSpec{
+		spec(httpclient.DefaultRoute, "https://api.thirdparty.com/data"),
+		spec("partner", "https://partner.example.com/data"),
+	}, nil, mockClient, nil)
+	handler := handlers.NewSyncWriteHandler(nil).WithRouter(httpclient.NewRouter(table))
+
+	router := gin.Default()
+	router.GET("/proxy", handler.HandleRequest)
+	router.GET("/proxy/:route", handler.HandleRequest)
+
+	mockClient.On("GetWithContext", mock.Anything, "https://api.thirdparty.com/data").Return(&http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(bytes.NewBufferString("default")),
+	}, nil)
+	mockClient.On("GetWithContext", mock.Anything, "https://partner.example.com/data").Return(&http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(bytes.NewBufferString("partner")),
+	}, nil)
+
+	for path, expected := range map[string]string{
+		"/proxy":         `{"data":"default"}`,
+		"/proxy/partner": `{"data":"partner"}`,
+	} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, expected, w.Body.String())
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/proxy/unknown", nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.JSONEq(t, `{"error":"Route not found"}`, w.Body.String())
+	// 完了したリクエストは処理中として残らない
+	assert.Equal(t, int64(0), table.InFlight())
+	mockClient.AssertExpectations(t)
+}
+
+func TestHandleRequest_ForwardsMethodAndBody(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var method, contentType, body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		method, contentType, body = r.Method, r.Header.Get("Content-Type"), string(b)
+	}))
+	defer server.Close()
+
+	table := httpclient.NewRouteTable([]httpclient.RouteSpec{{
+		Name:       httpclient.DefaultRoute,
+		URL:        server.URL,
+		MaxRetries: 1,
+		RateLimit:  1000,
+		Burst:      10,
+		Breaker:    httpclient.BreakerSpec{Name: "HTTP GET", MaxRequests: 1, Timeout: time.Minute},
+	}}, nil, &httpclient.DefaultHttpClient{}, nil)
+	handler := handlers.NewSyncWriteHandler(nil).WithRouter(httpclient.NewRouter(table))
+
+	router := gin.Default()
+	router.GET("/proxy", handler.HandleRequest)
+	router.POST("/proxy", handler.HandleRequest)
+
+	req, _ := http.NewRequest("POST", "/proxy", bytes.NewBufferString("name=test"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, http.MethodPost, method)
+	assert.Equal(t, "application/x-www-form-urlencoded", contentType)
+	assert.Equal(t, "name=test", body)
+
+	req, _ = http.NewRequest("GET", "/proxy", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, http.MethodGet, method)
+	assert.Empty(t, body)
+}
+
+func TestHandleRequest_CancelsWithClient(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockClient := new(httpclient.MockClient)
+	handler := handlers.NewSyncWriteHandler(mockClient)
+	router := gin.Default()
+	router.GET("/proxy", handler.HandleRequest)
+
+	// 非同期に切り替えないリクエストはクライアントが切断したら上流へのリクエストも中断する
+	var upstreamErr error
+	mockClient.On("GetWithContext", mock.Anything, "https://api.thirdparty.com/data").
+		Run(func(args mock.Arguments) { upstreamErr = args.Get(0).(context.Context).Err() }).
+		Return(nil, context.Canceled)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", "/proxy", nil)
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	assert.ErrorIs(t, upstreamErr, context.Canceled)
+	mockClient.AssertExpectations(t)
+}
@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"net/http"
+	"regexp"
+	"reliproxy/pkg/queue"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	APIKeyHeader = "X-API-Key"
+	TenantHeader = "X-Tenant-ID"
+
+	tenantKey      = "reliproxy.tenant"
+	callbackURLKey = "reliproxy.callbackURL"
+)
+
+// テナント名はキュー名の一部になるため使える文字を制限する
+var tenantPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// TenantMiddleware は API キーまたはヘッダからリクエストのテナントを決める
+//
+// ヘッダは認証されないため、設定にないテナント名は既定のテナントとして扱い、
+// 任意の名前でサブキューやレジストリのエントリが作られないようにする。
+type TenantMiddleware struct {
+	apiKeys map[string]string
+	// callbackURLs は API キーで認証したテナントの既定のコールバック URL
+	callbackURLs map[string]string
+	// tenants はヘッダで指定できるテナント
+	tenants map[string]struct{}
+}
+
+// NewTenantMiddleware の tenants は API キーに対応するテナント以外にヘッダで指定できるテナント
+func NewTenantMiddleware(apiKeys map[string]string, callbackURLs map[string]string, tenants []string) *TenantMiddleware {
+	known := make(map[string]struct{})
+	for _, tenant := range apiKeys {
+		known[tenant] = struct{}{}
+	}
+	for _, tenant := range tenants {
+		known[tenant] = struct{}{}
+	}
+	return &TenantMiddleware{apiKeys: apiKeys, callbackURLs: callbackURLs, tenants: known}
+}
+
+func (m *TenantMiddleware) Handle(c *gin.Context) {
+	if apiKey := c.GetHeader(APIKeyHeader); apiKey != "" {
+		tenant, ok := m.apiKeys[apiKey]
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid API key"})
+			return
+		}
+		c.Set(tenantKey, tenant)
+		if callbackURL, ok := m.callbackURLs[tenant]; ok {
+			c.Set(callbackURLKey, callbackURL)
+		}
+	} else if tenant := c.GetHeader(TenantHeader); tenant != "" {
+		if !tenantPattern.MatchString(tenant) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant"})
+			return
+		}
+		if _, ok := m.tenants[tenant]; ok {
+			c.Set(tenantKey, tenant)
+		}
+	}
+	c.Next()
+}
+
+func requestTenant(c *gin.Context) string {
+	if tenant := c.GetString(tenantKey); tenant != "" {
+		return tenant
+	}
+	return queue.DefaultTenant
+}
@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTenantMiddleware_Handle(t *testing.T) {
+	middleware := NewTenantMiddleware(map[string]string{"secret-key": "team-a"}, nil, []string{"team-b"})
+
+	gin.SetMode(gin.TestMode)
+	router := gin.Default()
+	router.GET("/request", middleware.Handle, func(c *gin.Context) {
+		c.String(http.StatusOK, requestTenant(c))
+	})
+
+	tests := []struct {
+		name     string
+		headers  map[string]string
+		code     int
+		expected string
+	}{
+		{"no tenant", nil, http.StatusOK, "default"},
+		{"api key", map[string]string{APIKeyHeader: "secret-key", TenantHeader: "team-b"}, http.StatusOK, "team-a"},
+		{"tenant header", map[string]string{TenantHeader: "team-b"}, http.StatusOK, "team-b"},
+		{"unknown tenant header", map[string]string{TenantHeader: "team-c"}, http.StatusOK, "default"},
+		{"invalid api key", map[string]string{APIKeyHeader: "unknown"}, http.StatusUnauthorized, ""},
+		{"invalid tenant", map[string]string{TenantHeader: "team b:*"}, http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", "/request", nil)
+			for key, value := range tt.headers {
+				req.Header.Set(key, value)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.code, w.Code)
+			if tt.code == http.StatusOK {
+				assert.Equal(t, tt.expected, w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/sony/gobreaker"
+	"gorm.io/gorm"
+)
+
+const (
+	StatusUp   = "up"
+	StatusDown = "down"
+)
+
+// Check は依存先の状態を確認し、利用できなければエラーを返す
+type Check func(ctx context.Context) error
+
+// Result は1つの依存先の確認結果
+type Result struct {
+	Status    string  `json:"status"`
+	Error     string  `json:"error,omitempty"`
+	LatencyMS float64 `json:"latency_ms"`
+}
+
+// Report は全ての依存先の確認結果
+type Report struct {
+	Status    string            `json:"status"`
+	Checks    map[string]Result `json:"checks"`
+	CheckedAt time.Time         `json:"checked_at"`
+}
+
+func (r Report) Ready() bool {
+	return r.Status == StatusUp
+}
+
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+// Checker は登録された依存先を並行して確認し、結果を ttl の間キャッシュする
+//
+// プローブが頻繁に呼ばれても依存先への確認は ttl ごとに1回に抑える。
+type Checker struct {
+	checks  []namedCheck
+	ttl     time.Duration
+	timeout time.Duration
+
+	mu     sync.Mutex
+	report *Report
+}
+
+func NewChecker(ttl, timeout time.Duration) *Checker {
+	return &Checker{
+		ttl:     ttl,
+		timeout: timeout,
+	}
+}
+
+// Add は name の依存先の確認を登録する
+func (c *Checker) Add(name string, check Check) {
+	c.checks = append(c.checks, namedCheck{name: name, check: check})
+}
+
+// Check はキャッシュが有効であればその結果を、そうでなければ全ての依存先を確認した結果を返す
+func (c *Checker) Check(ctx context.Context) Report {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.report != nil && time.Since(c.report.CheckedAt) < c.ttl {
+		return *c.report
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	report := Report{
+		Status:    StatusUp,
+		Checks:    make(map[string]Result, len(c.checks)),
+		CheckedAt: time.Now(),
+	}
+	var wg sync.WaitGroup
+	var resultMu sync.Mutex
+	for _, check := range c.checks {
+		wg.Add(1)
+		go func(check namedCheck) {
+			defer wg.Done()
+			result := run(ctx, check.check)
+
+			resultMu.Lock()
+			defer resultMu.Unlock()
+			report.Checks[check.name] = result
+			if result.Status != StatusUp {
+				report.Status = StatusDown
+			}
+		}(check)
+	}
+	wg.Wait()
+
+	c.report = &report
+	return report
+}
+
+func run(ctx context.Context, check Check) Result {
+	start := time.Now()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- check(ctx)
+	}()
+
+	var err error
+	select {
+	case err = <-errCh:
+	case <-ctx.Done():
+		// コンテキストを無視する確認もタイムアウトで打ち切る
+		err = ctx.Err()
+	}
+
+	result := Result{
+		Status:    StatusUp,
+		LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		result.Status = StatusDown
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// DBCheck は MySQL に ping できるかを確認する
+func DBCheck(db *gorm.DB) Check {
+	return func(ctx context.Context) error {
+		sqlDB, err := db.DB()
+		if err != nil {
+			return err
+		}
+		return sqlDB.PingContext(ctx)
+	}
+}
+
+// RedisCheck は Redis に ping できるかを確認する
+func RedisCheck(client redis.Cmdable) Check {
+	return func(ctx context.Context) error {
+		return client.Ping(ctx).Err()
+	}
+}
+
+// Breaker は状態を確認するサーキットブレーカー
+type Breaker interface {
+	Name() string
+	State() gobreaker.State
+}
+
+// BreakerCheck は上流へのサーキットブレーカーが開いていないかを確認する
+func BreakerCheck(cb Breaker) Check {
+	return func(ctx context.Context) error {
+		if cb.State() == gobreaker.StateOpen {
+			return fmt.Errorf("circuit breaker %s is open", cb.Name())
+		}
+		return nil
+	}
+}
@@ -0,0 +1,68 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sony/gobreaker"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChecker(t *testing.T) {
+	var calls atomic.Int32
+	checker := NewChecker(time.Minute, 50*time.Millisecond)
+	checker.Add("ok", func(ctx context.Context) error {
+		calls.Add(1)
+		return nil
+	})
+	checker.Add("failing", func(ctx context.Context) error {
+		return errors.New("connection refused")
+	})
+	checker.Add("slow", func(ctx context.Context) error {
+		// コンテキストを無視する確認もタイムアウトで打ち切る
+		time.Sleep(time.Second)
+		return nil
+	})
+
+	report := checker.Check(context.Background())
+	assert.False(t, report.Ready())
+	assert.Equal(t, StatusUp, report.Checks["ok"].Status)
+	assert.Equal(t, Result{Status: StatusDown, Error: "connection refused", LatencyMS: report.Checks["failing"].LatencyMS}, report.Checks["failing"])
+	assert.Equal(t, StatusDown, report.Checks["slow"].Status)
+	assert.Equal(t, context.DeadlineExceeded.Error(), report.Checks["slow"].Error)
+
+	// ttl の間は依存先を確認しない
+	cached := checker.Check(context.Background())
+	assert.Equal(t, report.CheckedAt, cached.CheckedAt)
+	assert.Equal(t, int32(1), calls.Load())
+}
+
+func TestChecker_Expires(t *testing.T) {
+	var calls atomic.Int32
+	checker := NewChecker(0, time.Second)
+	checker.Add("ok", func(ctx context.Context) error {
+		calls.Add(1)
+		return nil
+	})
+
+	assert.True(t, checker.Check(context.Background()).Ready())
+	assert.True(t, checker.Check(context.Background()).Ready())
+	assert.Equal(t, int32(2), calls.Load())
+}
+
+func TestBreakerCheck(t *testing.T) {
+	cb := gobreaker.NewCircuitBreaker(gobreaker.Settings{
+		Name: "upstream",
+		ReadyToTrip: func(counts gobreaker.Counts) bool {
+			return counts.ConsecutiveFailures >= 1
+		},
+	})
+	check := BreakerCheck(cb)
+	assert.NoError(t, check(context.Background()))
+
+	cb.Execute(func() (interface{}, error) { return nil, errors.New("failed") })
+	assert.EqualError(t, check(context.Background()), "circuit breaker upstream is open")
+}
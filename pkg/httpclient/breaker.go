@@ -0,0 +1,143 @@
+package httpclient
+
+import (
+	"sync"
+
+	"github.com/sony/gobreaker"
+)
+
+// CircuitBreaker は ReliClient が上流へのリクエストに使うサーキットブレーカー
+type CircuitBreaker interface {
+	Name() string
+	State() gobreaker.State
+	Execute(req func() (interface{}, error)) (interface{}, error)
+}
+
+// BreakerOverride は運用者が強制したサーキットブレーカーの状態
+type BreakerOverride string
+
+const (
+	OverrideNone   BreakerOverride = ""
+	OverrideOpen   BreakerOverride = "open"
+	OverrideClosed BreakerOverride = "closed"
+)
+
+// BreakerSnapshot はサーキットブレーカーの現在の状態とカウント
+type BreakerSnapshot struct {
+	Name                 string          `json:"name"`
+	State                string          `json:"state"`
+	Override             BreakerOverride `json:"override,omitempty"`
+	Requests             uint32          `json:"requests"`
+	TotalSuccesses       uint32          `json:"total_successes"`
+	TotalFailures        uint32          `json:"total_failures"`
+	ConsecutiveSuccesses uint32          `json:"consecutive_successes"`
+	ConsecutiveFailures  uint32          `json:"consecutive_failures"`
+}
+
+// ManagedBreaker は運用者が実行中に強制的に開閉したりリセットしたりできるサーキットブレーカー
+//
+// 強制している間は gobreaker の状態遷移を止め、リセットすると同じ設定で閉じた状態から作り直す。
+type ManagedBreaker struct {
+	settings gobreaker.Settings
+
+	mu       sync.RWMutex
+	cb       *gobreaker.CircuitBreaker
+	override BreakerOverride
+}
+
+func NewManagedBreaker(settings gobreaker.Settings) *ManagedBreaker {
+	return &ManagedBreaker{
+		settings: settings,
+		cb:       gobreaker.NewCircuitBreaker(settings),
+	}
+}
+
+func (b *ManagedBreaker) Name() string {
+	return b.settings.Name
+}
+
+// State は強制している状態があればその状態を、なければ gobreaker の状態を返す
+func (b *ManagedBreaker) State() gobreaker.State {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.state()
+}
+
+func (b *ManagedBreaker) state() gobreaker.State {
+	switch b.override {
+	case OverrideOpen:
+		return gobreaker.StateOpen
+	case OverrideClosed:
+		return gobreaker.StateClosed
+	default:
+		return b.cb.State()
+	}
+}
+
+// Execute は強制的に開いている間は req を呼ばずに gobreaker.ErrOpenState を返し、強制的に閉じている間は失敗を数えずに req を呼ぶ
+func (b *ManagedBreaker) Execute(req func() (interface{}, error)) (interface{}, error) {
+	b.mu.RLock()
+	override, cb := b.override, b.cb
+	b.mu.RUnlock()
+
+	switch override {
+	case OverrideOpen:
+		return nil, gobreaker.ErrOpenState
+	case OverrideClosed:
+		return req()
+	default:
+		return cb.Execute(req)
+	}
+}
+
+func (b *ManagedBreaker) ForceOpen() {
+	b.setOverride(OverrideOpen)
+}
+
+func (b *ManagedBreaker) ForceClose() {
+	b.setOverride(OverrideClosed)
+}
+
+// Reset は強制した状態を解除し、カウントを捨てて閉じた状態に戻す
+func (b *ManagedBreaker) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	from := b.state()
+	b.override = OverrideNone
+	b.cb = gobreaker.NewCircuitBreaker(b.settings)
+	b.notify(from)
+}
+
+func (b *ManagedBreaker) setOverride(override BreakerOverride) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	from := b.state()
+	b.override = override
+	b.notify(from)
+}
+
+// notify は運用者の操作による状態の遷移を OnStateChange に通知する
+func (b *ManagedBreaker) notify(from gobreaker.State) {
+	if to := b.state(); to != from && b.settings.OnStateChange != nil {
+		b.settings.OnStateChange(b.settings.Name, from, to)
+	}
+}
+
+func (b *ManagedBreaker) Snapshot() BreakerSnapshot {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	counts := b.cb.Counts()
+	return BreakerSnapshot{
+		Name:                 b.settings.Name,
+		State:                b.state().String(),
+		Override:             b.override,
+		Requests:             counts.Requests,
+		TotalSuccesses:       counts.TotalSuccesses,
+		TotalFailures:        counts.TotalFailures,
+		ConsecutiveSuccesses: counts.ConsecutiveSuccesses,
+		ConsecutiveFailures:  counts.ConsecutiveFailures,
+	}
+}
@@ -1,9 +1,111 @@
 package httpclient
 
-import "net/http"
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"reliproxy/pkg/tracing"
+	"reliproxy/pkg/utils"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RequestIDHeader は上流へ伝えるリクエストの ID のヘッダ
+const RequestIDHeader = "X-Request-ID"
+
+type headersKey struct{}
+
+// WithHeaders は上流へのリクエストに付けるヘッダを ctx に設定する
+func WithHeaders(ctx context.Context, headers map[string]string) context.Context {
+	return context.WithValue(ctx, headersKey{}, headers)
+}
+
+func headersFromContext(ctx context.Context) map[string]string {
+	headers, _ := ctx.Value(headersKey{}).(map[string]string)
+	return headers
+}
+
+type requestKey struct{}
+
+// Request は上流へ送るリクエストのメソッドと本文
+type Request struct {
+	// Method が空の場合は GET で送る
+	Method      string
+	ContentType string
+	Body        []byte
+}
+
+// WithRequest は上流へ送るリクエストのメソッドと本文を ctx に設定する
+func WithRequest(ctx context.Context, request Request) context.Context {
+	return context.WithValue(ctx, requestKey{}, request)
+}
+
+func requestFromContext(ctx context.Context) Request {
+	request, _ := ctx.Value(requestKey{}).(Request)
+	if request.Method == "" {
+		request.Method = http.MethodGet
+	}
+	return request
+}
 
 type DefaultHttpClient struct{}
 
 func (c *DefaultHttpClient) Get(url string) (*http.Response, error) {
-	return http.Get(url)
+	return c.GetWithContext(context.Background(), url)
+}
+
+// GetWithContext は上流へのリクエストをスパンとして記録し、W3C Trace Context と X-Request-ID のヘッダを付けて送る
+//
+// ctx に設定されたメソッドと本文で送る。本文の Content-Type は、ルートのヘッダで指定されていない場合だけ設定する。
+func (c *DefaultHttpClient) GetWithContext(ctx context.Context, url string) (*http.Response, error) {
+	request := requestFromContext(ctx)
+	var body io.Reader
+	if len(request.Body) > 0 {
+		// 再試行のたびに最初から読めるよう呼び出しごとに作る
+		body = bytes.NewReader(request.Body)
+	}
+
+	ctx, span := tracing.Tracer().Start(ctx, "HTTP "+request.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.HTTPRequestMethodKey.String(request.Method), semconv.URLFull(url)),
+	)
+	defer span.End()
+
+	req, err := http.NewRequestWithContext(ctx, request.Method, url, body)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	for name, value := range headersFromContext(ctx) {
+		req.Header.Set(name, value)
+	}
+	if body != nil && req.Header.Get("Content-Type") == "" {
+		contentType := request.ContentType
+		if contentType == "" {
+			contentType = "application/json"
+		}
+		req.Header.Set("Content-Type", contentType)
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	if requestID := utils.RequestIDFromContext(ctx); requestID != "" {
+		req.Header.Set(RequestIDHeader, requestID)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
+	if resp.StatusCode >= http.StatusBadRequest {
+		span.SetStatus(codes.Error, http.StatusText(resp.StatusCode))
+	}
+	return resp, nil
 }
@@ -1,7 +1,12 @@
 package httpclient
 
-import "net/http"
+import (
+	"context"
+	"net/http"
+)
 
 type HttpClient interface {
 	Get(url string) (*http.Response, error)
+	// GetWithContext は ctx が終了した時点でリクエストを中断する
+	GetWithContext(ctx context.Context, url string) (*http.Response, error)
 }
@@ -0,0 +1,77 @@
+package httpclient
+
+import (
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// ManagedLimiter は運用者が実行中にレートとバーストを変更できるルートのレートリミッター
+//
+// 運用者が変更した値はルートテーブルを作り直しても維持し、リセットすると設定の値に戻す。
+type ManagedLimiter struct {
+	*rate.Limiter
+
+	mu            sync.Mutex
+	limit         rate.Limit
+	burst         int
+	limitOverride bool
+	burstOverride bool
+}
+
+func NewManagedLimiter(limit rate.Limit, burst int) *ManagedLimiter {
+	return &ManagedLimiter{
+		Limiter: rate.NewLimiter(limit, burst),
+		limit:   limit,
+		burst:   burst,
+	}
+}
+
+// Configure は設定の値を変更する。運用者が変更した値はそのまま使う
+func (l *ManagedLimiter) Configure(limit rate.Limit, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.limit, l.burst = limit, burst
+	if !l.limitOverride {
+		l.Limiter.SetLimit(limit)
+	}
+	if !l.burstOverride {
+		l.Limiter.SetBurst(burst)
+	}
+}
+
+// SetLimit は運用者が変更したレートとして設定の値より優先する
+func (l *ManagedLimiter) SetLimit(limit rate.Limit) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.limitOverride = true
+	l.Limiter.SetLimit(limit)
+}
+
+// SetBurst は運用者が変更したバーストとして設定の値より優先する
+func (l *ManagedLimiter) SetBurst(burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.burstOverride = true
+	l.Limiter.SetBurst(burst)
+}
+
+// Overridden は運用者が変更した値を使っているかを返す
+func (l *ManagedLimiter) Overridden() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limitOverride || l.burstOverride
+}
+
+// Reset は運用者が変更した値を捨てて設定の値に戻す
+func (l *ManagedLimiter) Reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.limitOverride, l.burstOverride = false, false
+	l.Limiter.SetLimit(l.limit)
+	l.Limiter.SetBurst(l.burst)
+}
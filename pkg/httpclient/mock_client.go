@@ -1,6 +1,7 @@
 package httpclient
 
 import (
+	"context"
 	"net/http"
 
 	"github.com/stretchr/testify/mock"
@@ -17,3 +18,11 @@ func (m *MockClient) Get(key string) (*http.Response, error) {
 	}
 	return args.Get(0).(*http.Response), args.Error(1)
 }
+
+func (m *MockClient) GetWithContext(ctx context.Context, key string) (*http.Response, error) {
+	args := m.Called(ctx, key)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*http.Response), args.Error(1)
+}
@@ -1,23 +1,43 @@
 package httpclient
 
 import (
+	"context"
 	"fmt"
 	"net/http"
+	"reliproxy/pkg/metrics"
+	"reliproxy/pkg/tracing"
 	"reliproxy/pkg/utils"
 
-	"github.com/sony/gobreaker"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 
 	"golang.org/x/time/rate"
 )
 
+type failFastKey struct{}
+
+// WithFailFast はレート制限で拒否されたリクエストを再試行せずにすぐ返すよう ctx に設定する
+//
+// 混雑していれば非同期に切り替える呼び出し側が、再試行と待機を使い切る前に切り替えられるようにする。
+// サーキットブレーカーが開いている場合は設定にかかわらず再試行せずに返す。
+func WithFailFast(ctx context.Context) context.Context {
+	return context.WithValue(ctx, failFastKey{}, true)
+}
+
+func failFastFromContext(ctx context.Context) bool {
+	failFast, _ := ctx.Value(failFastKey{}).(bool)
+	return failFast
+}
+
 type ReliClient struct {
 	client         HttpClient
-	circuitBreaker *gobreaker.CircuitBreaker
+	circuitBreaker CircuitBreaker
 	rateLimiter    *rate.Limiter
 	maxRetries     int
 }
 
-func NewReliClient(client HttpClient, circuitBreaker *gobreaker.CircuitBreaker, rateLimiter *rate.Limiter, maxRetries int) *ReliClient {
+func NewReliClient(client HttpClient, circuitBreaker CircuitBreaker, rateLimiter *rate.Limiter, maxRetries int) *ReliClient {
 	return &ReliClient{
 		client:         client,
 		circuitBreaker: circuitBreaker,
@@ -27,31 +47,83 @@ func NewReliClient(client HttpClient, circuitBreaker *gobreaker.CircuitBreaker,
 }
 
 func (r *ReliClient) Get(url string) (*http.Response, error) {
+	return r.execute(context.Background(), func(context.Context) (*http.Response, error) {
+		return r.client.Get(url)
+	})
+}
+
+func (r *ReliClient) GetWithContext(ctx context.Context, url string) (*http.Response, error) {
+	return r.execute(ctx, func(ctx context.Context) (*http.Response, error) {
+		return r.client.GetWithContext(ctx, url)
+	})
+}
+
+func (r *ReliClient) execute(ctx context.Context, get func(ctx context.Context) (*http.Response, error)) (*http.Response, error) {
+	ctx, span := tracing.Tracer().Start(ctx, "circuit_breaker", trace.WithAttributes(
+		attribute.String("breaker.name", r.circuitBreaker.Name()),
+		attribute.String("breaker.state", r.circuitBreaker.State().String()),
+	))
+	defer span.End()
+
+	failFast := failFastFromContext(ctx)
+	retryCtx, stopRetry := context.WithCancel(ctx)
+	defer stopRetry()
+
 	var response *http.Response
+	var rejected error
+	attempt := 0
 	_, err := r.circuitBreaker.Execute(func() (interface{}, error) {
-		return utils.RetryWithExponentialBackoff(func() (*http.Response, error) {
+		resp, err := utils.RetryWithExponentialBackoffContext(retryCtx, func() (*http.Response, error) {
+			attempt++
+			// 再試行ごとにスパンを分け、上流へのリクエストはその子スパンにする
+			attemptCtx, attemptSpan := tracing.Tracer().Start(ctx, "retry_attempt", trace.WithAttributes(attribute.Int("retry.attempt", attempt)))
+			defer attemptSpan.End()
+
 			if !r.rateLimiter.Allow() {
+				metrics.RateLimitRejections.WithLabelValues("upstream").Inc()
+				attemptSpan.SetStatus(codes.Error, utils.ErrRateLimitExceeded.Error())
+				if failFast {
+					rejected = utils.ErrRateLimitExceeded
+					stopRetry()
+				}
 				return nil, utils.ErrRateLimitExceeded
 			}
 
-			resp, err := r.client.Get(url)
+			resp, err := get(attemptCtx)
 			if err != nil {
+				attemptSpan.RecordError(err)
+				attemptSpan.SetStatus(codes.Error, err.Error())
 				return nil, err
 			}
 
 			if resp.StatusCode != http.StatusOK {
 				resp.Body.Close()
-				return nil, fmt.Errorf("%w: %d", utils.ErrUnexpectedStatusCode, resp.StatusCode)
+				err := fmt.Errorf("%w: %d", utils.ErrUnexpectedStatusCode, resp.StatusCode)
+				attemptSpan.SetStatus(codes.Error, err.Error())
+				return nil, err
 			}
 
 			response = resp
 			return response, nil
 		}, r.maxRetries)
+		if rejected != nil {
+			return nil, rejected
+		}
+		// 呼び出し側による中断は上流の障害ではないためブレーカーの失敗に数えない
+		if err != nil && ctx.Err() != nil {
+			return nil, nil
+		}
+		return resp, err
 	})
 
 	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
 		return nil, err
 	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
 
 	return response, nil
 }
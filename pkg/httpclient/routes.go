@@ -0,0 +1,210 @@
+package httpclient
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/sony/gobreaker"
+	"golang.org/x/time/rate"
+)
+
+// DefaultRoute はルート名を指定しないリクエストが使うルート
+const DefaultRoute = "default"
+
+// RouteNamePattern はルート名に使える文字列。URL のパスにそのまま使えるものに限る
+var RouteNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// BreakerSpec はルートのサーキットブレーカーの設定
+type BreakerSpec struct {
+	Name             string
+	MaxRequests      uint32
+	Interval         time.Duration
+	Timeout          time.Duration
+	FailureThreshold uint32
+}
+
+// RouteSpec はルートの上流の URL と、そこへのリクエストに使う再試行、レート制限、サーキットブレーカーの設定
+type RouteSpec struct {
+	Name       string
+	URL        string
+	MaxRetries int
+	RateLimit  float64
+	Burst      int
+	Breaker    BreakerSpec
+	// Headers は認証情報など、このルートへの全てのリクエストに付けるヘッダ
+	Headers map[string]string
+	// SyncOverflow は上流が混雑している場合に同期の書き込みリクエストを非同期に切り替えるか
+	SyncOverflow bool
+	// SyncOverflowLatency を超えた同期の書き込みリクエストは応答を待たずに非同期に切り替える。0 の場合は待ち続ける
+	SyncOverflowLatency time.Duration
+}
+
+// Route は上流の URL とそこへのリクエストに使うクライアント
+type Route struct {
+	Spec    RouteSpec
+	Client  *ReliClient
+	Breaker *ManagedBreaker
+	Limiter *ManagedLimiter
+}
+
+// RouteTable はルート名からルートへの対応。作成した後は変更しない
+type RouteTable struct {
+	routes   map[string]*Route
+	inFlight atomic.Int64
+}
+
+// NewRouteTable は specs からルートテーブルを作成する
+//
+// previous に同じ設定のサーキットブレーカーがあれば状態を引き継ぐためそのまま使い、
+// 同じ名前のルートのレートリミッターは残っているトークンと運用者が変更した値を引き継ぐため設定の値を変更して使う。
+// onStateChange は新しく作成したサーキットブレーカーの状態の遷移に通知する。
+func NewRouteTable(specs []RouteSpec, previous *RouteTable, client HttpClient, onStateChange func(name string, from, to gobreaker.State)) *RouteTable {
+	breakers := make(map[BreakerSpec]*ManagedBreaker)
+	if previous != nil {
+		for _, route := range previous.routes {
+			breakers[route.Spec.Breaker] = route.Breaker
+		}
+	}
+
+	table := &RouteTable{routes: make(map[string]*Route, len(specs))}
+	for _, spec := range specs {
+		breaker, ok := breakers[spec.Breaker]
+		if !ok {
+			breaker = newBreaker(spec.Breaker, onStateChange)
+			breakers[spec.Breaker] = breaker
+		}
+
+		var limiter *ManagedLimiter
+		if old, ok := previous.Route(spec.Name); ok {
+			limiter = old.Limiter
+			limiter.Configure(rate.Limit(spec.RateLimit), spec.Burst)
+		} else {
+			limiter = NewManagedLimiter(rate.Limit(spec.RateLimit), spec.Burst)
+		}
+
+		routeClient := client
+		if len(spec.Headers) > 0 {
+			routeClient = &headerClient{client: client, headers: spec.Headers}
+		}
+		table.routes[spec.Name] = &Route{
+			Spec:    spec,
+			Client:  NewReliClient(routeClient, breaker, limiter.Limiter, spec.MaxRetries),
+			Breaker: breaker,
+			Limiter: limiter,
+		}
+	}
+	return table
+}
+
+func newBreaker(spec BreakerSpec, onStateChange func(name string, from, to gobreaker.State)) *ManagedBreaker {
+	return NewManagedBreaker(gobreaker.Settings{
+		Name:        spec.Name,
+		MaxRequests: spec.MaxRequests,
+		Interval:    spec.Interval,
+		Timeout:     spec.Timeout,
+		ReadyToTrip: func(counts gobreaker.Counts) bool {
+			return counts.TotalFailures > spec.FailureThreshold
+		},
+		OnStateChange: onStateChange,
+	})
+}
+
+// headerClient はルートのヘッダを付けて上流へリクエストを送る
+type headerClient struct {
+	client  HttpClient
+	headers map[string]string
+}
+
+func (c *headerClient) Get(url string) (*http.Response, error) {
+	return c.GetWithContext(context.Background(), url)
+}
+
+func (c *headerClient) GetWithContext(ctx context.Context, url string) (*http.Response, error) {
+	return c.client.GetWithContext(WithHeaders(ctx, c.headers), url)
+}
+
+// Route は name のルートを返す。t が nil の場合はルートがないものとして扱う
+func (t *RouteTable) Route(name string) (*Route, bool) {
+	if t == nil {
+		return nil, false
+	}
+	route, ok := t.routes[name]
+	return route, ok
+}
+
+// Routes は全てのルートを名前順に返す
+func (t *RouteTable) Routes() []*Route {
+	routes := make([]*Route, 0, len(t.routes))
+	for _, route := range t.routes {
+		routes = append(routes, route)
+	}
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Spec.Name < routes[j].Spec.Name })
+	return routes
+}
+
+// Breakers は全てのルートのサーキットブレーカーを重複なく名前順に返す
+func (t *RouteTable) Breakers() []*ManagedBreaker {
+	seen := make(map[*ManagedBreaker]bool)
+	var breakers []*ManagedBreaker
+	for _, route := range t.Routes() {
+		if !seen[route.Breaker] {
+			seen[route.Breaker] = true
+			breakers = append(breakers, route.Breaker)
+		}
+	}
+	sort.Slice(breakers, func(i, j int) bool { return breakers[i].Name() < breakers[j].Name() })
+	return breakers
+}
+
+// InFlight はこのルートテーブルで処理中のリクエスト数を返す
+func (t *RouteTable) InFlight() int64 {
+	return t.inFlight.Load()
+}
+
+// Drain は処理中のリクエストがなくなるか ctx が終了するまで待つ
+func (t *RouteTable) Drain(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for t.InFlight() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// Router は設定の再読み込みで差し替わるルートテーブルを保持する
+type Router struct {
+	table atomic.Pointer[RouteTable]
+}
+
+func NewRouter(table *RouteTable) *Router {
+	r := &Router{}
+	r.table.Store(table)
+	return r
+}
+
+// Current は現在のルートテーブルを返す
+func (r *Router) Current() *RouteTable {
+	return r.table.Load()
+}
+
+// Acquire は現在のルートテーブルを返す。呼び出し側はリクエストが完了したら release を呼ぶ
+//
+// 差し替えの後も処理中のリクエストは取得したルートテーブルで完了させる。
+func (r *Router) Acquire() (table *RouteTable, release func()) {
+	table = r.table.Load()
+	table.inFlight.Add(1)
+	return table, func() { table.inFlight.Add(-1) }
+}
+
+// Swap はルートテーブルを差し替え、それまでのルートテーブルを返す
+func (r *Router) Swap(table *RouteTable) *RouteTable {
+	return r.table.Swap(table)
+}
@@ -0,0 +1,99 @@
+package httpclient_test
+
+import (
+	"context"
+	"reliproxy/pkg/httpclient"
+	"testing"
+	"time"
+
+	"github.com/sony/gobreaker"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+)
+
+func routeSpec(name, breaker string) httpclient.RouteSpec {
+	return httpclient.RouteSpec{
+		Name:       name,
+		URL:        "https://" + name + ".example.com/data",
+		MaxRetries: 1,
+		RateLimit:  5,
+		Burst:      10,
+		Breaker: httpclient.BreakerSpec{
+			Name:        breaker,
+			MaxRequests: 1,
+			Timeout:     time.Minute,
+		},
+	}
+}
+
+func TestNewRouteTable_KeepsUnchangedBreakers(t *testing.T) {
+	client := new(httpclient.MockClient)
+	previous := httpclient.NewRouteTable([]httpclient.RouteSpec{
+		routeSpec("default", "shared"),
+		routeSpec("partner", "partner"),
+	}, nil, client, nil)
+
+	shared, _ := previous.Route("default")
+	partner, _ := previous.Route("partner")
+	shared.Breaker.ForceOpen()
+	partner.Breaker.ForceOpen()
+
+	changed := routeSpec("partner", "partner")
+	changed.URL = "https://partner-v2.example.com/data"
+	changed.RateLimit = 1
+	changed.Breaker.Timeout = time.Second
+	table := httpclient.NewRouteTable([]httpclient.RouteSpec{
+		routeSpec("default", "shared"),
+		changed,
+		routeSpec("billing", "shared"),
+	}, previous, client, nil)
+
+	// 設定が同じサーキットブレーカーは強制した状態も含めて引き継ぐ
+	route, ok := table.Route("default")
+	require.True(t, ok)
+	assert.Same(t, shared.Breaker, route.Breaker)
+	assert.Equal(t, gobreaker.StateOpen, route.Breaker.State())
+
+	billing, ok := table.Route("billing")
+	require.True(t, ok)
+	assert.Same(t, shared.Breaker, billing.Breaker)
+
+	// 設定が変わったサーキットブレーカーは閉じた状態から作り直す
+	route, ok = table.Route("partner")
+	require.True(t, ok)
+	assert.NotSame(t, partner.Breaker, route.Breaker)
+	assert.Equal(t, gobreaker.StateClosed, route.Breaker.State())
+	assert.Equal(t, "https://partner-v2.example.com/data", route.Spec.URL)
+
+	// レートリミッターは同じ名前のルートのものを新しいレートで使い続ける
+	assert.Same(t, partner.Limiter, route.Limiter)
+	assert.Equal(t, rate.Limit(1), route.Limiter.Limit())
+
+	assert.Len(t, table.Breakers(), 2)
+	_, ok = table.Route("unknown")
+	assert.False(t, ok)
+}
+
+func TestRouter_DrainsPreviousTable(t *testing.T) {
+	client := new(httpclient.MockClient)
+	first := httpclient.NewRouteTable([]httpclient.RouteSpec{routeSpec("default", "default")}, nil, client, nil)
+	router := httpclient.NewRouter(first)
+
+	table, release := router.Acquire()
+	assert.Same(t, first, table)
+
+	second := httpclient.NewRouteTable([]httpclient.RouteSpec{routeSpec("default", "default")}, first, client, nil)
+	assert.Same(t, first, router.Swap(second))
+	assert.Same(t, second, router.Current())
+
+	// 差し替える前に始まったリクエストが完了するまで待つ
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, first.Drain(ctx, time.Millisecond), context.DeadlineExceeded)
+	assert.Equal(t, int64(1), first.InFlight())
+
+	release()
+	assert.NoError(t, first.Drain(context.Background(), time.Millisecond))
+	assert.Equal(t, int64(0), second.InFlight())
+}
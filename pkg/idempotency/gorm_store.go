@@ -0,0 +1,81 @@
+package idempotency
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// IdempotencyRecord は GormStore が保存する Record
+type IdempotencyRecord struct {
+	Key         string `gorm:"primary_key;size:255"`
+	Fingerprint string
+	Completed   bool
+	StatusCode  int
+	ContentType string
+	Body        []byte
+	ExpiresAt   time.Time `gorm:"index"`
+}
+
+type GormStore struct {
+	db *gorm.DB
+}
+
+func NewGormStore(db *gorm.DB) *GormStore {
+	return &GormStore{db}
+}
+
+func (s *GormStore) Get(key string) (*Record, error) {
+	var record IdempotencyRecord
+	err := s.db.Where("expires_at > ?", time.Now()).Take(&record, "`key` = ?", key).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrRecordNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Record{
+		Fingerprint: record.Fingerprint,
+		Completed:   record.Completed,
+		StatusCode:  record.StatusCode,
+		ContentType: record.ContentType,
+		Body:        record.Body,
+	}, nil
+}
+
+func (s *GormStore) Reserve(key string, fingerprint string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	// 期限切れのレコードは未使用のキーとして扱う
+	err := s.db.Where("`key` = ? AND expires_at <= ?", key, now).Delete(&IdempotencyRecord{}).Error
+	if err != nil {
+		return false, err
+	}
+
+	result := s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&IdempotencyRecord{
+		Key:         key,
+		Fingerprint: fingerprint,
+		ExpiresAt:   now.Add(ttl),
+	})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+func (s *GormStore) Save(key string, record *Record, ttl time.Duration) error {
+	return s.db.Save(&IdempotencyRecord{
+		Key:         key,
+		Fingerprint: record.Fingerprint,
+		Completed:   record.Completed,
+		StatusCode:  record.StatusCode,
+		ContentType: record.ContentType,
+		Body:        record.Body,
+		ExpiresAt:   time.Now().Add(ttl),
+	}).Error
+}
+
+func (s *GormStore) Delete(key string) error {
+	return s.db.Delete(&IdempotencyRecord{}, "`key` = ?", key).Error
+}
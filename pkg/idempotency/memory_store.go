@@ -0,0 +1,76 @@
+package idempotency
+
+import (
+	"sync"
+	"time"
+)
+
+type memoryEntry struct {
+	record    Record
+	expiresAt time.Time
+}
+
+// MemoryStore は単一プロセス用のスレッドセーフな Store
+type MemoryStore struct {
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{entries: make(map[string]memoryEntry)}
+}
+
+func (s *MemoryStore) Get(key string) (*Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.lookup(key)
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+	record := entry.record
+	return &record, nil
+}
+
+func (s *MemoryStore) Reserve(key string, fingerprint string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.lookup(key); ok {
+		return false, nil
+	}
+	s.entries[key] = memoryEntry{
+		record:    Record{Fingerprint: fingerprint},
+		expiresAt: time.Now().Add(ttl),
+	}
+	return true, nil
+}
+
+func (s *MemoryStore) Save(key string, record *Record, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries[key] = memoryEntry{record: *record, expiresAt: time.Now().Add(ttl)}
+	return nil
+}
+
+func (s *MemoryStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.entries, key)
+	return nil
+}
+
+// lookup は期限切れのエントリを削除しつつ有効なエントリを返す
+func (s *MemoryStore) lookup(key string) (memoryEntry, bool) {
+	entry, ok := s.entries[key]
+	if !ok {
+		return memoryEntry{}, false
+	}
+	if time.Now().After(entry.expiresAt) {
+		delete(s.entries, key)
+		return memoryEntry{}, false
+	}
+	return entry, true
+}
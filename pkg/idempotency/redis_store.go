@@ -0,0 +1,61 @@
+package idempotency
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+type RedisClient interface {
+	Get(ctx context.Context, key string) *redis.StringCmd
+	SetNX(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.BoolCmd
+	Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.StatusCmd
+	Del(ctx context.Context, keys ...string) *redis.IntCmd
+}
+
+type RedisStore struct {
+	client    RedisClient
+	keyPrefix string
+}
+
+func NewRedisStore(client RedisClient, keyPrefix string) *RedisStore {
+	return &RedisStore{client: client, keyPrefix: keyPrefix}
+}
+
+func (s *RedisStore) Get(key string) (*Record, error) {
+	data, err := s.client.Get(context.Background(), s.keyPrefix+key).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrRecordNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var record Record
+	if err := json.Unmarshal([]byte(data), &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+func (s *RedisStore) Reserve(key string, fingerprint string, ttl time.Duration) (bool, error) {
+	data, err := json.Marshal(Record{Fingerprint: fingerprint})
+	if err != nil {
+		return false, err
+	}
+	return s.client.SetNX(context.Background(), s.keyPrefix+key, string(data), ttl).Result()
+}
+
+func (s *RedisStore) Save(key string, record *Record, ttl time.Duration) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return s.client.Set(context.Background(), s.keyPrefix+key, string(data), ttl).Err()
+}
+
+func (s *RedisStore) Delete(key string) error {
+	return s.client.Del(context.Background(), s.keyPrefix+key).Err()
+}
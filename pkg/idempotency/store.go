@@ -0,0 +1,25 @@
+package idempotency
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrRecordNotFound = errors.New("idempotency record not found")
+
+// Record は Idempotency-Key に紐づく最初のリクエストの内容と結果
+type Record struct {
+	Fingerprint string `json:"fingerprint"`
+	Completed   bool   `json:"completed"`
+	StatusCode  int    `json:"status_code,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Body        []byte `json:"body,omitempty"`
+}
+
+type Store interface {
+	Get(key string) (*Record, error)
+	// Reserve はキーが未使用の場合のみ処理中のレコードを登録し、登録できたかを返す
+	Reserve(key string, fingerprint string, ttl time.Duration) (bool, error)
+	Save(key string, record *Record, ttl time.Duration) error
+	Delete(key string) error
+}
@@ -0,0 +1,14 @@
+package metrics
+
+import "github.com/sony/gobreaker"
+
+// ObserveBreakerStateChange は gobreaker.Settings の OnStateChange に設定して状態の遷移を記録する
+func ObserveBreakerStateChange(name string, from gobreaker.State, to gobreaker.State) {
+	BreakerTransitions.WithLabelValues(name, from.String(), to.String()).Inc()
+	SetBreakerState(name, to)
+}
+
+// SetBreakerState はサーキットブレーカーの現在の状態を記録する
+func SetBreakerState(name string, state gobreaker.State) {
+	BreakerState.WithLabelValues(name).Set(float64(state))
+}
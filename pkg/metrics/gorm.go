@@ -0,0 +1,56 @@
+package metrics
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const startTimeKey = "metrics:start_time"
+
+// GormPlugin は gorm の各操作の処理時間を記録するプラグイン
+type GormPlugin struct{}
+
+func NewGormPlugin() *GormPlugin {
+	return &GormPlugin{}
+}
+
+func (p *GormPlugin) Name() string {
+	return "metrics"
+}
+
+func (p *GormPlugin) Initialize(db *gorm.DB) error {
+	return errors.Join(
+		db.Callback().Create().Before("gorm:create").Register("metrics:before_create", startTimer),
+		db.Callback().Create().After("gorm:create").Register("metrics:after_create", observeDuration("create")),
+		db.Callback().Query().Before("gorm:query").Register("metrics:before_query", startTimer),
+		db.Callback().Query().After("gorm:query").Register("metrics:after_query", observeDuration("query")),
+		db.Callback().Update().Before("gorm:update").Register("metrics:before_update", startTimer),
+		db.Callback().Update().After("gorm:update").Register("metrics:after_update", observeDuration("update")),
+		db.Callback().Delete().Before("gorm:delete").Register("metrics:before_delete", startTimer),
+		db.Callback().Delete().After("gorm:delete").Register("metrics:after_delete", observeDuration("delete")),
+		db.Callback().Row().Before("gorm:row").Register("metrics:before_row", startTimer),
+		db.Callback().Row().After("gorm:row").Register("metrics:after_row", observeDuration("row")),
+		db.Callback().Raw().Before("gorm:raw").Register("metrics:before_raw", startTimer),
+		db.Callback().Raw().After("gorm:raw").Register("metrics:after_raw", observeDuration("raw")),
+	)
+}
+
+func startTimer(db *gorm.DB) {
+	db.InstanceSet(startTimeKey, time.Now())
+}
+
+func observeDuration(operation string) func(*gorm.DB) {
+	return func(db *gorm.DB) {
+		value, ok := db.InstanceGet(startTimeKey)
+		if !ok {
+			return
+		}
+		start, ok := value.(time.Time)
+		if !ok {
+			return
+		}
+		DBOperationDuration.WithLabelValues(operation, db.Statement.Table).Observe(time.Since(start).Seconds())
+	}
+}
@@ -0,0 +1,90 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "reliproxy"
+
+var (
+	// HTTPRequests はルート、メソッド、ステータスコードごとの受け付けたリクエスト数
+	HTTPRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "Number of HTTP requests handled by route, method and status code.",
+	}, []string{"route", "method", "status"})
+
+	// HTTPRequestDuration はルート、メソッド、ステータスコードごとのリクエストの処理時間
+	HTTPRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of HTTP requests by route, method and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	// UpstreamRetries は上流へのリクエストを再試行した回数
+	UpstreamRetries = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_retries_total",
+		Help:      "Number of retry attempts made after a failed upstream request.",
+	})
+
+	// RateLimitRejections はレート制限で拒否したリクエスト数
+	RateLimitRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limit_rejections_total",
+		Help:      "Number of requests rejected by a rate limiter.",
+	}, []string{"limiter"})
+
+	// BreakerState はサーキットブレーカーの現在の状態。0 が closed、1 が half-open、2 が open
+	BreakerState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "circuit_breaker_state",
+		Help:      "Current circuit breaker state (0 = closed, 1 = half-open, 2 = open).",
+	}, []string{"name"})
+
+	// BreakerTransitions はサーキットブレーカーの状態の遷移回数
+	BreakerTransitions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "circuit_breaker_transitions_total",
+		Help:      "Number of circuit breaker state transitions.",
+	}, []string{"name", "from", "to"})
+
+	// QueueEnqueued は優先度ごとのキューに追加したリクエスト数
+	QueueEnqueued = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "queue_enqueued_total",
+		Help:      "Number of requests added to the queue by priority.",
+	}, []string{"priority"})
+
+	// QueueDequeued は優先度ごとのキューから取り出したリクエスト数
+	QueueDequeued = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "queue_dequeued_total",
+		Help:      "Number of requests taken from the queue by priority.",
+	}, []string{"priority"})
+
+	// ConsumerJobs は処理結果ごとのワーカーが処理したジョブ数
+	ConsumerJobs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "consumer_jobs_total",
+		Help:      "Number of jobs handled by the consumer by outcome.",
+	}, []string{"outcome"})
+
+	// ConsumerJobDuration は処理結果ごとのジョブの処理時間
+	ConsumerJobDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "consumer_job_duration_seconds",
+		Help:      "Time spent handling a job by outcome.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"outcome"})
+
+	// DBOperationDuration は操作とテーブルごとの DB 操作の処理時間
+	DBOperationDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "db_operation_duration_seconds",
+		Help:      "Latency of database operations by operation and table.",
+		Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"operation", "table"})
+)
@@ -0,0 +1,83 @@
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sony/gobreaker"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeQueue struct {
+	depths map[string]int64
+	age    time.Duration
+	err    error
+}
+
+func (q *fakeQueue) Depths() (map[string]int64, error) {
+	return q.depths, q.err
+}
+
+func (q *fakeQueue) OldestAge() (time.Duration, error) {
+	return q.age, q.err
+}
+
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(Middleware())
+	router.GET("/requests/:id", func(c *gin.Context) {
+		c.Status(http.StatusNotFound)
+	})
+
+	before := testutil.ToFloat64(HTTPRequests.WithLabelValues("/requests/:id", "GET", "404"))
+	unmatched := testutil.ToFloat64(HTTPRequests.WithLabelValues("unmatched", "GET", "404"))
+	for _, path := range []string{"/requests/a", "/requests/b", "/unknown"} {
+		req, _ := http.NewRequest("GET", path, nil)
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// パスパラメータを含まないルートごとに数える
+	assert.Equal(t, before+2, testutil.ToFloat64(HTTPRequests.WithLabelValues("/requests/:id", "GET", "404")))
+	assert.Equal(t, unmatched+1, testutil.ToFloat64(HTTPRequests.WithLabelValues("unmatched", "GET", "404")))
+}
+
+func TestObserveBreakerStateChange(t *testing.T) {
+	breaker := gobreaker.NewCircuitBreaker(gobreaker.Settings{
+		Name:          "test",
+		ReadyToTrip:   func(counts gobreaker.Counts) bool { return counts.ConsecutiveFailures >= 1 },
+		OnStateChange: ObserveBreakerStateChange,
+	})
+	SetBreakerState("test", gobreaker.StateClosed)
+
+	breaker.Execute(func() (interface{}, error) {
+		return nil, errors.New("upstream error")
+	})
+
+	assert.Equal(t, float64(gobreaker.StateOpen), testutil.ToFloat64(BreakerState.WithLabelValues("test")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(BreakerTransitions.WithLabelValues("test", "closed", "open")))
+}
+
+func TestQueueCollector(t *testing.T) {
+	collector := NewQueueCollector[string](&fakeQueue{depths: map[string]int64{"high": 2, "normal": 40}, age: 90 * time.Second})
+
+	expected := `
+# HELP reliproxy_queue_depth Number of requests waiting in the queue.
+# TYPE reliproxy_queue_depth gauge
+reliproxy_queue_depth{priority="high"} 2
+reliproxy_queue_depth{priority="normal"} 40
+# HELP reliproxy_queue_oldest_age_seconds Seconds since the oldest waiting request was added to the queue.
+# TYPE reliproxy_queue_oldest_age_seconds gauge
+reliproxy_queue_oldest_age_seconds 90
+`
+	assert.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(expected)))
+
+	// キューの負荷を取得できない場合はスクレイプのエラーになる
+	assert.Error(t, testutil.CollectAndCompare(NewQueueCollector[string](&fakeQueue{err: errors.New("redis error")}), strings.NewReader("")))
+}
@@ -0,0 +1,55 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MeasurableQueue は優先度ごとの保留中のリクエスト数と最も古いリクエストの経過時間を返せるキュー
+type MeasurableQueue[P ~string] interface {
+	Depths() (map[P]int64, error)
+	OldestAge() (time.Duration, error)
+}
+
+var (
+	queueDepthDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "queue", "depth"),
+		"Number of requests waiting in the queue.",
+		[]string{"priority"}, nil,
+	)
+	queueOldestAgeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "queue", "oldest_age_seconds"),
+		"Seconds since the oldest waiting request was added to the queue.",
+		nil, nil,
+	)
+)
+
+// QueueCollector はスクレイプのたびに優先度ごとのキューの深さと最も古いリクエストの経過時間を取得する
+type QueueCollector[P ~string] struct {
+	queue MeasurableQueue[P]
+}
+
+func NewQueueCollector[P ~string](queue MeasurableQueue[P]) *QueueCollector[P] {
+	return &QueueCollector[P]{queue: queue}
+}
+
+func (c *QueueCollector[P]) Describe(ch chan<- *prometheus.Desc) {
+	ch <- queueDepthDesc
+	ch <- queueOldestAgeDesc
+}
+
+func (c *QueueCollector[P]) Collect(ch chan<- prometheus.Metric) {
+	if depths, err := c.queue.Depths(); err != nil {
+		ch <- prometheus.NewInvalidMetric(queueDepthDesc, err)
+	} else {
+		for priority, depth := range depths {
+			ch <- prometheus.MustNewConstMetric(queueDepthDesc, prometheus.GaugeValue, float64(depth), string(priority))
+		}
+	}
+	if age, err := c.queue.OldestAge(); err != nil {
+		ch <- prometheus.NewInvalidMetric(queueOldestAgeDesc, err)
+	} else {
+		ch <- prometheus.MustNewConstMetric(queueOldestAgeDesc, prometheus.GaugeValue, age.Seconds())
+	}
+}
@@ -0,0 +1,50 @@
+package outbox
+
+import (
+	"encoding/json"
+	"reliproxy/pkg/queue"
+	"reliproxy/pkg/repository"
+	"reliproxy/pkg/utils"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Relay はアウトボックスに保存されたジョブをキューへ送信する
+type Relay struct {
+	repository repository.OutboxRepository
+	queue      queue.Queue
+	interval   time.Duration
+	batchSize  int
+}
+
+func NewRelay(repository repository.OutboxRepository, queue queue.Queue, interval time.Duration, batchSize int) *Relay {
+	return &Relay{
+		repository: repository,
+		queue:      queue,
+		interval:   interval,
+		batchSize:  batchSize,
+	}
+}
+
+func (r *Relay) Start() {
+	for {
+		sent, err := r.RelayOnce()
+		if err != nil {
+			utils.Logger.WithFields(logrus.Fields{
+				"error": err,
+			}).Error("Failed to relay outbox messages")
+		}
+
+		// バッチが埋まっている間は待たずに続きを送信する
+		if err != nil || sent < r.batchSize {
+			time.Sleep(r.interval)
+		}
+	}
+}
+
+func (r *Relay) RelayOnce() (int, error) {
+	return r.repository.ProcessUnsent(r.batchSize, func(message *repository.OutboxMessage) error {
+		return r.queue.Enqueue(message.RequestID, json.RawMessage(message.Payload))
+	})
+}
@@ -0,0 +1,89 @@
+package queue
+
+import "time"
+
+// DelayedQueue は実行時刻が未来のリクエストをスケジュールに保持し、時刻を迎えてからキューに追加する
+type DelayedQueue struct {
+	queue    Queue
+	schedule Schedule
+}
+
+func NewDelayedQueue(queue Queue, schedule Schedule) *DelayedQueue {
+	return &DelayedQueue{queue: queue, schedule: schedule}
+}
+
+func (q *DelayedQueue) Enqueue(requestID string, requestData interface{}) error {
+	if job, err := DecodeJob(requestData); err == nil && job.NotBefore != nil && job.NotBefore.After(time.Now()) {
+		return q.schedule.Add(requestID, requestData, *job.NotBefore)
+	}
+	return q.queue.Enqueue(requestID, requestData)
+}
+
+// EnqueueBatch は実行時刻が未来のリクエストをスケジュールに、それ以外をまとめてキューに追加する
+func (q *DelayedQueue) EnqueueBatch(requests []Request) error {
+	now := time.Now()
+	ready := make([]Request, 0, len(requests))
+	for _, request := range requests {
+		if job, err := DecodeJob(request.Data); err == nil && job.NotBefore != nil && job.NotBefore.After(now) {
+			if err := q.schedule.Add(request.ID, request.Data, *job.NotBefore); err != nil {
+				return err
+			}
+			continue
+		}
+		ready = append(ready, request)
+	}
+	return EnqueueBatch(q.queue, ready)
+}
+
+func (q *DelayedQueue) Dequeue() (string, interface{}, error) {
+	return q.queue.Dequeue()
+}
+
+func (q *DelayedQueue) Ack(requestID string) error {
+	if acknowledger, ok := q.queue.(Acknowledger); ok {
+		return acknowledger.Ack(requestID)
+	}
+	return nil
+}
+
+func (q *DelayedQueue) Nack(requestID string, delay time.Duration) error {
+	if acknowledger, ok := q.queue.(Acknowledger); ok {
+		return acknowledger.Nack(requestID, delay)
+	}
+	return ErrRetryUnsupported
+}
+
+// PromoteDue は実行時刻を迎えたリクエストをキューに追加し、追加したリクエストの ID を返す
+//
+// ready が指定された場合はキューに追加する前に呼び出し、false を返したリクエストは追加せずにスケジュールから取り除く。
+// ワーカーが取り出した時点でステータスが queued になっているよう、ready でステータスを更新する。
+func (q *DelayedQueue) PromoteDue(limit int, ready func(requestID string) (bool, error)) ([]string, error) {
+	var promoted []string
+	_, err := q.schedule.PromoteDue(time.Now(), limit, func(requestID string, requestData interface{}) error {
+		if ready != nil {
+			ok, err := ready(requestID)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return nil
+			}
+		}
+		if err := q.queue.Enqueue(requestID, requestData); err != nil {
+			return err
+		}
+		promoted = append(promoted, requestID)
+		return nil
+	})
+	return promoted, err
+}
+
+// Cancel は実行時刻を迎えていないリクエストを取り除き、取り除けたかを返す
+func (q *DelayedQueue) Cancel(requestID string) (bool, error) {
+	return q.schedule.Remove(requestID)
+}
+
+// ScheduledLen は実行時刻を待っているリクエスト数を返す
+func (q *DelayedQueue) ScheduledLen() (int64, error) {
+	return q.schedule.Len()
+}
@@ -0,0 +1,99 @@
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDelayedQueue(t *testing.T) {
+	t.Run("ImmediateJob", func(t *testing.T) {
+		memoryQueue := NewMemoryQueue()
+		queue := NewDelayedQueue(memoryQueue, NewMemorySchedule())
+
+		assert.NoError(t, queue.Enqueue("now", &Job{}))
+
+		depth, _ := memoryQueue.Len()
+		assert.Equal(t, int64(1), depth)
+	})
+
+	t.Run("ScheduledJob", func(t *testing.T) {
+		memoryQueue := NewMemoryQueue()
+		queue := NewDelayedQueue(memoryQueue, NewMemorySchedule())
+
+		notBefore := time.Now().Add(50 * time.Millisecond)
+		assert.NoError(t, queue.Enqueue("later", &Job{NotBefore: &notBefore}))
+
+		depth, _ := memoryQueue.Len()
+		assert.Equal(t, int64(0), depth)
+		scheduled, _ := queue.ScheduledLen()
+		assert.Equal(t, int64(1), scheduled)
+
+		promoted, err := queue.PromoteDue(10, nil)
+		assert.NoError(t, err)
+		assert.Empty(t, promoted)
+
+		time.Sleep(60 * time.Millisecond)
+		promoted, err = queue.PromoteDue(10, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"later"}, promoted)
+
+		requestID, _, err := queue.Dequeue()
+		assert.NoError(t, err)
+		assert.Equal(t, "later", requestID)
+	})
+
+	t.Run("PromotesInDueOrder", func(t *testing.T) {
+		queue := NewDelayedQueue(NewMemoryQueue(), NewMemorySchedule())
+		schedule := queue.schedule
+
+		now := time.Now()
+		assert.NoError(t, schedule.Add("second", &Job{}, now.Add(-time.Second)))
+		assert.NoError(t, schedule.Add("first", &Job{}, now.Add(-2*time.Second)))
+		assert.NoError(t, schedule.Add("future", &Job{}, now.Add(time.Hour)))
+
+		promoted, err := queue.PromoteDue(10, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"first", "second"}, promoted)
+	})
+
+	t.Run("SkipsNotReady", func(t *testing.T) {
+		memoryQueue := NewMemoryQueue()
+		queue := NewDelayedQueue(memoryQueue, NewMemorySchedule())
+
+		now := time.Now()
+		assert.NoError(t, queue.schedule.Add("cancelled", &Job{}, now.Add(-time.Second)))
+		assert.NoError(t, queue.schedule.Add("ready", &Job{}, now.Add(-time.Second)))
+
+		var checked []string
+		promoted, err := queue.PromoteDue(10, func(requestID string) (bool, error) {
+			// キューに追加する前に呼び出される
+			depth, _ := memoryQueue.Len()
+			assert.Equal(t, int64(0), depth)
+			checked = append(checked, requestID)
+			return requestID == "ready", nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"cancelled", "ready"}, checked)
+		assert.Equal(t, []string{"ready"}, promoted)
+
+		scheduled, _ := queue.ScheduledLen()
+		assert.Equal(t, int64(0), scheduled)
+	})
+
+	t.Run("Cancel", func(t *testing.T) {
+		queue := NewDelayedQueue(NewMemoryQueue(), NewMemorySchedule())
+
+		notBefore := time.Now().Add(time.Hour)
+		assert.NoError(t, queue.Enqueue("later", &Job{NotBefore: &notBefore}))
+
+		cancelled, err := queue.Cancel("later")
+		assert.NoError(t, err)
+		assert.True(t, cancelled)
+
+		cancelled, err = queue.Cancel("later")
+		assert.NoError(t, err)
+		assert.False(t, cancelled)
+	})
+}
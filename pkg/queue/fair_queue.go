@@ -0,0 +1,426 @@
+package queue
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// TenantRegistry はキューにリクエストを追加したことのあるテナントを記録する
+//
+// 複数のレプリカが同じテナントのサブキューを処理できるよう、共有ストアに保存する実装を使う。
+type TenantRegistry interface {
+	Register(tenant string) error
+	Unregister(tenant string) error
+	Tenants() ([]string, error)
+}
+
+// defaultIdleTimeout はサブキューが空のままこの期間が過ぎたテナントを取り出し対象から外す
+const defaultIdleTimeout = 10 * time.Minute
+
+// TenantStats はテナントごとのキューの統計
+type TenantStats struct {
+	Backlog          int64   `json:"backlog"`
+	Dequeued         int64   `json:"dequeued"`
+	AvgWaitSeconds   float64 `json:"avg_wait_seconds"`
+	LastWaitSeconds  float64 `json:"last_wait_seconds"`
+	OldestAgeSeconds float64 `json:"oldest_age_seconds"`
+}
+
+type tenantWait struct {
+	dequeued  int64
+	totalWait time.Duration
+	lastWait  time.Duration
+}
+
+// FairQueue はテナントごとのサブキューから deficit round-robin でリクエストを取り出すキュー
+//
+// 各テナントは重み(quantum)の数だけ連続して取り出され、大量のリクエストを追加したテナントが
+// 他のテナントのリクエストを待たせないようにする。
+type FairQueue struct {
+	registry        TenantRegistry
+	newQueue        func(tenant string) PollingQueue
+	weights         map[string]int
+	pollInterval    time.Duration
+	refreshInterval time.Duration
+	idleTimeout     time.Duration
+
+	mu          sync.Mutex
+	queues      map[string]PollingQueue
+	tenants     []string
+	refreshedAt time.Time
+	next        int
+	deficits    map[string]int
+	inFlight    map[string]string
+	waits       map[string]*tenantWait
+	// idleSince はサブキューが空だと分かった時刻
+	idleSince map[string]time.Time
+}
+
+func NewFairQueue(registry TenantRegistry, newQueue func(tenant string) PollingQueue, weights map[string]int, pollInterval time.Duration) *FairQueue {
+	return &FairQueue{
+		registry:        registry,
+		newQueue:        newQueue,
+		weights:         weights,
+		pollInterval:    pollInterval,
+		refreshInterval: time.Second,
+		idleTimeout:     defaultIdleTimeout,
+		queues:          make(map[string]PollingQueue),
+		deficits:        make(map[string]int),
+		inFlight:        make(map[string]string),
+		waits:           make(map[string]*tenantWait),
+		idleSince:       make(map[string]time.Time),
+	}
+}
+
+// Enqueue はサブキューに追加してからテナントを登録する
+//
+// 他のレプリカがアイドルのテナントを登録から外すのと競合しても、追加したリクエストのテナントは必ず登録された状態になる。
+func (q *FairQueue) Enqueue(requestID string, requestData interface{}) error {
+	tenant := JobTenant(requestData)
+	q.mu.Lock()
+	lane := q.queue(tenant)
+	q.addTenant(tenant)
+	delete(q.idleSince, tenant)
+	q.mu.Unlock()
+
+	if err := lane.Enqueue(requestID, requestData); err != nil {
+		return err
+	}
+	return q.registry.Register(tenant)
+}
+
+// EnqueueBatch はリクエストをテナントごとにまとめてサブキューに追加する
+func (q *FairQueue) EnqueueBatch(requests []Request) error {
+	var tenants []string
+	byTenant := make(map[string][]Request)
+	for _, request := range requests {
+		tenant := JobTenant(request.Data)
+		if _, ok := byTenant[tenant]; !ok {
+			tenants = append(tenants, tenant)
+		}
+		byTenant[tenant] = append(byTenant[tenant], request)
+	}
+
+	for _, tenant := range tenants {
+		q.mu.Lock()
+		lane := q.queue(tenant)
+		q.addTenant(tenant)
+		delete(q.idleSince, tenant)
+		q.mu.Unlock()
+		if err := EnqueueBatch(lane, byTenant[tenant]); err != nil {
+			return err
+		}
+		if err := q.registry.Register(tenant); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (q *FairQueue) Dequeue() (string, interface{}, error) {
+	for {
+		requestID, requestData, err := q.TryDequeue()
+		if errors.Is(err, ErrQueueEmpty) {
+			time.Sleep(q.pollInterval)
+			continue
+		}
+		return requestID, requestData, err
+	}
+}
+
+// TryDequeue はサブキューからの取り出しの間ロックを解放し、他のワーカーやリクエストの追加を待たせない
+func (q *FairQueue) TryDequeue() (string, interface{}, error) {
+	if err := q.refreshTenants(); err != nil {
+		return "", nil, err
+	}
+
+	for i := 0; ; i++ {
+		q.mu.Lock()
+		n := len(q.tenants)
+		if i >= n {
+			q.mu.Unlock()
+			return "", nil, ErrQueueEmpty
+		}
+		tenant := q.tenants[q.next%n]
+		if q.deficits[tenant] < 1 {
+			q.deficits[tenant] += q.quantum(tenant)
+		}
+		lane := q.queue(tenant)
+		q.mu.Unlock()
+
+		requestID, requestData, err := lane.TryDequeue()
+
+		q.mu.Lock()
+		if errors.Is(err, ErrQueueEmpty) {
+			// 空のテナントは余った deficit を持ち越さない
+			q.deficits[tenant] = 0
+			q.advance(tenant)
+			if _, ok := q.idleSince[tenant]; !ok {
+				q.idleSince[tenant] = time.Now()
+			}
+			q.mu.Unlock()
+			continue
+		}
+		if err != nil {
+			q.mu.Unlock()
+			return "", nil, err
+		}
+		delete(q.idleSince, tenant)
+
+		q.deficits[tenant]--
+		if q.deficits[tenant] < 1 {
+			q.advance(tenant)
+		}
+		q.inFlight[requestID] = tenant
+		q.recordWait(tenant, requestData)
+		q.mu.Unlock()
+		return requestID, requestData, nil
+	}
+}
+
+func (q *FairQueue) Ack(requestID string) error {
+	acknowledger, ok := q.acknowledger(requestID)
+	if !ok {
+		return nil
+	}
+	return acknowledger.Ack(requestID)
+}
+
+func (q *FairQueue) Nack(requestID string, delay time.Duration) error {
+	acknowledger, ok := q.acknowledger(requestID)
+	if !ok {
+		return ErrRetryUnsupported
+	}
+	return acknowledger.Nack(requestID, delay)
+}
+
+func (q *FairQueue) Len() (int64, error) {
+	stats, err := q.TenantStats()
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, s := range stats {
+		total += s.Backlog
+	}
+	return total, nil
+}
+
+// OldestAge は全テナントのサブキューのうち最も古いリクエストの経過時間を返す
+func (q *FairQueue) OldestAge() (time.Duration, error) {
+	stats, err := q.TenantStats()
+	if err != nil {
+		return 0, err
+	}
+	var oldest float64
+	for _, s := range stats {
+		if s.OldestAgeSeconds > oldest {
+			oldest = s.OldestAgeSeconds
+		}
+	}
+	return time.Duration(oldest * float64(time.Second)), nil
+}
+
+// TenantStats はテナントごとの保留中のリクエスト数と、このプロセスで取り出したリクエストの待ち時間を返す
+func (q *FairQueue) TenantStats() (map[string]TenantStats, error) {
+	if err := q.refreshTenants(); err != nil {
+		return nil, err
+	}
+
+	q.mu.Lock()
+	lanes := make(map[string]PollingQueue, len(q.tenants))
+	for _, tenant := range q.tenants {
+		lanes[tenant] = q.queue(tenant)
+	}
+	q.mu.Unlock()
+
+	stats := make(map[string]TenantStats)
+	for tenant, lane := range lanes {
+		var s TenantStats
+		if measurable, ok := lane.(Measurable); ok {
+			backlog, err := measurable.Len()
+			if err != nil {
+				return nil, err
+			}
+			s.Backlog = backlog
+		}
+		if ager, ok := lane.(Ager); ok {
+			age, err := ager.OldestAge()
+			if err != nil {
+				return nil, err
+			}
+			s.OldestAgeSeconds = age.Seconds()
+		}
+		stats[tenant] = s
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for tenant, s := range stats {
+		if wait, ok := q.waits[tenant]; ok && wait.dequeued > 0 {
+			s.Dequeued = wait.dequeued
+			s.AvgWaitSeconds = (wait.totalWait / time.Duration(wait.dequeued)).Seconds()
+			s.LastWaitSeconds = wait.lastWait.Seconds()
+			stats[tenant] = s
+		}
+	}
+	return stats, nil
+}
+
+func (q *FairQueue) acknowledger(requestID string) (Acknowledger, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	tenant, ok := q.inFlight[requestID]
+	if !ok {
+		return nil, false
+	}
+	delete(q.inFlight, requestID)
+	acknowledger, ok := q.queue(tenant).(Acknowledger)
+	return acknowledger, ok
+}
+
+func (q *FairQueue) recordWait(tenant string, requestData interface{}) {
+	job, err := DecodeJob(requestData)
+	if err != nil || job.EnqueuedAt.IsZero() {
+		return
+	}
+	wait, ok := q.waits[tenant]
+	if !ok {
+		wait = &tenantWait{}
+		q.waits[tenant] = wait
+	}
+	wait.dequeued++
+	wait.lastWait = time.Since(job.EnqueuedAt)
+	wait.totalWait += wait.lastWait
+}
+
+// refreshTenants は一定間隔でレジストリからテナントの一覧を読み直す
+//
+// 読み直しの間はロックを解放する。読み直しを始めた時点で refreshedAt を進めるため、
+// 同時に呼ばれても読み直すのは1回だけで、失敗した場合も次の間隔まで読み直さない。
+func (q *FairQueue) refreshTenants() error {
+	q.mu.Lock()
+	if time.Since(q.refreshedAt) < q.refreshInterval {
+		q.mu.Unlock()
+		return nil
+	}
+	q.refreshedAt = time.Now()
+	q.mu.Unlock()
+
+	if err := q.pruneIdleTenants(); err != nil {
+		return err
+	}
+	tenants, err := q.registry.Tenants()
+	if err != nil {
+		return err
+	}
+	sort.Strings(tenants)
+
+	q.mu.Lock()
+	q.tenants = tenants
+	q.mu.Unlock()
+	return nil
+}
+
+// pruneIdleTenants はサブキューが空のまま idleTimeout が過ぎたテナントを登録から外し、サブキューを破棄する
+//
+// 登録を外した後に追加されたリクエストが残っていれば登録し直す。
+// 確認の間にリクエストが追加された場合は Enqueue が idleSince を消すため、サブキューを破棄しない。
+func (q *FairQueue) pruneIdleTenants() error {
+	q.mu.Lock()
+	idleSince := make(map[string]time.Time)
+	lanes := make(map[string]Measurable)
+	for tenant, since := range q.idleSince {
+		if time.Since(since) < q.idleTimeout || q.hasInFlight(tenant) {
+			continue
+		}
+		if measurable, ok := q.queue(tenant).(Measurable); ok {
+			idleSince[tenant] = since
+			lanes[tenant] = measurable
+		}
+	}
+	q.mu.Unlock()
+
+	for tenant, measurable := range lanes {
+		if err := q.registry.Unregister(tenant); err != nil {
+			return err
+		}
+		backlog, err := measurable.Len()
+		if err != nil {
+			return err
+		}
+		if backlog > 0 {
+			if err := q.registry.Register(tenant); err != nil {
+				return err
+			}
+			q.mu.Lock()
+			delete(q.idleSince, tenant)
+			q.mu.Unlock()
+			continue
+		}
+
+		q.mu.Lock()
+		if since, ok := q.idleSince[tenant]; ok && since.Equal(idleSince[tenant]) && !q.hasInFlight(tenant) {
+			delete(q.idleSince, tenant)
+			delete(q.queues, tenant)
+			delete(q.deficits, tenant)
+			delete(q.waits, tenant)
+			if i := sort.SearchStrings(q.tenants, tenant); i < len(q.tenants) && q.tenants[i] == tenant {
+				q.tenants = append(q.tenants[:i], q.tenants[i+1:]...)
+			}
+		}
+		q.mu.Unlock()
+	}
+	return nil
+}
+
+// advance は取り出し位置が tenant を指している場合に次のテナントへ進める。呼び出し側でロックを取得すること
+//
+// 複数のワーカーが同じテナントから取り出した場合に、位置が2つ以上進まないようにする。
+func (q *FairQueue) advance(tenant string) {
+	n := len(q.tenants)
+	if n > 0 && q.tenants[q.next%n] == tenant {
+		q.next = (q.next + 1) % n
+	}
+}
+
+// hasInFlight はテナントのリクエストを処理中かどうかを返す。呼び出し側でロックを取得すること
+func (q *FairQueue) hasInFlight(tenant string) bool {
+	for _, t := range q.inFlight {
+		if t == tenant {
+			return true
+		}
+	}
+	return false
+}
+
+// addTenant は次回の読み直しを待たずにテナントを取り出し対象に加える。呼び出し側でロックを取得すること
+func (q *FairQueue) addTenant(tenant string) {
+	i := sort.SearchStrings(q.tenants, tenant)
+	if i < len(q.tenants) && q.tenants[i] == tenant {
+		return
+	}
+	q.tenants = append(q.tenants, "")
+	copy(q.tenants[i+1:], q.tenants[i:])
+	q.tenants[i] = tenant
+}
+
+// queue はテナントのサブキューを返す。呼び出し側でロックを取得すること
+func (q *FairQueue) queue(tenant string) PollingQueue {
+	lane, ok := q.queues[tenant]
+	if !ok {
+		lane = q.newQueue(tenant)
+		q.queues[tenant] = lane
+	}
+	return lane
+}
+
+func (q *FairQueue) quantum(tenant string) int {
+	if weight, ok := q.weights[tenant]; ok && weight > 0 {
+		return weight
+	}
+	return 1
+}
@@ -0,0 +1,156 @@
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newMemoryFairQueue(weights map[string]int) *FairQueue {
+	return NewFairQueue(NewMemoryTenantRegistry(), func(tenant string) PollingQueue {
+		return NewMemoryQueue()
+	}, weights, time.Millisecond)
+}
+
+func TestFairQueue(t *testing.T) {
+	t.Run("RoundRobinAcrossTenants", func(t *testing.T) {
+		queue := newMemoryFairQueue(nil)
+
+		for i := 0; i < 100; i++ {
+			assert.NoError(t, queue.Enqueue("bulk", &Job{Tenant: "bulk"}))
+		}
+		assert.NoError(t, queue.Enqueue("a", &Job{Tenant: "team-a"}))
+		assert.NoError(t, queue.Enqueue("b", &Job{Tenant: "team-b"}))
+
+		var dequeued []string
+		for i := 0; i < 3; i++ {
+			requestID, _, err := queue.Dequeue()
+			assert.NoError(t, err)
+			dequeued = append(dequeued, requestID)
+		}
+		assert.ElementsMatch(t, []string{"bulk", "a", "b"}, dequeued)
+	})
+
+	t.Run("WeightedQuantum", func(t *testing.T) {
+		queue := newMemoryFairQueue(map[string]int{"team-a": 3})
+
+		for i := 0; i < 10; i++ {
+			assert.NoError(t, queue.Enqueue("a", &Job{Tenant: "team-a"}))
+			assert.NoError(t, queue.Enqueue("b", &Job{Tenant: "team-b"}))
+		}
+
+		counts := make(map[string]int)
+		for i := 0; i < 8; i++ {
+			requestID, _, err := queue.Dequeue()
+			assert.NoError(t, err)
+			counts[requestID]++
+		}
+		assert.Equal(t, map[string]int{"a": 6, "b": 2}, counts)
+	})
+
+	t.Run("TenantStats", func(t *testing.T) {
+		queue := newMemoryFairQueue(nil)
+
+		assert.NoError(t, queue.Enqueue("a-1", &Job{Tenant: "team-a", EnqueuedAt: time.Now().Add(-time.Second)}))
+		assert.NoError(t, queue.Enqueue("a-2", &Job{Tenant: "team-a", EnqueuedAt: time.Now()}))
+		assert.NoError(t, queue.Enqueue("plain", "data"))
+
+		// テナント名の順に取り出されるため default, team-a の順になる
+		for _, expected := range []string{"plain", "a-1"} {
+			requestID, _, err := queue.Dequeue()
+			assert.NoError(t, err)
+			assert.Equal(t, expected, requestID)
+			assert.NoError(t, queue.Ack(requestID))
+		}
+
+		stats, err := queue.TenantStats()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(0), stats[DefaultTenant].Backlog)
+		assert.Equal(t, int64(1), stats["team-a"].Backlog)
+		assert.Equal(t, int64(1), stats["team-a"].Dequeued)
+		assert.GreaterOrEqual(t, stats["team-a"].AvgWaitSeconds, 1.0)
+
+		depth, err := queue.Len()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), depth)
+	})
+	t.Run("PrunesIdleTenants", func(t *testing.T) {
+		registry := NewMemoryTenantRegistry()
+		queue := NewFairQueue(registry, func(tenant string) PollingQueue {
+			return NewMemoryQueue()
+		}, nil, time.Millisecond)
+		queue.refreshInterval = 0
+		queue.idleTimeout = 0
+
+		assert.NoError(t, queue.Enqueue("a", &Job{Tenant: "team-a"}))
+		requestID, _, err := queue.TryDequeue()
+		assert.NoError(t, err)
+		assert.Equal(t, "a", requestID)
+
+		// 処理中のリクエストがある間は空になっても外さない
+		_, _, err = queue.TryDequeue()
+		assert.ErrorIs(t, err, ErrQueueEmpty)
+		_, _, err = queue.TryDequeue()
+		assert.ErrorIs(t, err, ErrQueueEmpty)
+		tenants, _ := registry.Tenants()
+		assert.Equal(t, []string{"team-a"}, tenants)
+
+		assert.NoError(t, queue.Ack("a"))
+		_, _, err = queue.TryDequeue()
+		assert.ErrorIs(t, err, ErrQueueEmpty)
+		tenants, _ = registry.Tenants()
+		assert.Empty(t, tenants)
+		assert.Empty(t, queue.queues)
+
+		// 再び追加されたテナントは取り出し対象に戻る
+		assert.NoError(t, queue.Enqueue("a-2", &Job{Tenant: "team-a"}))
+		requestID, _, err = queue.TryDequeue()
+		assert.NoError(t, err)
+		assert.Equal(t, "a-2", requestID)
+	})
+	t.Run("DoesNotHoldLockDuringDequeue", func(t *testing.T) {
+		release := make(chan struct{})
+		queue := NewFairQueue(NewMemoryTenantRegistry(), func(tenant string) PollingQueue {
+			if tenant == "slow" {
+				return &blockingQueue{MemoryQueue: NewMemoryQueue(), release: release}
+			}
+			return NewMemoryQueue()
+		}, nil, time.Millisecond)
+
+		assert.NoError(t, queue.Enqueue("slow", &Job{Tenant: "slow"}))
+		dequeued := make(chan string)
+		go func() {
+			requestID, _, _ := queue.TryDequeue()
+			dequeued <- requestID
+		}()
+
+		// サブキューの取り出しが返らない間も、他のテナントへの追加と統計の取得は待たされない
+		done := make(chan struct{})
+		go func() {
+			assert.NoError(t, queue.Enqueue("a", &Job{Tenant: "team-a"}))
+			_, err := queue.TenantStats()
+			assert.NoError(t, err)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("Enqueue blocked while a lane was being dequeued")
+		}
+
+		close(release)
+		assert.Equal(t, "slow", <-dequeued)
+	})
+}
+
+// blockingQueue は release が閉じられるまで取り出しを返さないサブキュー
+type blockingQueue struct {
+	*MemoryQueue
+	release chan struct{}
+}
+
+func (q *blockingQueue) TryDequeue() (string, interface{}, error) {
+	<-q.release
+	return q.MemoryQueue.TryDequeue()
+}
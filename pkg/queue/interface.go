@@ -1,6 +1,62 @@
 package queue
 
+import (
+	"errors"
+	"time"
+)
+
+var ErrQueueEmpty = errors.New("queue is empty")
+
+// ErrMaxAttemptsExceeded は Nack されたリクエストが最大試行回数に達し、再び取り出されないことを表す
+var ErrMaxAttemptsExceeded = errors.New("max attempts exceeded")
+
+// ErrRetryUnsupported は Nack されたリクエストをキューに戻せず、再び取り出されないことを表す
+var ErrRetryUnsupported = errors.New("queue does not support retries")
+
 type Queue interface {
 	Enqueue(requestID string, requestData interface{}) error
 	Dequeue() (string, interface{}, error)
 }
+
+// Acknowledger は取り出したリクエストの処理結果をキューに通知できるキュー
+type Acknowledger interface {
+	Ack(requestID string) error
+	// Nack は delay 経過後に再び取り出せるようリクエストをキューに戻す
+	Nack(requestID string, delay time.Duration) error
+}
+
+// PollingQueue はリクエストがなければ待たずに ErrQueueEmpty を返せるキュー
+type PollingQueue interface {
+	Queue
+	TryDequeue() (string, interface{}, error)
+}
+
+// Measurable は保留中のリクエスト数を返せるキュー
+type Measurable interface {
+	Len() (int64, error)
+}
+
+// Ager は最も古い保留中のリクエストがキューに追加されてからの経過時間を返せるキュー
+//
+// 保留中のリクエストがなければ 0 を返す。
+type Ager interface {
+	OldestAge() (time.Duration, error)
+}
+
+// BatchEnqueuer は複数のリクエストをまとめて追加できるキュー
+type BatchEnqueuer interface {
+	EnqueueBatch(requests []Request) error
+}
+
+// EnqueueBatch は q が BatchEnqueuer であればまとめて、そうでなければ1件ずつ追加する
+func EnqueueBatch(q Queue, requests []Request) error {
+	if batchEnqueuer, ok := q.(BatchEnqueuer); ok {
+		return batchEnqueuer.EnqueueBatch(requests)
+	}
+	for _, request := range requests {
+		if err := q.Enqueue(request.ID, request.Data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reliproxy/pkg/tracing"
+	"strings"
+	"time"
+)
+
+type Priority string
+
+const (
+	PriorityHigh   Priority = "high"
+	PriorityNormal Priority = "normal"
+	PriorityLow    Priority = "low"
+)
+
+// Priorities は優先度の高い順に並んだ全ての優先度
+var Priorities = []Priority{PriorityHigh, PriorityNormal, PriorityLow}
+
+func ParsePriority(s string) (Priority, error) {
+	for _, priority := range Priorities {
+		if string(priority) == s {
+			return priority, nil
+		}
+	}
+	return "", fmt.Errorf("unknown priority: %q", s)
+}
+
+// DefaultTenant はテナントが指定されていないリクエストのテナント
+const DefaultTenant = "default"
+
+// Job は非同期リクエストとしてキューに積まれる内容
+type Job struct {
+	// Method と ContentType は上流へ送るリクエストのメソッドと本文の形式。Method が空の場合は GET で送る
+	Method      string `json:"method,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Body        string `json:"body"`
+	// Route は上流へ送るルートの名前。空の場合はデフォルトのルートを使う
+	Route      string    `json:"route,omitempty"`
+	Priority   Priority  `json:"priority,omitempty"`
+	Tenant     string    `json:"tenant,omitempty"`
+	EnqueuedAt time.Time `json:"enqueued_at"`
+	// NotBefore が設定されている場合、その時刻まで取り出されない
+	NotBefore *time.Time `json:"not_before,omitempty"`
+	// CallbackURL が設定されている場合、完了時に結果を POST する
+	CallbackURL string `json:"callback_url,omitempty"`
+	// TraceContext はリクエストを受け付けたときの W3C Trace Context
+	TraceContext map[string]string `json:"trace_context,omitempty"`
+	// CorrelationID はリクエストを受け付けたときの X-Request-ID
+	CorrelationID string `json:"correlation_id,omitempty"`
+}
+
+// DecodeJob はキューから取り出したデータを Job に変換する
+//
+// メモリ上のキューは *Job をそのまま返し、シリアライズするキューは JSON を経由したデータを返すため両方を扱う。
+func DecodeJob(requestData interface{}) (*Job, error) {
+	var data []byte
+	switch v := requestData.(type) {
+	case *Job:
+		return v, nil
+	case Job:
+		return &v, nil
+	case json.RawMessage:
+		data = v
+	case []byte:
+		data = v
+	default:
+		var err error
+		data, err = json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var job Job
+	if err := json.Unmarshal(data, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// jobAge はデータが Job であれば追加時刻から now までの経過時間を、そうでなければ 0 を返す
+func jobAge(requestData interface{}, now time.Time) time.Duration {
+	job, err := DecodeJob(requestData)
+	if err != nil || job.EnqueuedAt.IsZero() || job.EnqueuedAt.After(now) {
+		return 0
+	}
+	return now.Sub(job.EnqueuedAt)
+}
+
+// JobPriority はデータが Job であればその優先度を、そうでなければ通常の優先度を返す
+func JobPriority(requestData interface{}) Priority {
+	job, err := DecodeJob(requestData)
+	if err != nil || job.Priority == "" {
+		return PriorityNormal
+	}
+	return job.Priority
+}
+
+// JobTenant はデータが Job であればそのテナントを、そうでなければ DefaultTenant を返す
+func JobTenant(requestData interface{}) string {
+	job, err := DecodeJob(requestData)
+	if err != nil || job.Tenant == "" {
+		return DefaultTenant
+	}
+	return job.Tenant
+}
+
+// JobRoute はデータが Job であればそのルートの名前を、そうでなければ空文字列を返す
+//
+// 以前のバージョンはリクエストを受け付けたパスを保存していたため、パスはルートの指定がないものとして扱う。
+func JobRoute(requestData interface{}) string {
+	job, err := DecodeJob(requestData)
+	if err != nil || strings.HasPrefix(job.Route, "/") {
+		return ""
+	}
+	return job.Route
+}
+
+// JobContext はジョブを受け付けたリクエストのスパンを親に持つコンテキストを返す
+//
+// キューやスケジュールへの追加を受け付けたリクエストのトレースに含めるために使う。
+func JobContext(requestData interface{}) context.Context {
+	return tracing.Extract(context.Background(), JobTraceContext(requestData))
+}
+
+// batchContext はまとめて追加するリクエストの先頭のジョブから JobContext を返す
+func batchContext(requests []Request) context.Context {
+	if len(requests) == 0 {
+		return context.Background()
+	}
+	return JobContext(requests[0].Data)
+}
+
+// JobTraceContext はデータが Job であればそのトレースコンテキストを、そうでなければ nil を返す
+func JobTraceContext(requestData interface{}) map[string]string {
+	job, err := DecodeJob(requestData)
+	if err != nil {
+		return nil
+	}
+	return job.TraceContext
+}
@@ -0,0 +1,155 @@
+package queue
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrRequestNotInFlight = errors.New("request is not in flight")
+
+type memoryItem struct {
+	requestID   string
+	requestData interface{}
+	visibleAt   time.Time
+	enqueuedAt  time.Time
+	attempts    int
+}
+
+// MemoryQueue は単一プロセス用のスレッドセーフなキュー
+type MemoryQueue struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	items    []memoryItem
+	inFlight map[string]memoryItem
+
+	maxAttempts int
+}
+
+func NewMemoryQueue() *MemoryQueue {
+	q := &MemoryQueue{inFlight: make(map[string]memoryItem)}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// WithMaxAttempts は Nack されたリクエストを maxAttempts 回まで取り出し、それを超えたものを破棄する
+func (q *MemoryQueue) WithMaxAttempts(maxAttempts int) *MemoryQueue {
+	q.maxAttempts = maxAttempts
+	return q
+}
+
+func (q *MemoryQueue) Enqueue(requestID string, requestData interface{}) error {
+	now := time.Now()
+	q.push(memoryItem{requestID: requestID, requestData: requestData, visibleAt: now, enqueuedAt: now})
+	return nil
+}
+
+func (q *MemoryQueue) EnqueueBatch(requests []Request) error {
+	now := time.Now()
+	for _, request := range requests {
+		q.push(memoryItem{requestID: request.ID, requestData: request.Data, visibleAt: now, enqueuedAt: now})
+	}
+	return nil
+}
+
+// Dequeue は取り出せるリクエストが追加されるまでブロックする
+func (q *MemoryQueue) Dequeue() (string, interface{}, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for {
+		if item, ok := q.take(); ok {
+			return item.requestID, item.requestData, nil
+		}
+		q.cond.Wait()
+	}
+}
+
+func (q *MemoryQueue) TryDequeue() (string, interface{}, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	item, ok := q.take()
+	if !ok {
+		return "", nil, ErrQueueEmpty
+	}
+	return item.requestID, item.requestData, nil
+}
+
+func (q *MemoryQueue) Len() (int64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return int64(len(q.items)), nil
+}
+
+// OldestAge は保留中のリクエストのうち最も早く追加されたものからの経過時間を返す
+func (q *MemoryQueue) OldestAge() (time.Duration, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var oldest time.Time
+	for _, item := range q.items {
+		if oldest.IsZero() || item.enqueuedAt.Before(oldest) {
+			oldest = item.enqueuedAt
+		}
+	}
+	if oldest.IsZero() {
+		return 0, nil
+	}
+	return time.Since(oldest), nil
+}
+
+// take は取り出せる最も古いリクエストを処理中にする。呼び出し側でロックを取得すること
+func (q *MemoryQueue) take() (memoryItem, bool) {
+	now := time.Now()
+	for i, item := range q.items {
+		if item.visibleAt.After(now) {
+			continue
+		}
+		q.items = append(q.items[:i], q.items[i+1:]...)
+		item.attempts++
+		q.inFlight[item.requestID] = item
+		return item, true
+	}
+	return memoryItem{}, false
+}
+
+func (q *MemoryQueue) Ack(requestID string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, ok := q.inFlight[requestID]; !ok {
+		return ErrRequestNotInFlight
+	}
+	delete(q.inFlight, requestID)
+	return nil
+}
+
+func (q *MemoryQueue) Nack(requestID string, delay time.Duration) error {
+	q.mu.Lock()
+	item, ok := q.inFlight[requestID]
+	delete(q.inFlight, requestID)
+	q.mu.Unlock()
+
+	if !ok {
+		return ErrRequestNotInFlight
+	}
+	if q.maxAttempts > 0 && item.attempts >= q.maxAttempts {
+		return ErrMaxAttemptsExceeded
+	}
+	item.visibleAt = time.Now().Add(delay)
+	q.push(item)
+	return nil
+}
+
+func (q *MemoryQueue) push(item memoryItem) {
+	q.mu.Lock()
+	q.items = append(q.items, item)
+	q.mu.Unlock()
+
+	q.cond.Broadcast()
+	if delay := time.Until(item.visibleAt); delay > 0 {
+		// 待機中の Dequeue が期限到来後に再確認できるよう起こす
+		time.AfterFunc(delay, q.cond.Broadcast)
+	}
+}
@@ -0,0 +1,115 @@
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryQueue(t *testing.T) {
+	t.Run("EnqueueDequeue", func(t *testing.T) {
+		queue := NewMemoryQueue()
+
+		assert.NoError(t, queue.Enqueue("first", "data-1"))
+		assert.NoError(t, queue.Enqueue("second", "data-2"))
+
+		requestID, requestData, err := queue.Dequeue()
+		assert.NoError(t, err)
+		assert.Equal(t, "first", requestID)
+		assert.Equal(t, "data-1", requestData)
+
+		requestID, _, err = queue.Dequeue()
+		assert.NoError(t, err)
+		assert.Equal(t, "second", requestID)
+	})
+
+	t.Run("BlockingDequeue", func(t *testing.T) {
+		queue := NewMemoryQueue()
+
+		dequeued := make(chan string)
+		go func() {
+			requestID, _, _ := queue.Dequeue()
+			dequeued <- requestID
+		}()
+
+		select {
+		case <-dequeued:
+			t.Fatal("Dequeue returned before Enqueue")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		assert.NoError(t, queue.Enqueue("request", "data"))
+		select {
+		case requestID := <-dequeued:
+			assert.Equal(t, "request", requestID)
+		case <-time.After(time.Second):
+			t.Fatal("Dequeue did not return after Enqueue")
+		}
+	})
+
+	t.Run("OldestAge", func(t *testing.T) {
+		queue := NewMemoryQueue()
+
+		age, err := queue.OldestAge()
+		assert.NoError(t, err)
+		assert.Equal(t, time.Duration(0), age)
+
+		assert.NoError(t, queue.Enqueue("first", "data-1"))
+		time.Sleep(20 * time.Millisecond)
+		assert.NoError(t, queue.Enqueue("second", "data-2"))
+
+		age, err = queue.OldestAge()
+		assert.NoError(t, err)
+		assert.GreaterOrEqual(t, age, 20*time.Millisecond)
+
+		_, _, err = queue.Dequeue()
+		assert.NoError(t, err)
+		age, err = queue.OldestAge()
+		assert.NoError(t, err)
+		assert.Less(t, age, 20*time.Millisecond)
+	})
+
+	t.Run("Ack", func(t *testing.T) {
+		queue := NewMemoryQueue()
+		assert.NoError(t, queue.Enqueue("request", "data"))
+
+		requestID, _, err := queue.Dequeue()
+		assert.NoError(t, err)
+		assert.NoError(t, queue.Ack(requestID))
+		assert.ErrorIs(t, queue.Ack(requestID), ErrRequestNotInFlight)
+	})
+
+	t.Run("NackWithDelay", func(t *testing.T) {
+		queue := NewMemoryQueue()
+		assert.NoError(t, queue.Enqueue("request", "data"))
+
+		requestID, _, err := queue.Dequeue()
+		assert.NoError(t, err)
+
+		nackedAt := time.Now()
+		assert.NoError(t, queue.Nack(requestID, 50*time.Millisecond))
+
+		requestID, requestData, err := queue.Dequeue()
+		assert.NoError(t, err)
+		assert.Equal(t, "request", requestID)
+		assert.Equal(t, "data", requestData)
+		assert.GreaterOrEqual(t, time.Since(nackedAt), 50*time.Millisecond)
+	})
+
+	t.Run("NackMaxAttempts", func(t *testing.T) {
+		queue := NewMemoryQueue().WithMaxAttempts(2)
+		assert.NoError(t, queue.Enqueue("request", "data"))
+
+		requestID, _, err := queue.Dequeue()
+		assert.NoError(t, err)
+		assert.NoError(t, queue.Nack(requestID, 0))
+
+		requestID, _, err = queue.Dequeue()
+		assert.NoError(t, err)
+		assert.ErrorIs(t, queue.Nack(requestID, 0), ErrMaxAttemptsExceeded)
+
+		_, _, err = queue.TryDequeue()
+		assert.ErrorIs(t, err, ErrQueueEmpty)
+	})
+}
@@ -0,0 +1,300 @@
+package queue
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"reliproxy/pkg/events"
+	"reliproxy/pkg/repository"
+	"reliproxy/pkg/utils"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	JobStatusReady   = "ready"
+	JobStatusClaimed = "claimed"
+	JobStatusDead    = "dead"
+)
+
+// QueueJob は MySQLQueue に保存されるリクエスト
+type QueueJob struct {
+	ID         string    `gorm:"primary_key"`
+	QueueName  string    `gorm:"index:idx_queue_jobs_claim,priority:1"`
+	Status     string    `gorm:"index:idx_queue_jobs_claim,priority:2"`
+	VisibleAt  time.Time `gorm:"index:idx_queue_jobs_claim,priority:3"`
+	LeaseUntil *time.Time
+	// LeaseOwner はリースを持つ MySQLQueue の ID
+	LeaseOwner string
+	Attempts   int
+	Payload    string `gorm:"type:text"`
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+type MySQLQueue struct {
+	db            *gorm.DB
+	queueName     string
+	leaseDuration time.Duration
+	pollInterval  time.Duration
+	maxAttempts   int
+	events        events.Publisher
+
+	// owner と leases は、リースが切れた後に他のワーカーが取り出したジョブを Nack しないために使う
+	owner  string
+	mu     sync.Mutex
+	leases map[string]time.Time
+}
+
+func NewMySQLQueue(db *gorm.DB, queueName string, leaseDuration time.Duration, pollInterval time.Duration, maxAttempts int) *MySQLQueue {
+	return &MySQLQueue{
+		db:            db,
+		queueName:     queueName,
+		leaseDuration: leaseDuration,
+		pollInterval:  pollInterval,
+		maxAttempts:   maxAttempts,
+		owner:         uuid.New().String(),
+		leases:        make(map[string]time.Time),
+	}
+}
+
+// WithEvents は最大試行回数に達して failed にしたリクエストのステータスの遷移を発行する
+func (q *MySQLQueue) WithEvents(publisher events.Publisher) *MySQLQueue {
+	q.events = publisher
+	return q
+}
+
+func (q *MySQLQueue) Enqueue(requestID string, requestData interface{}) error {
+	return q.EnqueueAt(requestID, requestData, time.Now())
+}
+
+// EnqueueAt は visibleAt 以降に取り出せるリクエストを追加する
+func (q *MySQLQueue) EnqueueAt(requestID string, requestData interface{}, visibleAt time.Time) error {
+	data, err := json.Marshal(requestData)
+	if err != nil {
+		return err
+	}
+	return q.db.WithContext(JobContext(requestData)).Create(&QueueJob{
+		ID:        requestID,
+		QueueName: q.queueName,
+		Status:    JobStatusReady,
+		VisibleAt: visibleAt,
+		Payload:   string(data),
+	}).Error
+}
+
+func (q *MySQLQueue) EnqueueBatch(requests []Request) error {
+	if len(requests) == 0 {
+		return nil
+	}
+	now := time.Now()
+	jobs := make([]QueueJob, 0, len(requests))
+	for _, request := range requests {
+		data, err := json.Marshal(request.Data)
+		if err != nil {
+			return err
+		}
+		jobs = append(jobs, QueueJob{
+			ID:        request.ID,
+			QueueName: q.queueName,
+			Status:    JobStatusReady,
+			VisibleAt: now,
+			Payload:   string(data),
+		})
+	}
+	return q.db.WithContext(batchContext(requests)).CreateInBatches(jobs, 500).Error
+}
+
+func (q *MySQLQueue) Dequeue() (string, interface{}, error) {
+	for {
+		requestID, requestData, err := q.TryDequeue()
+		if errors.Is(err, ErrQueueEmpty) {
+			time.Sleep(q.pollInterval)
+			continue
+		}
+		return requestID, requestData, err
+	}
+}
+
+func (q *MySQLQueue) TryDequeue() (string, interface{}, error) {
+	job, err := q.claim()
+	if err != nil {
+		return "", nil, err
+	}
+	if job == nil {
+		return "", nil, ErrQueueEmpty
+	}
+
+	var requestData interface{}
+	if err := json.Unmarshal([]byte(job.Payload), &requestData); err != nil {
+		return "", nil, err
+	}
+	return job.ID, requestData, nil
+}
+
+// Len は取り出し待ちのジョブ数を返す
+func (q *MySQLQueue) Len() (int64, error) {
+	var count int64
+	err := q.db.Model(&QueueJob{}).
+		Where("queue_name = ? AND status = ?", q.queueName, JobStatusReady).
+		Count(&count).Error
+	return count, err
+}
+
+// OldestAge は取り出し待ちのジョブのうち最も早く追加されたものからの経過時間を返す
+func (q *MySQLQueue) OldestAge() (time.Duration, error) {
+	var oldest sql.NullTime
+	err := q.db.Model(&QueueJob{}).
+		Select("MIN(created_at)").
+		Where("queue_name = ? AND status = ?", q.queueName, JobStatusReady).
+		Scan(&oldest).Error
+	if err != nil || !oldest.Valid {
+		return 0, err
+	}
+	return time.Since(oldest.Time), nil
+}
+
+// claim は取り出し可能なジョブを1件ロックしてリースを設定する
+//
+// 取り出すたびに試行回数を数え、最大試行回数に達したジョブは取り出さずに dead にし、
+// 同じトランザクションでリクエストのステータスを failed にする。
+func (q *MySQLQueue) claim() (*QueueJob, error) {
+	var claimed *QueueJob
+	var dead []string
+	err := q.db.Transaction(func(tx *gorm.DB) error {
+		dead = nil
+		now := time.Now()
+		for {
+			var job QueueJob
+			// リース切れのジョブはワーカーが落ちたものとみなして再度取り出す
+			err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+				Where("queue_name = ?", q.queueName).
+				Where("(status = ? AND visible_at <= ?) OR (status = ? AND lease_until < ?)", JobStatusReady, now, JobStatusClaimed, now).
+				Order("visible_at").
+				Take(&job).Error
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			// 処理中にワーカーを落とすジョブは Nack されないため、リース切れのたびに取り出されないようここで止める
+			if q.maxAttempts > 0 && job.Attempts >= q.maxAttempts {
+				err = tx.Model(&job).Updates(map[string]interface{}{
+					"status":      JobStatusDead,
+					"lease_until": nil,
+					"lease_owner": "",
+				}).Error
+				if err != nil {
+					return err
+				}
+				failed, err := repository.NewGormRequestStatusRepository(tx).TransitionStatus(job.ID, []string{repository.StatusQueued, repository.StatusRunning}, repository.StatusFailed)
+				if err != nil {
+					return err
+				}
+				if failed {
+					dead = append(dead, job.ID)
+				}
+				continue
+			}
+
+			// MySQL に保存される精度に揃え、Nack で同じ値と比較できるようにする
+			leaseUntil := now.Add(q.leaseDuration).Truncate(time.Millisecond)
+			err = tx.Model(&job).Updates(map[string]interface{}{
+				"status":      JobStatusClaimed,
+				"lease_until": &leaseUntil,
+				"lease_owner": q.owner,
+				"attempts":    gorm.Expr("attempts + 1"),
+			}).Error
+			if err != nil {
+				return err
+			}
+			q.mu.Lock()
+			q.leases[job.ID] = leaseUntil
+			q.mu.Unlock()
+			claimed = &job
+			return nil
+		}
+	})
+	if err == nil {
+		for _, requestID := range dead {
+			q.publish(requestID, repository.StatusFailed)
+		}
+	}
+	return claimed, err
+}
+
+func (q *MySQLQueue) publish(requestID string, status string) {
+	if q.events == nil {
+		return
+	}
+	if err := q.events.Publish(events.Event{RequestID: requestID, Status: status, At: time.Now()}); err != nil {
+		utils.Logger.WithFields(logrus.Fields{
+			"error": err,
+			"jobID": requestID,
+		}).Error("Failed to publish status event")
+	}
+}
+
+// takeLease はこのキューが取り出したジョブのリースの期限を返し、記録から取り除く
+func (q *MySQLQueue) takeLease(requestID string) (time.Time, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	leaseUntil, ok := q.leases[requestID]
+	delete(q.leases, requestID)
+	return leaseUntil, ok
+}
+
+func (q *MySQLQueue) Ack(requestID string) error {
+	q.takeLease(requestID)
+	return q.db.Where("queue_name = ?", q.queueName).Delete(&QueueJob{ID: requestID}).Error
+}
+
+// Nack はこのキューがリースを持っている場合だけジョブを戻す
+//
+// リースが切れた後に他のワーカーが取り出したジョブは、そのワーカーの処理に任せて ErrRequestNotInFlight を返す。
+func (q *MySQLQueue) Nack(requestID string, delay time.Duration) error {
+	leaseUntil, ok := q.takeLease(requestID)
+	if !ok {
+		return ErrRequestNotInFlight
+	}
+
+	var status string
+	err := q.db.Transaction(func(tx *gorm.DB) error {
+		var job QueueJob
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("queue_name = ? AND status = ? AND lease_owner = ? AND lease_until = ?", q.queueName, JobStatusClaimed, q.owner, leaseUntil).
+			Take(&job, "id = ?", requestID).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrRequestNotInFlight
+		}
+		if err != nil {
+			return err
+		}
+
+		// 最大試行回数に達したジョブは取り出し対象から外す
+		status = JobStatusReady
+		if q.maxAttempts > 0 && job.Attempts >= q.maxAttempts {
+			status = JobStatusDead
+		}
+		return tx.Model(&job).
+			Where("lease_owner = ? AND lease_until = ?", q.owner, leaseUntil).
+			Updates(map[string]interface{}{
+				"status":      status,
+				"visible_at":  time.Now().Add(delay),
+				"lease_until": nil,
+				"lease_owner": "",
+			}).Error
+	})
+	if err == nil && status == JobStatusDead {
+		return ErrMaxAttemptsExceeded
+	}
+	return err
+}
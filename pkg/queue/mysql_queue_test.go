@@ -0,0 +1,97 @@
+package queue
+
+import (
+	"reliproxy/pkg/events"
+	"reliproxy/pkg/repository"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+)
+
+var mysqlQueueColumns = []string{"id", "queue_name", "status", "visible_at", "lease_until", "lease_owner", "attempts", "payload"}
+
+func newSQLMockQueue(t *testing.T) (*MySQLQueue, sqlmock.Sqlmock) {
+	sqlDB, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	t.Cleanup(func() { sqlDB.Close() })
+	db, err := gorm.Open(mysql.New(mysql.Config{Conn: sqlDB, SkipInitializeWithVersion: true}), &gorm.Config{SkipDefaultTransaction: true})
+	require.NoError(t, err)
+	return NewMySQLQueue(db, "request_queue", time.Minute, time.Millisecond, 3), mock
+}
+
+func TestMySQLQueue_ClaimDeadLettersAfterMaxAttempts(t *testing.T) {
+	queue, mock := newSQLMockQueue(t)
+	broker := events.NewMemoryBroker()
+	queue.WithEvents(broker)
+	watched, stop := broker.Watch("request-1")
+	defer stop()
+
+	expired := time.Now().Add(-time.Second)
+
+	mock.ExpectBegin()
+	// 最大試行回数までリースが切れ続けたジョブは取り出さずに dead にし、リクエストを failed にする
+	mock.ExpectQuery("SELECT \\* FROM `queue_jobs` .* FOR UPDATE SKIP LOCKED").
+		WillReturnRows(sqlmock.NewRows(mysqlQueueColumns).
+			AddRow("request-1", "request_queue", JobStatusClaimed, expired, expired, "other", 3, `"data"`))
+	mock.ExpectExec("UPDATE `queue_jobs` SET `lease_owner`=\\?,`lease_until`=\\?,`status`=\\?,`updated_at`=\\? WHERE `id` = \\?").
+		WithArgs("", nil, JobStatusDead, sqlmock.AnyArg(), "request-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE `request_statuses` SET `status`=\\? WHERE id = \\? AND status IN \\(\\?,\\?\\)").
+		WithArgs(repository.StatusFailed, "request-1", repository.StatusQueued, repository.StatusRunning).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT \\* FROM `queue_jobs` .* FOR UPDATE SKIP LOCKED").
+		WillReturnRows(sqlmock.NewRows(mysqlQueueColumns).
+			AddRow("request-2", "request_queue", JobStatusClaimed, expired, expired, "other", 1, `"data"`))
+	mock.ExpectExec("UPDATE `queue_jobs` SET `attempts`=attempts \\+ 1,`lease_owner`=\\?,`lease_until`=\\?,`status`=\\?,`updated_at`=\\? WHERE `id` = \\?").
+		WithArgs(queue.owner, sqlmock.AnyArg(), JobStatusClaimed, sqlmock.AnyArg(), "request-2").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	requestID, requestData, err := queue.TryDequeue()
+	require.NoError(t, err)
+	assert.Equal(t, "request-2", requestID)
+	assert.Equal(t, "data", requestData)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	// 待ち受けているクライアントに failed を通知する
+	select {
+	case event := <-watched:
+		assert.Equal(t, repository.StatusFailed, event.Status)
+	default:
+		t.Fatal("status event was not published")
+	}
+}
+
+func TestMySQLQueue_NackRequiresLease(t *testing.T) {
+	queue, mock := newSQLMockQueue(t)
+
+	// このキューが取り出していないジョブは Nack しない
+	assert.ErrorIs(t, queue.Nack("request-1", 0), ErrRequestNotInFlight)
+
+	leaseUntil := time.Now().Add(time.Minute).Truncate(time.Millisecond)
+	queue.leases["request-1"] = leaseUntil
+
+	// リースが切れた後に他のワーカーが取り出したジョブは見つからない
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT \\* FROM `queue_jobs` WHERE \\(queue_name = \\? AND status = \\? AND lease_owner = \\? AND lease_until = \\?\\) AND id = \\? LIMIT \\? FOR UPDATE").
+		WithArgs("request_queue", JobStatusClaimed, queue.owner, leaseUntil, "request-1", 1).
+		WillReturnRows(sqlmock.NewRows(mysqlQueueColumns))
+	mock.ExpectRollback()
+	assert.ErrorIs(t, queue.Nack("request-1", 0), ErrRequestNotInFlight)
+
+	queue.leases["request-1"] = leaseUntil
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT \\* FROM `queue_jobs` .* FOR UPDATE").
+		WillReturnRows(sqlmock.NewRows(mysqlQueueColumns).
+			AddRow("request-1", "request_queue", JobStatusClaimed, time.Now(), leaseUntil, queue.owner, 1, `"data"`))
+	mock.ExpectExec("UPDATE `queue_jobs` SET .* WHERE \\(lease_owner = \\? AND lease_until = \\?\\) AND `id` = \\?").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	assert.NoError(t, queue.Nack("request-1", 0))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
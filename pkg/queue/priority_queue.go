@@ -0,0 +1,281 @@
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"reliproxy/pkg/metrics"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PriorityQueue は優先度ごとのキューからリクエストを取り出すキュー
+//
+// strict の場合は常に優先度の高いキューから取り出し、そうでなければ重み付きラウンドロビンで
+// 取り出す順序を決めるため、低い優先度のリクエストも重みに応じて処理される。
+type PriorityQueue struct {
+	lanes        map[Priority]PollingQueue
+	weights      map[Priority]int
+	strict       bool
+	pollInterval time.Duration
+
+	mu       sync.Mutex
+	current  map[Priority]int
+	inFlight map[string]Priority
+}
+
+func NewPriorityQueue(lanes map[Priority]PollingQueue, weights map[Priority]int, strict bool, pollInterval time.Duration) *PriorityQueue {
+	return &PriorityQueue{
+		lanes:        lanes,
+		weights:      weights,
+		strict:       strict,
+		pollInterval: pollInterval,
+		current:      make(map[Priority]int),
+		inFlight:     make(map[string]Priority),
+	}
+}
+
+func (q *PriorityQueue) Enqueue(requestID string, requestData interface{}) error {
+	priority := JobPriority(requestData)
+	lane, ok := q.lanes[priority]
+	if !ok {
+		priority = PriorityNormal
+		lane = q.lanes[priority]
+	}
+	if err := lane.Enqueue(requestID, requestData); err != nil {
+		return err
+	}
+	metrics.QueueEnqueued.WithLabelValues(string(priority)).Inc()
+	return nil
+}
+
+// EnqueueBatch はリクエストを優先度ごとにまとめて追加する
+func (q *PriorityQueue) EnqueueBatch(requests []Request) error {
+	byPriority := make(map[Priority][]Request)
+	for _, request := range requests {
+		priority := JobPriority(request.Data)
+		if _, ok := q.lanes[priority]; !ok {
+			priority = PriorityNormal
+		}
+		byPriority[priority] = append(byPriority[priority], request)
+	}
+
+	for _, priority := range Priorities {
+		if len(byPriority[priority]) == 0 {
+			continue
+		}
+		if err := EnqueueBatch(q.lanes[priority], byPriority[priority]); err != nil {
+			return err
+		}
+		metrics.QueueEnqueued.WithLabelValues(string(priority)).Add(float64(len(byPriority[priority])))
+	}
+	return nil
+}
+
+func (q *PriorityQueue) Dequeue() (string, interface{}, error) {
+	for {
+		requestID, requestData, err := q.TryDequeue()
+		if errors.Is(err, ErrQueueEmpty) {
+			time.Sleep(q.pollInterval)
+			continue
+		}
+		return requestID, requestData, err
+	}
+}
+
+func (q *PriorityQueue) TryDequeue() (string, interface{}, error) {
+	for _, priority := range q.order() {
+		lane, ok := q.lanes[priority]
+		if !ok {
+			continue
+		}
+		requestID, requestData, err := lane.TryDequeue()
+		if errors.Is(err, ErrQueueEmpty) {
+			continue
+		}
+		if err != nil {
+			return "", nil, err
+		}
+
+		if _, ok := lane.(Acknowledger); ok {
+			q.mu.Lock()
+			q.inFlight[requestID] = priority
+			q.mu.Unlock()
+		}
+		metrics.QueueDequeued.WithLabelValues(string(priority)).Inc()
+		return requestID, requestData, nil
+	}
+	return "", nil, ErrQueueEmpty
+}
+
+func (q *PriorityQueue) Ack(requestID string) error {
+	acknowledger, ok := q.acknowledger(requestID)
+	if !ok {
+		return nil
+	}
+	return acknowledger.Ack(requestID)
+}
+
+func (q *PriorityQueue) Nack(requestID string, delay time.Duration) error {
+	acknowledger, ok := q.acknowledger(requestID)
+	if !ok {
+		return ErrRetryUnsupported
+	}
+	return acknowledger.Nack(requestID, delay)
+}
+
+func (q *PriorityQueue) Len() (int64, error) {
+	depths, err := q.Depths()
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, depth := range depths {
+		total += depth
+	}
+	return total, nil
+}
+
+// Depths は優先度ごとの保留中のリクエスト数を返す
+func (q *PriorityQueue) Depths() (map[Priority]int64, error) {
+	depths := make(map[Priority]int64)
+	for priority, lane := range q.lanes {
+		measurable, ok := lane.(Measurable)
+		if !ok {
+			continue
+		}
+		depth, err := measurable.Len()
+		if err != nil {
+			return nil, err
+		}
+		depths[priority] = depth
+	}
+	return depths, nil
+}
+
+// OldestAge は全ての優先度のキューのうち最も古いリクエストの経過時間を返す
+func (q *PriorityQueue) OldestAge() (time.Duration, error) {
+	var oldest time.Duration
+	for _, lane := range q.lanes {
+		ager, ok := lane.(Ager)
+		if !ok {
+			continue
+		}
+		age, err := ager.OldestAge()
+		if err != nil {
+			return 0, err
+		}
+		if age > oldest {
+			oldest = age
+		}
+	}
+	return oldest, nil
+}
+
+// TenantStatser はテナントごとの統計を返せるキュー
+type TenantStatser interface {
+	TenantStats() (map[string]TenantStats, error)
+}
+
+// TenantStats は各優先度のキューのテナントごとの統計を合算して返す
+func (q *PriorityQueue) TenantStats() (map[string]TenantStats, error) {
+	stats := make(map[string]TenantStats)
+	for _, lane := range q.lanes {
+		statser, ok := lane.(TenantStatser)
+		if !ok {
+			continue
+		}
+		laneStats, err := statser.TenantStats()
+		if err != nil {
+			return nil, err
+		}
+		for tenant, s := range laneStats {
+			merged := stats[tenant]
+			if dequeued := merged.Dequeued + s.Dequeued; dequeued > 0 {
+				merged.AvgWaitSeconds = (merged.AvgWaitSeconds*float64(merged.Dequeued) + s.AvgWaitSeconds*float64(s.Dequeued)) / float64(dequeued)
+			}
+			merged.Backlog += s.Backlog
+			merged.Dequeued += s.Dequeued
+			if s.LastWaitSeconds > merged.LastWaitSeconds {
+				merged.LastWaitSeconds = s.LastWaitSeconds
+			}
+			if s.OldestAgeSeconds > merged.OldestAgeSeconds {
+				merged.OldestAgeSeconds = s.OldestAgeSeconds
+			}
+			stats[tenant] = merged
+		}
+	}
+	return stats, nil
+}
+
+func (q *PriorityQueue) acknowledger(requestID string) (Acknowledger, bool) {
+	q.mu.Lock()
+	priority, ok := q.inFlight[requestID]
+	delete(q.inFlight, requestID)
+	q.mu.Unlock()
+
+	if !ok {
+		return nil, false
+	}
+	acknowledger, ok := q.lanes[priority].(Acknowledger)
+	return acknowledger, ok
+}
+
+// order は今回の取り出しでキューを確認する順序を返す
+func (q *PriorityQueue) order() []Priority {
+	if q.strict {
+		return Priorities
+	}
+
+	// smooth weighted round-robin で最初に確認するキューを選び、空であれば優先度順に確認する
+	q.mu.Lock()
+	total := 0
+	var selected Priority
+	for _, priority := range Priorities {
+		weight := q.weights[priority]
+		if weight <= 0 {
+			continue
+		}
+		total += weight
+		q.current[priority] += weight
+		if selected == "" || q.current[priority] > q.current[selected] {
+			selected = priority
+		}
+	}
+	if selected == "" {
+		q.mu.Unlock()
+		return Priorities
+	}
+	q.current[selected] -= total
+	q.mu.Unlock()
+
+	order := []Priority{selected}
+	for _, priority := range Priorities {
+		if priority != selected {
+			order = append(order, priority)
+		}
+	}
+	return order
+}
+
+// ParsePriorityWeights は "high=6,normal=3,low=1" 形式の重みを読み取る
+func ParsePriorityWeights(s string) (map[Priority]int, error) {
+	weights := make(map[Priority]int)
+	for _, pair := range strings.Split(s, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid priority weight: %q", pair)
+		}
+		priority, err := ParsePriority(name)
+		if err != nil {
+			return nil, err
+		}
+		weight, err := strconv.Atoi(value)
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("invalid weight for priority %s: %q", priority, value)
+		}
+		weights[priority] = weight
+	}
+	return weights, nil
+}
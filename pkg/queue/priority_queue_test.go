@@ -0,0 +1,114 @@
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newMemoryLanes() map[Priority]PollingQueue {
+	return map[Priority]PollingQueue{
+		PriorityHigh:   NewMemoryQueue(),
+		PriorityNormal: NewMemoryQueue(),
+		PriorityLow:    NewMemoryQueue(),
+	}
+}
+
+func TestPriorityQueue(t *testing.T) {
+	weights := map[Priority]int{PriorityHigh: 6, PriorityNormal: 3, PriorityLow: 1}
+
+	t.Run("EnqueueRoutesByJobPriority", func(t *testing.T) {
+		lanes := newMemoryLanes()
+		queue := NewPriorityQueue(lanes, weights, true, time.Millisecond)
+
+		assert.NoError(t, queue.Enqueue("high", &Job{Priority: PriorityHigh}))
+		assert.NoError(t, queue.Enqueue("low", &Job{Priority: PriorityLow}))
+		assert.NoError(t, queue.Enqueue("plain", "data"))
+
+		depths, err := queue.Depths()
+		assert.NoError(t, err)
+		assert.Equal(t, map[Priority]int64{PriorityHigh: 1, PriorityNormal: 1, PriorityLow: 1}, depths)
+	})
+
+	t.Run("EnqueueBatchRoutesByJobPriorityAndTenant", func(t *testing.T) {
+		lanes := map[Priority]PollingQueue{
+			PriorityHigh:   newMemoryFairQueue(nil),
+			PriorityNormal: newMemoryFairQueue(nil),
+			PriorityLow:    newMemoryFairQueue(nil),
+		}
+		queue := NewDelayedQueue(NewPriorityQueue(lanes, weights, true, time.Millisecond), NewMemorySchedule())
+		notBefore := time.Now().Add(time.Hour)
+
+		assert.NoError(t, queue.EnqueueBatch([]Request{
+			{ID: "high-a", Data: &Job{Priority: PriorityHigh, Tenant: "team-a"}},
+			{ID: "high-b", Data: &Job{Priority: PriorityHigh, Tenant: "team-b"}},
+			{ID: "normal", Data: &Job{Tenant: "team-a"}},
+			{ID: "scheduled", Data: &Job{Priority: PriorityHigh, NotBefore: &notBefore}},
+		}))
+
+		stats, err := lanes[PriorityHigh].(*FairQueue).TenantStats()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), stats["team-a"].Backlog)
+		assert.Equal(t, int64(1), stats["team-b"].Backlog)
+		normal, _ := lanes[PriorityNormal].(*FairQueue).Len()
+		assert.Equal(t, int64(1), normal)
+		scheduled, _ := queue.ScheduledLen()
+		assert.Equal(t, int64(1), scheduled)
+	})
+
+	t.Run("StrictPriority", func(t *testing.T) {
+		queue := NewPriorityQueue(newMemoryLanes(), weights, true, time.Millisecond)
+
+		assert.NoError(t, queue.Enqueue("low", &Job{Priority: PriorityLow}))
+		assert.NoError(t, queue.Enqueue("normal", &Job{Priority: PriorityNormal}))
+		assert.NoError(t, queue.Enqueue("high", &Job{Priority: PriorityHigh}))
+
+		for _, expected := range []string{"high", "normal", "low"} {
+			requestID, _, err := queue.Dequeue()
+			assert.NoError(t, err)
+			assert.Equal(t, expected, requestID)
+		}
+	})
+
+	t.Run("WeightedDoesNotStarveLowPriority", func(t *testing.T) {
+		queue := NewPriorityQueue(newMemoryLanes(), weights, false, time.Millisecond)
+
+		for i := 0; i < 20; i++ {
+			assert.NoError(t, queue.Enqueue("high", &Job{Priority: PriorityHigh}))
+			assert.NoError(t, queue.Enqueue("low", &Job{Priority: PriorityLow}))
+		}
+
+		counts := make(map[string]int)
+		for i := 0; i < 10; i++ {
+			requestID, _, err := queue.Dequeue()
+			assert.NoError(t, err)
+			counts[requestID]++
+		}
+		assert.Greater(t, counts["low"], 0)
+		assert.Greater(t, counts["high"], counts["low"])
+	})
+
+	t.Run("AckRoutesToLane", func(t *testing.T) {
+		queue := NewPriorityQueue(newMemoryLanes(), weights, false, time.Millisecond)
+		assert.NoError(t, queue.Enqueue("low", &Job{Priority: PriorityLow}))
+
+		requestID, _, err := queue.Dequeue()
+		assert.NoError(t, err)
+		assert.NoError(t, queue.Nack(requestID, 0))
+
+		requestID, _, err = queue.Dequeue()
+		assert.NoError(t, err)
+		assert.Equal(t, "low", requestID)
+		assert.NoError(t, queue.Ack(requestID))
+	})
+
+	t.Run("ParsePriorityWeights", func(t *testing.T) {
+		parsed, err := ParsePriorityWeights("high=6, normal=3,low=1")
+		assert.NoError(t, err)
+		assert.Equal(t, weights, parsed)
+
+		_, err = ParsePriorityWeights("urgent=1")
+		assert.Error(t, err)
+	})
+}
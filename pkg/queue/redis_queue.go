@@ -3,16 +3,105 @@ package queue
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"reliproxy/pkg/events"
+	"reliproxy/pkg/repository"
+	"reliproxy/pkg/utils"
 	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
 )
 
+// 取り出すたびに試行回数を数え、最大試行回数を超えたリクエストは dead-letter のリストに移す。
+// リースが切れたリクエストと再試行の待ち時間を過ぎたリクエストは、取り出しのたびにキューへ戻す。
+// 取り出したデータ (なければ空文字列) と、dead-letter に移したリクエストの ID を続けて返す。
+var redisDequeueScript = `
+local expired = redis.call('ZRANGEBYSCORE', KEYS[2], '-inf', ARGV[1], 'LIMIT', 0, 100)
+for _, id in ipairs(expired) do
+	redis.call('ZREM', KEYS[2], id)
+	local payload = redis.call('HGET', KEYS[3], id)
+	redis.call('HDEL', KEYS[3], id)
+	if payload then
+		redis.call('RPUSH', KEYS[1], payload)
+	end
+end
+local result = {''}
+while true do
+	local payload = redis.call('RPOP', KEYS[1])
+	if not payload then
+		return result
+	end
+	local id = cjson.decode(payload)['id']
+	local attempts = redis.call('HINCRBY', KEYS[4], id, 1)
+	if tonumber(ARGV[3]) > 0 and attempts > tonumber(ARGV[3]) then
+		redis.call('HDEL', KEYS[4], id)
+		redis.call('LPUSH', KEYS[5], payload)
+		table.insert(result, id)
+	else
+		redis.call('ZADD', KEYS[2], tonumber(ARGV[1]) + tonumber(ARGV[2]), id)
+		redis.call('HSET', KEYS[3], id, payload)
+		result[1] = payload
+		return result
+	end
+end
+`
+
+var redisAckScript = `
+redis.call('ZREM', KEYS[1], ARGV[1])
+redis.call('HDEL', KEYS[3], ARGV[1])
+return redis.call('HDEL', KEYS[2], ARGV[1])
+`
+
+// 最大試行回数に達したリクエストは dead-letter のリストに移し、それ以外は再試行の時刻までリースを延ばす
+var redisNackScript = `
+local payload = redis.call('HGET', KEYS[2], ARGV[1])
+if not payload then
+	return -1
+end
+local attempts = tonumber(redis.call('HGET', KEYS[3], ARGV[1]) or '0')
+if tonumber(ARGV[3]) > 0 and attempts >= tonumber(ARGV[3]) then
+	redis.call('ZREM', KEYS[1], ARGV[1])
+	redis.call('HDEL', KEYS[2], ARGV[1])
+	redis.call('HDEL', KEYS[3], ARGV[1])
+	redis.call('LPUSH', KEYS[4], payload)
+	return 0
+end
+redis.call('ZADD', KEYS[1], ARGV[2], ARGV[1])
+return 1
+`
+
+// RedisQueue は Redis のリストを使うキュー
+//
+// 取り出したリクエストは Ack されるまでリースを付けて保持し、リースが切れたものはワーカーが落ちたものとみなして再び取り出す。
 type RedisQueue struct {
-	client    RedisClient
-	queueName string
+	client        RedisClient
+	queueName     string
+	leaseDuration time.Duration
+	pollInterval  time.Duration
+	maxAttempts   int
+
+	statusRepository repository.RequestStatusRepository
+	events           events.Publisher
 }
 
-func NewRedisQueue(client RedisClient, queueName string) *RedisQueue {
-	return &RedisQueue{client: client, queueName: queueName}
+func NewRedisQueue(client RedisClient, queueName string, leaseDuration time.Duration, pollInterval time.Duration, maxAttempts int) *RedisQueue {
+	return &RedisQueue{
+		client:        client,
+		queueName:     queueName,
+		leaseDuration: leaseDuration,
+		pollInterval:  pollInterval,
+		maxAttempts:   maxAttempts,
+	}
+}
+
+// WithDeadLetters は取り出すときに dead-letter に移したリクエストのステータスを failed にし、遷移を発行する
+//
+// 処理中にワーカーが落ち続けたリクエストは Nack されないため、ここで失敗として記録しないと完了しないまま残る。
+func (q *RedisQueue) WithDeadLetters(statusRepository repository.RequestStatusRepository, publisher events.Publisher) *RedisQueue {
+	q.statusRepository = statusRepository
+	q.events = publisher
+	return q
 }
 
 type Request struct {
@@ -21,7 +110,7 @@ type Request struct {
 }
 
 func (q *RedisQueue) Enqueue(requestID string, requestData interface{}) error {
-	ctx := context.Background()
+	ctx := JobContext(requestData)
 	request := Request{
 		ID:   requestID,
 		Data: requestData,
@@ -33,14 +122,152 @@ func (q *RedisQueue) Enqueue(requestID string, requestData interface{}) error {
 	return q.client.LPush(ctx, q.queueName, string(data)).Err()
 }
 
+// EnqueueBatch は全てのリクエストを1回の LPUSH で追加する
+func (q *RedisQueue) EnqueueBatch(requests []Request) error {
+	if len(requests) == 0 {
+		return nil
+	}
+	values := make([]interface{}, 0, len(requests))
+	for _, request := range requests {
+		data, err := json.Marshal(request)
+		if err != nil {
+			return err
+		}
+		values = append(values, string(data))
+	}
+	return q.client.LPush(batchContext(requests), q.queueName, values...).Err()
+}
+
 func (q *RedisQueue) Dequeue() (string, interface{}, error) {
-	ctx := context.Background()
-	result, err := q.client.BRPop(ctx, 0*time.Second, q.queueName).Result()
+	for {
+		requestID, requestData, err := q.TryDequeue()
+		if errors.Is(err, ErrQueueEmpty) {
+			time.Sleep(q.pollInterval)
+			continue
+		}
+		return requestID, requestData, err
+	}
+}
+
+func (q *RedisQueue) TryDequeue() (string, interface{}, error) {
+	now := time.Now()
+	result, err := q.client.Eval(context.Background(), redisDequeueScript,
+		[]string{q.queueName, q.leasesKey(), q.inFlightKey(), q.attemptsKey(), q.DeadLetterKey()},
+		now.UnixMilli(), q.leaseDuration.Milliseconds(), q.maxAttempts,
+	).StringSlice()
 	if err != nil {
 		return "", nil, err
 	}
+	if len(result) == 0 {
+		return "", nil, errors.New("unexpected dequeue result")
+	}
+	q.failDeadLetters(result[1:])
+	if result[0] == "" {
+		return "", nil, ErrQueueEmpty
+	}
+	return decodeRequest(result[0])
+}
+
+// failDeadLetters は dead-letter に移したリクエストを failed にし、待ち受けているクライアントに通知する
+func (q *RedisQueue) failDeadLetters(requestIDs []string) {
+	if q.statusRepository == nil {
+		return
+	}
+	for _, requestID := range requestIDs {
+		logger := utils.Logger.WithField("jobID", requestID)
+		failed, err := q.statusRepository.TransitionStatus(requestID, []string{repository.StatusQueued, repository.StatusRunning}, repository.StatusFailed)
+		if err != nil {
+			logger.WithFields(logrus.Fields{
+				"error": err,
+			}).Error("Failed to update request status")
+			continue
+		}
+		if !failed || q.events == nil {
+			continue
+		}
+		if err := q.events.Publish(events.Event{RequestID: requestID, Status: repository.StatusFailed, At: time.Now()}); err != nil {
+			logger.WithFields(logrus.Fields{
+				"error": err,
+			}).Error("Failed to publish status event")
+		}
+	}
+}
+
+func (q *RedisQueue) Ack(requestID string) error {
+	removed, err := q.client.Eval(context.Background(), redisAckScript,
+		[]string{q.leasesKey(), q.inFlightKey(), q.attemptsKey()},
+		requestID,
+	).Int()
+	if err != nil {
+		return err
+	}
+	if removed == 0 {
+		return ErrRequestNotInFlight
+	}
+	return nil
+}
+
+func (q *RedisQueue) Nack(requestID string, delay time.Duration) error {
+	result, err := q.client.Eval(context.Background(), redisNackScript,
+		[]string{q.leasesKey(), q.inFlightKey(), q.attemptsKey(), q.DeadLetterKey()},
+		requestID, time.Now().Add(delay).UnixMilli(), q.maxAttempts,
+	).Int()
+	if err != nil {
+		return err
+	}
+	switch result {
+	case -1:
+		return ErrRequestNotInFlight
+	case 0:
+		return ErrMaxAttemptsExceeded
+	}
+	return nil
+}
+
+func (q *RedisQueue) Len() (int64, error) {
+	return q.client.LLen(context.Background(), q.queueName).Result()
+}
+
+// OldestAge は次に取り出されるリクエストの追加時刻からの経過時間を返す
+//
+// LPUSH で追加して RPOP で取り出すため、リストの末尾が最も古い。
+func (q *RedisQueue) OldestAge() (time.Duration, error) {
+	data, err := q.client.LIndex(context.Background(), q.queueName, -1).Result()
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	_, requestData, err := decodeRequest(data)
+	if err != nil {
+		return 0, err
+	}
+	return jobAge(requestData, time.Now()), nil
+}
+
+// DeadLetterKey は最大試行回数を超えたリクエストを保存するリストのキー
+func (q *RedisQueue) DeadLetterKey() string {
+	return q.queueName + ":dead"
+}
+
+// leasesKey は取り出したリクエストのリースの期限と、再試行するリクエストの再び取り出せる時刻を保存するソート済みセットのキー
+func (q *RedisQueue) leasesKey() string {
+	return q.queueName + ":leases"
+}
+
+// inFlightKey は取り出したリクエストを Ack されるまで保存するハッシュのキー
+func (q *RedisQueue) inFlightKey() string {
+	return q.queueName + ":inflight"
+}
+
+func (q *RedisQueue) attemptsKey() string {
+	return q.queueName + ":attempts"
+}
+
+func decodeRequest(data string) (string, interface{}, error) {
 	var request Request
-	if err := json.Unmarshal([]byte(result[1]), &request); err != nil {
+	if err := json.Unmarshal([]byte(data), &request); err != nil {
 		return "", nil, err
 	}
 	return request.ID, request.Data, nil
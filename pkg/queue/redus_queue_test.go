@@ -4,9 +4,12 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"reliproxy/pkg/events"
+	"reliproxy/pkg/repository"
 	"testing"
 	"time"
 
+	"github.com/alicebob/miniredis/v2"
 	"github.com/go-redis/redis/v8"
 	"github.com/stretchr/testify/assert"
 	gomock "go.uber.org/mock/gomock"
@@ -17,7 +20,7 @@ func TestRedisQueue(t *testing.T) {
 	defer ctrl.Finish()
 
 	mockClient := NewMockRedisClient(ctrl)
-	queue := NewRedisQueue(mockClient, "request_queue")
+	queue := NewRedisQueue(mockClient, "request_queue", time.Minute, time.Millisecond, 3)
 
 	t.Run("Enqueue", func(t *testing.T) {
 		t.Run("Success", func(t *testing.T) {
@@ -61,43 +64,168 @@ func TestRedisQueue(t *testing.T) {
 		})
 	})
 
-	t.Run("Dequeue", func(t *testing.T) {
-		t.Run("Success", func(t *testing.T) {
-			requestID := "test-request-id"
-			requestData := map[string]string{"key": "value"}
-			request := Request{
-				ID:   requestID,
-				Data: requestData,
-			}
-			data, _ := json.Marshal(request)
-			expectedResult := []string{"request_queue", string(data)}
+	t.Run("EnqueueBatch", func(t *testing.T) {
+		requests := []Request{
+			{ID: "request-1", Data: map[string]string{"key": "value1"}},
+			{ID: "request-2", Data: map[string]string{"key": "value2"}},
+		}
+		first, _ := json.Marshal(requests[0])
+		second, _ := json.Marshal(requests[1])
 
-			mockClient.EXPECT().BRPop(gomock.Any(), 0*time.Second, "request_queue").Return(redis.NewStringSliceResult(expectedResult, nil))
+		// 全てのリクエストを1回の LPUSH で追加する
+		mockClient.EXPECT().LPush(gomock.Any(), "request_queue", string(first), string(second)).Return(redis.NewIntCmd(context.Background()))
 
-			dequeuedRequestID, result, err := queue.Dequeue()
-			assert.NoError(t, err)
-			assert.Equal(t, requestID, dequeuedRequestID)
+		err := queue.EnqueueBatch(requests)
+		assert.NoError(t, err)
+	})
 
-			resultData, ok := result.(map[string]interface{})
-			assert.True(t, ok)
-			assert.Equal(t, requestData["key"], resultData["key"])
+	t.Run("OldestAge", func(t *testing.T) {
+		t.Run("Success", func(t *testing.T) {
+			data, _ := json.Marshal(Request{ID: "oldest", Data: &Job{EnqueuedAt: time.Now().Add(-time.Minute)}})
+			// 次に取り出されるリストの末尾を確認する
+			mockClient.EXPECT().LIndex(gomock.Any(), "request_queue", int64(-1)).Return(redis.NewStringResult(string(data), nil))
+
+			age, err := queue.OldestAge()
+			assert.NoError(t, err)
+			assert.GreaterOrEqual(t, age, time.Minute)
 		})
 
-		t.Run("RedisConnectionError", func(t *testing.T) {
-			mockClient.EXPECT().BRPop(gomock.Any(), 0*time.Second, "request_queue").Return(redis.NewStringSliceResult(nil, errors.New("redis connection error")))
+		t.Run("Empty", func(t *testing.T) {
+			mockClient.EXPECT().LIndex(gomock.Any(), "request_queue", int64(-1)).Return(redis.NewStringResult("", redis.Nil))
 
-			_, _, err := queue.Dequeue()
-			assert.Error(t, err)
+			age, err := queue.OldestAge()
+			assert.NoError(t, err)
+			assert.Equal(t, time.Duration(0), age)
 		})
+	})
+}
 
-		t.Run("DeserializationError", func(t *testing.T) {
-			invalidData := "invalid data"
-			expectedResult := []string{"request_queue", invalidData}
+func newMiniRedisQueue(t *testing.T, leaseDuration time.Duration, maxAttempts int) (*RedisQueue, *miniredis.Miniredis) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return NewRedisQueue(client, "request_queue", leaseDuration, time.Millisecond, maxAttempts), server
+}
 
-			mockClient.EXPECT().BRPop(gomock.Any(), 0*time.Second, "request_queue").Return(redis.NewStringSliceResult(expectedResult, nil))
+func TestRedisQueue_Dequeue(t *testing.T) {
+	t.Run("Success", func(t *testing.T) {
+		queue, _ := newMiniRedisQueue(t, time.Minute, 3)
+		requestData := map[string]string{"key": "value"}
+		assert.NoError(t, queue.Enqueue("test-request-id", requestData))
+
+		requestID, result, err := queue.Dequeue()
+		assert.NoError(t, err)
+		assert.Equal(t, "test-request-id", requestID)
+		resultData, ok := result.(map[string]interface{})
+		assert.True(t, ok)
+		assert.Equal(t, "value", resultData["key"])
+
+		_, _, err = queue.TryDequeue()
+		assert.ErrorIs(t, err, ErrQueueEmpty)
+	})
 
-			_, _, err := queue.Dequeue()
-			assert.Error(t, err)
-		})
+	t.Run("RedisConnectionError", func(t *testing.T) {
+		queue, server := newMiniRedisQueue(t, time.Minute, 3)
+		server.Close()
+
+		_, _, err := queue.TryDequeue()
+		assert.Error(t, err)
+		assert.NotErrorIs(t, err, ErrQueueEmpty)
+	})
+
+	t.Run("DeserializationError", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		mockClient := NewMockRedisClient(ctrl)
+		queue := NewRedisQueue(mockClient, "request_queue", time.Minute, time.Millisecond, 3)
+
+		mockClient.EXPECT().Eval(gomock.Any(), redisDequeueScript, gomock.Any(), gomock.Any()).Return(redis.NewCmdResult([]interface{}{"invalid data"}, nil))
+
+		_, _, err := queue.Dequeue()
+		assert.Error(t, err)
+	})
+}
+
+func TestRedisQueue_AckNack(t *testing.T) {
+	t.Run("Ack", func(t *testing.T) {
+		queue, server := newMiniRedisQueue(t, time.Minute, 3)
+		assert.NoError(t, queue.Enqueue("request-1", "data"))
+		_, _, err := queue.TryDequeue()
+		assert.NoError(t, err)
+
+		assert.NoError(t, queue.Ack("request-1"))
+		assert.ErrorIs(t, queue.Ack("request-1"), ErrRequestNotInFlight)
+		assert.False(t, server.Exists("request_queue:inflight"))
+		assert.False(t, server.Exists("request_queue:attempts"))
+	})
+
+	t.Run("NackRetriesAfterDelay", func(t *testing.T) {
+		queue, _ := newMiniRedisQueue(t, time.Minute, 3)
+		assert.NoError(t, queue.Enqueue("request-1", "data"))
+		_, _, err := queue.TryDequeue()
+		assert.NoError(t, err)
+
+		assert.NoError(t, queue.Nack("request-1", 50*time.Millisecond))
+		_, _, err = queue.TryDequeue()
+		assert.ErrorIs(t, err, ErrQueueEmpty)
+
+		time.Sleep(60 * time.Millisecond)
+		requestID, _, err := queue.TryDequeue()
+		assert.NoError(t, err)
+		assert.Equal(t, "request-1", requestID)
+	})
+
+	t.Run("NackDeadLettersAfterMaxAttempts", func(t *testing.T) {
+		queue, server := newMiniRedisQueue(t, time.Minute, 2)
+		assert.NoError(t, queue.Enqueue("request-1", "data"))
+
+		_, _, err := queue.TryDequeue()
+		assert.NoError(t, err)
+		assert.NoError(t, queue.Nack("request-1", 0))
+
+		_, _, err = queue.TryDequeue()
+		assert.NoError(t, err)
+		assert.ErrorIs(t, queue.Nack("request-1", 0), ErrMaxAttemptsExceeded)
+
+		_, _, err = queue.TryDequeue()
+		assert.ErrorIs(t, err, ErrQueueEmpty)
+		dead, err := server.List(queue.DeadLetterKey())
+		assert.NoError(t, err)
+		assert.Len(t, dead, 1)
+	})
+
+	t.Run("ExpiredLeaseIsRetried", func(t *testing.T) {
+		queue, server := newMiniRedisQueue(t, 50*time.Millisecond, 2)
+		statusRepository := repository.NewMemoryRequestStatusRepository()
+		broker := events.NewMemoryBroker()
+		queue.WithDeadLetters(statusRepository, broker)
+		watched, stop := broker.Watch("request-1")
+		defer stop()
+		assert.NoError(t, statusRepository.Create(&repository.RequestStatus{ID: "request-1", Status: repository.StatusRunning}))
+		assert.NoError(t, queue.Enqueue("request-1", "data"))
+
+		// Ack も Nack もされないまま落ちたワーカーのリクエストはリースが切れた後に再び取り出す
+		_, _, err := queue.TryDequeue()
+		assert.NoError(t, err)
+		time.Sleep(60 * time.Millisecond)
+		requestID, _, err := queue.TryDequeue()
+		assert.NoError(t, err)
+		assert.Equal(t, "request-1", requestID)
+
+		// 最大試行回数を超えたリクエストは取り出さずに dead-letter に移し、リクエストを failed にする
+		time.Sleep(60 * time.Millisecond)
+		_, _, err = queue.TryDequeue()
+		assert.ErrorIs(t, err, ErrQueueEmpty)
+		dead, err := server.List(queue.DeadLetterKey())
+		assert.NoError(t, err)
+		assert.Len(t, dead, 1)
+		requestStatus, err := statusRepository.GetByID("request-1")
+		assert.NoError(t, err)
+		assert.Equal(t, repository.StatusFailed, requestStatus.Status)
+		select {
+		case event := <-watched:
+			assert.Equal(t, repository.StatusFailed, event.Status)
+		default:
+			t.Fatal("status event was not published")
+		}
 	})
 }
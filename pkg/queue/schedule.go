@@ -0,0 +1,258 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Schedule は実行時刻の順にリクエストを保持する
+type Schedule interface {
+	Add(requestID string, requestData interface{}, dueAt time.Time) error
+	// PromoteDue は now までに実行時刻を迎えたリクエストを最大 limit 件 publish に渡し、成功したものを取り除く
+	PromoteDue(now time.Time, limit int, publish func(requestID string, requestData interface{}) error) (int, error)
+	// Remove はリクエストを取り除き、取り除けたかを返す
+	Remove(requestID string) (bool, error)
+	Len() (int64, error)
+}
+
+// redisClaimScheduledScript は実行時刻を迎えたリクエストの実行時刻を ARGV[3] まで延ばし、データを返す
+//
+// キューへ送るまでに落ちたレプリカのリクエストは、延ばした時刻を過ぎると再び送信される。
+// データが見つからないリクエストは送信できないため取り除く。
+var redisClaimScheduledScript = `
+local score = redis.call('ZSCORE', KEYS[1], ARGV[1])
+if not score or tonumber(score) > tonumber(ARGV[2]) then
+	return false
+end
+local payload = redis.call('HGET', KEYS[2], ARGV[1])
+if not payload then
+	redis.call('ZREM', KEYS[1], ARGV[1])
+	return false
+end
+redis.call('ZADD', KEYS[1], ARGV[3], ARGV[1])
+return payload
+`
+
+var redisRemoveScheduledScript = `
+local removed = redis.call('ZREM', KEYS[1], ARGV[1])
+redis.call('HDEL', KEYS[2], ARGV[1])
+return removed
+`
+
+// redisPromoteLease はリクエストをキューへ送っている間、他のレプリカに送らせない時間
+const redisPromoteLease = time.Minute
+
+type RedisSchedule struct {
+	client RedisClient
+	key    string
+}
+
+// NewRedisSchedule は実行時刻をスコアとするソート済みセットと、データを保存するハッシュを使うスケジュールを返す
+func NewRedisSchedule(client RedisClient, key string) *RedisSchedule {
+	return &RedisSchedule{client: client, key: key}
+}
+
+func (s *RedisSchedule) Add(requestID string, requestData interface{}, dueAt time.Time) error {
+	ctx := JobContext(requestData)
+	data, err := json.Marshal(Request{ID: requestID, Data: requestData})
+	if err != nil {
+		return err
+	}
+	if err := s.client.HSet(ctx, s.payloadKey(), requestID, string(data)).Err(); err != nil {
+		return err
+	}
+	return s.client.ZAdd(ctx, s.key, &redis.Z{Score: float64(dueAt.UnixMilli()), Member: requestID}).Err()
+}
+
+// PromoteDue はリクエストの実行時刻を延ばしてから publish に渡し、送信できたものだけを取り除く
+//
+// 送信の途中で失敗したりレプリカが落ちたりしてもリクエストはスケジュールに残るため、失われない。
+func (s *RedisSchedule) PromoteDue(now time.Time, limit int, publish func(requestID string, requestData interface{}) error) (int, error) {
+	ctx := context.Background()
+	requestIDs, err := s.client.ZRangeByScore(ctx, s.key, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(now.UnixMilli(), 10),
+		Count: int64(limit),
+	}).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	promoted := 0
+	for _, requestID := range requestIDs {
+		// 実行時刻を延ばせたレプリカだけが送信する
+		data, err := s.client.Eval(ctx, redisClaimScheduledScript, []string{s.key, s.payloadKey()},
+			requestID, now.UnixMilli(), now.Add(redisPromoteLease).UnixMilli(),
+		).Text()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			return promoted, err
+		}
+
+		id, requestData, err := decodeRequest(data)
+		if err != nil {
+			return promoted, err
+		}
+		if err := publish(id, requestData); err != nil {
+			// 送信できなかったリクエストは次回に再送できるよう実行時刻を戻す
+			s.client.ZAdd(ctx, s.key, &redis.Z{Score: float64(now.UnixMilli()), Member: requestID})
+			return promoted, err
+		}
+		if err := s.client.Eval(ctx, redisRemoveScheduledScript, []string{s.key, s.payloadKey()}, requestID).Err(); err != nil {
+			return promoted, err
+		}
+		promoted++
+	}
+	return promoted, nil
+}
+
+func (s *RedisSchedule) Remove(requestID string) (bool, error) {
+	removed, err := s.client.Eval(context.Background(), redisRemoveScheduledScript, []string{s.key, s.payloadKey()}, requestID).Int()
+	return removed > 0, err
+}
+
+func (s *RedisSchedule) Len() (int64, error) {
+	return s.client.ZCard(context.Background(), s.key).Result()
+}
+
+func (s *RedisSchedule) payloadKey() string {
+	return s.key + ":payloads"
+}
+
+// ScheduledJob は GormSchedule に保存されるリクエスト
+type ScheduledJob struct {
+	ID      string    `gorm:"primary_key"`
+	DueAt   time.Time `gorm:"index"`
+	Payload string    `gorm:"type:text"`
+}
+
+type GormSchedule struct {
+	db *gorm.DB
+}
+
+func NewGormSchedule(db *gorm.DB) *GormSchedule {
+	return &GormSchedule{db}
+}
+
+func (s *GormSchedule) Add(requestID string, requestData interface{}, dueAt time.Time) error {
+	data, err := json.Marshal(requestData)
+	if err != nil {
+		return err
+	}
+	return s.db.WithContext(JobContext(requestData)).Create(&ScheduledJob{ID: requestID, DueAt: dueAt, Payload: string(data)}).Error
+}
+
+func (s *GormSchedule) PromoteDue(now time.Time, limit int, publish func(requestID string, requestData interface{}) error) (int, error) {
+	promoted := 0
+	var publishErr error
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var jobs []ScheduledJob
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("due_at <= ?", now).
+			Order("due_at").
+			Limit(limit).
+			Find(&jobs).Error
+		if err != nil {
+			return err
+		}
+
+		for _, job := range jobs {
+			if publishErr = publish(job.ID, json.RawMessage(job.Payload)); publishErr != nil {
+				break
+			}
+			if err := tx.Delete(&job).Error; err != nil {
+				return err
+			}
+			promoted++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return promoted, publishErr
+}
+
+func (s *GormSchedule) Remove(requestID string) (bool, error) {
+	result := s.db.Delete(&ScheduledJob{ID: requestID})
+	return result.RowsAffected > 0, result.Error
+}
+
+func (s *GormSchedule) Len() (int64, error) {
+	var count int64
+	err := s.db.Model(&ScheduledJob{}).Count(&count).Error
+	return count, err
+}
+
+type scheduledItem struct {
+	requestID   string
+	requestData interface{}
+	dueAt       time.Time
+}
+
+// MemorySchedule は単一プロセス用のスレッドセーフなスケジュール
+type MemorySchedule struct {
+	mu    sync.Mutex
+	items []scheduledItem
+}
+
+func NewMemorySchedule() *MemorySchedule {
+	return &MemorySchedule{}
+}
+
+func (s *MemorySchedule) Add(requestID string, requestData interface{}, dueAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := sort.Search(len(s.items), func(i int) bool { return s.items[i].dueAt.After(dueAt) })
+	s.items = append(s.items, scheduledItem{})
+	copy(s.items[i+1:], s.items[i:])
+	s.items[i] = scheduledItem{requestID: requestID, requestData: requestData, dueAt: dueAt}
+	return nil
+}
+
+func (s *MemorySchedule) PromoteDue(now time.Time, limit int, publish func(requestID string, requestData interface{}) error) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	promoted := 0
+	for len(s.items) > 0 && promoted < limit && !s.items[0].dueAt.After(now) {
+		item := s.items[0]
+		if err := publish(item.requestID, item.requestData); err != nil {
+			return promoted, err
+		}
+		s.items = s.items[1:]
+		promoted++
+	}
+	return promoted, nil
+}
+
+func (s *MemorySchedule) Remove(requestID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, item := range s.items {
+		if item.requestID == requestID {
+			s.items = append(s.items[:i], s.items[i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *MemorySchedule) Len() (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return int64(len(s.items)), nil
+}
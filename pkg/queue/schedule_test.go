@@ -0,0 +1,93 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedisSchedule(t *testing.T) {
+	newSchedule := func(t *testing.T) (*RedisSchedule, *miniredis.Miniredis) {
+		server := miniredis.RunT(t)
+		client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+		t.Cleanup(func() { client.Close() })
+		return NewRedisSchedule(client, "request_queue:scheduled"), server
+	}
+	collect := func(promoted *[]string) func(string, interface{}) error {
+		return func(requestID string, requestData interface{}) error {
+			*promoted = append(*promoted, requestID)
+			return nil
+		}
+	}
+	now := time.Now()
+
+	t.Run("PromoteDue", func(t *testing.T) {
+		schedule, server := newSchedule(t)
+		assert.NoError(t, schedule.Add("request-1", "data", now.Add(-time.Second)))
+		assert.NoError(t, schedule.Add("request-2", "data", now.Add(time.Hour)))
+
+		var promoted []string
+		count, err := schedule.PromoteDue(now, 10, collect(&promoted))
+		assert.NoError(t, err)
+		assert.Equal(t, 1, count)
+		assert.Equal(t, []string{"request-1"}, promoted)
+
+		length, _ := schedule.Len()
+		assert.Equal(t, int64(1), length)
+		payloads, _ := server.HKeys("request_queue:scheduled:payloads")
+		assert.Equal(t, []string{"request-2"}, payloads)
+	})
+
+	t.Run("FailedPublishIsRetried", func(t *testing.T) {
+		schedule, _ := newSchedule(t)
+		assert.NoError(t, schedule.Add("request-1", "data", now.Add(-time.Second)))
+
+		_, err := schedule.PromoteDue(now, 10, func(string, interface{}) error { return errors.New("queue is down") })
+		assert.Error(t, err)
+
+		var promoted []string
+		_, err = schedule.PromoteDue(now, 10, collect(&promoted))
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"request-1"}, promoted)
+	})
+
+	t.Run("ClaimedRequestIsNotLost", func(t *testing.T) {
+		schedule, _ := newSchedule(t)
+		assert.NoError(t, schedule.Add("request-1", "data", now.Add(-time.Second)))
+
+		// 送信中に落ちたレプリカのように、取り除かないまま publish が戻らなかった状態を作る
+		err := schedule.client.Eval(context.Background(), redisClaimScheduledScript, []string{schedule.key, schedule.payloadKey()},
+			"request-1", now.UnixMilli(), now.Add(redisPromoteLease).UnixMilli(),
+		).Err()
+		assert.NoError(t, err)
+
+		// 他のレプリカは延ばした時刻まで送信せず、その後に送信する
+		var promoted []string
+		count, err := schedule.PromoteDue(now, 10, collect(&promoted))
+		assert.NoError(t, err)
+		assert.Equal(t, 0, count)
+
+		count, err = schedule.PromoteDue(now.Add(redisPromoteLease), 10, collect(&promoted))
+		assert.NoError(t, err)
+		assert.Equal(t, 1, count)
+		assert.Equal(t, []string{"request-1"}, promoted)
+	})
+
+	t.Run("Remove", func(t *testing.T) {
+		schedule, server := newSchedule(t)
+		assert.NoError(t, schedule.Add("request-1", "data", now.Add(time.Hour)))
+
+		removed, err := schedule.Remove("request-1")
+		assert.NoError(t, err)
+		assert.True(t, removed)
+		removed, err = schedule.Remove("request-1")
+		assert.NoError(t, err)
+		assert.False(t, removed)
+		assert.False(t, server.Exists("request_queue:scheduled:payloads"))
+	})
+}
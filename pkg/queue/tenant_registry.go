@@ -0,0 +1,94 @@
+package queue
+
+import (
+	"context"
+	"sync"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type RedisTenantRegistry struct {
+	client RedisClient
+	key    string
+}
+
+func NewRedisTenantRegistry(client RedisClient, key string) *RedisTenantRegistry {
+	return &RedisTenantRegistry{client: client, key: key}
+}
+
+func (r *RedisTenantRegistry) Register(tenant string) error {
+	return r.client.SAdd(context.Background(), r.key, tenant).Err()
+}
+
+func (r *RedisTenantRegistry) Unregister(tenant string) error {
+	return r.client.SRem(context.Background(), r.key, tenant).Err()
+}
+
+func (r *RedisTenantRegistry) Tenants() ([]string, error) {
+	return r.client.SMembers(context.Background(), r.key).Result()
+}
+
+// QueueTenant は GormTenantRegistry に保存されるテナント
+type QueueTenant struct {
+	QueueName string `gorm:"primary_key;size:191"`
+	Tenant    string `gorm:"primary_key;size:191"`
+}
+
+type GormTenantRegistry struct {
+	db        *gorm.DB
+	queueName string
+}
+
+func NewGormTenantRegistry(db *gorm.DB, queueName string) *GormTenantRegistry {
+	return &GormTenantRegistry{db: db, queueName: queueName}
+}
+
+func (r *GormTenantRegistry) Register(tenant string) error {
+	return r.db.Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&QueueTenant{QueueName: r.queueName, Tenant: tenant}).Error
+}
+
+func (r *GormTenantRegistry) Unregister(tenant string) error {
+	return r.db.Where("queue_name = ? AND tenant = ?", r.queueName, tenant).Delete(&QueueTenant{}).Error
+}
+
+func (r *GormTenantRegistry) Tenants() ([]string, error) {
+	var tenants []string
+	err := r.db.Model(&QueueTenant{}).Where("queue_name = ?", r.queueName).Pluck("tenant", &tenants).Error
+	return tenants, err
+}
+
+type MemoryTenantRegistry struct {
+	mu      sync.Mutex
+	tenants map[string]struct{}
+}
+
+func NewMemoryTenantRegistry() *MemoryTenantRegistry {
+	return &MemoryTenantRegistry{tenants: make(map[string]struct{})}
+}
+
+func (r *MemoryTenantRegistry) Register(tenant string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tenants[tenant] = struct{}{}
+	return nil
+}
+
+func (r *MemoryTenantRegistry) Unregister(tenant string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.tenants, tenant)
+	return nil
+}
+
+func (r *MemoryTenantRegistry) Tenants() ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tenants := make([]string, 0, len(r.tenants))
+	for tenant := range r.tenants {
+		tenants = append(tenants, tenant)
+	}
+	return tenants, nil
+}
@@ -0,0 +1,129 @@
+package reload
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"os"
+	"os/signal"
+	"reliproxy/pkg/config"
+	"reliproxy/pkg/utils"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Reloader は SIGHUP を受け取るか設定ファイルが変更されると設定を読み込み直し、apply で反映する
+//
+// 読み込めない設定や検証を通らない設定は反映せず、それまでの設定を使い続ける。
+type Reloader struct {
+	path     string
+	interval time.Duration
+	load     func(path string) (*config.Config, error)
+	apply    func(old, cfg *config.Config)
+
+	mu      sync.Mutex
+	current *config.Config
+	digest  []byte
+}
+
+// NewReloader は current を読み込み済みの設定として作成する。interval が 0 の場合は SIGHUP でだけ読み込み直す
+func NewReloader(path string, current *config.Config, interval time.Duration, load func(path string) (*config.Config, error), apply func(old, cfg *config.Config)) *Reloader {
+	r := &Reloader{
+		path:     path,
+		interval: interval,
+		load:     load,
+		apply:    apply,
+		current:  current,
+	}
+	r.digest, _ = r.fileDigest()
+	return r
+}
+
+func (r *Reloader) Start() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	if r.interval > 0 {
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-signals:
+			utils.Logger.Info("Received SIGHUP, reloading config")
+			r.Reload()
+		case <-tick:
+			r.ReloadIfChanged()
+		}
+	}
+}
+
+// Current は反映している設定を返す
+func (r *Reloader) Current() *config.Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.current
+}
+
+// ReloadIfChanged は前回読み込んでから設定ファイルの内容が変わっていれば読み込み直す
+func (r *Reloader) ReloadIfChanged() error {
+	digest, err := r.fileDigest()
+	if err != nil {
+		utils.Logger.WithFields(logrus.Fields{
+			"error": err,
+			"path":  r.path,
+		}).Error("Failed to read config file")
+		return err
+	}
+
+	r.mu.Lock()
+	changed := !bytes.Equal(digest, r.digest)
+	r.mu.Unlock()
+	if !changed {
+		return nil
+	}
+	utils.Logger.WithField("path", r.path).Info("Config file changed, reloading config")
+	return r.Reload()
+}
+
+// Reload は設定ファイルを読み込み直して反映する。エラーの場合はそれまでの設定を使い続ける
+func (r *Reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// 不正な内容のファイルを繰り返し読み込まないよう、失敗した場合も内容を記録する
+	r.digest, _ = r.fileDigest()
+
+	cfg, err := r.load(r.path)
+	if err != nil {
+		utils.Logger.WithFields(logrus.Fields{
+			"error": err,
+			"path":  r.path,
+		}).Error("Rejected invalid config, keeping the current config")
+		return err
+	}
+
+	if changed := config.RestartRequired(r.current, cfg); len(changed) > 0 {
+		utils.Logger.WithFields(logrus.Fields{
+			"sections": changed,
+		}).Warn("Config sections changed that require a restart to take effect")
+	}
+	r.apply(r.current, cfg)
+	r.current = cfg
+	utils.Logger.WithField("path", r.path).Info("Reloaded config")
+	return nil
+}
+
+func (r *Reloader) fileDigest() ([]byte, error) {
+	data, err := os.ReadFile(r.path)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(data)
+	return digest[:], nil
+}
@@ -0,0 +1,43 @@
+package reload
+
+import (
+	"os"
+	"path/filepath"
+	"reliproxy/pkg/config"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReloader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reliproxy.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("upstream:\n  max_retries: 1\n"), 0o644))
+	current, err := config.Load(path)
+	require.NoError(t, err)
+
+	var applied []*config.Config
+	reloader := NewReloader(path, current, 0, config.Load, func(old, cfg *config.Config) {
+		assert.Same(t, current, old)
+		applied = append(applied, cfg)
+	})
+
+	// 内容が変わっていなければ読み込み直さない
+	require.NoError(t, reloader.ReloadIfChanged())
+	assert.Empty(t, applied)
+
+	// 不正な設定は反映せず、それまでの設定を使い続ける
+	require.NoError(t, os.WriteFile(path, []byte("upstream:\n  max_retries: 0\n"), 0o644))
+	assert.ErrorContains(t, reloader.ReloadIfChanged(), "upstream.max_retries: must be positive")
+	assert.Empty(t, applied)
+	assert.Same(t, current, reloader.Current())
+
+	// 同じ不正な内容は繰り返し読み込まない
+	assert.NoError(t, reloader.ReloadIfChanged())
+
+	require.NoError(t, os.WriteFile(path, []byte("upstream:\n  max_retries: 5\n"), 0o644))
+	require.NoError(t, reloader.ReloadIfChanged())
+	require.Len(t, applied, 1)
+	assert.Equal(t, 5, applied[0].Upstream.MaxRetries)
+	assert.Same(t, applied[0], reloader.Current())
+}
@@ -0,0 +1,439 @@
+package repository
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// MemoryRequestStatusRepository は単一プロセス用のスレッドセーフなリポジトリ
+type MemoryRequestStatusRepository struct {
+	mu       sync.RWMutex
+	statuses map[string]RequestStatus
+}
+
+func NewMemoryRequestStatusRepository() *MemoryRequestStatusRepository {
+	return &MemoryRequestStatusRepository{statuses: make(map[string]RequestStatus)}
+}
+
+// WithContext はトレースを記録しないため、同じリポジトリを返す
+func (r *MemoryRequestStatusRepository) WithContext(ctx context.Context) RequestStatusRepository {
+	return r
+}
+
+// GetByID は GormRequestStatusRepository と同じく見つからない場合 gorm.ErrRecordNotFound を返す
+func (r *MemoryRequestStatusRepository) GetByID(id string) (*RequestStatus, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	requestStatus, ok := r.statuses[id]
+	if !ok {
+		return &RequestStatus{}, gorm.ErrRecordNotFound
+	}
+	return &requestStatus, nil
+}
+
+func (r *MemoryRequestStatusRepository) Create(requestStatus *RequestStatus) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.statuses[requestStatus.ID]; ok {
+		return gorm.ErrDuplicatedKey
+	}
+	r.statuses[requestStatus.ID] = *requestStatus
+	return nil
+}
+
+func (r *MemoryRequestStatusRepository) CreateBatch(requestStatuses []RequestStatus) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, requestStatus := range requestStatuses {
+		if _, ok := r.statuses[requestStatus.ID]; ok {
+			return gorm.ErrDuplicatedKey
+		}
+	}
+	for _, requestStatus := range requestStatuses {
+		r.statuses[requestStatus.ID] = requestStatus
+	}
+	return nil
+}
+
+func (r *MemoryRequestStatusRepository) CountByBatch(batchID string) (map[string]int64, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	counts := make(map[string]int64)
+	for _, requestStatus := range r.statuses {
+		if requestStatus.BatchID == batchID {
+			counts[requestStatus.Status]++
+		}
+	}
+	return counts, nil
+}
+
+func (r *MemoryRequestStatusRepository) TransitionStatus(id string, from []string, to string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	requestStatus, ok := r.statuses[id]
+	if !ok {
+		return false, nil
+	}
+	for _, status := range from {
+		if requestStatus.Status == status {
+			requestStatus.Status = to
+			r.statuses[id] = requestStatus
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r *MemoryRequestStatusRepository) TransitionBatchStatus(batchID string, from []string, to string) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var transitioned int64
+	for id, requestStatus := range r.statuses {
+		if requestStatus.BatchID == batchID && slices.Contains(from, requestStatus.Status) {
+			requestStatus.Status = to
+			r.statuses[id] = requestStatus
+			transitioned++
+		}
+	}
+	return transitioned, nil
+}
+
+func (r *MemoryRequestStatusRepository) SaveResponse(id string, response string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	requestStatus, ok := r.statuses[id]
+	if !ok {
+		return nil
+	}
+	requestStatus.Response = response
+	r.statuses[id] = requestStatus
+	return nil
+}
+
+func (r *MemoryRequestStatusRepository) Delete(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.statuses, id)
+	return nil
+}
+
+// MemoryWebhookDeliveryRepository は単一プロセス用のリポジトリ
+type MemoryWebhookDeliveryRepository struct {
+	mu         sync.Mutex
+	deliveries map[uint]WebhookDelivery
+	nextID     uint
+}
+
+func NewMemoryWebhookDeliveryRepository() *MemoryWebhookDeliveryRepository {
+	return &MemoryWebhookDeliveryRepository{deliveries: make(map[uint]WebhookDelivery)}
+}
+
+func (r *MemoryWebhookDeliveryRepository) Create(delivery *WebhookDelivery) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.nextID++
+	delivery.ID = r.nextID
+	delivery.CreatedAt = time.Now()
+	delivery.UpdatedAt = delivery.CreatedAt
+	r.deliveries[delivery.ID] = *delivery
+	return nil
+}
+
+func (r *MemoryWebhookDeliveryRepository) ClaimDue(now time.Time, limit int, lease time.Duration) ([]WebhookDelivery, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var deliveries []WebhookDelivery
+	for _, delivery := range r.deliveries {
+		if delivery.Status == DeliveryPending && !delivery.NextAttemptAt.After(now) {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+	sort.Slice(deliveries, func(i, j int) bool { return deliveries[i].NextAttemptAt.Before(deliveries[j].NextAttemptAt) })
+	if len(deliveries) > limit {
+		deliveries = deliveries[:limit]
+	}
+	for i := range deliveries {
+		deliveries[i].NextAttemptAt = now.Add(lease)
+		r.deliveries[deliveries[i].ID] = deliveries[i]
+	}
+	return deliveries, nil
+}
+
+func (r *MemoryWebhookDeliveryRepository) Update(delivery *WebhookDelivery) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.deliveries[delivery.ID]; !ok {
+		return gorm.ErrRecordNotFound
+	}
+	delivery.UpdatedAt = time.Now()
+	r.deliveries[delivery.ID] = *delivery
+	return nil
+}
+
+func (r *MemoryWebhookDeliveryRepository) ListByRequestID(requestID string) ([]WebhookDelivery, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var deliveries []WebhookDelivery
+	for _, delivery := range r.deliveries {
+		if delivery.RequestID == requestID {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+	sort.Slice(deliveries, func(i, j int) bool { return deliveries[i].ID < deliveries[j].ID })
+	return deliveries, nil
+}
+
+// MemoryRouteRepository は単一プロセス用のリポジトリ
+type MemoryRouteRepository struct {
+	mu          sync.Mutex
+	routes      map[string]Route
+	versions    map[string][]RouteVersion
+	policies    map[string]RoutePolicy
+	credentials map[string]RouteCredential
+	nextID      uint
+}
+
+func NewMemoryRouteRepository() *MemoryRouteRepository {
+	return &MemoryRouteRepository{
+		routes:      make(map[string]Route),
+		versions:    make(map[string][]RouteVersion),
+		policies:    make(map[string]RoutePolicy),
+		credentials: make(map[string]RouteCredential),
+	}
+}
+
+func (r *MemoryRouteRepository) ListRoutes() ([]Route, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	routes := make([]Route, 0, len(r.routes))
+	for _, route := range r.routes {
+		routes = append(routes, route)
+	}
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Name < routes[j].Name })
+	return routes, nil
+}
+
+func (r *MemoryRouteRepository) GetRoute(name string) (*Route, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	route, ok := r.routes[name]
+	if !ok {
+		return &Route{}, gorm.ErrRecordNotFound
+	}
+	return &route, nil
+}
+
+func (r *MemoryRouteRepository) SaveRoute(route *Route, operator string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.saveRoute(route, operator)
+	return nil
+}
+
+func (r *MemoryRouteRepository) DeleteRoute(name string, operator string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, err := r.deleteRoute(name, operator)
+	return err
+}
+
+func (r *MemoryRouteRepository) ListRouteVersions(name string) ([]RouteVersion, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]RouteVersion(nil), r.versions[name]...), nil
+}
+
+func (r *MemoryRouteRepository) RollbackRoute(name string, version int, operator string) (*RouteVersion, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, target := range r.versions[name] {
+		if target.Version != version {
+			continue
+		}
+		if target.Deleted {
+			return r.deleteRoute(name, operator)
+		}
+		return r.saveRoute(&Route{
+			Name:           name,
+			URL:            target.URL,
+			PolicyName:     target.PolicyName,
+			CredentialName: target.CredentialName,
+		}, operator), nil
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (r *MemoryRouteRepository) saveRoute(route *Route, operator string) *RouteVersion {
+	now := time.Now()
+	if existing, ok := r.routes[route.Name]; ok {
+		route.CreatedAt = existing.CreatedAt
+	} else {
+		route.CreatedAt = now
+	}
+	route.UpdatedAt = now
+	route.Version = len(r.versions[route.Name]) + 1
+	route.UpdatedBy = operator
+	r.routes[route.Name] = *route
+
+	return r.addVersion(RouteVersion{
+		RouteName:      route.Name,
+		Version:        route.Version,
+		URL:            route.URL,
+		PolicyName:     route.PolicyName,
+		CredentialName: route.CredentialName,
+		CreatedBy:      operator,
+	})
+}
+
+func (r *MemoryRouteRepository) deleteRoute(name string, operator string) (*RouteVersion, error) {
+	if _, ok := r.routes[name]; !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	delete(r.routes, name)
+
+	return r.addVersion(RouteVersion{
+		RouteName: name,
+		Version:   len(r.versions[name]) + 1,
+		Deleted:   true,
+		CreatedBy: operator,
+	}), nil
+}
+
+func (r *MemoryRouteRepository) addVersion(version RouteVersion) *RouteVersion {
+	r.nextID++
+	version.ID = r.nextID
+	version.CreatedAt = time.Now()
+	r.versions[version.RouteName] = append(r.versions[version.RouteName], version)
+	return &version
+}
+
+func (r *MemoryRouteRepository) ListPolicies() ([]RoutePolicy, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	policies := make([]RoutePolicy, 0, len(r.policies))
+	for _, policy := range r.policies {
+		policies = append(policies, policy)
+	}
+	sort.Slice(policies, func(i, j int) bool { return policies[i].Name < policies[j].Name })
+	return policies, nil
+}
+
+func (r *MemoryRouteRepository) GetPolicy(name string) (*RoutePolicy, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	policy, ok := r.policies[name]
+	if !ok {
+		return &RoutePolicy{}, gorm.ErrRecordNotFound
+	}
+	return &policy, nil
+}
+
+func (r *MemoryRouteRepository) SavePolicy(policy *RoutePolicy) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if existing, ok := r.policies[policy.Name]; ok {
+		policy.CreatedAt = existing.CreatedAt
+	} else {
+		policy.CreatedAt = now
+	}
+	policy.UpdatedAt = now
+	r.policies[policy.Name] = *policy
+	return nil
+}
+
+func (r *MemoryRouteRepository) DeletePolicy(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.policies[name]; !ok {
+		return gorm.ErrRecordNotFound
+	}
+	for _, route := range r.routes {
+		if route.PolicyName == name {
+			return ErrInUse
+		}
+	}
+	delete(r.policies, name)
+	return nil
+}
+
+func (r *MemoryRouteRepository) ListCredentials() ([]RouteCredential, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	credentials := make([]RouteCredential, 0, len(r.credentials))
+	for _, credential := range r.credentials {
+		credentials = append(credentials, credential)
+	}
+	sort.Slice(credentials, func(i, j int) bool { return credentials[i].Name < credentials[j].Name })
+	return credentials, nil
+}
+
+func (r *MemoryRouteRepository) GetCredential(name string) (*RouteCredential, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	credential, ok := r.credentials[name]
+	if !ok {
+		return &RouteCredential{}, gorm.ErrRecordNotFound
+	}
+	return &credential, nil
+}
+
+func (r *MemoryRouteRepository) SaveCredential(credential *RouteCredential) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if existing, ok := r.credentials[credential.Name]; ok {
+		credential.CreatedAt = existing.CreatedAt
+	} else {
+		credential.CreatedAt = now
+	}
+	credential.UpdatedAt = now
+	r.credentials[credential.Name] = *credential
+	return nil
+}
+
+func (r *MemoryRouteRepository) DeleteCredential(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.credentials[name]; !ok {
+		return gorm.ErrRecordNotFound
+	}
+	for _, route := range r.routes {
+		if route.CredentialName == name {
+			return ErrInUse
+		}
+	}
+	delete(r.credentials, name)
+	return nil
+}
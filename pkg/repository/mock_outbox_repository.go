@@ -0,0 +1,111 @@
+// Code generated by MockGen. DO NOT EDIT.
+// Source: pkg/repository/outbox.go
+//
+// Generated by this command:
+//
+//	mockgen -source=pkg/repository/outbox.go -destination=pkg/repository/mock_outbox_repository.go -package=repository
+//
+// Package repository is a generated GoMock package.
+package repository
+
+import (
+	context "context"
+	reflect "reflect"
+
+	gomock "go.uber.org/mock/gomock"
+)
+
+// MockOutboxRepository is a mock of OutboxRepository interface.
+type MockOutboxRepository struct {
+	ctrl     *gomock.Controller
+	recorder *MockOutboxRepositoryMockRecorder
+}
+
+// MockOutboxRepositoryMockRecorder is the mock recorder for MockOutboxRepository.
+type MockOutboxRepositoryMockRecorder struct {
+	mock *MockOutboxRepository
+}
+
+// NewMockOutboxRepository creates a new mock instance.
+func NewMockOutboxRepository(ctrl *gomock.Controller) *MockOutboxRepository {
+	mock := &MockOutboxRepository{ctrl: ctrl}
+	mock.recorder = &MockOutboxRepositoryMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockOutboxRepository) EXPECT() *MockOutboxRepositoryMockRecorder {
+	return m.recorder
+}
+
+// CreateBatchWithStatus mocks base method.
+func (m *MockOutboxRepository) CreateBatchWithStatus(requestStatuses []RequestStatus, messages []OutboxMessage) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateBatchWithStatus", requestStatuses, messages)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CreateBatchWithStatus indicates an expected call of CreateBatchWithStatus.
+func (mr *MockOutboxRepositoryMockRecorder) CreateBatchWithStatus(requestStatuses, messages any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateBatchWithStatus", reflect.TypeOf((*MockOutboxRepository)(nil).CreateBatchWithStatus), requestStatuses, messages)
+}
+
+// CreateWithStatus mocks base method.
+func (m *MockOutboxRepository) CreateWithStatus(requestStatus *RequestStatus, message *OutboxMessage) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateWithStatus", requestStatus, message)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CreateWithStatus indicates an expected call of CreateWithStatus.
+func (mr *MockOutboxRepositoryMockRecorder) CreateWithStatus(requestStatus, message any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateWithStatus", reflect.TypeOf((*MockOutboxRepository)(nil).CreateWithStatus), requestStatus, message)
+}
+
+// Len mocks base method.
+func (m *MockOutboxRepository) Len() (int64, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Len")
+	ret0, _ := ret[0].(int64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Len indicates an expected call of Len.
+func (mr *MockOutboxRepositoryMockRecorder) Len() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Len", reflect.TypeOf((*MockOutboxRepository)(nil).Len))
+}
+
+// ProcessUnsent mocks base method.
+func (m *MockOutboxRepository) ProcessUnsent(limit int, publish func(*OutboxMessage) error) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ProcessUnsent", limit, publish)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ProcessUnsent indicates an expected call of ProcessUnsent.
+func (mr *MockOutboxRepositoryMockRecorder) ProcessUnsent(limit, publish any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ProcessUnsent", reflect.TypeOf((*MockOutboxRepository)(nil).ProcessUnsent), limit, publish)
+}
+
+// WithContext mocks base method.
+func (m *MockOutboxRepository) WithContext(ctx context.Context) OutboxRepository {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "WithContext", ctx)
+	ret0, _ := ret[0].(OutboxRepository)
+	return ret0
+}
+
+// WithContext indicates an expected call of WithContext.
+func (mr *MockOutboxRepositoryMockRecorder) WithContext(ctx any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "WithContext", reflect.TypeOf((*MockOutboxRepository)(nil).WithContext), ctx)
+}
@@ -0,0 +1,68 @@
+// Code generated by MockGen. DO NOT EDIT.
+// Source: pkg/repository/recurring_job.go
+//
+// Generated by this command:
+//
+//	mockgen -source=pkg/repository/recurring_job.go -destination=pkg/repository/mock_recurring_job_repository.go -package=repository
+//
+// Package repository is a generated GoMock package.
+package repository
+
+import (
+	reflect "reflect"
+	time "time"
+
+	gomock "go.uber.org/mock/gomock"
+)
+
+// MockRecurringJobRepository is a mock of RecurringJobRepository interface.
+type MockRecurringJobRepository struct {
+	ctrl     *gomock.Controller
+	recorder *MockRecurringJobRepositoryMockRecorder
+}
+
+// MockRecurringJobRepositoryMockRecorder is the mock recorder for MockRecurringJobRepository.
+type MockRecurringJobRepositoryMockRecorder struct {
+	mock *MockRecurringJobRepository
+}
+
+// NewMockRecurringJobRepository creates a new mock instance.
+func NewMockRecurringJobRepository(ctrl *gomock.Controller) *MockRecurringJobRepository {
+	mock := &MockRecurringJobRepository{ctrl: ctrl}
+	mock.recorder = &MockRecurringJobRepositoryMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockRecurringJobRepository) EXPECT() *MockRecurringJobRepositoryMockRecorder {
+	return m.recorder
+}
+
+// ListEnabled mocks base method.
+func (m *MockRecurringJobRepository) ListEnabled() ([]RecurringJob, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListEnabled")
+	ret0, _ := ret[0].([]RecurringJob)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ListEnabled indicates an expected call of ListEnabled.
+func (mr *MockRecurringJobRepositoryMockRecorder) ListEnabled() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListEnabled", reflect.TypeOf((*MockRecurringJobRepository)(nil).ListEnabled))
+}
+
+// UpdateLastRunAt mocks base method.
+func (m *MockRecurringJobRepository) UpdateLastRunAt(id string, lastRunAt time.Time) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpdateLastRunAt", id, lastRunAt)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UpdateLastRunAt indicates an expected call of UpdateLastRunAt.
+func (mr *MockRecurringJobRepositoryMockRecorder) UpdateLastRunAt(id, lastRunAt any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateLastRunAt", reflect.TypeOf((*MockRecurringJobRepository)(nil).UpdateLastRunAt), id, lastRunAt)
+}
@@ -5,10 +5,12 @@
 //
 //	mockgen -source=pkg/repository/request_status.go -destination=pkg/repository/mock_request_status_repository.go -package=repository
 //
+
 // Package repository is a generated GoMock package.
 package repository
 
 import (
+	context "context"
 	reflect "reflect"
 
 	gomock "go.uber.org/mock/gomock"
@@ -37,6 +39,21 @@ func (m *MockRequestStatusRepository) EXPECT() *MockRequestStatusRepositoryMockR
 	return m.recorder
 }
 
+// CountByBatch mocks base method.
+func (m *MockRequestStatusRepository) CountByBatch(batchID string) (map[string]int64, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CountByBatch", batchID)
+	ret0, _ := ret[0].(map[string]int64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CountByBatch indicates an expected call of CountByBatch.
+func (mr *MockRequestStatusRepositoryMockRecorder) CountByBatch(batchID any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CountByBatch", reflect.TypeOf((*MockRequestStatusRepository)(nil).CountByBatch), batchID)
+}
+
 // Create mocks base method.
 func (m *MockRequestStatusRepository) Create(requestStatus *RequestStatus) error {
 	m.ctrl.T.Helper()
@@ -51,6 +68,34 @@ func (mr *MockRequestStatusRepositoryMockRecorder) Create(requestStatus any) *go
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Create", reflect.TypeOf((*MockRequestStatusRepository)(nil).Create), requestStatus)
 }
 
+// CreateBatch mocks base method.
+func (m *MockRequestStatusRepository) CreateBatch(requestStatuses []RequestStatus) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateBatch", requestStatuses)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CreateBatch indicates an expected call of CreateBatch.
+func (mr *MockRequestStatusRepositoryMockRecorder) CreateBatch(requestStatuses any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateBatch", reflect.TypeOf((*MockRequestStatusRepository)(nil).CreateBatch), requestStatuses)
+}
+
+// Delete mocks base method.
+func (m *MockRequestStatusRepository) Delete(id string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Delete", id)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Delete indicates an expected call of Delete.
+func (mr *MockRequestStatusRepositoryMockRecorder) Delete(id any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Delete", reflect.TypeOf((*MockRequestStatusRepository)(nil).Delete), id)
+}
+
 // GetByID mocks base method.
 func (m *MockRequestStatusRepository) GetByID(id string) (*RequestStatus, error) {
 	m.ctrl.T.Helper()
@@ -65,3 +110,61 @@ func (mr *MockRequestStatusRepositoryMockRecorder) GetByID(id any) *gomock.Call
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetByID", reflect.TypeOf((*MockRequestStatusRepository)(nil).GetByID), id)
 }
+
+// SaveResponse mocks base method.
+func (m *MockRequestStatusRepository) SaveResponse(id, response string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SaveResponse", id, response)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SaveResponse indicates an expected call of SaveResponse.
+func (mr *MockRequestStatusRepositoryMockRecorder) SaveResponse(id, response any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveResponse", reflect.TypeOf((*MockRequestStatusRepository)(nil).SaveResponse), id, response)
+}
+
+// TransitionBatchStatus mocks base method.
+func (m *MockRequestStatusRepository) TransitionBatchStatus(batchID string, from []string, to string) (int64, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "TransitionBatchStatus", batchID, from, to)
+	ret0, _ := ret[0].(int64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// TransitionBatchStatus indicates an expected call of TransitionBatchStatus.
+func (mr *MockRequestStatusRepositoryMockRecorder) TransitionBatchStatus(batchID, from, to any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TransitionBatchStatus", reflect.TypeOf((*MockRequestStatusRepository)(nil).TransitionBatchStatus), batchID, from, to)
+}
+
+// TransitionStatus mocks base method.
+func (m *MockRequestStatusRepository) TransitionStatus(id string, from []string, to string) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "TransitionStatus", id, from, to)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// TransitionStatus indicates an expected call of TransitionStatus.
+func (mr *MockRequestStatusRepositoryMockRecorder) TransitionStatus(id, from, to any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TransitionStatus", reflect.TypeOf((*MockRequestStatusRepository)(nil).TransitionStatus), id, from, to)
+}
+
+// WithContext mocks base method.
+func (m *MockRequestStatusRepository) WithContext(ctx context.Context) RequestStatusRepository {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "WithContext", ctx)
+	ret0, _ := ret[0].(RequestStatusRepository)
+	return ret0
+}
+
+// WithContext indicates an expected call of WithContext.
+func (mr *MockRequestStatusRepositoryMockRecorder) WithContext(ctx any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "WithContext", reflect.TypeOf((*MockRequestStatusRepository)(nil).WithContext), ctx)
+}
@@ -0,0 +1,27 @@
+package repository
+
+import (
+	"context"
+	"time"
+)
+
+// OutboxMessage はステータスと同一トランザクションで保存されるキュー送信待ちのジョブ
+type OutboxMessage struct {
+	ID        uint       `gorm:"primary_key"`
+	RequestID string     `gorm:"index"`
+	Payload   string     `gorm:"type:text"`
+	SentAt    *time.Time `gorm:"index"`
+	CreatedAt time.Time
+}
+
+type OutboxRepository interface {
+	CreateWithStatus(requestStatus *RequestStatus, message *OutboxMessage) error
+	// CreateBatchWithStatus は複数のステータスとメッセージを1つのトランザクションで保存する
+	CreateBatchWithStatus(requestStatuses []RequestStatus, messages []OutboxMessage) error
+	// ProcessUnsent は未送信のメッセージを publish に渡し、成功したものを送信済みにする
+	ProcessUnsent(limit int, publish func(message *OutboxMessage) error) (int, error)
+	// Len は未送信のメッセージ数を返す
+	Len() (int64, error)
+	// WithContext は ctx のスパンの子として操作を記録するリポジトリを返す
+	WithContext(ctx context.Context) OutboxRepository
+}
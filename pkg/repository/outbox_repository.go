@@ -0,0 +1,78 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type GormOutboxRepository struct {
+	db *gorm.DB
+}
+
+func NewGormOutboxRepository(db *gorm.DB) *GormOutboxRepository {
+	return &GormOutboxRepository{db}
+}
+
+func (r *GormOutboxRepository) WithContext(ctx context.Context) OutboxRepository {
+	return &GormOutboxRepository{r.db.WithContext(ctx)}
+}
+
+func (r *GormOutboxRepository) CreateWithStatus(requestStatus *RequestStatus, message *OutboxMessage) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(requestStatus).Error; err != nil {
+			return err
+		}
+		return tx.Create(message).Error
+	})
+}
+
+func (r *GormOutboxRepository) CreateBatchWithStatus(requestStatuses []RequestStatus, messages []OutboxMessage) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.CreateInBatches(requestStatuses, 500).Error; err != nil {
+			return err
+		}
+		return tx.CreateInBatches(messages, 500).Error
+	})
+}
+
+func (r *GormOutboxRepository) ProcessUnsent(limit int, publish func(message *OutboxMessage) error) (int, error) {
+	sent := 0
+	var publishErr error
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		// 複数のリレーが同じメッセージを送信しないようロック済みの行は飛ばす
+		var messages []OutboxMessage
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("sent_at IS NULL").
+			Order("id").
+			Limit(limit).
+			Find(&messages).Error
+		if err != nil {
+			return err
+		}
+
+		for i := range messages {
+			if publishErr = publish(&messages[i]); publishErr != nil {
+				break
+			}
+			now := time.Now()
+			if err := tx.Model(&messages[i]).Update("sent_at", &now).Error; err != nil {
+				return err
+			}
+			sent++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return sent, publishErr
+}
+
+func (r *GormOutboxRepository) Len() (int64, error) {
+	var count int64
+	err := r.db.Model(&OutboxMessage{}).Where("sent_at IS NULL").Count(&count).Error
+	return count, err
+}
@@ -0,0 +1,38 @@
+package repository
+
+import "time"
+
+const (
+	// MissedRunSkip は取りこぼした実行を行わず、直近の実行時刻が猶予内であればそれだけを実行する
+	MissedRunSkip = "skip"
+	// MissedRunOnce は取りこぼした実行をまとめて1回だけ実行する
+	MissedRunOnce = "run_once"
+	// MissedRunAll は取りこぼした実行を全て実行する
+	MissedRunAll = "run_all"
+)
+
+// RecurringJob は cron 式に従って定期的に非同期キューへ追加されるリクエストの定義
+type RecurringJob struct {
+	ID       string `gorm:"primary_key"`
+	Name     string
+	Schedule string
+	// Route はリクエストを送るルートの名前。空の場合はデフォルトのルートを使う
+	Route string
+	// Method は上流へ送るリクエストのメソッド。空の場合は GET で送る
+	Method string
+	// RequestTemplate は上流へ送る JSON の本文。空の場合は本文なしで送る
+	RequestTemplate string `gorm:"type:text"`
+	Priority        string
+	Tenant          string
+	MissedRunPolicy string
+	Enabled         bool `gorm:"index"`
+	LastRunAt       *time.Time
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+}
+
+type RecurringJobRepository interface {
+	ListEnabled() ([]RecurringJob, error)
+	// UpdateLastRunAt は lastRunAt が記録済みの時刻より新しい場合のみ更新する
+	UpdateLastRunAt(id string, lastRunAt time.Time) error
+}
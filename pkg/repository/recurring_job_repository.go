@@ -0,0 +1,27 @@
+package repository
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type GormRecurringJobRepository struct {
+	db *gorm.DB
+}
+
+func NewGormRecurringJobRepository(db *gorm.DB) *GormRecurringJobRepository {
+	return &GormRecurringJobRepository{db}
+}
+
+func (r *GormRecurringJobRepository) ListEnabled() ([]RecurringJob, error) {
+	var jobs []RecurringJob
+	err := r.db.Where("enabled = ?", true).Find(&jobs).Error
+	return jobs, err
+}
+
+func (r *GormRecurringJobRepository) UpdateLastRunAt(id string, lastRunAt time.Time) error {
+	return r.db.Model(&RecurringJob{}).
+		Where("id = ? AND (last_run_at IS NULL OR last_run_at < ?)", id, lastRunAt).
+		Update("last_run_at", lastRunAt).Error
+}
@@ -1,11 +1,44 @@
 package repository
 
+import "context"
+
+const (
+	StatusScheduled = "scheduled"
+	StatusQueued    = "queued"
+	StatusRunning   = "running"
+	StatusProcessed = "processed"
+	StatusFailed    = "failed"
+	StatusCancelled = "cancelled"
+)
+
+// IsTerminalStatus はステータスがこれ以上変化しないかを返す
+func IsTerminalStatus(status string) bool {
+	return status == StatusProcessed || status == StatusFailed || status == StatusCancelled
+}
+
 type RequestStatus struct {
 	ID     string `gorm:"primary_key"`
 	Status string
+	// BatchID はバッチで投入されたリクエストの場合のみ設定される
+	BatchID string `gorm:"index"`
+	// Response は同期リクエストを応答の途中で非同期に切り替えた場合に、上流の応答の本文を記録する
+	Response string `gorm:"type:mediumtext"`
 }
 
 type RequestStatusRepository interface {
 	GetByID(id string) (*RequestStatus, error)
 	Create(requestStatus *RequestStatus) error
+	CreateBatch(requestStatuses []RequestStatus) error
+	// CountByBatch はバッチに含まれるリクエスト数をステータスごとに返す
+	CountByBatch(batchID string) (map[string]int64, error)
+	// TransitionStatus は現在のステータスが from のいずれかである場合のみ to に更新し、更新したかを返す
+	TransitionStatus(id string, from []string, to string) (bool, error)
+	// TransitionBatchStatus はバッチのうち現在のステータスが from のいずれかであるものを to に更新し、更新した数を返す
+	TransitionBatchStatus(batchID string, from []string, to string) (int64, error)
+	// SaveResponse は上流の応答の本文を記録する。存在しない場合もエラーにしない
+	SaveResponse(id string, response string) error
+	// Delete はステータスを削除する。存在しない場合もエラーにしない
+	Delete(id string) error
+	// WithContext は ctx のスパンの子として操作を記録するリポジトリを返す
+	WithContext(ctx context.Context) RequestStatusRepository
 }
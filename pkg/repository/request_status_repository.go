@@ -1,6 +1,11 @@
 package repository
 
-import "gorm.io/gorm"
+import (
+	"context"
+	"slices"
+
+	"gorm.io/gorm"
+)
 
 type GormRequestStatusRepository struct {
 	db *gorm.DB
@@ -10,6 +15,10 @@ func NewGormRequestStatusRepository(db *gorm.DB) *GormRequestStatusRepository {
 	return &GormRequestStatusRepository{db}
 }
 
+func (r *GormRequestStatusRepository) WithContext(ctx context.Context) RequestStatusRepository {
+	return &GormRequestStatusRepository{r.db.WithContext(ctx)}
+}
+
 func (r *GormRequestStatusRepository) GetByID(id string) (*RequestStatus, error) {
 	var requestStatus RequestStatus
 	err := r.db.First(&requestStatus, "id = ?", id).Error
@@ -19,3 +28,62 @@ func (r *GormRequestStatusRepository) GetByID(id string) (*RequestStatus, error)
 func (r *GormRequestStatusRepository) Create(requestStatus *RequestStatus) error {
 	return r.db.Create(requestStatus).Error
 }
+
+func (r *GormRequestStatusRepository) CreateBatch(requestStatuses []RequestStatus) error {
+	return r.db.CreateInBatches(requestStatuses, 500).Error
+}
+
+func (r *GormRequestStatusRepository) CountByBatch(batchID string) (map[string]int64, error) {
+	var rows []struct {
+		Status string
+		Count  int64
+	}
+	err := r.db.Model(&RequestStatus{}).
+		Select("status, COUNT(*) AS count").
+		Where("batch_id = ?", batchID).
+		Group("status").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int64)
+	for _, row := range rows {
+		counts[row.Status] = row.Count
+	}
+	return counts, nil
+}
+
+func (r *GormRequestStatusRepository) TransitionStatus(id string, from []string, to string) (bool, error) {
+	result := r.db.Model(&RequestStatus{}).Where("id = ? AND status IN ?", id, from).Update("status", to)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected > 0 {
+		return true, nil
+	}
+
+	// MySQL は値が変わらなかった行を更新した行数に含めないため、from に to が含まれる場合は
+	// 現在のステータスが既に to であれば更新したものとして扱う
+	if !slices.Contains(from, to) {
+		return false, nil
+	}
+	var count int64
+	if err := r.db.Model(&RequestStatus{}).Where("id = ? AND status = ?", id, to).Count(&count).Error; err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func (r *GormRequestStatusRepository) TransitionBatchStatus(batchID string, from []string, to string) (int64, error) {
+	result := r.db.Model(&RequestStatus{}).Where("batch_id = ? AND status IN ?", batchID, from).Update("status", to)
+	return result.RowsAffected, result.Error
+}
+
+func (r *GormRequestStatusRepository) SaveResponse(id string, response string) error {
+	return r.db.Model(&RequestStatus{ID: id}).Update("response", response).Error
+}
+
+func (r *GormRequestStatusRepository) Delete(id string) error {
+	return r.db.Delete(&RequestStatus{}, "id = ?", id).Error
+}
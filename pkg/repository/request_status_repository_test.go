@@ -0,0 +1,81 @@
+package repository
+
+import (
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+)
+
+func newMockDB(t *testing.T) (*gorm.DB, sqlmock.Sqlmock) {
+	sqlDB, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	t.Cleanup(func() { sqlDB.Close() })
+
+	db, err := gorm.Open(mysql.New(mysql.Config{Conn: sqlDB, SkipInitializeWithVersion: true}), &gorm.Config{SkipDefaultTransaction: true})
+	require.NoError(t, err)
+	return db, mock
+}
+
+func TestGormRequestStatusRepository_TransitionStatus(t *testing.T) {
+	db, mock := newMockDB(t)
+	repo := NewGormRequestStatusRepository(db)
+
+	// queued から running への遷移
+	mock.ExpectExec("UPDATE `request_statuses` SET `status`=\\? WHERE id = \\? AND status IN \\(\\?,\\?\\)").
+		WithArgs(StatusRunning, "req-1", StatusQueued, StatusRunning).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	started, err := repo.TransitionStatus("req-1", []string{StatusQueued, StatusRunning}, StatusRunning)
+	require.NoError(t, err)
+	assert.True(t, started)
+
+	// 再試行で running のまま取り出されたリクエストは、MySQL が更新した行数を 0 と返しても遷移できたものとして扱う
+	mock.ExpectExec("UPDATE `request_statuses`").
+		WithArgs(StatusRunning, "req-1", StatusQueued, StatusRunning).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT count\\(\\*\\) FROM `request_statuses` WHERE id = \\? AND status = \\?").
+		WithArgs("req-1", StatusRunning).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	started, err = repo.TransitionStatus("req-1", []string{StatusQueued, StatusRunning}, StatusRunning)
+	require.NoError(t, err)
+	assert.True(t, started)
+
+	// 取り消されたリクエストは遷移しない
+	mock.ExpectExec("UPDATE `request_statuses`").
+		WithArgs(StatusRunning, "req-2", StatusQueued, StatusRunning).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT count\\(\\*\\) FROM `request_statuses`").
+		WithArgs("req-2", StatusRunning).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	started, err = repo.TransitionStatus("req-2", []string{StatusQueued, StatusRunning}, StatusRunning)
+	require.NoError(t, err)
+	assert.False(t, started)
+
+	// from に to が含まれない場合は更新した行数だけで判定する
+	mock.ExpectExec("UPDATE `request_statuses`").
+		WithArgs(StatusProcessed, "req-2", StatusRunning).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	processed, err := repo.TransitionStatus("req-2", []string{StatusRunning}, StatusProcessed)
+	require.NoError(t, err)
+	assert.False(t, processed)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGormRequestStatusRepository_TransitionBatchStatus(t *testing.T) {
+	db, mock := newMockDB(t)
+	repo := NewGormRequestStatusRepository(db)
+
+	// ワーカーが取り出す前のリクエストだけを更新する
+	mock.ExpectExec("UPDATE `request_statuses` SET `status`=\\? WHERE batch_id = \\? AND status IN \\(\\?,\\?\\)").
+		WithArgs(StatusFailed, "batch-1", StatusQueued, StatusScheduled).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	transitioned, err := repo.TransitionBatchStatus("batch-1", []string{StatusQueued, StatusScheduled}, StatusFailed)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), transitioned)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,97 @@
+package repository
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	// CredentialSourceEnv は環境変数から認証情報を読み込む
+	CredentialSourceEnv = "env"
+	// CredentialSourceFile はファイルから認証情報を読み込む。Kubernetes の Secret をマウントしたファイルなどに使う
+	CredentialSourceFile = "file"
+)
+
+// ErrInUse は他のルートから参照されているため削除できない場合に返す
+var ErrInUse = errors.New("referenced by a route")
+
+// Route は管理 API で登録した上流へのルート
+type Route struct {
+	Name           string `gorm:"primary_key"`
+	URL            string `gorm:"type:text"`
+	PolicyName     string `gorm:"index"`
+	CredentialName string `gorm:"index"`
+	// Version はこのルートの最新の RouteVersion の版数
+	Version   int
+	UpdatedBy string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// RouteVersion はルートを変更するたびに記録する変更後の内容。ロールバックに使う
+type RouteVersion struct {
+	ID             uint   `gorm:"primary_key"`
+	RouteName      string `gorm:"uniqueIndex:idx_route_versions_name_version"`
+	Version        int    `gorm:"uniqueIndex:idx_route_versions_name_version"`
+	URL            string `gorm:"type:text"`
+	PolicyName     string
+	CredentialName string
+	// Deleted はこの版でルートを削除したかを表す
+	Deleted   bool
+	CreatedBy string
+	CreatedAt time.Time
+}
+
+// RoutePolicy はルートの再試行、レート制限、サーキットブレーカーの設定。0 の項目は upstream と breaker の設定を使う
+type RoutePolicy struct {
+	Name                    string `gorm:"primary_key"`
+	MaxRetries              int
+	RateLimit               float64
+	Burst                   int
+	BreakerMaxRequests      uint32
+	BreakerInterval         time.Duration
+	BreakerTimeout          time.Duration
+	BreakerFailureThreshold uint32
+	// SyncOverflow が nil の項目と 0 の SyncOverflowLatency は async の設定を使う
+	SyncOverflow        *bool
+	SyncOverflowLatency time.Duration
+	CreatedAt           time.Time
+	UpdatedAt           time.Time
+}
+
+// RouteCredential は上流へのリクエストに付ける認証情報の参照。秘密の値そのものは保存しない
+type RouteCredential struct {
+	Name string `gorm:"primary_key"`
+	// Source は CredentialSourceEnv か CredentialSourceFile で、Ref は環境変数の名前かファイルのパス
+	Source string
+	Ref    string `gorm:"type:text"`
+	// Header に Scheme と読み込んだ値を空白でつないで設定する。Scheme が空の場合は値だけを設定する
+	Header    string
+	Scheme    string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+type RouteRepository interface {
+	ListRoutes() ([]Route, error)
+	GetRoute(name string) (*Route, error)
+	// SaveRoute はルートを作成または更新し、新しい版として記録する
+	SaveRoute(route *Route, operator string) error
+	// DeleteRoute はルートを削除し、削除した版として記録する
+	DeleteRoute(name string, operator string) error
+	ListRouteVersions(name string) ([]RouteVersion, error)
+	// RollbackRoute は version の版の内容を新しい版として記録し、ルートをその内容に戻す
+	RollbackRoute(name string, version int, operator string) (*RouteVersion, error)
+
+	ListPolicies() ([]RoutePolicy, error)
+	GetPolicy(name string) (*RoutePolicy, error)
+	SavePolicy(policy *RoutePolicy) error
+	// DeletePolicy はルートから参照されている場合 ErrInUse を返す
+	DeletePolicy(name string) error
+
+	ListCredentials() ([]RouteCredential, error)
+	GetCredential(name string) (*RouteCredential, error)
+	SaveCredential(credential *RouteCredential) error
+	// DeleteCredential はルートから参照されている場合 ErrInUse を返す
+	DeleteCredential(name string) error
+}
@@ -0,0 +1,186 @@
+package repository
+
+import (
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type GormRouteRepository struct {
+	db *gorm.DB
+}
+
+func NewGormRouteRepository(db *gorm.DB) *GormRouteRepository {
+	return &GormRouteRepository{db}
+}
+
+func (r *GormRouteRepository) ListRoutes() ([]Route, error) {
+	var routes []Route
+	err := r.db.Order("name").Find(&routes).Error
+	return routes, err
+}
+
+func (r *GormRouteRepository) GetRoute(name string) (*Route, error) {
+	var route Route
+	err := r.db.Where("name = ?", name).First(&route).Error
+	return &route, err
+}
+
+func (r *GormRouteRepository) SaveRoute(route *Route, operator string) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		_, err := saveRoute(tx, route, operator)
+		return err
+	})
+}
+
+func (r *GormRouteRepository) DeleteRoute(name string, operator string) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		_, err := deleteRoute(tx, name, operator)
+		return err
+	})
+}
+
+func (r *GormRouteRepository) ListRouteVersions(name string) ([]RouteVersion, error) {
+	var versions []RouteVersion
+	err := r.db.Where("route_name = ?", name).Order("version").Find(&versions).Error
+	return versions, err
+}
+
+func (r *GormRouteRepository) RollbackRoute(name string, version int, operator string) (*RouteVersion, error) {
+	var rolledBack *RouteVersion
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		var target RouteVersion
+		if err := tx.Where("route_name = ? AND version = ?", name, version).First(&target).Error; err != nil {
+			return err
+		}
+
+		var err error
+		if target.Deleted {
+			rolledBack, err = deleteRoute(tx, name, operator)
+		} else {
+			rolledBack, err = saveRoute(tx, &Route{
+				Name:           name,
+				URL:            target.URL,
+				PolicyName:     target.PolicyName,
+				CredentialName: target.CredentialName,
+			}, operator)
+		}
+		return err
+	})
+	return rolledBack, err
+}
+
+// saveRoute は削除した後に作り直したルートも含めて版数が増え続けるよう、記録済みの最大の版数の次を使う
+func saveRoute(tx *gorm.DB, route *Route, operator string) (*RouteVersion, error) {
+	version, err := nextRouteVersion(tx, route.Name)
+	if err != nil {
+		return nil, err
+	}
+	route.Version = version
+	route.UpdatedBy = operator
+	if err := tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(route).Error; err != nil {
+		return nil, err
+	}
+
+	routeVersion := &RouteVersion{
+		RouteName:      route.Name,
+		Version:        version,
+		URL:            route.URL,
+		PolicyName:     route.PolicyName,
+		CredentialName: route.CredentialName,
+		CreatedBy:      operator,
+	}
+	return routeVersion, tx.Create(routeVersion).Error
+}
+
+func deleteRoute(tx *gorm.DB, name string, operator string) (*RouteVersion, error) {
+	result := tx.Where("name = ?", name).Delete(&Route{})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+
+	version, err := nextRouteVersion(tx, name)
+	if err != nil {
+		return nil, err
+	}
+	routeVersion := &RouteVersion{
+		RouteName: name,
+		Version:   version,
+		Deleted:   true,
+		CreatedBy: operator,
+	}
+	return routeVersion, tx.Create(routeVersion).Error
+}
+
+func nextRouteVersion(tx *gorm.DB, name string) (int, error) {
+	var latest int
+	err := tx.Model(&RouteVersion{}).
+		Where("route_name = ?", name).
+		Select("COALESCE(MAX(version), 0)").
+		Scan(&latest).Error
+	return latest + 1, err
+}
+
+func (r *GormRouteRepository) ListPolicies() ([]RoutePolicy, error) {
+	var policies []RoutePolicy
+	err := r.db.Order("name").Find(&policies).Error
+	return policies, err
+}
+
+func (r *GormRouteRepository) GetPolicy(name string) (*RoutePolicy, error) {
+	var policy RoutePolicy
+	err := r.db.Where("name = ?", name).First(&policy).Error
+	return &policy, err
+}
+
+func (r *GormRouteRepository) SavePolicy(policy *RoutePolicy) error {
+	return r.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(policy).Error
+}
+
+func (r *GormRouteRepository) DeletePolicy(name string) error {
+	return r.deleteReferenced(&RoutePolicy{}, "policy_name", name)
+}
+
+func (r *GormRouteRepository) ListCredentials() ([]RouteCredential, error) {
+	var credentials []RouteCredential
+	err := r.db.Order("name").Find(&credentials).Error
+	return credentials, err
+}
+
+func (r *GormRouteRepository) GetCredential(name string) (*RouteCredential, error) {
+	var credential RouteCredential
+	err := r.db.Where("name = ?", name).First(&credential).Error
+	return &credential, err
+}
+
+func (r *GormRouteRepository) SaveCredential(credential *RouteCredential) error {
+	return r.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(credential).Error
+}
+
+func (r *GormRouteRepository) DeleteCredential(name string) error {
+	return r.deleteReferenced(&RouteCredential{}, "credential_name", name)
+}
+
+// deleteReferenced は column で name を参照しているルートがなければ model を削除する
+func (r *GormRouteRepository) deleteReferenced(model interface{}, column string, name string) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		var referenced int64
+		if err := tx.Model(&Route{}).Where(column+" = ?", name).Count(&referenced).Error; err != nil {
+			return err
+		}
+		if referenced > 0 {
+			return ErrInUse
+		}
+
+		result := tx.Where("name = ?", name).Delete(model)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return nil
+	})
+}
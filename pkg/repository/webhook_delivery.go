@@ -0,0 +1,33 @@
+package repository
+
+import "time"
+
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryDead      = "dead"
+)
+
+// WebhookDelivery はリクエストの完了をコールバック URL へ通知する配信
+type WebhookDelivery struct {
+	ID             uint   `gorm:"primary_key"`
+	RequestID      string `gorm:"index"`
+	URL            string `gorm:"type:text"`
+	Payload        string `gorm:"type:text"`
+	Status         string `gorm:"index"`
+	Attempts       int
+	LastStatusCode int
+	LastError      string    `gorm:"type:text"`
+	NextAttemptAt  time.Time `gorm:"index"`
+	DeliveredAt    *time.Time
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
+
+type WebhookDeliveryRepository interface {
+	Create(delivery *WebhookDelivery) error
+	// ClaimDue は送信時刻を迎えた配信を返し、lease の間は他のディスパッチャーが取得しないようにする
+	ClaimDue(now time.Time, limit int, lease time.Duration) ([]WebhookDelivery, error)
+	Update(delivery *WebhookDelivery) error
+	ListByRequestID(requestID string) ([]WebhookDelivery, error)
+}
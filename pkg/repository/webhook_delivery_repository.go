@@ -0,0 +1,52 @@
+package repository
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type GormWebhookDeliveryRepository struct {
+	db *gorm.DB
+}
+
+func NewGormWebhookDeliveryRepository(db *gorm.DB) *GormWebhookDeliveryRepository {
+	return &GormWebhookDeliveryRepository{db}
+}
+
+func (r *GormWebhookDeliveryRepository) Create(delivery *WebhookDelivery) error {
+	return r.db.Create(delivery).Error
+}
+
+func (r *GormWebhookDeliveryRepository) ClaimDue(now time.Time, limit int, lease time.Duration) ([]WebhookDelivery, error) {
+	var deliveries []WebhookDelivery
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ? AND next_attempt_at <= ?", DeliveryPending, now).
+			Order("next_attempt_at").
+			Limit(limit).
+			Find(&deliveries).Error
+		if err != nil || len(deliveries) == 0 {
+			return err
+		}
+
+		ids := make([]uint, len(deliveries))
+		for i := range deliveries {
+			ids[i] = deliveries[i].ID
+			deliveries[i].NextAttemptAt = now.Add(lease)
+		}
+		return tx.Model(&WebhookDelivery{}).Where("id IN ?", ids).Update("next_attempt_at", now.Add(lease)).Error
+	})
+	return deliveries, err
+}
+
+func (r *GormWebhookDeliveryRepository) Update(delivery *WebhookDelivery) error {
+	return r.db.Save(delivery).Error
+}
+
+func (r *GormWebhookDeliveryRepository) ListByRequestID(requestID string) ([]WebhookDelivery, error) {
+	var deliveries []WebhookDelivery
+	err := r.db.Where("request_id = ?", requestID).Order("id").Find(&deliveries).Error
+	return deliveries, err
+}
@@ -0,0 +1,93 @@
+package routing
+
+import (
+	"context"
+	"sync"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Invalidator はルートの変更を全てのレプリカに通知し、ルートテーブルを作り直させる
+type Invalidator interface {
+	// Publish は name のルートやその参照先が変更されたことを通知する
+	Publish(name string) error
+	// Subscribe は ctx が終了するまで変更されたルートなどの名前を handler に渡す
+	Subscribe(ctx context.Context, handler func(name string)) error
+}
+
+type RedisClient interface {
+	Publish(ctx context.Context, channel string, message interface{}) *redis.IntCmd
+	Subscribe(ctx context.Context, channels ...string) *redis.PubSub
+}
+
+// RedisInvalidator は Redis の Pub/Sub でレプリカ間にルートの変更を通知する
+type RedisInvalidator struct {
+	client  RedisClient
+	channel string
+}
+
+func NewRedisInvalidator(client RedisClient, channel string) *RedisInvalidator {
+	return &RedisInvalidator{client: client, channel: channel}
+}
+
+func (i *RedisInvalidator) Publish(name string) error {
+	return i.client.Publish(context.Background(), i.channel, name).Err()
+}
+
+func (i *RedisInvalidator) Subscribe(ctx context.Context, handler func(name string)) error {
+	pubsub := i.client.Subscribe(ctx, i.channel)
+	defer pubsub.Close()
+
+	// 購読の完了を待ってから受信を始める
+	if _, err := pubsub.Receive(ctx); err != nil {
+		return err
+	}
+	messages := pubsub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case message, ok := <-messages:
+			if !ok {
+				return nil
+			}
+			handler(message.Payload)
+		}
+	}
+}
+
+// MemoryInvalidator は単一プロセス用の Invalidator
+type MemoryInvalidator struct {
+	mu       sync.RWMutex
+	handlers map[int]func(name string)
+	nextID   int
+}
+
+func NewMemoryInvalidator() *MemoryInvalidator {
+	return &MemoryInvalidator{handlers: make(map[int]func(name string))}
+}
+
+func (i *MemoryInvalidator) Publish(name string) error {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	for _, handler := range i.handlers {
+		handler(name)
+	}
+	return nil
+}
+
+func (i *MemoryInvalidator) Subscribe(ctx context.Context, handler func(name string)) error {
+	i.mu.Lock()
+	id := i.nextID
+	i.nextID++
+	i.handlers[id] = handler
+	i.mu.Unlock()
+
+	<-ctx.Done()
+
+	i.mu.Lock()
+	delete(i.handlers, id)
+	i.mu.Unlock()
+	return ctx.Err()
+}
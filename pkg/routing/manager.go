@@ -0,0 +1,179 @@
+package routing
+
+import (
+	"context"
+	"reflect"
+	"reliproxy/pkg/httpclient"
+	"reliproxy/pkg/metrics"
+	"reliproxy/pkg/repository"
+	"reliproxy/pkg/utils"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Manager は設定ファイルのルートと管理 API で登録したルートからルートテーブルを作り、変更のたびに差し替える
+//
+// 設定ファイルのルートと同じ名前の登録済みのルートは無視する。ルートが変わっていなければ差し替えない。
+// 差し替える前のルートテーブルで処理中のリクエストはそのまま完了させ、完了を待ってからログに記録する。
+type Manager struct {
+	router           *httpclient.Router
+	client           httpclient.HttpClient
+	routeRepository  repository.RouteRepository
+	credentialPolicy CredentialPolicy
+
+	mu           sync.Mutex
+	static       []httpclient.RouteSpec
+	dynamic      []httpclient.RouteSpec
+	drainTimeout time.Duration
+	// applied は現在のルートテーブルの作成に使ったルート
+	applied []httpclient.RouteSpec
+}
+
+// NewManager は static の先頭をデフォルトのルートとしてルートテーブルを作成する。routeRepository が nil の場合は static だけを使う
+//
+// 登録済みのルートの認証情報は credentialPolicy で許可された参照先からだけ読み込む。
+func NewManager(static []httpclient.RouteSpec, drainTimeout time.Duration, client httpclient.HttpClient, routeRepository repository.RouteRepository, credentialPolicy CredentialPolicy) *Manager {
+	m := &Manager{
+		client:           client,
+		routeRepository:  routeRepository,
+		credentialPolicy: credentialPolicy,
+		static:           static,
+		drainTimeout:     drainTimeout,
+	}
+	m.loadDynamic()
+	m.applied = m.specs()
+	m.router = httpclient.NewRouter(m.newTable(m.applied, nil))
+	return m
+}
+
+func (m *Manager) Router() *httpclient.Router {
+	return m.router
+}
+
+// IsStatic は name が設定ファイルで定義したルートかを返す
+func (m *Manager) IsStatic(name string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, spec := range m.static {
+		if spec.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Reconfigure は設定ファイルの再読み込みで変わったルートを反映する
+func (m *Manager) Reconfigure(static []httpclient.RouteSpec, drainTimeout time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.static = static
+	m.drainTimeout = drainTimeout
+	// 登録済みのルートは設定ファイルのデフォルトのルートの値を引き継ぐため作り直す
+	m.loadDynamic()
+	m.swap()
+}
+
+// Refresh は登録済みのルートを読み込み直して反映する。読み込めない場合はそれまでのルートを使い続ける
+func (m *Manager) Refresh() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.loadDynamic(); err != nil {
+		return err
+	}
+	m.swap()
+	return nil
+}
+
+// Start は invalidator で通知されるか interval が経過するたびに登録済みのルートを読み込み直す
+//
+// 通知を受け取れなかった場合も interval ごとの読み込みで最終的に反映する。
+func (m *Manager) Start(invalidator Invalidator, interval time.Duration) {
+	go func() {
+		for {
+			err := invalidator.Subscribe(context.Background(), func(name string) {
+				utils.Logger.WithField("route", name).Info("Route changed, refreshing routes")
+				m.Refresh()
+			})
+			utils.Logger.WithFields(logrus.Fields{
+				"error": err,
+			}).Error("Route invalidation subscription stopped")
+			time.Sleep(1 * time.Second)
+			// 購読していない間の変更を取りこぼさないよう読み込み直す
+			m.Refresh()
+		}
+	}()
+
+	for {
+		time.Sleep(interval)
+		m.Refresh()
+	}
+}
+
+// loadDynamic は登録済みのルートを読み込む。呼び出し側は mu を保持する
+func (m *Manager) loadDynamic() error {
+	if m.routeRepository == nil {
+		return nil
+	}
+	dynamic, err := LoadSpecs(m.routeRepository, m.static[0], m.credentialPolicy)
+	if err != nil {
+		utils.Logger.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Failed to load routes, keeping the current routes")
+		return err
+	}
+	m.dynamic = dynamic
+	return nil
+}
+
+// swap はルートが変わっていればルートテーブルを作り直して差し替える。呼び出し側は mu を保持する
+func (m *Manager) swap() {
+	specs := m.specs()
+	if reflect.DeepEqual(specs, m.applied) {
+		return
+	}
+	m.applied = specs
+	previous := m.router.Swap(m.newTable(specs, m.router.Current()))
+
+	drainTimeout := m.drainTimeout
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+		defer cancel()
+		if err := previous.Drain(ctx, 100*time.Millisecond); err != nil {
+			utils.Logger.WithFields(logrus.Fields{
+				"inFlight": previous.InFlight(),
+			}).Warn("Timed out draining requests on the previous routes")
+			return
+		}
+		utils.Logger.Debug("Drained requests on the previous routes")
+	}()
+}
+
+// specs は設定ファイルのルートと登録済みのルートを合わせて返す。呼び出し側は mu を保持する
+func (m *Manager) specs() []httpclient.RouteSpec {
+	specs := append([]httpclient.RouteSpec(nil), m.static...)
+	names := make(map[string]bool, len(m.static))
+	for _, spec := range m.static {
+		names[spec.Name] = true
+	}
+	for _, spec := range m.dynamic {
+		if names[spec.Name] {
+			utils.Logger.WithField("route", spec.Name).Warn("Ignoring route that is also defined in the config file")
+			continue
+		}
+		specs = append(specs, spec)
+	}
+	return specs
+}
+
+func (m *Manager) newTable(specs []httpclient.RouteSpec, previous *httpclient.RouteTable) *httpclient.RouteTable {
+	table := httpclient.NewRouteTable(specs, previous, m.client, metrics.ObserveBreakerStateChange)
+	for _, breaker := range table.Breakers() {
+		metrics.SetBreakerState(breaker.Name(), breaker.State())
+	}
+	return table
+}
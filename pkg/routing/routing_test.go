@@ -0,0 +1,185 @@
+package routing
+
+import (
+	"os"
+	"path/filepath"
+	"reliproxy/pkg/httpclient"
+	"reliproxy/pkg/repository"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+)
+
+var base = httpclient.RouteSpec{
+	Name:       httpclient.DefaultRoute,
+	URL:        "https://api.thirdparty.com/data",
+	MaxRetries: 3,
+	RateLimit:  5,
+	Burst:      10,
+	Breaker: httpclient.BreakerSpec{
+		Name:             "HTTP GET",
+		MaxRequests:      5,
+		Interval:         2 * time.Second,
+		Timeout:          10 * time.Second,
+		FailureThreshold: 3,
+	},
+}
+
+var credentialPolicy = CredentialPolicy{EnvPrefix: "RELIPROXY_CREDENTIAL_"}
+
+func TestLoadSpecs(t *testing.T) {
+	t.Setenv("RELIPROXY_CREDENTIAL_PARTNER", "secret")
+	routeRepository := repository.NewMemoryRouteRepository()
+	overflow := true
+	require.NoError(t, routeRepository.SavePolicy(&repository.RoutePolicy{Name: "slow", MaxRetries: 1, BreakerTimeout: time.Minute, SyncOverflow: &overflow}))
+	require.NoError(t, routeRepository.SaveCredential(&repository.RouteCredential{
+		Name:   "partner",
+		Source: repository.CredentialSourceEnv,
+		Ref:    "RELIPROXY_CREDENTIAL_PARTNER",
+		Header: "Authorization",
+		Scheme: "Bearer",
+	}))
+	require.NoError(t, routeRepository.SaveCredential(&repository.RouteCredential{
+		Name:   "missing",
+		Source: repository.CredentialSourceEnv,
+		Ref:    "RELIPROXY_CREDENTIAL_MISSING",
+		Header: "X-Api-Key",
+	}))
+	require.NoError(t, routeRepository.SaveRoute(&repository.Route{Name: "partner", URL: "https://partner.example.com", PolicyName: "slow", CredentialName: "partner"}, "alice"))
+	require.NoError(t, routeRepository.SaveRoute(&repository.Route{Name: "plain", URL: "https://plain.example.com"}, "alice"))
+	require.NoError(t, routeRepository.SaveRoute(&repository.Route{Name: "broken", URL: "https://broken.example.com", CredentialName: "missing"}, "alice"))
+
+	specs, err := LoadSpecs(routeRepository, base, credentialPolicy)
+	require.NoError(t, err)
+	// 認証情報を読み込めないルートは除外する
+	require.Len(t, specs, 2)
+
+	partner := specs[0]
+	assert.Equal(t, "partner", partner.Name)
+	assert.Equal(t, "https://partner.example.com", partner.URL)
+	assert.Equal(t, 1, partner.MaxRetries)
+	// ポリシーで指定しなかった項目は base の値を使う
+	assert.Equal(t, 5.0, partner.RateLimit)
+	assert.Equal(t, time.Minute, partner.Breaker.Timeout)
+	assert.Equal(t, uint32(5), partner.Breaker.MaxRequests)
+	assert.Equal(t, "route:partner", partner.Breaker.Name)
+	assert.True(t, partner.SyncOverflow)
+	assert.Equal(t, map[string]string{"Authorization": "Bearer secret"}, partner.Headers)
+
+	plain := specs[1]
+	assert.Equal(t, "plain", plain.Name)
+	assert.Equal(t, base.MaxRetries, plain.MaxRetries)
+	assert.Equal(t, base.SyncOverflow, plain.SyncOverflow)
+	assert.Nil(t, plain.Headers)
+}
+
+func TestResolveCredential(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "partner"), []byte("file-secret\n"), 0o600))
+	outside := filepath.Join(t.TempDir(), "outside")
+	require.NoError(t, os.WriteFile(outside, []byte("outside-secret"), 0o600))
+	require.NoError(t, os.Symlink(outside, filepath.Join(dir, "link")))
+	t.Setenv("RELIPROXY_CREDENTIAL_PARTNER", "env-secret")
+	t.Setenv("MYSQL_PASSWORD", "password")
+
+	policy := CredentialPolicy{EnvPrefix: "RELIPROXY_CREDENTIAL_", Dir: dir}
+	tests := []struct {
+		name    string
+		source  string
+		ref     string
+		want    string
+		wantErr string
+	}{
+		{"env with prefix", repository.CredentialSourceEnv, "RELIPROXY_CREDENTIAL_PARTNER", "env-secret", ""},
+		{"env without prefix", repository.CredentialSourceEnv, "MYSQL_PASSWORD", "", "must start with RELIPROXY_CREDENTIAL_"},
+		{"file in dir", repository.CredentialSourceFile, "partner", "file-secret", ""},
+		{"absolute file in dir", repository.CredentialSourceFile, filepath.Join(dir, "partner"), "file-secret", ""},
+		{"file outside dir", repository.CredentialSourceFile, outside, "", "must be under"},
+		{"path traversal", repository.CredentialSourceFile, "../outside", "", "must be under"},
+		{"symlink out of dir", repository.CredentialSourceFile, "link", "", "must be under"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, err := ResolveCredential(repository.RouteCredential{Name: "partner", Source: tt.source, Ref: tt.ref}, policy)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, value)
+		})
+	}
+
+	// 許可する参照先を設定しない場合は使えない
+	_, err := ResolveCredential(repository.RouteCredential{Name: "partner", Source: repository.CredentialSourceFile, Ref: "partner"}, CredentialPolicy{})
+	assert.ErrorContains(t, err, "disabled")
+}
+
+func TestManager(t *testing.T) {
+	routeRepository := repository.NewMemoryRouteRepository()
+	manager := NewManager([]httpclient.RouteSpec{base}, time.Second, new(httpclient.MockClient), routeRepository, credentialPolicy)
+	router := manager.Router()
+	first := router.Current()
+
+	_, ok := first.Route("partner")
+	assert.False(t, ok)
+
+	require.NoError(t, routeRepository.SaveRoute(&repository.Route{Name: "partner", URL: "https://partner.example.com"}, "alice"))
+	// 設定ファイルのルートと同じ名前の登録は無視する
+	require.NoError(t, routeRepository.SaveRoute(&repository.Route{Name: httpclient.DefaultRoute, URL: "https://other.example.com"}, "alice"))
+	require.NoError(t, manager.Refresh())
+
+	table := router.Current()
+	assert.NotSame(t, first, table)
+	route, ok := table.Route("partner")
+	require.True(t, ok)
+	assert.Equal(t, "https://partner.example.com", route.Spec.URL)
+	route, ok = table.Route(httpclient.DefaultRoute)
+	require.True(t, ok)
+	assert.Equal(t, base.URL, route.Spec.URL)
+	assert.True(t, manager.IsStatic(httpclient.DefaultRoute))
+	assert.False(t, manager.IsStatic("partner"))
+
+	// 設定ファイルの再読み込みでは登録済みのルートも base の値で作り直す
+	reconfigured := base
+	reconfigured.MaxRetries = 7
+	manager.Reconfigure([]httpclient.RouteSpec{reconfigured}, time.Second)
+	route, ok = router.Current().Route("partner")
+	require.True(t, ok)
+	assert.Equal(t, 7, route.Spec.MaxRetries)
+}
+
+func TestManager_KeepsTableAndLimiterOverrides(t *testing.T) {
+	routeRepository := repository.NewMemoryRouteRepository()
+	require.NoError(t, routeRepository.SaveRoute(&repository.Route{Name: "partner", URL: "https://partner.example.com"}, "alice"))
+	manager := NewManager([]httpclient.RouteSpec{base}, time.Second, new(httpclient.MockClient), routeRepository, credentialPolicy)
+	router := manager.Router()
+	first := router.Current()
+
+	route, ok := first.Route("partner")
+	require.True(t, ok)
+	route.Limiter.SetLimit(1)
+
+	// ルートが変わっていなければ差し替えない
+	require.NoError(t, manager.Refresh())
+	assert.Same(t, first, router.Current())
+
+	// 作り直しても運用者が変更したレートは維持し、変更していないバーストは設定の値に従う
+	reconfigured := base
+	reconfigured.RateLimit = 50
+	reconfigured.Burst = 20
+	manager.Reconfigure([]httpclient.RouteSpec{reconfigured}, time.Second)
+	assert.NotSame(t, first, router.Current())
+	route, ok = router.Current().Route("partner")
+	require.True(t, ok)
+	assert.Equal(t, rate.Limit(1), route.Limiter.Limit())
+	assert.Equal(t, 20, route.Limiter.Burst())
+	assert.True(t, route.Limiter.Overridden())
+
+	route.Limiter.Reset()
+	assert.Equal(t, rate.Limit(50), route.Limiter.Limit())
+	assert.False(t, route.Limiter.Overridden())
+}
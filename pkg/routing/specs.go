@@ -0,0 +1,198 @@
+package routing
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reliproxy/pkg/httpclient"
+	"reliproxy/pkg/repository"
+	"reliproxy/pkg/utils"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// BreakerNamePrefix は管理 API で登録したルートのサーキットブレーカーの名前に付ける接頭辞
+//
+// 設定ファイルのルートのサーキットブレーカーと名前が重ならないようにする。
+const BreakerNamePrefix = "route:"
+
+// CredentialPolicy は管理 API で登録する認証情報の参照先として許可する環境変数とファイル
+//
+// 管理 API のトークンを持つ運用者がデータベースのパスワードなど、プロセスの他の秘密を上流へ送らせないよう、
+// EnvPrefix で始まる環境変数と Dir の下のファイルだけを許可する。空の場合はその参照先を使えない。
+type CredentialPolicy struct {
+	EnvPrefix string
+	Dir       string
+}
+
+// Check は参照先が許可されているかを確認する
+func (p CredentialPolicy) Check(source, ref string) error {
+	switch source {
+	case repository.CredentialSourceEnv:
+		if p.EnvPrefix == "" {
+			return errors.New("environment variable credentials are disabled")
+		}
+		if !strings.HasPrefix(ref, p.EnvPrefix) || ref == p.EnvPrefix {
+			return fmt.Errorf("environment variable must start with %s", p.EnvPrefix)
+		}
+	case repository.CredentialSourceFile:
+		if p.Dir == "" {
+			return errors.New("file credentials are disabled")
+		}
+		if !withinDir(p.Dir, ref) {
+			return fmt.Errorf("file must be under %s", p.Dir)
+		}
+	default:
+		return fmt.Errorf("unknown source %q", source)
+	}
+	return nil
+}
+
+// path はファイルの参照先のパスを返す。相対パスは Dir からのパスとして扱う
+func (p CredentialPolicy) path(ref string) string {
+	if filepath.IsAbs(ref) {
+		return filepath.Clean(ref)
+	}
+	return filepath.Join(p.Dir, ref)
+}
+
+func withinDir(dir, ref string) bool {
+	path := ref
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	rel, err := filepath.Rel(filepath.Clean(dir), filepath.Clean(path))
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// LoadSpecs は管理 API で登録したルートの設定を読み込む
+//
+// ポリシーで指定しなかった項目は base の値を使う。参照先が見つからないルートや
+// 認証情報を読み込めないルートは、誤った設定で上流へ送らないよう除外してログに記録する。
+func LoadSpecs(routeRepository repository.RouteRepository, base httpclient.RouteSpec, credentialPolicy CredentialPolicy) ([]httpclient.RouteSpec, error) {
+	routes, err := routeRepository.ListRoutes()
+	if err != nil {
+		return nil, err
+	}
+	policies, err := routeRepository.ListPolicies()
+	if err != nil {
+		return nil, err
+	}
+	credentials, err := routeRepository.ListCredentials()
+	if err != nil {
+		return nil, err
+	}
+
+	policiesByName := make(map[string]repository.RoutePolicy, len(policies))
+	for _, policy := range policies {
+		policiesByName[policy.Name] = policy
+	}
+	credentialsByName := make(map[string]repository.RouteCredential, len(credentials))
+	for _, credential := range credentials {
+		credentialsByName[credential.Name] = credential
+	}
+
+	specs := make([]httpclient.RouteSpec, 0, len(routes))
+	for _, route := range routes {
+		spec, err := routeSpec(route, base, policiesByName, credentialsByName, credentialPolicy)
+		if err != nil {
+			utils.Logger.WithFields(logrus.Fields{
+				"error": err,
+				"route": route.Name,
+			}).Error("Skipping route with invalid references")
+			continue
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+func routeSpec(route repository.Route, base httpclient.RouteSpec, policies map[string]repository.RoutePolicy, credentials map[string]repository.RouteCredential, credentialPolicy CredentialPolicy) (httpclient.RouteSpec, error) {
+	spec := base
+	spec.Name = route.Name
+	spec.URL = route.URL
+	spec.Breaker.Name = BreakerNamePrefix + route.Name
+	spec.Headers = nil
+
+	if route.PolicyName != "" {
+		policy, ok := policies[route.PolicyName]
+		if !ok {
+			return spec, fmt.Errorf("policy %q not found", route.PolicyName)
+		}
+		spec.MaxRetries = orDefault(policy.MaxRetries, base.MaxRetries)
+		spec.RateLimit = orDefault(policy.RateLimit, base.RateLimit)
+		spec.Burst = orDefault(policy.Burst, base.Burst)
+		spec.Breaker.MaxRequests = orDefault(policy.BreakerMaxRequests, base.Breaker.MaxRequests)
+		spec.Breaker.Interval = orDefault(policy.BreakerInterval, base.Breaker.Interval)
+		spec.Breaker.Timeout = orDefault(policy.BreakerTimeout, base.Breaker.Timeout)
+		spec.Breaker.FailureThreshold = orDefault(policy.BreakerFailureThreshold, base.Breaker.FailureThreshold)
+		if policy.SyncOverflow != nil {
+			spec.SyncOverflow = *policy.SyncOverflow
+		}
+		spec.SyncOverflowLatency = orDefault(policy.SyncOverflowLatency, base.SyncOverflowLatency)
+	}
+
+	if route.CredentialName != "" {
+		credential, ok := credentials[route.CredentialName]
+		if !ok {
+			return spec, fmt.Errorf("credential %q not found", route.CredentialName)
+		}
+		value, err := ResolveCredential(credential, credentialPolicy)
+		if err != nil {
+			return spec, err
+		}
+		spec.Headers = map[string]string{credential.Header: value}
+	}
+	return spec, nil
+}
+
+// ResolveCredential は認証情報の参照先から値を読み込み、ヘッダに設定する値を返す
+//
+// 登録後に許可する参照先の設定が変わった場合やデータベースを直接変更された場合に備え、読み込むたびに policy を確認する。
+func ResolveCredential(credential repository.RouteCredential, policy CredentialPolicy) (string, error) {
+	if err := policy.Check(credential.Source, credential.Ref); err != nil {
+		return "", fmt.Errorf("credential %q is not allowed: %w", credential.Name, err)
+	}
+
+	var value string
+	switch credential.Source {
+	case repository.CredentialSourceEnv:
+		value = os.Getenv(credential.Ref)
+	case repository.CredentialSourceFile:
+		// シンボリックリンクで許可したディレクトリの外を指していないか、解決したパスで確認する
+		path, err := filepath.EvalSymlinks(policy.path(credential.Ref))
+		if err != nil {
+			return "", fmt.Errorf("failed to read credential %q: %w", credential.Name, err)
+		}
+		dir, err := filepath.EvalSymlinks(policy.Dir)
+		if err != nil {
+			return "", fmt.Errorf("failed to read credential %q: %w", credential.Name, err)
+		}
+		if !withinDir(dir, path) {
+			return "", fmt.Errorf("credential %q is not allowed: file must be under %s", credential.Name, policy.Dir)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to read credential %q: %w", credential.Name, err)
+		}
+		value = strings.TrimSpace(string(data))
+	}
+	if value == "" {
+		return "", fmt.Errorf("credential %q is empty", credential.Name)
+	}
+
+	if credential.Scheme != "" {
+		value = credential.Scheme + " " + value
+	}
+	return value, nil
+}
+
+func orDefault[T comparable](value, fallback T) T {
+	var zero T
+	if value == zero {
+		return fallback
+	}
+	return value
+}
@@ -0,0 +1,108 @@
+package scheduler
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Locker は複数のレプリカのうち1つだけが処理を行うためのロック
+type Locker interface {
+	// Acquire はキーのロックを取得できたかを返す。ロックは ttl 経過後に解放される
+	Acquire(key string, ttl time.Duration) (bool, error)
+	// Release は取得したロックを ttl の経過を待たずに解放する
+	Release(key string) error
+}
+
+type RedisClient interface {
+	SetNX(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.BoolCmd
+	Del(ctx context.Context, keys ...string) *redis.IntCmd
+}
+
+type RedisLocker struct {
+	client    RedisClient
+	keyPrefix string
+}
+
+func NewRedisLocker(client RedisClient, keyPrefix string) *RedisLocker {
+	return &RedisLocker{client: client, keyPrefix: keyPrefix}
+}
+
+func (l *RedisLocker) Acquire(key string, ttl time.Duration) (bool, error) {
+	return l.client.SetNX(context.Background(), l.keyPrefix+key, time.Now().Unix(), ttl).Result()
+}
+
+func (l *RedisLocker) Release(key string) error {
+	return l.client.Del(context.Background(), l.keyPrefix+key).Err()
+}
+
+// SchedulerLock は GormLocker が保存するロック
+type SchedulerLock struct {
+	Key       string    `gorm:"primary_key;size:255"`
+	ExpiresAt time.Time `gorm:"index"`
+}
+
+// GormLocker はキーを主キーとする行でロックする。Redis を使わない環境でレプリカ間で共有する
+type GormLocker struct {
+	db *gorm.DB
+}
+
+func NewGormLocker(db *gorm.DB) *GormLocker {
+	return &GormLocker{db}
+}
+
+func (l *GormLocker) Acquire(key string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	// 期限切れのロックは解放されたものとして扱う。実行ごとにキーが変わるため、他のキーの期限切れの行もまとめて消す
+	err := l.db.Where("expires_at <= ?", now).Delete(&SchedulerLock{}).Error
+	if err != nil {
+		return false, err
+	}
+
+	result := l.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&SchedulerLock{
+		Key:       key,
+		ExpiresAt: now.Add(ttl),
+	})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+func (l *GormLocker) Release(key string) error {
+	return l.db.Where("`key` = ?", key).Delete(&SchedulerLock{}).Error
+}
+
+// MemoryLocker は単一プロセス用のロック
+type MemoryLocker struct {
+	mu    sync.Mutex
+	locks map[string]time.Time
+}
+
+func NewMemoryLocker() *MemoryLocker {
+	return &MemoryLocker{locks: make(map[string]time.Time)}
+}
+
+func (l *MemoryLocker) Acquire(key string, ttl time.Duration) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if expiresAt, ok := l.locks[key]; ok && now.Before(expiresAt) {
+		return false, nil
+	}
+	l.locks[key] = now.Add(ttl)
+	return true, nil
+}
+
+func (l *MemoryLocker) Release(key string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.locks, key)
+	return nil
+}
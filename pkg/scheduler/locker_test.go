@@ -0,0 +1,46 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+)
+
+func TestGormLocker(t *testing.T) {
+	sqlDB, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer sqlDB.Close()
+	db, err := gorm.Open(mysql.New(mysql.Config{Conn: sqlDB, SkipInitializeWithVersion: true}), &gorm.Config{SkipDefaultTransaction: true})
+	require.NoError(t, err)
+	locker := NewGormLocker(db)
+
+	// 全てのキーの期限切れのロックを消してから挿入し、挿入できたレプリカだけがロックを取得する
+	mock.ExpectExec("DELETE FROM `scheduler_locks` WHERE expires_at <= \\?").
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO `scheduler_locks` .* ON DUPLICATE KEY UPDATE").
+		WithArgs("recurring:poll:1", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	acquired, err := locker.Acquire("recurring:poll:1", time.Hour)
+	require.NoError(t, err)
+	assert.True(t, acquired)
+
+	mock.ExpectExec("DELETE FROM `scheduler_locks`").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO `scheduler_locks`").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	acquired, err = locker.Acquire("recurring:poll:1", time.Hour)
+	require.NoError(t, err)
+	assert.False(t, acquired)
+
+	mock.ExpectExec("DELETE FROM `scheduler_locks` WHERE `key` = \\?").
+		WithArgs("recurring:poll:1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	require.NoError(t, locker.Release("recurring:poll:1"))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,52 @@
+package scheduler
+
+import (
+	"reliproxy/pkg/queue"
+	"reliproxy/pkg/repository"
+	"reliproxy/pkg/utils"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Promoter は実行時刻を迎えたリクエストのステータスを queued にし、キューに追加する
+type Promoter struct {
+	queue            *queue.DelayedQueue
+	statusRepository repository.RequestStatusRepository
+	interval         time.Duration
+	batchSize        int
+}
+
+func NewPromoter(queue *queue.DelayedQueue, statusRepository repository.RequestStatusRepository, interval time.Duration, batchSize int) *Promoter {
+	return &Promoter{
+		queue:            queue,
+		statusRepository: statusRepository,
+		interval:         interval,
+		batchSize:        batchSize,
+	}
+}
+
+func (p *Promoter) Start() {
+	for {
+		promoted, err := p.PromoteOnce()
+		if err != nil {
+			utils.Logger.WithFields(logrus.Fields{
+				"error": err,
+			}).Error("Failed to promote scheduled requests")
+		}
+
+		// バッチが埋まっている間は待たずに続きを処理する
+		if err != nil || promoted < p.batchSize {
+			time.Sleep(p.interval)
+		}
+	}
+}
+
+func (p *Promoter) PromoteOnce() (int, error) {
+	requestIDs, err := p.queue.PromoteDue(p.batchSize, func(requestID string) (bool, error) {
+		// ワーカーが取り出したときに scheduled のままだと取り消されたものとして破棄されるため、キューに追加する前に更新する
+		// 前回キューへの追加に失敗したリクエストは queued のまま残っている
+		return p.statusRepository.TransitionStatus(requestID, []string{repository.StatusScheduled, repository.StatusQueued}, repository.StatusQueued)
+	})
+	return len(requestIDs), err
+}
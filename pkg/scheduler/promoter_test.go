@@ -0,0 +1,47 @@
+package scheduler
+
+import (
+	"reliproxy/pkg/queue"
+	"reliproxy/pkg/repository"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPromoter_PromoteOnce(t *testing.T) {
+	statusRepository := repository.NewMemoryRequestStatusRepository()
+	requestQueue := queue.NewMemoryQueue()
+	schedule := queue.NewMemorySchedule()
+	delayedQueue := queue.NewDelayedQueue(requestQueue, schedule)
+	promoter := NewPromoter(delayedQueue, statusRepository, time.Second, 10)
+
+	dueAt := time.Now().Add(-time.Second)
+	for _, id := range []string{"due", "cancelled"} {
+		require.NoError(t, statusRepository.Create(&repository.RequestStatus{ID: id, Status: repository.StatusScheduled}))
+		require.NoError(t, schedule.Add(id, &queue.Job{}, dueAt))
+	}
+	cancelled, err := statusRepository.TransitionStatus("cancelled", []string{repository.StatusScheduled}, repository.StatusCancelled)
+	require.NoError(t, err)
+	require.True(t, cancelled)
+
+	promoted, err := promoter.PromoteOnce()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, promoted)
+
+	// 取り出したワーカーがステータスを running に遷移できるよう、キューに追加した時点で queued になっている
+	requestID, _, err := requestQueue.Dequeue()
+	require.NoError(t, err)
+	assert.Equal(t, "due", requestID)
+	status, _ := statusRepository.GetByID("due")
+	assert.Equal(t, repository.StatusQueued, status.Status)
+
+	// 取り消されたリクエストはキューに追加せずにスケジュールから取り除く
+	depth, _ := requestQueue.Len()
+	assert.Equal(t, int64(0), depth)
+	scheduled, _ := delayedQueue.ScheduledLen()
+	assert.Equal(t, int64(0), scheduled)
+	status, _ = statusRepository.GetByID("cancelled")
+	assert.Equal(t, repository.StatusCancelled, status.Status)
+}
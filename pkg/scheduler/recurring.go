@@ -0,0 +1,215 @@
+package scheduler
+
+import (
+	"fmt"
+	"reliproxy/pkg/queue"
+	"reliproxy/pkg/repository"
+	"reliproxy/pkg/utils"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/robfig/cron/v3"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// maxMissedRuns は run_all で一度に追加する実行の上限
+	maxMissedRuns = 100
+	// lockTTL は実行ごとのロックを保持する期間。この間は他のレプリカが同じ実行を追加しない
+	lockTTL = 24 * time.Hour
+)
+
+var cronParser = cron.NewParser(cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+
+// RecurringScheduler は定期実行ジョブの定義に従ってリクエストを非同期キューに追加する
+//
+// 実行時刻ごとにロックを取得したレプリカだけが追加するため、複数のレプリカで動かしても1回だけ実行される。
+type RecurringScheduler struct {
+	jobRepository    repository.RecurringJobRepository
+	statusRepository repository.RequestStatusRepository
+	queue            queue.Queue
+	locker           Locker
+	interval         time.Duration
+	// gracePeriod は skip の場合に遅れて実行してよい期間
+	gracePeriod time.Duration
+	now         func() time.Time
+}
+
+func NewRecurringScheduler(jobRepository repository.RecurringJobRepository, statusRepository repository.RequestStatusRepository, queue queue.Queue, locker Locker, interval time.Duration, gracePeriod time.Duration) *RecurringScheduler {
+	return &RecurringScheduler{
+		jobRepository:    jobRepository,
+		statusRepository: statusRepository,
+		queue:            queue,
+		locker:           locker,
+		interval:         interval,
+		gracePeriod:      gracePeriod,
+		now:              time.Now,
+	}
+}
+
+func (s *RecurringScheduler) Start() {
+	for {
+		if _, err := s.RunOnce(); err != nil {
+			utils.Logger.WithFields(logrus.Fields{
+				"error": err,
+			}).Error("Failed to run recurring jobs")
+		}
+		time.Sleep(s.interval)
+	}
+}
+
+// RunOnce は実行時刻を迎えた定期実行ジョブをキューに追加し、追加したリクエストの ID を返す
+func (s *RecurringScheduler) RunOnce() ([]string, error) {
+	jobs, err := s.jobRepository.ListEnabled()
+	if err != nil {
+		return nil, err
+	}
+
+	now := s.now()
+	var requestIDs []string
+	for _, job := range jobs {
+		ids, err := s.runJob(&job, now)
+		requestIDs = append(requestIDs, ids...)
+		if err != nil {
+			utils.Logger.WithFields(logrus.Fields{
+				"error":          err,
+				"recurringJobID": job.ID,
+			}).Error("Failed to run recurring job")
+		}
+	}
+	return requestIDs, nil
+}
+
+func (s *RecurringScheduler) runJob(job *repository.RecurringJob, now time.Time) ([]string, error) {
+	schedule, err := cronParser.Parse(job.Schedule)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schedule %q: %w", job.Schedule, err)
+	}
+
+	// 初回は定義の作成時刻から数える
+	from := job.CreatedAt
+	if job.LastRunAt != nil {
+		from = *job.LastRunAt
+	}
+	due := dueTimes(schedule, from, now)
+	if len(due) == 0 {
+		return nil, nil
+	}
+	latest := due[len(due)-1]
+
+	var runs []time.Time
+	switch job.MissedRunPolicy {
+	case repository.MissedRunAll:
+		runs = due
+		if len(runs) > maxMissedRuns {
+			runs = runs[len(runs)-maxMissedRuns:]
+		}
+	case repository.MissedRunOnce:
+		runs = []time.Time{latest}
+	default:
+		if now.Sub(latest) <= s.gracePeriod {
+			runs = []time.Time{latest}
+		}
+	}
+
+	if len(runs) == 0 {
+		// 実行しなかった時刻も処理済みとして記録する
+		return nil, s.jobRepository.UpdateLastRunAt(job.ID, latest)
+	}
+
+	var requestIDs []string
+	for _, runAt := range runs {
+		requestID, acquired, err := s.fire(job, runAt)
+		if err != nil {
+			// 失敗した実行以降は次回に再試行する
+			return requestIDs, err
+		}
+		if !acquired {
+			// 他のレプリカが追加している。追加に失敗した場合に再試行できるよう、実行時刻は追加したレプリカだけが進める
+			return requestIDs, nil
+		}
+		requestIDs = append(requestIDs, requestID)
+		if err := s.jobRepository.UpdateLastRunAt(job.ID, runAt); err != nil {
+			return requestIDs, err
+		}
+	}
+	return requestIDs, nil
+}
+
+// fire はロックを取得できた場合のみリクエストを追加し、その ID とロックを取得できたかを返す
+//
+// 追加に失敗した場合はロックを解放して次回に再試行できるようにし、作成したステータスも削除する。
+func (s *RecurringScheduler) fire(job *repository.RecurringJob, runAt time.Time) (string, bool, error) {
+	key := fmt.Sprintf("recurring:%s:%d", job.ID, runAt.Unix())
+	acquired, err := s.locker.Acquire(key, lockTTL)
+	if err != nil || !acquired {
+		return "", false, err
+	}
+
+	requestID, err := s.enqueue(job)
+	if err != nil {
+		if releaseErr := s.locker.Release(key); releaseErr != nil {
+			utils.Logger.WithFields(logrus.Fields{
+				"error":          releaseErr,
+				"recurringJobID": job.ID,
+			}).Error("Failed to release recurring job lock")
+		}
+		return "", true, err
+	}
+	return requestID, true, nil
+}
+
+func (s *RecurringScheduler) enqueue(job *repository.RecurringJob) (string, error) {
+	priority := queue.PriorityNormal
+	if job.Priority != "" {
+		var err error
+		if priority, err = queue.ParsePriority(job.Priority); err != nil {
+			return "", err
+		}
+	}
+	tenant := job.Tenant
+	if tenant == "" {
+		tenant = queue.DefaultTenant
+	}
+
+	requestID := uuid.New().String()
+	if err := s.statusRepository.Create(&repository.RequestStatus{
+		ID:     requestID,
+		Status: repository.StatusQueued,
+	}); err != nil {
+		return "", err
+	}
+	err := s.queue.Enqueue(requestID, &queue.Job{
+		Method:     job.Method,
+		Body:       job.RequestTemplate,
+		Route:      job.Route,
+		Priority:   priority,
+		Tenant:     tenant,
+		EnqueuedAt: s.now(),
+	})
+	if err != nil {
+		// キューにないリクエストが queued のまま残らないようにする
+		if deleteErr := s.statusRepository.Delete(requestID); deleteErr != nil {
+			utils.Logger.WithFields(logrus.Fields{
+				"error":          deleteErr,
+				"jobID":          requestID,
+				"recurringJobID": job.ID,
+			}).Error("Failed to delete status of recurring job")
+		}
+		return "", err
+	}
+	return requestID, nil
+}
+
+// dueTimes は from より後で now 以前の実行時刻を古い順に返す
+func dueTimes(schedule cron.Schedule, from time.Time, now time.Time) []time.Time {
+	var due []time.Time
+	for t := schedule.Next(from); !t.After(now); t = schedule.Next(t) {
+		due = append(due, t)
+		// 長期間停止していた場合に備えて保持する数を制限する
+		if len(due) > maxMissedRuns {
+			due = due[1:]
+		}
+	}
+	return due
+}
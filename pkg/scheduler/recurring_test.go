@@ -0,0 +1,165 @@
+package scheduler
+
+import (
+	"errors"
+	"reliproxy/pkg/queue"
+	"reliproxy/pkg/repository"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	gomock "go.uber.org/mock/gomock"
+)
+
+func TestRecurringScheduler_RunOnce(t *testing.T) {
+	// 12:00 から 12:05 までの毎分の実行を取りこぼした状態
+	lastRunAt := time.Date(2024, 1, 1, 11, 59, 0, 0, time.UTC)
+	late := time.Date(2024, 1, 1, 12, 5, 50, 0, time.UTC)
+	onTime := time.Date(2024, 1, 1, 12, 5, 10, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		policy   string
+		now      time.Time
+		wantRuns int
+	}{
+		{"skip missed runs", repository.MissedRunSkip, late, 0},
+		{"skip runs only the latest within grace period", repository.MissedRunSkip, onTime, 1},
+		{"run missed runs once", repository.MissedRunOnce, late, 1},
+		{"run all missed runs", repository.MissedRunAll, late, 6},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			jobRepository := repository.NewMockRecurringJobRepository(ctrl)
+			statusRepository := repository.NewMemoryRequestStatusRepository()
+			requestQueue := queue.NewMemoryQueue()
+			scheduler := NewRecurringScheduler(jobRepository, statusRepository, requestQueue, NewMemoryLocker(), time.Second, 30*time.Second)
+			scheduler.now = func() time.Time { return tt.now }
+
+			jobRepository.EXPECT().ListEnabled().Return([]repository.RecurringJob{{
+				ID:              "poll",
+				Schedule:        "* * * * *",
+				Route:           "partner",
+				RequestTemplate: `{"data": "poll"}`,
+				MissedRunPolicy: tt.policy,
+				Enabled:         true,
+				LastRunAt:       &lastRunAt,
+			}}, nil)
+			jobRepository.EXPECT().UpdateLastRunAt("poll", gomock.Any()).Return(nil).AnyTimes()
+
+			requestIDs, err := scheduler.RunOnce()
+			assert.NoError(t, err)
+			assert.Len(t, requestIDs, tt.wantRuns)
+			length, _ := requestQueue.Len()
+			assert.Equal(t, int64(tt.wantRuns), length)
+			if tt.wantRuns > 0 {
+				// ワーカーが定義のルートへテンプレートの本文を送れるようにする
+				_, requestData, err := requestQueue.TryDequeue()
+				assert.NoError(t, err)
+				assert.Equal(t, "partner", queue.JobRoute(requestData))
+				job, _ := queue.DecodeJob(requestData)
+				assert.Equal(t, `{"data": "poll"}`, job.Body)
+			}
+
+			for _, requestID := range requestIDs {
+				status, err := statusRepository.GetByID(requestID)
+				assert.NoError(t, err)
+				assert.Equal(t, repository.StatusQueued, status.Status)
+			}
+		})
+	}
+}
+
+func TestRecurringScheduler_RunOnceLocked(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	now := time.Date(2024, 1, 1, 12, 0, 30, 0, time.UTC)
+	lastRunAt := now.Add(-time.Minute).Truncate(time.Minute)
+	job := repository.RecurringJob{
+		ID:              "poll",
+		Schedule:        "* * * * *",
+		MissedRunPolicy: repository.MissedRunSkip,
+		Enabled:         true,
+		LastRunAt:       &lastRunAt,
+	}
+
+	// 2つのレプリカが同じロックを共有する場合、一方だけが追加し、実行時刻を進める
+	jobRepository := repository.NewMockRecurringJobRepository(ctrl)
+	jobRepository.EXPECT().ListEnabled().Return([]repository.RecurringJob{job}, nil).Times(2)
+	jobRepository.EXPECT().UpdateLastRunAt("poll", now.Truncate(time.Minute)).Return(nil).Times(1)
+
+	locker := NewMemoryLocker()
+	requestQueue := queue.NewMemoryQueue()
+	statusRepository := repository.NewMemoryRequestStatusRepository()
+	replicas := []*RecurringScheduler{
+		NewRecurringScheduler(jobRepository, statusRepository, requestQueue, locker, time.Second, 45*time.Second),
+		NewRecurringScheduler(jobRepository, statusRepository, requestQueue, locker, time.Second, 45*time.Second),
+	}
+
+	total := 0
+	for _, replica := range replicas {
+		replica.now = func() time.Time { return now }
+		requestIDs, err := replica.RunOnce()
+		assert.NoError(t, err)
+		total += len(requestIDs)
+	}
+	assert.Equal(t, 1, total)
+	length, _ := requestQueue.Len()
+	assert.Equal(t, int64(1), length)
+}
+
+// flakyQueue は fail の間 Enqueue に失敗するキュー
+type flakyQueue struct {
+	*queue.MemoryQueue
+	fail bool
+}
+
+func (q *flakyQueue) Enqueue(requestID string, requestData interface{}) error {
+	if q.fail {
+		return errors.New("queue unavailable")
+	}
+	return q.MemoryQueue.Enqueue(requestID, requestData)
+}
+
+func TestRecurringScheduler_RunOnceRetriesFailedEnqueue(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	now := time.Date(2024, 1, 1, 12, 0, 30, 0, time.UTC)
+	lastRunAt := now.Add(-time.Minute).Truncate(time.Minute)
+	jobRepository := repository.NewMockRecurringJobRepository(ctrl)
+	jobRepository.EXPECT().ListEnabled().Return([]repository.RecurringJob{{
+		ID:              "poll",
+		Schedule:        "* * * * *",
+		MissedRunPolicy: repository.MissedRunSkip,
+		Enabled:         true,
+		LastRunAt:       &lastRunAt,
+	}}, nil).Times(2)
+	// 追加に失敗した実行の時刻は進めない
+	jobRepository.EXPECT().UpdateLastRunAt("poll", now.Truncate(time.Minute)).Return(nil).Times(1)
+
+	requestQueue := &flakyQueue{MemoryQueue: queue.NewMemoryQueue(), fail: true}
+	statusRepository := repository.NewMemoryRequestStatusRepository()
+	scheduler := NewRecurringScheduler(jobRepository, statusRepository, requestQueue, NewMemoryLocker(), time.Second, 45*time.Second)
+	scheduler.now = func() time.Time { return now }
+
+	// 追加に失敗した実行はステータスを残さない
+	requestIDs, err := scheduler.RunOnce()
+	assert.NoError(t, err)
+	assert.Empty(t, requestIDs)
+	counts, _ := statusRepository.CountByBatch("")
+	assert.Empty(t, counts)
+
+	// ロックを解放しているため次回に同じ実行を追加できる
+	requestQueue.fail = false
+	requestIDs, err = scheduler.RunOnce()
+	assert.NoError(t, err)
+	assert.Len(t, requestIDs, 1)
+	length, _ := requestQueue.Len()
+	assert.Equal(t, int64(1), length)
+}
@@ -0,0 +1,98 @@
+package spool
+
+import (
+	"encoding/json"
+	"reliproxy/pkg/queue"
+	"reliproxy/pkg/utils"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// FallbackQueue は primary への追加に失敗したリクエストをスプールに保存するキュー
+type FallbackQueue struct {
+	primary queue.Queue
+	spool   *Spool
+}
+
+func NewFallbackQueue(primary queue.Queue, spool *Spool) *FallbackQueue {
+	return &FallbackQueue{primary: primary, spool: spool}
+}
+
+func (q *FallbackQueue) Enqueue(requestID string, requestData interface{}) error {
+	err := q.primary.Enqueue(requestID, requestData)
+	if err == nil {
+		return nil
+	}
+
+	utils.Logger.WithFields(logrus.Fields{
+		"error": err,
+		"jobID": requestID,
+	}).Warn("Failed to enqueue request, spooling to disk")
+	return q.spool.Append(requestID, requestData)
+}
+
+// EnqueueBatch は primary にまとめて追加し、失敗した場合は全てのリクエストをまとめてスプールに保存する
+//
+// primary が一部を追加した後に失敗した場合、そのリクエストは二重に追加される。リースの期限切れによる
+// 再配信と同じく、キューは少なくとも1回の配信として扱う。
+func (q *FallbackQueue) EnqueueBatch(requests []queue.Request) error {
+	err := queue.EnqueueBatch(q.primary, requests)
+	if err == nil {
+		return nil
+	}
+
+	utils.Logger.WithFields(logrus.Fields{
+		"error":    err,
+		"requests": len(requests),
+	}).Warn("Failed to enqueue batch, spooling to disk")
+	return q.spool.AppendBatch(requests)
+}
+
+func (q *FallbackQueue) Dequeue() (string, interface{}, error) {
+	return q.primary.Dequeue()
+}
+
+func (q *FallbackQueue) Ack(requestID string) error {
+	if acknowledger, ok := q.primary.(queue.Acknowledger); ok {
+		return acknowledger.Ack(requestID)
+	}
+	return nil
+}
+
+func (q *FallbackQueue) Nack(requestID string, delay time.Duration) error {
+	if acknowledger, ok := q.primary.(queue.Acknowledger); ok {
+		return acknowledger.Nack(requestID, delay)
+	}
+	return nil
+}
+
+// Relay はスプールに保存されたリクエストを primary が復旧し次第送信する
+type Relay struct {
+	spool    *Spool
+	queue    queue.Queue
+	interval time.Duration
+}
+
+func NewRelay(spool *Spool, queue queue.Queue, interval time.Duration) *Relay {
+	return &Relay{spool: spool, queue: queue, interval: interval}
+}
+
+func (r *Relay) Start() {
+	for {
+		drained, err := r.spool.Drain(func(requestID string, requestData json.RawMessage) error {
+			return r.queue.Enqueue(requestID, requestData)
+		})
+		if drained > 0 {
+			utils.Logger.WithFields(logrus.Fields{
+				"drained": drained,
+			}).Info("Relayed spooled requests")
+		}
+		if err != nil {
+			utils.Logger.WithFields(logrus.Fields{
+				"error": err,
+			}).Warn("Failed to relay spooled requests")
+		}
+		time.Sleep(r.interval)
+	}
+}
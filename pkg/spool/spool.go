@@ -0,0 +1,331 @@
+package spool
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"reliproxy/pkg/queue"
+	"reliproxy/pkg/utils"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	segmentExt    = ".wal"
+	checkpointExt = ".offset"
+	corruptExt    = ".corrupt"
+
+	// レコードヘッダはペイロード長と CRC32 の 8 バイト
+	headerSize = 8
+)
+
+var ErrCorruptRecord = errors.New("corrupt spool record")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// spooledRequest は queue.Request のデータを再エンコードせずに読み出すための型
+type spooledRequest struct {
+	ID   string          `json:"id"`
+	Data json.RawMessage `json:"data"`
+}
+
+// Spool はキューに送信できなかったリクエストをローカルディスクに保存する追記型ログ
+//
+// ログは一定サイズごとのセグメントに分割され、各レコードはチェックサム付きで
+// fsync してから書き込み完了とする。送信済みの位置はセグメントごとのチェックポイントに記録する。
+type Spool struct {
+	dir             string
+	maxSegmentBytes int64
+
+	mu          sync.Mutex
+	drainMu     sync.Mutex
+	current     *os.File
+	currentSeq  uint64
+	currentSize int64
+}
+
+func Open(dir string, maxSegmentBytes int64) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &Spool{dir: dir, maxSegmentBytes: maxSegmentBytes}
+
+	seqs, err := s.segments()
+	if err != nil {
+		return nil, err
+	}
+	// 既存のセグメントは書き込み途中の可能性があるため追記せず新しいセグメントを使う
+	nextSeq := uint64(1)
+	if len(seqs) > 0 {
+		nextSeq = seqs[len(seqs)-1] + 1
+	}
+	if err := s.openSegment(nextSeq); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Spool) Append(requestID string, requestData interface{}) error {
+	return s.AppendBatch([]queue.Request{{ID: requestID, Data: requestData}})
+}
+
+// AppendBatch は requests をまとめて書き込み、書き込んだセグメントごとに1回だけ fsync する
+func (s *Spool) AppendBatch(requests []queue.Request) error {
+	records := make([][]byte, len(requests))
+	for i, request := range requests {
+		payload, err := json.Marshal(request)
+		if err != nil {
+			return err
+		}
+		record := make([]byte, headerSize+len(payload))
+		binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+		binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(payload, crcTable))
+		copy(record[headerSize:], payload)
+		records[i] = record
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, record := range records {
+		if s.currentSize > 0 && s.currentSize+int64(len(record)) > s.maxSegmentBytes {
+			if err := s.current.Sync(); err != nil {
+				return err
+			}
+			if err := s.rotate(); err != nil {
+				return err
+			}
+		}
+		if _, err := s.current.Write(record); err != nil {
+			return err
+		}
+		s.currentSize += int64(len(record))
+	}
+	return s.current.Sync()
+}
+
+// Drain は保存済みのリクエストを古い順に publish へ渡し、成功した分を削除する
+//
+// publish が失敗した時点で位置を記録して終了するため、次回はその続きから送信される。
+func (s *Spool) Drain(publish func(requestID string, requestData json.RawMessage) error) (int, error) {
+	s.drainMu.Lock()
+	defer s.drainMu.Unlock()
+
+	if err := s.seal(); err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	currentSeq := s.currentSeq
+	s.mu.Unlock()
+
+	seqs, err := s.segments()
+	if err != nil {
+		return 0, err
+	}
+
+	drained := 0
+	for _, seq := range seqs {
+		if seq >= currentSeq {
+			break
+		}
+		n, err := s.drainSegment(seq, publish)
+		drained += n
+		if err != nil {
+			return drained, err
+		}
+	}
+	return drained, nil
+}
+
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.current.Close()
+}
+
+func (s *Spool) drainSegment(seq uint64, publish func(requestID string, requestData json.RawMessage) error) (int, error) {
+	path := s.segmentPath(seq)
+	offset, err := s.readCheckpoint(seq)
+	if err != nil {
+		return 0, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	drained := 0
+	for {
+		payload, size, err := readRecord(file)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			// 壊れたレコード以降は読めないため調査用に退避して次のセグメントへ進む
+			utils.Logger.WithFields(logrus.Fields{
+				"error":   err,
+				"segment": path,
+				"offset":  offset,
+			}).Error("Corrupt spool segment")
+			file.Close()
+			os.Remove(s.checkpointPath(seq))
+			return drained, os.Rename(path, path+corruptExt)
+		}
+
+		var request spooledRequest
+		if err := json.Unmarshal(payload, &request); err != nil {
+			return drained, err
+		}
+
+		if err := publish(request.ID, request.Data); err != nil {
+			if cpErr := s.writeCheckpoint(seq, offset); cpErr != nil {
+				return drained, cpErr
+			}
+			return drained, err
+		}
+		offset += size
+		drained++
+	}
+
+	file.Close()
+	if err := os.Remove(path); err != nil {
+		return drained, err
+	}
+	if err := os.Remove(s.checkpointPath(seq)); err != nil && !os.IsNotExist(err) {
+		return drained, err
+	}
+	return drained, nil
+}
+
+func readRecord(r io.Reader) ([]byte, int64, error) {
+	header := make([]byte, headerSize)
+	n, err := io.ReadFull(r, header)
+	if err == io.EOF {
+		return nil, 0, io.EOF
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: truncated header (%d bytes)", ErrCorruptRecord, n)
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	checksum := binary.BigEndian.Uint32(header[4:8])
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, 0, fmt.Errorf("%w: truncated payload", ErrCorruptRecord)
+	}
+	if crc32.Checksum(payload, crcTable) != checksum {
+		return nil, 0, fmt.Errorf("%w: checksum mismatch", ErrCorruptRecord)
+	}
+	return payload, int64(headerSize) + int64(length), nil
+}
+
+// seal は書き込み中のセグメントにレコードがあれば新しいセグメントに切り替える
+func (s *Spool) seal() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.currentSize == 0 {
+		return nil
+	}
+	return s.rotate()
+}
+
+func (s *Spool) rotate() error {
+	if err := s.current.Close(); err != nil {
+		return err
+	}
+	return s.openSegment(s.currentSeq + 1)
+}
+
+func (s *Spool) openSegment(seq uint64) error {
+	file, err := os.OpenFile(s.segmentPath(seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	// 新しいセグメントのエントリをディレクトリに永続化する
+	if dir, err := os.Open(s.dir); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	s.current = file
+	s.currentSeq = seq
+	s.currentSize = 0
+	return nil
+}
+
+func (s *Spool) segments() ([]uint64, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var seqs []uint64
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
+
+func (s *Spool) readCheckpoint(seq uint64) (int64, error) {
+	data, err := os.ReadFile(s.checkpointPath(seq))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
+func (s *Spool) writeCheckpoint(seq uint64, offset int64) error {
+	path := s.checkpointPath(seq)
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteString(strconv.FormatInt(offset, 10)); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s *Spool) segmentPath(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, segmentExt))
+}
+
+func (s *Spool) checkpointPath(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, checkpointExt))
+}
@@ -0,0 +1,201 @@
+package spool
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reliproxy/pkg/queue"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type published struct {
+	requestID   string
+	requestData string
+}
+
+func collect(records *[]published) func(string, json.RawMessage) error {
+	return func(requestID string, requestData json.RawMessage) error {
+		*records = append(*records, published{requestID, string(requestData)})
+		return nil
+	}
+}
+
+func TestSpool(t *testing.T) {
+	t.Run("AppendAndDrain", func(t *testing.T) {
+		spool, err := Open(t.TempDir(), 1024)
+		assert.NoError(t, err)
+		defer spool.Close()
+
+		assert.NoError(t, spool.Append("first", "data-1"))
+		assert.NoError(t, spool.Append("second", map[string]string{"key": "value"}))
+
+		var records []published
+		drained, err := spool.Drain(collect(&records))
+		assert.NoError(t, err)
+		assert.Equal(t, 2, drained)
+		assert.Equal(t, []published{
+			{"first", `"data-1"`},
+			{"second", `{"key":"value"}`},
+		}, records)
+
+		records = nil
+		drained, err = spool.Drain(collect(&records))
+		assert.NoError(t, err)
+		assert.Equal(t, 0, drained)
+	})
+
+	t.Run("SegmentRotation", func(t *testing.T) {
+		dir := t.TempDir()
+		spool, err := Open(dir, 64)
+		assert.NoError(t, err)
+		defer spool.Close()
+
+		for i := 0; i < 5; i++ {
+			assert.NoError(t, spool.Append("request", "some request data"))
+		}
+		segments, err := spool.segments()
+		assert.NoError(t, err)
+		assert.Greater(t, len(segments), 1)
+
+		var records []published
+		drained, err := spool.Drain(collect(&records))
+		assert.NoError(t, err)
+		assert.Equal(t, 5, drained)
+	})
+
+	t.Run("AppendBatch", func(t *testing.T) {
+		spool, err := Open(t.TempDir(), 64)
+		assert.NoError(t, err)
+		defer spool.Close()
+
+		requests := make([]queue.Request, 5)
+		for i := range requests {
+			requests[i] = queue.Request{ID: fmt.Sprintf("request-%d", i), Data: "some request data"}
+		}
+		assert.NoError(t, spool.AppendBatch(requests))
+		segments, err := spool.segments()
+		assert.NoError(t, err)
+		assert.Greater(t, len(segments), 1)
+
+		var records []published
+		drained, err := spool.Drain(collect(&records))
+		assert.NoError(t, err)
+		assert.Equal(t, 5, drained)
+		assert.Equal(t, published{"request-4", `"some request data"`}, records[4])
+	})
+
+	t.Run("ResumeAfterPublishFailure", func(t *testing.T) {
+		spool, err := Open(t.TempDir(), 1024)
+		assert.NoError(t, err)
+		defer spool.Close()
+
+		assert.NoError(t, spool.Append("first", "data-1"))
+		assert.NoError(t, spool.Append("second", "data-2"))
+
+		var records []published
+		drained, err := spool.Drain(func(requestID string, requestData json.RawMessage) error {
+			if requestID == "second" {
+				return errors.New("redis connection error")
+			}
+			return collect(&records)(requestID, requestData)
+		})
+		assert.Error(t, err)
+		assert.Equal(t, 1, drained)
+
+		drained, err = spool.Drain(collect(&records))
+		assert.NoError(t, err)
+		assert.Equal(t, 1, drained)
+		assert.Equal(t, []published{
+			{"first", `"data-1"`},
+			{"second", `"data-2"`},
+		}, records)
+	})
+
+	t.Run("ReopenKeepsPendingRecords", func(t *testing.T) {
+		dir := t.TempDir()
+		spool, err := Open(dir, 1024)
+		assert.NoError(t, err)
+		assert.NoError(t, spool.Append("first", "data-1"))
+		assert.NoError(t, spool.Close())
+
+		spool, err = Open(dir, 1024)
+		assert.NoError(t, err)
+		defer spool.Close()
+
+		var records []published
+		drained, err := spool.Drain(collect(&records))
+		assert.NoError(t, err)
+		assert.Equal(t, 1, drained)
+	})
+
+	t.Run("CorruptRecord", func(t *testing.T) {
+		dir := t.TempDir()
+		spool, err := Open(dir, 1024)
+		assert.NoError(t, err)
+		defer spool.Close()
+
+		assert.NoError(t, spool.Append("first", "data-1"))
+		path := spool.segmentPath(spool.currentSeq)
+		data, err := os.ReadFile(path)
+		assert.NoError(t, err)
+		data[len(data)-2] ^= 0xff
+		assert.NoError(t, os.WriteFile(path, data, 0o644))
+
+		var records []published
+		drained, err := spool.Drain(collect(&records))
+		assert.NoError(t, err)
+		assert.Equal(t, 0, drained)
+
+		_, err = os.Stat(path + corruptExt)
+		assert.NoError(t, err)
+		matches, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+		assert.Len(t, matches, 1)
+	})
+}
+
+// unavailableQueue は全ての追加に失敗するキュー
+type unavailableQueue struct {
+	enqueued int
+}
+
+func (q *unavailableQueue) Enqueue(requestID string, requestData interface{}) error {
+	q.enqueued++
+	return errors.New("redis connection error")
+}
+
+func (q *unavailableQueue) Dequeue() (string, interface{}, error) {
+	return "", nil, queue.ErrQueueEmpty
+}
+
+func TestFallbackQueue_EnqueueBatch(t *testing.T) {
+	spool, err := Open(t.TempDir(), 1024)
+	assert.NoError(t, err)
+	defer spool.Close()
+
+	t.Run("EnqueuesToPrimary", func(t *testing.T) {
+		primary := queue.NewMemoryQueue()
+		fallback := NewFallbackQueue(primary, spool)
+
+		assert.NoError(t, fallback.EnqueueBatch([]queue.Request{{ID: "first", Data: "data-1"}, {ID: "second", Data: "data-2"}}))
+		length, _ := primary.Len()
+		assert.Equal(t, int64(2), length)
+	})
+
+	t.Run("SpoolsBatchWhenPrimaryFails", func(t *testing.T) {
+		primary := &unavailableQueue{}
+		fallback := NewFallbackQueue(primary, spool)
+
+		assert.NoError(t, fallback.EnqueueBatch([]queue.Request{{ID: "first", Data: "data-1"}, {ID: "second", Data: "data-2"}}))
+		// 最初の失敗でスプールに切り替え、残りを1件ずつ試さない
+		assert.Equal(t, 1, primary.enqueued)
+
+		var records []published
+		drained, err := spool.Drain(collect(&records))
+		assert.NoError(t, err)
+		assert.Equal(t, 2, drained)
+	})
+}
@@ -0,0 +1,78 @@
+package tracing
+
+import (
+	"errors"
+
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+const spanKey = "tracing:span"
+
+// GormPlugin は gorm の各操作をスパンとして記録するプラグイン
+//
+// 操作に WithContext で渡したコンテキストのスパンの子スパンにする。
+// スパンのないコンテキストの操作(キューのポーリングなど)は記録しない。
+type GormPlugin struct{}
+
+func NewGormPlugin() *GormPlugin {
+	return &GormPlugin{}
+}
+
+func (p *GormPlugin) Name() string {
+	return "tracing"
+}
+
+func (p *GormPlugin) Initialize(db *gorm.DB) error {
+	return errors.Join(
+		db.Callback().Create().Before("gorm:create").Register("tracing:before_create", startSpan("create")),
+		db.Callback().Create().After("gorm:create").Register("tracing:after_create", endSpan),
+		db.Callback().Query().Before("gorm:query").Register("tracing:before_query", startSpan("query")),
+		db.Callback().Query().After("gorm:query").Register("tracing:after_query", endSpan),
+		db.Callback().Update().Before("gorm:update").Register("tracing:before_update", startSpan("update")),
+		db.Callback().Update().After("gorm:update").Register("tracing:after_update", endSpan),
+		db.Callback().Delete().Before("gorm:delete").Register("tracing:before_delete", startSpan("delete")),
+		db.Callback().Delete().After("gorm:delete").Register("tracing:after_delete", endSpan),
+		db.Callback().Row().Before("gorm:row").Register("tracing:before_row", startSpan("row")),
+		db.Callback().Row().After("gorm:row").Register("tracing:after_row", endSpan),
+		db.Callback().Raw().Before("gorm:raw").Register("tracing:before_raw", startSpan("raw")),
+		db.Callback().Raw().After("gorm:raw").Register("tracing:after_raw", endSpan),
+	)
+}
+
+func startSpan(operation string) func(*gorm.DB) {
+	return func(db *gorm.DB) {
+		if !hasParent(db.Statement.Context) {
+			return
+		}
+		ctx, span := Tracer().Start(db.Statement.Context, "gorm."+operation,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				semconv.DBSystemMySQL,
+				semconv.DBOperationName(operation),
+				semconv.DBCollectionName(db.Statement.Table),
+			),
+		)
+		db.Statement.Context = ctx
+		db.InstanceSet(spanKey, span)
+	}
+}
+
+func endSpan(db *gorm.DB) {
+	value, ok := db.InstanceGet(spanKey)
+	if !ok {
+		return
+	}
+	span, ok := value.(trace.Span)
+	if !ok {
+		return
+	}
+	if db.Error != nil && !errors.Is(db.Error, gorm.ErrRecordNotFound) {
+		span.RecordError(db.Error)
+		span.SetStatus(codes.Error, db.Error.Error())
+	}
+	span.SetAttributes(semconv.DBQueryText(db.Statement.SQL.String()))
+	span.End()
+}
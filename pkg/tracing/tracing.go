@@ -0,0 +1,58 @@
+package tracing
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "reliproxy"
+
+// Tracer はグローバルな TracerProvider から reliproxy のトレーサーを返す
+//
+// TracerProvider を設定していなければ何も記録しない。
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// hasParent は ctx に親にできるスパンがあるかを返す
+func hasParent(ctx context.Context) bool {
+	return trace.SpanContextFromContext(ctx).IsValid()
+}
+
+// Setup は exporter にスパンを送る TracerProvider と W3C Trace Context のプロパゲーターをグローバルに設定する
+//
+// 返された TracerProvider は終了時に Shutdown して送信待ちのスパンを送ること。
+func Setup(exporter sdktrace.SpanExporter, serviceName string, opts ...sdktrace.TracerProviderOption) *sdktrace.TracerProvider {
+	opts = append([]sdktrace.TracerProviderOption{
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(serviceName))),
+	}, opts...)
+	provider := sdktrace.NewTracerProvider(opts...)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider
+}
+
+// Inject は ctx のトレースコンテキストをキューのメッセージに含められる形で返す。記録中のスパンがなければ nil を返す
+func Inject(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+	return carrier
+}
+
+// Extract は Inject で保存したトレースコンテキストを ctx に設定する
+func Extract(ctx context.Context, carrier map[string]string) context.Context {
+	if len(carrier) == 0 {
+		return ctx
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(carrier))
+}
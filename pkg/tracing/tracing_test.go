@@ -0,0 +1,115 @@
+package tracing_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reliproxy/pkg/httpclient"
+	"reliproxy/pkg/queue"
+	"reliproxy/pkg/tracing"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+func setupExporter(t *testing.T) *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	// 終了したスパンをすぐに確認できるよう同期的に送る
+	provider := tracing.Setup(exporter, "reliproxy-test", trace.WithSyncer(exporter))
+	t.Cleanup(func() { provider.Shutdown(context.Background()) })
+	return exporter
+}
+
+func TestMiddleware(t *testing.T) {
+	exporter := setupExporter(t)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(tracing.Middleware())
+	router.GET("/requests/:id", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	req, _ := http.NewRequest("GET", "/requests/abc", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := exporter.GetSpans()
+	assert.Len(t, spans, 1)
+	assert.Equal(t, "GET /requests/:id", spans[0].Name)
+	assert.Equal(t, oteltrace.SpanKindServer, spans[0].SpanKind)
+	// 呼び出し元のトレースを引き継ぐ
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", spans[0].SpanContext.TraceID().String())
+	assert.Equal(t, "00f067aa0ba902b7", spans[0].Parent.SpanID().String())
+}
+
+func TestInjectExtract(t *testing.T) {
+	setupExporter(t)
+
+	ctx, span := tracing.Tracer().Start(context.Background(), "origin")
+	defer span.End()
+
+	carrier := tracing.Inject(ctx)
+	assert.Contains(t, carrier, "traceparent")
+
+	extracted := oteltrace.SpanContextFromContext(tracing.Extract(context.Background(), carrier))
+	assert.Equal(t, span.SpanContext().TraceID(), extracted.TraceID())
+	assert.Equal(t, span.SpanContext().SpanID(), extracted.SpanID())
+
+	assert.Nil(t, tracing.Inject(context.Background()))
+}
+
+func TestDefaultHttpClientInjectsTraceContext(t *testing.T) {
+	exporter := setupExporter(t)
+
+	var traceparent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+	}))
+	defer server.Close()
+
+	ctx, span := tracing.Tracer().Start(context.Background(), "origin")
+	resp, err := (&httpclient.DefaultHttpClient{}).GetWithContext(ctx, server.URL)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	span.End()
+
+	spans := exporter.GetSpans()
+	assert.Len(t, spans, 2)
+	upstream := spans[0]
+	assert.Equal(t, "HTTP GET", upstream.Name)
+	assert.Equal(t, span.SpanContext().SpanID(), upstream.Parent.SpanID())
+	// 上流には HTTP GET のスパンを親として伝える
+	assert.Equal(t, "00-"+upstream.SpanContext.TraceID().String()+"-"+upstream.SpanContext.SpanID().String()+"-01", traceparent)
+}
+
+func TestRedisHookTracesOnlyWithinTrace(t *testing.T) {
+	exporter := setupExporter(t)
+
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	client.AddHook(tracing.RedisHook{})
+	requestQueue := queue.NewRedisQueue(client, "request_queue", time.Minute, time.Millisecond, 5)
+
+	// 空のキューのポーリングは記録しない
+	_, _, err := requestQueue.TryDequeue()
+	assert.ErrorIs(t, err, queue.ErrQueueEmpty)
+	assert.Empty(t, exporter.GetSpans())
+
+	// キューへの追加はジョブを受け付けたリクエストのスパンの子にする
+	ctx, span := tracing.Tracer().Start(context.Background(), "origin")
+	assert.NoError(t, requestQueue.Enqueue("request-1", &queue.Job{TraceContext: tracing.Inject(ctx)}))
+	span.End()
+
+	spans := exporter.GetSpans()
+	assert.Len(t, spans, 2)
+	assert.Equal(t, "redis.lpush", spans[0].Name)
+	assert.Equal(t, span.SpanContext().SpanID(), spans[0].Parent.SpanID())
+}
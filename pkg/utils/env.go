@@ -1,6 +1,10 @@
 package utils
 
-import "os"
+import (
+	"os"
+	"strings"
+	"time"
+)
 
 func GetEnv(key, defaultValue string) string {
 	value := os.Getenv(key)
@@ -9,3 +13,24 @@ func GetEnv(key, defaultValue string) string {
 	}
 	return value
 }
+
+func GetEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+// GetEnvMap は "key1=value1,key2=value2" 形式の環境変数を読み取る
+func GetEnvMap(key string) map[string]string {
+	values := make(map[string]string)
+	for _, pair := range strings.Split(os.Getenv(key), ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || k == "" {
+			continue
+		}
+		values[k] = v
+	}
+	return values
+}
@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"context"
 	"os"
 
 	"github.com/sirupsen/logrus"
@@ -13,4 +14,38 @@ func init() {
 	Logger.SetOutput(os.Stdout)
 	Logger.SetFormatter(&logrus.JSONFormatter{})
 	Logger.SetLevel(logrus.InfoLevel)
+
+	SetRedactor(NewRedactor(DefaultRedactionRules(), BodyLogTruncated, 512))
+	Logger.AddHook(redaction)
+}
+
+type contextKey int
+
+const (
+	loggerKey contextKey = iota
+	requestIDKey
+)
+
+// WithLogger はリクエストやジョブの識別子を付けたロガーを ctx に保存する
+func WithLogger(ctx context.Context, logger *logrus.Entry) context.Context {
+	return context.WithValue(ctx, loggerKey, logger)
+}
+
+// LoggerFromContext は ctx に保存されたロガーを返す。保存されていなければグローバルな Logger を返す
+func LoggerFromContext(ctx context.Context) *logrus.Entry {
+	if logger, ok := ctx.Value(loggerKey).(*logrus.Entry); ok {
+		return logger
+	}
+	return logrus.NewEntry(Logger)
+}
+
+// WithRequestID は上流へ伝える X-Request-ID を ctx に保存する
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey, requestID)
+}
+
+// RequestIDFromContext は ctx に保存された X-Request-ID を返す。保存されていなければ空文字を返す
+func RequestIDFromContext(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey).(string)
+	return requestID
 }
@@ -0,0 +1,237 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Redacted は秘匿した値の代わりにログへ出力する文字列
+const Redacted = "[REDACTED]"
+
+// BodyLogMode はリクエストやレスポンスの本文をログに出力する方法
+type BodyLogMode string
+
+const (
+	BodyLogOff       BodyLogMode = "off"
+	BodyLogTruncated BodyLogMode = "truncated"
+	BodyLogFull      BodyLogMode = "full"
+)
+
+func ParseBodyLogMode(s string) (BodyLogMode, error) {
+	switch mode := BodyLogMode(s); mode {
+	case BodyLogOff, BodyLogTruncated, BodyLogFull:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid body log mode: %q", s)
+	}
+}
+
+// RedactionRules はログから秘匿する値の規則
+type RedactionRules struct {
+	// Headers は値を秘匿する HTTP ヘッダ名。大文字と小文字は区別しない
+	Headers []string
+	// Fields は値を秘匿する JSON のフィールド名とログのフィールド名。大文字と小文字は区別しない
+	Fields []string
+	// Patterns は文字列から秘匿する正規表現。グループを含む場合は最初のグループだけを秘匿する
+	Patterns []*regexp.Regexp
+}
+
+// DefaultRedactionRules は認証情報と既知の個人情報を秘匿する規則を返す
+func DefaultRedactionRules() RedactionRules {
+	return RedactionRules{
+		Headers: []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-API-Key"},
+		Fields: []string{
+			"password", "secret", "token", "access_token", "refresh_token", "api_key", "apikey",
+			"email", "phone", "phone_number", "ssn", "credit_card", "card_number", "cvv",
+			"date_of_birth", "address",
+		},
+		Patterns: []*regexp.Regexp{
+			// URL のクエリに含まれるトークン
+			regexp.MustCompile(`(?i)[?&](?:access_token|token|api_key|apikey|key|secret|password|sig|signature)=([^&#\s"]+)`),
+			// URL のユーザー情報に含まれるパスワード
+			regexp.MustCompile(`://[^/\s:@]+:([^/\s@]+)@`),
+			regexp.MustCompile(`(?i)\bbearer\s+([A-Za-z0-9\-._~+/]+=*)`),
+			regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`),
+		},
+	}
+}
+
+// Redactor はログに出力する文字列、ヘッダ、本文から秘匿すべき値を取り除く
+type Redactor struct {
+	headers      map[string]bool
+	fields       map[string]bool
+	patterns     []*regexp.Regexp
+	bodyMode     BodyLogMode
+	maxBodyBytes int
+}
+
+func NewRedactor(rules RedactionRules, bodyMode BodyLogMode, maxBodyBytes int) *Redactor {
+	r := &Redactor{
+		headers:      make(map[string]bool),
+		fields:       make(map[string]bool),
+		patterns:     rules.Patterns,
+		bodyMode:     bodyMode,
+		maxBodyBytes: maxBodyBytes,
+	}
+	for _, header := range rules.Headers {
+		r.headers[strings.ToLower(header)] = true
+	}
+	for _, field := range rules.Fields {
+		r.fields[strings.ToLower(field)] = true
+	}
+	return r
+}
+
+// Redact は s が JSON であれば秘匿するフィールドの値を、その後に正規表現に一致する部分を秘匿する
+func (r *Redactor) Redact(s string) string {
+	s = r.redactJSON(s)
+	for _, pattern := range r.patterns {
+		s = redactPattern(pattern, s)
+	}
+	return s
+}
+
+// RedactHeaders は秘匿するヘッダの値を置き換えたコピーを返す
+func (r *Redactor) RedactHeaders(header http.Header) http.Header {
+	redacted := make(http.Header, len(header))
+	for name, values := range header {
+		if r.headers[strings.ToLower(name)] {
+			redacted[name] = []string{Redacted}
+			continue
+		}
+		redacted[name] = make([]string, len(values))
+		for i, value := range values {
+			redacted[name][i] = r.Redact(value)
+		}
+	}
+	return redacted
+}
+
+// Body は本文のログへの出力方法に従って秘匿した本文を返す。出力しない場合は false を返す
+func (r *Redactor) Body(body []byte) (string, bool) {
+	switch r.bodyMode {
+	case BodyLogOff:
+		return "", false
+	case BodyLogTruncated:
+		redacted := r.Redact(string(body))
+		if r.maxBodyBytes > 0 && len(redacted) > r.maxBodyBytes {
+			return redacted[:r.maxBodyBytes] + fmt.Sprintf("...(truncated %d bytes)", len(redacted)-r.maxBodyBytes), true
+		}
+		return redacted, true
+	default:
+		return r.Redact(string(body)), true
+	}
+}
+
+func (r *Redactor) sensitiveKey(key string) bool {
+	key = strings.ToLower(key)
+	return r.fields[key] || r.headers[key]
+}
+
+func (r *Redactor) redactValue(key string, value interface{}) interface{} {
+	if r.sensitiveKey(key) {
+		return Redacted
+	}
+	switch v := value.(type) {
+	case string:
+		return r.Redact(v)
+	case error:
+		return r.Redact(v.Error())
+	case http.Header:
+		return r.RedactHeaders(v)
+	default:
+		return value
+	}
+}
+
+// redactJSON は s が JSON のオブジェクトか配列であれば秘匿するフィールドの値を置き換える
+func (r *Redactor) redactJSON(s string) string {
+	trimmed := strings.TrimSpace(s)
+	if !strings.HasPrefix(trimmed, "{") && !strings.HasPrefix(trimmed, "[") {
+		return s
+	}
+	var value interface{}
+	if err := json.Unmarshal([]byte(trimmed), &value); err != nil {
+		return s
+	}
+	redacted, err := json.Marshal(r.redactJSONValue(value))
+	if err != nil {
+		return s
+	}
+	return string(redacted)
+}
+
+func (r *Redactor) redactJSONValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if r.sensitiveKey(key) {
+				v[key] = Redacted
+			} else {
+				v[key] = r.redactJSONValue(child)
+			}
+		}
+	case []interface{}:
+		for i, child := range v {
+			v[i] = r.redactJSONValue(child)
+		}
+	}
+	return value
+}
+
+func redactPattern(pattern *regexp.Regexp, s string) string {
+	if pattern.NumSubexp() == 0 {
+		return pattern.ReplaceAllLiteralString(s, Redacted)
+	}
+
+	var b strings.Builder
+	last := 0
+	for _, match := range pattern.FindAllStringSubmatchIndex(s, -1) {
+		if match[2] < 0 {
+			continue
+		}
+		b.WriteString(s[last:match[2]])
+		b.WriteString(Redacted)
+		last = match[3]
+	}
+	b.WriteString(s[last:])
+	return b.String()
+}
+
+// redactionHook は Logger に出力する全てのフィールドとメッセージを秘匿する
+type redactionHook struct {
+	redactor atomic.Pointer[Redactor]
+}
+
+func (h *redactionHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *redactionHook) Fire(entry *logrus.Entry) error {
+	r := h.redactor.Load()
+	data := make(logrus.Fields, len(entry.Data))
+	for key, value := range entry.Data {
+		data[key] = r.redactValue(key, value)
+	}
+	entry.Data = data
+	entry.Message = r.Redact(entry.Message)
+	return nil
+}
+
+var redaction = &redactionHook{}
+
+// SetRedactor は Logger の出力に使う Redactor を差し替える
+func SetRedactor(r *Redactor) {
+	redaction.redactor.Store(r)
+}
+
+// CurrentRedactor は Logger の出力に使っている Redactor を返す
+func CurrentRedactor() *Redactor {
+	return redaction.redactor.Load()
+}
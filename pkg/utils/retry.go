@@ -1,7 +1,9 @@
 package utils
 
 import (
+	"context"
 	"net/http"
+	"reliproxy/pkg/metrics"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -9,6 +11,11 @@ import (
 
 // RetryWithExponentialBackoff retries the operation with exponential backoff
 func RetryWithExponentialBackoff(operation func() (*http.Response, error), maxRetries int) (*http.Response, error) {
+	return RetryWithExponentialBackoffContext(context.Background(), operation, maxRetries)
+}
+
+// RetryWithExponentialBackoffContext retries the operation with exponential backoff until ctx is done
+func RetryWithExponentialBackoffContext(ctx context.Context, operation func() (*http.Response, error), maxRetries int) (*http.Response, error) {
 	var result *http.Response
 	var err error
 
@@ -17,19 +24,31 @@ func RetryWithExponentialBackoff(operation func() (*http.Response, error), maxRe
 		if err == nil {
 			return result, nil
 		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 
 		if i < maxRetries-1 {
+			metrics.UpstreamRetries.Inc()
 			backoffDuration := time.Duration((1 << i)) * time.Second
-			Logger.WithFields(logrus.Fields{
-				"retry":      i + 1,
+			LoggerFromContext(ctx).WithFields(logrus.Fields{
+				"attempt":    i + 1,
 				"maxRetries": maxRetries,
 				"error":      err,
 			}).Warningf("Retry %d/%d failed. Retrying in %v", i+1, maxRetries, backoffDuration)
-			time.Sleep(backoffDuration)
+
+			timer := time.NewTimer(backoffDuration)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, ctx.Err()
+			case <-timer.C:
+			}
 		}
 	}
 
-	Logger.WithFields(logrus.Fields{
+	LoggerFromContext(ctx).WithFields(logrus.Fields{
+		"attempt":    maxRetries,
 		"maxRetries": maxRetries,
 		"error":      err,
 	}).Errorf("operation failed after %d retries: %v", maxRetries, err)
@@ -0,0 +1,45 @@
+package webhook
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// ErrForbiddenAddress はコールバック URL の送信先が公開されたアドレスでないことを表す
+var ErrForbiddenAddress = errors.New("callback address is not public")
+
+// IsPublicIP は ip がループバック、プライベート、リンクローカルなどの内部向けのアドレスでないかを返す
+func IsPublicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast())
+}
+
+// NewHTTPClient は完了通知の送信に使うクライアントを返す
+//
+// allowPrivate でなければ名前解決した後のアドレスを接続の直前に確認し、内部向けのアドレスへは接続しない。
+// リダイレクト先や DNS の応答が変わった場合も同じく確認する。
+func NewHTTPClient(timeout time.Duration, allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout}
+	if !allowPrivate {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !IsPublicIP(ip) {
+				return fmt.Errorf("%w: %s", ErrForbiddenAddress, host)
+			}
+			return nil
+		}
+	}
+
+	// プロキシを経由すると接続先のアドレスを確認できないため使わない
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: &http.Transport{DialContext: dialer.DialContext},
+	}
+}
@@ -0,0 +1,179 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reliproxy/pkg/repository"
+	"reliproxy/pkg/utils"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// SignatureHeader は "t=<UNIX 時刻>,v1=<HMAC-SHA256>" 形式の署名を持つヘッダ
+	SignatureHeader = "X-Reliproxy-Signature"
+	RequestIDHeader = "X-Reliproxy-Request-ID"
+	AttemptHeader   = "X-Reliproxy-Delivery-Attempt"
+
+	// leaseMargin はバッチの送信にかかる時間に上乗せする余裕で、更新の遅れなどを吸収する
+	leaseMargin = time.Minute
+	maxBackoff  = time.Hour
+)
+
+// ErrNoSecret は署名の鍵がないため完了通知を送らなかったことを表す
+var ErrNoSecret = errors.New("webhook secret is not configured")
+
+type HTTPClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// Dispatcher は送信時刻を迎えた配信をコールバック URL へ POST する
+//
+// 2xx 以外の応答は失敗として指数バックオフで再送し、最大試行回数に達した配信は dead として残す。
+// 署名の鍵がない場合は受け取り側が検証できないため送信しない。
+type Dispatcher struct {
+	repository  repository.WebhookDeliveryRepository
+	client      HTTPClient
+	secret      []byte
+	maxAttempts int
+	backoff     time.Duration
+	interval    time.Duration
+	batchSize   int
+	lease       time.Duration
+}
+
+// NewDispatcher の timeout は client の1回の送信にかかる上限で、取得した配信のリース期間の算出に使う
+func NewDispatcher(repository repository.WebhookDeliveryRepository, client HTTPClient, timeout time.Duration, secret string, maxAttempts int, backoff time.Duration, interval time.Duration, batchSize int) *Dispatcher {
+	return &Dispatcher{
+		repository:  repository,
+		client:      client,
+		secret:      []byte(secret),
+		maxAttempts: maxAttempts,
+		backoff:     backoff,
+		interval:    interval,
+		batchSize:   batchSize,
+		lease:       leaseDuration(batchSize, timeout),
+	}
+}
+
+// leaseDuration は取得したバッチを1件ずつ送り終えるまで他のディスパッチャーが同じ配信を取得しない期間を返す
+//
+// すべての送信がタイムアウトしてもリースが切れないよう、バッチサイズ × タイムアウトに余裕を加える。
+func leaseDuration(batchSize int, timeout time.Duration) time.Duration {
+	return time.Duration(batchSize)*timeout + leaseMargin
+}
+
+func (d *Dispatcher) Start() {
+	for {
+		sent, err := d.DispatchOnce()
+		if err != nil {
+			utils.Logger.WithFields(logrus.Fields{
+				"error": err,
+			}).Error("Failed to dispatch webhooks")
+		}
+
+		// バッチが埋まっている間は待たずに続きを送信する
+		if err != nil || sent < d.batchSize {
+			time.Sleep(d.interval)
+		}
+	}
+}
+
+// DispatchOnce は送信時刻を迎えた配信を1回ずつ試行し、試行した数を返す
+func (d *Dispatcher) DispatchOnce() (int, error) {
+	deliveries, err := d.repository.ClaimDue(time.Now(), d.batchSize, d.lease)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := range deliveries {
+		d.deliver(&deliveries[i])
+		if err := d.repository.Update(&deliveries[i]); err != nil {
+			utils.Logger.WithFields(logrus.Fields{
+				"error": err,
+				"jobID": deliveries[i].RequestID,
+			}).Error("Failed to update webhook delivery")
+		}
+	}
+	return len(deliveries), nil
+}
+
+func (d *Dispatcher) deliver(delivery *repository.WebhookDelivery) {
+	delivery.Attempts++
+	statusCode, err := d.post(delivery)
+	delivery.LastStatusCode = statusCode
+
+	now := time.Now()
+	if err == nil {
+		delivery.Status = repository.DeliveryDelivered
+		delivery.LastError = ""
+		delivery.DeliveredAt = &now
+		return
+	}
+
+	delivery.LastError = err.Error()
+	if delivery.Attempts >= d.maxAttempts {
+		delivery.Status = repository.DeliveryDead
+		utils.Logger.WithFields(logrus.Fields{
+			"error":    err,
+			"jobID":    delivery.RequestID,
+			"attempts": delivery.Attempts,
+		}).Error("Webhook delivery moved to dead letter")
+		return
+	}
+	delivery.NextAttemptAt = now.Add(d.nextBackoff(delivery.Attempts))
+}
+
+func (d *Dispatcher) post(delivery *repository.WebhookDelivery) (int, error) {
+	if len(d.secret) == 0 {
+		return 0, ErrNoSecret
+	}
+	body := []byte(delivery.Payload)
+	req, err := http.NewRequest(http.MethodPost, delivery.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, Sign(d.secret, time.Now().Unix(), body))
+	req.Header.Set(RequestIDHeader, delivery.RequestID)
+	req.Header.Set(AttemptHeader, strconv.Itoa(delivery.Attempts))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("%w: %d", utils.ErrUnexpectedStatusCode, resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+func (d *Dispatcher) nextBackoff(attempts int) time.Duration {
+	backoff := d.backoff
+	for i := 1; i < attempts && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxBackoff {
+		return maxBackoff
+	}
+	return backoff
+}
+
+// Sign は受信側が検証できるよう時刻と本文を連結した値の HMAC-SHA256 を署名ヘッダの形式で返す
+func Sign(secret []byte, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return fmt.Sprintf("t=%d,v1=%s", timestamp, hex.EncodeToString(mac.Sum(nil)))
+}
@@ -0,0 +1,142 @@
+package webhook
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reliproxy/pkg/repository"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDispatcher_DispatchOnce(t *testing.T) {
+	t.Run("signed delivery", func(t *testing.T) {
+		var received *http.Request
+		var body []byte
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received = r
+			body, _ = io.ReadAll(r.Body)
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		defer server.Close()
+
+		deliveries := repository.NewMemoryWebhookDeliveryRepository()
+		dispatcher := NewDispatcher(deliveries, server.Client(), time.Second, "secret", 3, time.Second, time.Second, 10)
+		assert.NoError(t, deliveries.Create(&repository.WebhookDelivery{
+			RequestID:     "request-1",
+			URL:           server.URL,
+			Payload:       `{"request_id":"request-1","status":"processed"}`,
+			Status:        repository.DeliveryPending,
+			NextAttemptAt: time.Now(),
+		}))
+
+		sent, err := dispatcher.DispatchOnce()
+		assert.NoError(t, err)
+		assert.Equal(t, 1, sent)
+
+		assert.JSONEq(t, `{"request_id":"request-1","status":"processed"}`, string(body))
+		assert.Equal(t, "request-1", received.Header.Get(RequestIDHeader))
+		assert.Equal(t, "1", received.Header.Get(AttemptHeader))
+
+		// 受信側は署名ヘッダの時刻と本文から同じ署名を計算して検証できる
+		signature := received.Header.Get(SignatureHeader)
+		timestamp, err := strconv.ParseInt(strings.TrimPrefix(strings.Split(signature, ",")[0], "t="), 10, 64)
+		assert.NoError(t, err)
+		assert.Equal(t, Sign([]byte("secret"), timestamp, body), signature)
+
+		stored, _ := deliveries.ListByRequestID("request-1")
+		assert.Equal(t, repository.DeliveryDelivered, stored[0].Status)
+		assert.Equal(t, http.StatusNoContent, stored[0].LastStatusCode)
+		assert.NotNil(t, stored[0].DeliveredAt)
+	})
+
+	t.Run("retry and dead letter", func(t *testing.T) {
+		calls := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer server.Close()
+
+		deliveries := repository.NewMemoryWebhookDeliveryRepository()
+		dispatcher := NewDispatcher(deliveries, server.Client(), time.Second, "secret", 3, time.Second, time.Second, 10)
+		assert.NoError(t, deliveries.Create(&repository.WebhookDelivery{
+			RequestID:     "request-1",
+			URL:           server.URL,
+			Payload:       `{}`,
+			Status:        repository.DeliveryPending,
+			NextAttemptAt: time.Now(),
+		}))
+
+		for attempt := 1; attempt <= 3; attempt++ {
+			sent, err := dispatcher.DispatchOnce()
+			assert.NoError(t, err)
+			assert.Equal(t, 1, sent)
+
+			stored, _ := deliveries.ListByRequestID("request-1")
+			delivery := stored[0]
+			assert.Equal(t, attempt, delivery.Attempts)
+			assert.Equal(t, http.StatusServiceUnavailable, delivery.LastStatusCode)
+			assert.NotEmpty(t, delivery.LastError)
+			if attempt < 3 {
+				assert.Equal(t, repository.DeliveryPending, delivery.Status)
+				// バックオフが終わるまでは再送しない
+				sent, _ = dispatcher.DispatchOnce()
+				assert.Equal(t, 0, sent)
+
+				delivery.NextAttemptAt = time.Now()
+				assert.NoError(t, deliveries.Update(&delivery))
+			} else {
+				assert.Equal(t, repository.DeliveryDead, delivery.Status)
+			}
+		}
+		assert.Equal(t, 3, calls)
+
+		sent, _ := dispatcher.DispatchOnce()
+		assert.Equal(t, 0, sent)
+	})
+
+	t.Run("unsigned delivery is not sent", func(t *testing.T) {
+		calls := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+		}))
+		defer server.Close()
+
+		deliveries := repository.NewMemoryWebhookDeliveryRepository()
+		dispatcher := NewDispatcher(deliveries, server.Client(), time.Second, "", 3, time.Second, time.Second, 10)
+		assert.NoError(t, deliveries.Create(&repository.WebhookDelivery{
+			RequestID:     "request-1",
+			URL:           server.URL,
+			Payload:       `{}`,
+			Status:        repository.DeliveryPending,
+			NextAttemptAt: time.Now(),
+		}))
+
+		_, err := dispatcher.DispatchOnce()
+		assert.NoError(t, err)
+		assert.Equal(t, 0, calls)
+		stored, _ := deliveries.ListByRequestID("request-1")
+		assert.Equal(t, ErrNoSecret.Error(), stored[0].LastError)
+	})
+}
+
+func TestDispatcher_NextBackoff(t *testing.T) {
+	dispatcher := NewDispatcher(nil, nil, time.Second, "", 10, 5*time.Second, time.Second, 10)
+
+	assert.Equal(t, 5*time.Second, dispatcher.nextBackoff(1))
+	assert.Equal(t, 10*time.Second, dispatcher.nextBackoff(2))
+	assert.Equal(t, 40*time.Second, dispatcher.nextBackoff(4))
+	assert.Equal(t, maxBackoff, dispatcher.nextBackoff(20))
+}
+
+func TestDispatcher_LeaseCoversBatch(t *testing.T) {
+	dispatcher := NewDispatcher(nil, nil, 10*time.Second, "", 10, time.Second, time.Second, 50)
+
+	// 50 件すべてが 10 秒でタイムアウトしても、送り終える前にリースが切れない
+	assert.Equal(t, 500*time.Second+leaseMargin, dispatcher.lease)
+}